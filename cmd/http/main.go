@@ -7,19 +7,27 @@ import (
 	"konsulin-service/internal/app/delivery/http/controllers"
 	"konsulin-service/internal/app/delivery/http/middlewares"
 	"konsulin-service/internal/app/delivery/http/postfhir"
+	"konsulin-service/internal/app/delivery/http/prefhir"
 	"konsulin-service/internal/app/delivery/http/routers"
 	"konsulin-service/internal/app/drivers/database"
 	"konsulin-service/internal/app/drivers/logger"
 	"konsulin-service/internal/app/drivers/messaging"
+	"konsulin-service/internal/app/services/core/accesslog"
+	"konsulin-service/internal/app/services/core/apikeys"
 	"konsulin-service/internal/app/services/core/auth"
+	"konsulin-service/internal/app/services/core/bulkexport"
 	"konsulin-service/internal/app/services/core/organization"
 	"konsulin-service/internal/app/services/core/payments"
+	"konsulin-service/internal/app/services/core/roles"
 	"konsulin-service/internal/app/services/core/session"
 	"konsulin-service/internal/app/services/core/slot"
 	"konsulin-service/internal/app/services/core/transactions"
 	"konsulin-service/internal/app/services/core/users"
 	"konsulin-service/internal/app/services/core/webhook"
+	auditEventsFhir "konsulin-service/internal/app/services/fhir_spark/audit_events"
 	bundle "konsulin-service/internal/app/services/fhir_spark/bundle"
+	careTeamsFhir "konsulin-service/internal/app/services/fhir_spark/care_teams"
+	consentsFhir "konsulin-service/internal/app/services/fhir_spark/consents"
 	invoicesFhir "konsulin-service/internal/app/services/fhir_spark/invoices"
 	organizationsFhir "konsulin-service/internal/app/services/fhir_spark/organizations"
 	patientsFhir "konsulin-service/internal/app/services/fhir_spark/patients"
@@ -35,6 +43,7 @@ import (
 	"konsulin-service/internal/app/services/shared/mailer"
 	"konsulin-service/internal/app/services/shared/payment_gateway"
 	"konsulin-service/internal/app/services/shared/ratelimiter"
+	"konsulin-service/internal/app/services/shared/rbacstore"
 	redisKonsulin "konsulin-service/internal/app/services/shared/redis"
 	storageKonsulin "konsulin-service/internal/app/services/shared/storage"
 	"konsulin-service/internal/app/services/shared/webhookqueue"
@@ -178,6 +187,9 @@ func bootstrapingTheApp(bootstrap *config.Bootstrap) error {
 	// Initialize session service with Redis repository
 	lockService := locker.NewLockService(redisRepository, bootstrap.Logger)
 
+	// Initialize the RBAC policy store, seeded from the policy file
+	rbacPolicyStore := rbacstore.NewStore(redisRepository, lockService, "resources/rbac_policy.csv", bootstrap.Logger)
+
 	// Initialize FHIR clients
 	patientFhirClient := patientsFhir.NewPatientFhirClient(bootstrap.InternalConfig.FHIR.BaseUrl, bootstrap.Logger)
 	practitionerFhirClient := practitioners.NewPractitionerFhirClient(bootstrap.InternalConfig.FHIR.BaseUrl, bootstrap.Logger)
@@ -188,6 +200,8 @@ func bootstrapingTheApp(bootstrap *config.Bootstrap) error {
 	slotClient := slotFhir.NewSlotFhirClient(bootstrap.InternalConfig.FHIR.BaseUrl, bootstrap.Logger)
 	serviceRequestFhirClient := service_requests.NewServiceRequestFhirClient(bootstrap.InternalConfig.FHIR.BaseUrl, bootstrap.Logger)
 	questionnaireResponseFhirClient := questionnaireResponsesFhir.NewQuestionnaireResponseFhirClient(bootstrap.InternalConfig.FHIR.BaseUrl, bootstrap.Logger)
+	consentFhirClient := consentsFhir.NewConsentFhirClient(bootstrap.InternalConfig.FHIR.BaseUrl, bootstrap.Logger)
+	careTeamFhirClient := careTeamsFhir.NewCareTeamFhirClient(bootstrap.InternalConfig.FHIR.BaseUrl, bootstrap.Logger)
 
 	jwtManager, err := jwtmanager.NewJWTManager(bootstrap.InternalConfig, bootstrap.Logger)
 	if err != nil {
@@ -247,6 +261,10 @@ func bootstrapingTheApp(bootstrap *config.Bootstrap) error {
 		practitionerRoleClient,
 		scheduleClient,
 		questionnaireResponseFhirClient,
+		consentFhirClient,
+		careTeamFhirClient,
+		redisRepository,
+		rbacPolicyStore,
 	)
 
 	// Initialize supertokens
@@ -273,6 +291,9 @@ func bootstrapingTheApp(bootstrap *config.Bootstrap) error {
 	// Register post-FHIR-proxy hook for on-demand slot regeneration when PractitionerRole/Schedule are mutated.
 	middlewares.PostFHIRProxyHooks = append(middlewares.PostFHIRProxyHooks, postfhir.NewSlotRegenerationHook(bootstrap.Logger, slotUsecase))
 
+	// Register pre-FHIR-proxy hooks enforcing business rules before requests reach the FHIR server.
+	middlewares.PreFHIRProxyHooks = append(middlewares.PreFHIRProxyHooks, prefhir.NewAppointmentStartInFutureHook())
+
 	paymentUsecase := payments.NewPaymentUsecase(
 		transactions.NewTransactionPostgresRepository(nil, bootstrap.Logger),
 		bootstrap.InternalConfig,
@@ -306,6 +327,27 @@ func bootstrapingTheApp(bootstrap *config.Bootstrap) error {
 	)
 	orgController := controllers.NewOrganizationController(bootstrap.Logger, orgUsecase)
 
+	auditEventFhirClient := auditEventsFhir.NewAuditEventFhirClient(bootstrap.InternalConfig.FHIR.BaseUrl, bootstrap.Logger)
+	accessLogUsecase := accesslog.NewAccessLogUsecase(auditEventFhirClient, practitionerFhirClient, bootstrap.Logger)
+	accessLogController := controllers.NewAccessLogController(bootstrap.Logger, accessLogUsecase)
+
+	bulkExportStore, err := bulkexport.NewLocalFileStore(bootstrap.InternalConfig.FHIR.BulkExportStorageDir)
+	if err != nil {
+		return err
+	}
+	bulkExportUsecase := bulkexport.NewBulkExportUsecase(redisRepository, serviceRequestFhirClient, bulkExportStore, middlewares.Deidentifier, bootstrap.InternalConfig, bootstrap.Logger)
+	bulkExportController := controllers.NewBulkExportController(bootstrap.Logger, bulkExportUsecase, bootstrap.InternalConfig)
+
+	// Integrator API keys are checked by APIKeyAuth once the superadmin key does not match, and by
+	// RequestSignatureAuth for signed requests
+	apiKeyUsecase := apikeys.NewAPIKeyUsecase(redisRepository, middlewares.Enforcer, bootstrap.InternalConfig, bootstrap.Logger)
+	middlewares.APIKeys = apiKeyUsecase
+	apiKeyController := controllers.NewAPIKeyController(bootstrap.Logger, apiKeyUsecase)
+
+	roleUsecase := roles.NewCasbinRoleUsecase(middlewares.Enforcer, rbacPolicyStore, bootstrap.Logger)
+	roleController := controllers.NewRoleController(bootstrap.Logger, roleUsecase)
+	healthController := controllers.NewHealthController(bootstrap.Logger, rbacPolicyStore)
+
 	if err := orgUsecase.InitializeKonsulinOrganizationResource(context.Background()); err != nil {
 		log.Fatalf("Error initializing Konsulin organization resource: %v", err)
 	}
@@ -320,6 +362,15 @@ func bootstrapingTheApp(bootstrap *config.Bootstrap) error {
 	slotWorker.Start(context.Background())
 	bootstrap.SlotWorkerStop = slotWorker.Stop
 
+	// Start bulk export worker (per-job lock inside)
+	bulkExportWorker := bulkexport.NewWorker(bootstrap.Logger, bulkExportUsecase, lockService)
+	bootstrap.BulkExportWorkerStop = bulkExportWorker.Start(context.Background())
+
+	// Flush queued FHIR AuditEvents on shutdown
+	if middlewares.Audit != nil {
+		bootstrap.AuditStop = middlewares.Audit.Close
+	}
+
 	// Setup routes with the router, configuration, middlewares, and controllers
 	routers.SetupRoutes(
 		bootstrap.Router,
@@ -331,6 +382,11 @@ func bootstrapingTheApp(bootstrap *config.Bootstrap) error {
 		webhookController,
 		scheduleController,
 		orgController,
+		accessLogController,
+		bulkExportController,
+		apiKeyController,
+		roleController,
+		healthController,
 	)
 
 	return nil
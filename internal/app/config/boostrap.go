@@ -17,8 +17,11 @@ type Bootstrap struct {
 	InternalConfig *InternalConfig
 	DriverConfig   *DriverConfig
 	// WorkerStop if set will be called during Shutdown to gracefully stop background workers
-	WorkerStop     func()
-	SlotWorkerStop func()
+	WorkerStop           func()
+	SlotWorkerStop       func()
+	BulkExportWorkerStop func()
+	// AuditStop if set will be called during Shutdown to flush queued FHIR AuditEvents
+	AuditStop func()
 }
 
 func (b *Bootstrap) Shutdown(ctx context.Context) error {
@@ -32,6 +35,16 @@ func (b *Bootstrap) Shutdown(ctx context.Context) error {
 		log.Println("Successfully stopped slot worker")
 	}
 
+	if b.BulkExportWorkerStop != nil {
+		b.BulkExportWorkerStop()
+		log.Println("Successfully stopped bulk export worker")
+	}
+
+	if b.AuditStop != nil {
+		b.AuditStop()
+		log.Println("Successfully flushed audit trail")
+	}
+
 	err := b.Redis.Close()
 	if err != nil {
 		return err
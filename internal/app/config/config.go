@@ -5,6 +5,8 @@ import (
 	"konsulin-service/internal/pkg/utils"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/joho/godotenv"
@@ -83,10 +85,102 @@ func loadInternalConfigWithEnv() *InternalConfig {
 				return v
 			}(),
 			SlotWorkerCronSpec: utils.GetEnvString("SLOT_WORKER_CRON_SPEC", "@daily"),
+			RequestSigningClockSkewSeconds: func() int {
+				v := utils.GetEnvInt("APP_REQUEST_SIGNING_CLOCK_SKEW_SECONDS", 300)
+				if v <= 0 {
+					return 300
+				}
+				return v
+			}(),
+			RequestSigningPepper: utils.GetEnvString("APP_REQUEST_SIGNING_PEPPER", ""),
 		},
 		FHIR: AppFHIR{
 			BaseUrl:                  utils.GetEnvString("APP_FHIR_BASE_URL", "http://localhost:8080/fhir/"),
 			TerminologyServerBaseUrl: utils.GetEnvString("APP_TERMINOLOGY_BASE_URL", "https://tx.konsulin.care/fhir"),
+			TerminologyCacheEnabled:  utils.GetEnvBool("APP_TERMINOLOGY_CACHE_ENABLED", false),
+			TerminologyCacheTTLSeconds: func() int {
+				v := utils.GetEnvInt("APP_TERMINOLOGY_CACHE_TTL_SECONDS", 3600)
+				if v <= 0 {
+					return 3600
+				}
+				return v
+			}(),
+			TerminologyCacheTTLOverrides: parseCSVToIntMap(utils.GetEnvString("APP_TERMINOLOGY_CACHE_TTL_OVERRIDES", "")),
+			TerminologyFallbackDir:       utils.GetEnvString("APP_TERMINOLOGY_FALLBACK_DIR", ""),
+			TerminologyFallbackTimeoutSeconds: func() int {
+				v := utils.GetEnvInt("APP_TERMINOLOGY_FALLBACK_TIMEOUT_SECONDS", 3)
+				if v <= 0 {
+					return 3
+				}
+				return v
+			}(),
+			PageFillEnabled: utils.GetEnvBool("APP_FHIR_PAGE_FILL_ENABLED", false),
+			PageFillMaxFetches: func() int {
+				v := utils.GetEnvInt("APP_FHIR_PAGE_FILL_MAX_FETCHES", 5)
+				if v <= 0 {
+					return 5
+				}
+				return v
+			}(),
+			PageFillCursorKey:    utils.GetEnvString("APP_FHIR_PAGE_FILL_CURSOR_KEY", ""), // Sensitive
+			ResponseCacheEnabled: utils.GetEnvBool("APP_FHIR_RESPONSE_CACHE_ENABLED", false),
+			ResponseCacheTTLSeconds: func() int {
+				v := utils.GetEnvInt("APP_FHIR_RESPONSE_CACHE_TTL_SECONDS", 300)
+				if v <= 0 {
+					return 300
+				}
+				return v
+			}(),
+			ResponseCacheTTLOverrides:  parseCSVToIntMap(utils.GetEnvString("APP_FHIR_RESPONSE_CACHE_TTL_OVERRIDES", "")),
+			ResponseCacheResourceTypes: parseCSVToSlice(utils.GetEnvString("APP_FHIR_RESPONSE_CACHE_RESOURCE_TYPES", "")),
+			AuditEnabled:               utils.GetEnvBool("APP_FHIR_AUDIT_ENABLED", false),
+			AuditQueueSize: func() int {
+				v := utils.GetEnvInt("APP_FHIR_AUDIT_QUEUE_SIZE", 1000)
+				if v <= 0 {
+					return 1000
+				}
+				return v
+			}(),
+			AuditWorkers: func() int {
+				v := utils.GetEnvInt("APP_FHIR_AUDIT_WORKERS", 2)
+				if v <= 0 {
+					return 2
+				}
+				return v
+			}(),
+			ConsentRequired:                     utils.GetEnvBool("APP_FHIR_CONSENT_REQUIRED", false),
+			EverythingPractitionerResourceTypes: parseCSVToSlice(utils.GetEnvString("APP_FHIR_EVERYTHING_PRACTITIONER_RESOURCE_TYPES", "")),
+			EverythingMaxFetches: func() int {
+				v := utils.GetEnvInt("APP_FHIR_EVERYTHING_MAX_FETCHES", 100)
+				if v <= 0 {
+					return 100
+				}
+				return v
+			}(),
+			BulkExportStorageDir: utils.GetEnvString("APP_FHIR_BULK_EXPORT_STORAGE_DIR", filepath.Join(os.TempDir(), "konsulin-bulk-export")),
+			BulkExportRetentionHours: func() int {
+				v := utils.GetEnvInt("APP_FHIR_BULK_EXPORT_RETENTION_HOURS", 24)
+				if v <= 0 {
+					return 24
+				}
+				return v
+			}(),
+			BulkExportResourceTypes: parseCSVToSlice(utils.GetEnvString("APP_FHIR_BULK_EXPORT_RESOURCE_TYPES", "Patient,Observation,QuestionnaireResponse,Condition,Encounter")),
+			DeidentificationKey:     utils.GetEnvString("APP_FHIR_DEIDENTIFICATION_KEY", ""), // Sensitive
+			DeidentificationMinCellSize: func() int {
+				v := utils.GetEnvInt("APP_FHIR_DEIDENTIFICATION_MIN_CELL_SIZE", 5)
+				if v < 0 {
+					return 5
+				}
+				return v
+			}(),
+			DeidentificationMaxDateShiftDays: func() int {
+				v := utils.GetEnvInt("APP_FHIR_DEIDENTIFICATION_MAX_DATE_SHIFT_DAYS", 180)
+				if v < 0 {
+					return 180
+				}
+				return v
+			}(),
 		},
 		JWT: AppJWT{
 			Secret:        utils.GetEnvString("APP_JWT_SECRET", ""),
@@ -148,6 +242,9 @@ func loadInternalConfigWithEnv() *InternalConfig {
 		if cfg.JWT.Secret == "" {
 			log.Fatalf("APP_JWT_SECRET is required in %s environment", cfg.App.Env)
 		}
+		if cfg.FHIR.DeidentificationKey == "" {
+			log.Fatalf("APP_FHIR_DEIDENTIFICATION_KEY is required in %s environment", cfg.App.Env)
+		}
 		if cfg.Webhook.JWTHookKey == "" {
 			log.Fatalf("JWT_HOOK_KEY is required in %s environment", cfg.App.Env)
 		}
@@ -297,3 +394,39 @@ func parseCSVToLowerSlice(csv string) []string {
 	}
 	return result
 }
+
+// parseCSVToSlice parses a comma-separated string into a slice of trimmed strings, keeping their case.
+// Returns an empty slice if the input is empty or contains only whitespace.
+func parseCSVToSlice(csv string) []string {
+	csv = strings.TrimSpace(csv)
+	if csv == "" {
+		return []string{}
+	}
+	parts := strings.Split(csv, ",")
+	result := make([]string, 0, len(parts))
+	for _, p := range parts {
+		trimmed := strings.TrimSpace(p)
+		if trimmed != "" {
+			result = append(result, trimmed)
+		}
+	}
+	return result
+}
+
+// parseCSVToIntMap parses comma-separated key=value pairs (e.g. "ValueSet=86400,Questionnaire=600")
+// into a map. Pairs without a positive integer value are skipped.
+func parseCSVToIntMap(csv string) map[string]int {
+	result := map[string]int{}
+	for _, pair := range parseCSVToSlice(csv) {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n <= 0 {
+			continue
+		}
+		result[strings.TrimSpace(k)] = n
+	}
+	return result
+}
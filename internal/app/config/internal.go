@@ -39,11 +39,74 @@ type App struct {
 	SlotWindowDays int `mapstructure:"slot_window_days"`
 	// SlotWorkerCronSpec defines the cron expression for the slot worker schedule (e.g., "@daily")
 	SlotWorkerCronSpec string `mapstructure:"slot_worker_cron_spec"`
+	// RequestSigningClockSkewSeconds is how far the timestamp of a signed integrator request may be
+	// from the server clock (default 300)
+	RequestSigningClockSkewSeconds int `mapstructure:"request_signing_clock_skew_seconds"`
+	// RequestSigningPepper keys the derivation of integrator signing secrets. It must not be stored
+	// in Redis with the keys; without it signed requests are refused.
+	RequestSigningPepper string `mapstructure:"request_signing_pepper"`
 }
 
 type AppFHIR struct {
 	BaseUrl                  string `mapstructure:"base_url"`
 	TerminologyServerBaseUrl string `mapstructure:"terminology_server_base_url"`
+	// TerminologyCacheEnabled turns on the Redis cache for GET requests to the /tx terminology proxy (default false)
+	TerminologyCacheEnabled bool `mapstructure:"terminology_cache_enabled"`
+	// TerminologyCacheTTLSeconds is how long a cached terminology response is served (default 3600)
+	TerminologyCacheTTLSeconds int `mapstructure:"terminology_cache_ttl_seconds"`
+	// TerminologyCacheTTLOverrides sets TerminologyCacheTTLSeconds per operation name without the $, e.g. {"lookup": 86400}
+	TerminologyCacheTTLOverrides map[string]int `mapstructure:"terminology_cache_ttl_overrides"`
+	// TerminologyFallbackDir holds ValueSet and CodeSystem JSON files that answer ValueSet $expand
+	// when the terminology server is slow or down; empty disables the fallback
+	TerminologyFallbackDir string `mapstructure:"terminology_fallback_dir"`
+	// TerminologyFallbackTimeoutSeconds is how long the terminology server gets to answer a request
+	// the fallback could answer before the fallback is used (default 3)
+	TerminologyFallbackTimeoutSeconds int `mapstructure:"terminology_fallback_timeout_seconds"`
+	// PageFillEnabled makes the proxy keep fetching upstream pages of ownership- or RBAC-filtered
+	// searches until _count visible entries are collected (default false)
+	PageFillEnabled bool `mapstructure:"page_fill_enabled"`
+	// PageFillMaxFetches caps how many upstream pages a single page-filled response may fetch (default 5)
+	PageFillMaxFetches int `mapstructure:"page_fill_max_fetches"`
+	// PageFillCursorKey signs the continuation cursors of page-filled searches; it must be shared by
+	// every instance, and searches are not page-filled without it
+	PageFillCursorKey string `mapstructure:"page_fill_cursor_key"`
+	// ResponseCacheEnabled turns on the Redis cache for GET responses of public resource types (default false)
+	ResponseCacheEnabled bool `mapstructure:"response_cache_enabled"`
+	// ResponseCacheTTLSeconds is how long a cached response is served without revalidating it upstream (default 300)
+	ResponseCacheTTLSeconds int `mapstructure:"response_cache_ttl_seconds"`
+	// ResponseCacheTTLOverrides sets ResponseCacheTTLSeconds per resource type, e.g. {"ValueSet": 86400}
+	ResponseCacheTTLOverrides map[string]int `mapstructure:"response_cache_ttl_overrides"`
+	// ResponseCacheResourceTypes limits caching to these public resource types; empty caches all public types
+	ResponseCacheResourceTypes []string `mapstructure:"response_cache_resource_types"`
+	// AuditEnabled records a FHIR AuditEvent for every proxied request (default false). The patient
+	// access log is read from these AuditEvents, so it stays empty while this is off.
+	AuditEnabled bool `mapstructure:"audit_enabled"`
+	// AuditQueueSize is how many AuditEvents may wait to be written before new ones are dropped (default 1000)
+	AuditQueueSize int `mapstructure:"audit_queue_size"`
+	// AuditWorkers is the number of goroutines writing AuditEvents to the FHIR server (default 2)
+	AuditWorkers int `mapstructure:"audit_workers"`
+	// ConsentRequired lets practitioners see another patient's records only under that patient's
+	// active Consent; otherwise a Consent only adds access (default false)
+	ConsentRequired bool `mapstructure:"consent_required"`
+	// EverythingPractitionerResourceTypes limits the resource types a practitioner receives from
+	// Patient/$everything; empty keeps the built-in list of clinical types
+	EverythingPractitionerResourceTypes []string `mapstructure:"everything_practitioner_resource_types"`
+	// EverythingMaxFetches caps how many upstream pages a single Patient/$everything may fetch (default 100)
+	EverythingMaxFetches int `mapstructure:"everything_max_fetches"`
+	// BulkExportStorageDir is the directory $export jobs write their NDJSON files to
+	// (default konsulin-bulk-export in the OS temp directory)
+	BulkExportStorageDir string `mapstructure:"bulk_export_storage_dir"`
+	// BulkExportRetentionHours is how long a $export job and its files are kept once started (default 24)
+	BulkExportRetentionHours int `mapstructure:"bulk_export_retention_hours"`
+	// BulkExportResourceTypes are the types exported when a kick-off request has no _type
+	BulkExportResourceTypes []string `mapstructure:"bulk_export_resource_types"`
+	// DeidentificationKey keys the pseudonyms and date offsets of de-identified data; it must be
+	// shared by every instance for pseudonyms to stay stable
+	DeidentificationKey string `mapstructure:"deidentification_key"`
+	// DeidentificationMinCellSize is the k below which cells of de-identified data are suppressed (default 5)
+	DeidentificationMinCellSize int `mapstructure:"deidentification_min_cell_size"`
+	// DeidentificationMaxDateShiftDays bounds the per-patient date shift of de-identified data (default 180)
+	DeidentificationMaxDateShiftDays int `mapstructure:"deidentification_max_date_shift_days"`
 }
 
 type AppJWT struct {
@@ -0,0 +1,57 @@
+package contracts
+
+import (
+	"context"
+	"konsulin-service/internal/pkg/fhir_dto"
+	"net/url"
+	"time"
+)
+
+type AuditEventFhirClient interface {
+	// Search runs an AuditEvent search with the given query parameters and returns one page.
+	Search(ctx context.Context, params url.Values) (*fhir_dto.AuditEventBundle, error)
+}
+
+// ListAccessLogInput filters the access log of the calling patient.
+type ListAccessLogInput struct {
+	// From and To bound when the access happened; either may be empty. They are FHIR date or
+	// dateTime values, e.g. "2026-01-31".
+	From string
+	To   string
+	// ResourceType limits the log to accesses that touched this FHIR resource type.
+	ResourceType string
+	PageSize     int
+	// Cursor is the NextCursor of the previous page.
+	Cursor string
+}
+
+// ListAccessLogOutput is one page of the access log, newest first. A page may hold fewer than
+// PageSize entries when accesses by internal system actors were hidden from it.
+type ListAccessLogOutput struct {
+	Entries    []AccessLogEntry `json:"entries"`
+	NextCursor string           `json:"nextCursor,omitempty"`
+}
+
+// AccessLogEntry describes one access to the patient's records in plain terms.
+type AccessLogEntry struct {
+	Recorded    time.Time      `json:"recorded"`
+	Actor       AccessLogActor `json:"actor"`
+	Action      string         `json:"action"`
+	Resources   []string       `json:"resources"`
+	Outcome     string         `json:"outcome"`
+	Description string         `json:"description"`
+}
+
+// AccessLogActor is who accessed the records: a person with their role, or an integration.
+type AccessLogActor struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Reference string `json:"reference,omitempty"`
+}
+
+// AccessLogUsecase exposes the FHIR proxy audit trail to the patients it concerns.
+type AccessLogUsecase interface {
+	// ListPatientAccessLog lists who accessed the calling patient's records. The caller's Patient
+	// must already be resolved into the context.
+	ListPatientAccessLog(ctx context.Context, in ListAccessLogInput) (*ListAccessLogOutput, error)
+}
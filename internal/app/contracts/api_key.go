@@ -0,0 +1,105 @@
+package contracts
+
+import (
+	"context"
+	"time"
+)
+
+// APIKey is a named key issued to an integrator. Its secret is never stored, only its hash, and is
+// shown once when the key is created or rotated.
+type APIKey struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Owner is who answers for the key, e.g. the partner's contact email.
+	Owner string `json:"owner"`
+	// Roles are the Casbin roles requests made with the key are authorized as.
+	Roles      []string `json:"roles"`
+	SecretHash string   `json:"secretHash"`
+	// RequireSignature refuses the key in the x-api-key header; requests must be signed with it.
+	RequireSignature bool       `json:"requireSignature"`
+	CreatedBy        string     `json:"createdBy"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty"`
+	RotatedAt        *time.Time `json:"rotatedAt,omitempty"`
+	RevokedAt        *time.Time `json:"revokedAt,omitempty"`
+	LastUsedAt       *time.Time `json:"lastUsedAt,omitempty"`
+	// PreviousSecretHash keeps the secret replaced by the last rotation valid until
+	// PreviousSecretExpiresAt, so the integrator can switch over without downtime.
+	PreviousSecretHash      string     `json:"previousSecretHash,omitempty"`
+	PreviousSecretExpiresAt *time.Time `json:"previousSecretExpiresAt,omitempty"`
+}
+
+// CreateAPIKeyInput describes a key to issue.
+type CreateAPIKeyInput struct {
+	Name  string
+	Owner string
+	Roles []string
+	// ExpiresAt is when the key stops working; nil keeps it valid until revoked.
+	ExpiresAt *time.Time
+	// RequireSignature only accepts signed requests made with the key.
+	RequireSignature bool
+}
+
+// RotateAPIKeyInput describes a rotation.
+type RotateAPIKeyInput struct {
+	// GracePeriod keeps the current secret valid this long after the rotation; zero invalidates it
+	// at once.
+	GracePeriod time.Duration
+	// ExpiresAt, when set, replaces the key's expiry.
+	ExpiresAt *time.Time
+}
+
+// APIKeyOutput is a key as shown to administrators.
+type APIKeyOutput struct {
+	ID               string     `json:"id"`
+	Name             string     `json:"name"`
+	Owner            string     `json:"owner"`
+	Roles            []string   `json:"roles"`
+	RequireSignature bool       `json:"requireSignature"`
+	CreatedBy        string     `json:"createdBy"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty"`
+	RotatedAt        *time.Time `json:"rotatedAt,omitempty"`
+	RevokedAt        *time.Time `json:"revokedAt,omitempty"`
+	LastUsedAt       *time.Time `json:"lastUsedAt,omitempty"`
+	// Secret is only returned by Create and Rotate.
+	Secret string `json:"secret,omitempty"`
+	// SigningSecret keys request signatures. Like Secret, it is only returned by Create and Rotate.
+	SigningSecret string `json:"signingSecret,omitempty"`
+}
+
+// SignedRequestInput is a request signed with an integrator key. The signature is the hex
+// HMAC-SHA256, keyed with the key's signing secret, of
+//
+//	METHOD \n REQUEST-URI \n TIMESTAMP \n NONCE \n hex(SHA-256(body))
+type SignedRequestInput struct {
+	KeyID string
+	// Timestamp is when the request was signed, in Unix seconds.
+	Timestamp string
+	// Nonce is unique per request; a nonce is accepted once.
+	Nonce     string
+	Signature string
+	Method    string
+	// RequestURI is the path and query the request was sent to.
+	RequestURI string
+	Body       []byte
+}
+
+// APIKeyUsecase manages the integrator API keys accepted in the x-api-key header besides the
+// platform's own superadmin key.
+type APIKeyUsecase interface {
+	// Create issues a key. Only superadmins may manage keys.
+	Create(ctx context.Context, in CreateAPIKeyInput) (*APIKeyOutput, error)
+	List(ctx context.Context) ([]APIKeyOutput, error)
+	// Rotate replaces the key's secret and returns the new one.
+	Rotate(ctx context.Context, id string, in RotateAPIKeyInput) (*APIKeyOutput, error)
+	// Revoke stops the key from working. Revoked keys stay listed.
+	Revoke(ctx context.Context, id string) error
+	// Authenticate returns the key a secret belongs to, and records its use. It fails with
+	// exceptions.ErrInvalidAPIKey when the secret is unknown, revoked or expired.
+	Authenticate(ctx context.Context, secret string) (*APIKey, error)
+	// AuthenticateSigned returns the key a signed request was made with, and records its use. It
+	// fails with exceptions.ErrInvalidRequestSignature when the signature does not match, the
+	// timestamp is outside the allowed clock skew or the nonce was seen before.
+	AuthenticateSigned(ctx context.Context, in SignedRequestInput) (*APIKey, error)
+}
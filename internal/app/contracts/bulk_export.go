@@ -0,0 +1,107 @@
+package contracts
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Levels of a FHIR Bulk Data $export.
+const (
+	BulkExportLevelSystem  = "system"
+	BulkExportLevelPatient = "patient"
+	BulkExportLevelGroup   = "group"
+)
+
+// Statuses of a $export job.
+const (
+	BulkExportStatusAccepted   = "accepted"
+	BulkExportStatusInProgress = "in-progress"
+	BulkExportStatusCompleted  = "completed"
+	BulkExportStatusFailed     = "failed"
+)
+
+// BulkExportKickoffInput is a $export kick-off request.
+type BulkExportKickoffInput struct {
+	Level string
+	// GroupID is the Group whose members are exported, for the group level only.
+	GroupID string
+	// Types limits the export to these resource types; empty exports the configured default types.
+	Types []string
+	// Since limits the export to resources updated after this instant.
+	Since *time.Time
+	// RequestURL is the kick-off URL as the client sent it; the manifest echoes it back.
+	RequestURL string
+}
+
+// BulkExportJob is the state of a $export job, stored until its retention ends.
+type BulkExportJob struct {
+	ID         string     `json:"id"`
+	Level      string     `json:"level"`
+	GroupID    string     `json:"groupId,omitempty"`
+	Types      []string   `json:"types"`
+	Since      *time.Time `json:"since,omitempty"`
+	RequestURL string     `json:"requestUrl"`
+	// OwnerUID is the user who kicked the job off; only they may poll it or download its files.
+	OwnerUID   string   `json:"ownerUid"`
+	OwnerRoles []string `json:"ownerRoles"`
+	// ServiceRequestID is the paid access-dataset ServiceRequest the job was started with, empty
+	// for superadmins.
+	ServiceRequestID string           `json:"serviceRequestId,omitempty"`
+	Status           string           `json:"status"`
+	Progress         string           `json:"progress,omitempty"`
+	Error            string           `json:"error,omitempty"`
+	CreatedAt        time.Time        `json:"createdAt"`
+	TransactionTime  time.Time        `json:"transactionTime,omitempty"`
+	Output           []BulkExportFile `json:"output,omitempty"`
+}
+
+// BulkExportFile is one NDJSON file written by a job.
+type BulkExportFile struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// BulkExportManifest is the body of the status response of a completed job, as defined by the
+// FHIR Bulk Data Access specification.
+type BulkExportManifest struct {
+	TransactionTime     time.Time                `json:"transactionTime"`
+	Request             string                   `json:"request"`
+	RequiresAccessToken bool                     `json:"requiresAccessToken"`
+	Output              []BulkExportManifestFile `json:"output"`
+	Error               []BulkExportManifestFile `json:"error"`
+}
+
+// BulkExportManifestFile is a file listed in the manifest.
+type BulkExportManifestFile struct {
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+	Count int    `json:"count,omitempty"`
+}
+
+// BulkExportStatusOutput is the state of a job; Manifest is set once it completed.
+type BulkExportStatusOutput struct {
+	Job      *BulkExportJob
+	Manifest *BulkExportManifest
+}
+
+// BulkExportFileStore keeps the files written by $export jobs.
+type BulkExportFileStore interface {
+	// Create creates, or truncates, the file name of the job.
+	Create(ctx context.Context, jobID, name string) (io.WriteCloser, error)
+	Open(ctx context.Context, jobID, name string) (io.ReadCloser, error)
+	// RemoveJob removes every file of the job.
+	RemoveJob(ctx context.Context, jobID string) error
+}
+
+// BulkExportUsecase runs FHIR Bulk Data $export jobs for researchers who paid for the
+// access-dataset service, and for superadmins.
+type BulkExportUsecase interface {
+	// Kickoff checks the caller may export and queues the job.
+	Kickoff(ctx context.Context, in BulkExportKickoffInput) (*BulkExportJob, error)
+	Status(ctx context.Context, jobID string) (*BulkExportStatusOutput, error)
+	// Cancel stops the job and removes it with its files.
+	Cancel(ctx context.Context, jobID string) error
+	OpenFile(ctx context.Context, jobID, name string) (io.ReadCloser, error)
+}
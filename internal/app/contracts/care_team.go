@@ -0,0 +1,29 @@
+package contracts
+
+import (
+	"context"
+	"konsulin-service/internal/pkg/fhir_dto"
+	"net/url"
+	"strings"
+)
+
+type CareTeamFhirClient interface {
+	Search(ctx context.Context, params CareTeamSearchParams) ([]fhir_dto.CareTeam, error)
+}
+
+// CareTeamSearchParams searches CareTeams by their participants and status.
+type CareTeamSearchParams struct {
+	Participants []string // references such as Practitioner/1 or PractitionerRole/2, matched as any of
+	Status       string
+}
+
+func (p CareTeamSearchParams) ToQueryParam() url.Values {
+	v := url.Values{}
+	if len(p.Participants) > 0 {
+		v.Set("participant", strings.Join(p.Participants, ","))
+	}
+	if p.Status != "" {
+		v.Set("status", p.Status)
+	}
+	return v
+}
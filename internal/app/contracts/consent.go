@@ -0,0 +1,38 @@
+package contracts
+
+import (
+	"context"
+	"konsulin-service/internal/pkg/fhir_dto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type ConsentFhirClient interface {
+	Search(ctx context.Context, params ConsentSearchParams) ([]fhir_dto.Consent, error)
+}
+
+// ConsentSearchParams searches Consents by the actors they grant access to, their patient and status.
+type ConsentSearchParams struct {
+	Actors  []string // references such as Practitioner/1 or Organization/2, matched as any of
+	Patient string   // reference such as Patient/1
+	Status  string
+	Count   int
+}
+
+func (p ConsentSearchParams) ToQueryParam() url.Values {
+	v := url.Values{}
+	if len(p.Actors) > 0 {
+		v.Set("actor", strings.Join(p.Actors, ","))
+	}
+	if p.Patient != "" {
+		v.Set("patient", p.Patient)
+	}
+	if p.Status != "" {
+		v.Set("status", p.Status)
+	}
+	if p.Count > 0 {
+		v.Set("_count", strconv.Itoa(p.Count))
+	}
+	return v
+}
@@ -17,5 +17,10 @@ type RedisRepository interface {
 	PopFromList(ctx context.Context, key string) error
 	AddToSet(ctx context.Context, key string, values ...interface{}) error
 	GetSetMembers(ctx context.Context, key string) ([]string, error)
+	RemoveFromSet(ctx context.Context, key string, values ...interface{}) error
 	TrySetNX(ctx context.Context, key string, value interface{}, exp time.Duration) (bool, error)
+	Publish(ctx context.Context, channel string, message string) error
+	// Subscribe delivers the messages published on channel until ctx is done, when the returned
+	// channel is closed.
+	Subscribe(ctx context.Context, channel string) (<-chan string, error)
 }
@@ -3,12 +3,21 @@ package contracts
 import (
 	"context"
 	"konsulin-service/internal/app/models"
+	"time"
 )
 
 type RoleUsecase interface {
 	ListRoles(ctx context.Context) ([]string, error)
-	AddPermission(ctx context.Context, role, method, path string) error
-	RemovePermission(ctx context.Context, role, method, path string) error
+	ListPermissions(ctx context.Context, role string) ([]Permission, error)
+	AddPermission(ctx context.Context, role, method, path string) (*PolicyChange, error)
+	RemovePermission(ctx context.Context, role, method, path string) (*PolicyChange, error)
+	// ExportPolicy returns the RBAC policy in the format of resources/rbac_policy.csv.
+	ExportPolicy(ctx context.Context) ([]byte, error)
+	// ImportPolicy replaces the RBAC policy with the given CSV.
+	ImportPolicy(ctx context.Context, csv []byte) (*PolicyChange, error)
+	ListPolicyChanges(ctx context.Context, limit int) ([]PolicyChange, error)
+	// ReloadPolicy makes every instance reload the policy from the store.
+	ReloadPolicy(ctx context.Context) (*PolicyChange, error)
 }
 
 type RoleRepository interface {
@@ -18,3 +27,46 @@ type RoleRepository interface {
 	FindRoleByID(ctx context.Context, roleID string) (*models.Role, error)
 	UpdateRole(ctx context.Context, roleID string, updateData map[string]interface{}) error
 }
+
+// RBACPolicyStore persists the Casbin policy. A rule is a policy line split on commas, e.g.
+// ["p", "Clinic Admin", "GET", "/fhir/CareTeam"].
+type RBACPolicyStore interface {
+	Rules(ctx context.Context) ([][]string, error)
+	// Update adds and removes rules and records the change. Rules that are already present, or
+	// already absent, are left out of the recorded change.
+	Update(ctx context.Context, by, action string, added, removed [][]string) (*PolicyChange, error)
+	// Replace swaps the whole policy for rules and records the difference.
+	Replace(ctx context.Context, by, action string, rules [][]string) (*PolicyChange, error)
+	// Changes returns the most recent changes first.
+	Changes(ctx context.Context, limit int) ([]PolicyChange, error)
+	// Bump publishes a new policy version without changing the rules, so every instance reloads.
+	Bump(ctx context.Context, by string) (*PolicyChange, error)
+	// Status describes the policy this instance's enforcer has loaded.
+	Status() PolicyStatus
+}
+
+type Permission struct {
+	Role   string `json:"role"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+// PolicyChange records who changed the RBAC policy and how. Every change gets the next
+// policy version.
+type PolicyChange struct {
+	Version int64      `json:"version"`
+	At      time.Time  `json:"at"`
+	By      string     `json:"by"`
+	Action  string     `json:"action"`
+	Added   [][]string `json:"added,omitempty"`
+	Removed [][]string `json:"removed,omitempty"`
+}
+
+// PolicyStatus is the RBAC policy loaded by an instance. Instances that agree have the same
+// version and hash.
+type PolicyStatus struct {
+	Version  int64     `json:"version"`
+	Hash     string    `json:"hash"`
+	Rules    int       `json:"rules"`
+	LoadedAt time.Time `json:"loadedAt"`
+}
@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"fmt"
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+	"konsulin-service/internal/pkg/utils"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type AccessLogController struct {
+	Log     *zap.Logger
+	Usecase contracts.AccessLogUsecase
+}
+
+var (
+	accessLogControllerInstance *AccessLogController
+	onceAccessLogController     sync.Once
+)
+
+var resourceTypePattern = regexp.MustCompile(`^[A-Z][A-Za-z]+$`)
+
+func NewAccessLogController(logger *zap.Logger, uc contracts.AccessLogUsecase) *AccessLogController {
+	onceAccessLogController.Do(func() {
+		accessLogControllerInstance = &AccessLogController{
+			Log:     logger,
+			Usecase: uc,
+		}
+	})
+	return accessLogControllerInstance
+}
+
+// parseAccessLogQuery reads the access log filters: from/to (YYYY-MM-DD or RFC3339), resourceType,
+// pageSize and cursor.
+func parseAccessLogQuery(r *http.Request) (contracts.ListAccessLogInput, error) {
+	q := r.URL.Query()
+	in := contracts.ListAccessLogInput{
+		From:         q.Get("from"),
+		To:           q.Get("to"),
+		ResourceType: q.Get("resourceType"),
+		Cursor:       q.Get("cursor"),
+	}
+
+	for name, value := range map[string]string{"from": in.From, "to": in.To} {
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", value); err == nil {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return in, fmt.Errorf("%s must be YYYY-MM-DD or RFC3339 with timezone", name)
+		}
+	}
+
+	if in.ResourceType != "" && !resourceTypePattern.MatchString(in.ResourceType) {
+		return in, fmt.Errorf("resourceType must be a FHIR resource type")
+	}
+
+	if raw := q.Get("pageSize"); raw != "" {
+		pageSize, err := strconv.Atoi(raw)
+		if err != nil || pageSize <= 0 {
+			return in, fmt.Errorf("pageSize must be a positive integer")
+		}
+		in.PageSize = pageSize
+	}
+	return in, nil
+}
+
+// ListMyAccessLog lists who accessed the calling patient's records.
+func (ctrl *AccessLogController) ListMyAccessLog(w http.ResponseWriter, r *http.Request) {
+	in, err := parseAccessLogQuery(r)
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, exceptions.BuildNewCustomError(nil, constvars.StatusBadRequest, constvars.ErrClientCannotProcessRequest, err.Error()))
+		return
+	}
+
+	out, err := ctrl.Usecase.ListPatientAccessLog(r.Context(), in)
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
+	}
+
+	utils.BuildSuccessResponse(w, constvars.StatusOK, constvars.GetAccessLogSuccessMessage, out)
+}
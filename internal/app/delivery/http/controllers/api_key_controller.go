@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+	"konsulin-service/internal/pkg/utils"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+type APIKeyController struct {
+	Log     *zap.Logger
+	Usecase contracts.APIKeyUsecase
+}
+
+var (
+	apiKeyControllerInstance *APIKeyController
+	onceAPIKeyController     sync.Once
+)
+
+func NewAPIKeyController(logger *zap.Logger, uc contracts.APIKeyUsecase) *APIKeyController {
+	onceAPIKeyController.Do(func() {
+		apiKeyControllerInstance = &APIKeyController{
+			Log:     logger,
+			Usecase: uc,
+		}
+	})
+	return apiKeyControllerInstance
+}
+
+type createAPIKeyRequest struct {
+	Name             string     `json:"name"`
+	Owner            string     `json:"owner"`
+	Roles            []string   `json:"roles"`
+	ExpiresAt        *time.Time `json:"expiresAt"`
+	RequireSignature bool       `json:"requireSignature"`
+}
+
+type rotateAPIKeyRequest struct {
+	GracePeriodSeconds int        `json:"gracePeriodSeconds"`
+	ExpiresAt          *time.Time `json:"expiresAt"`
+}
+
+// Create issues an integrator API key. The secret is only shown in this response.
+func (ctrl *APIKeyController) Create(w http.ResponseWriter, r *http.Request) {
+	var req createAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, exceptions.ErrCannotParseJSON(err))
+		return
+	}
+
+	out, err := ctrl.Usecase.Create(r.Context(), contracts.CreateAPIKeyInput{
+		Name:             req.Name,
+		Owner:            req.Owner,
+		Roles:            req.Roles,
+		ExpiresAt:        req.ExpiresAt,
+		RequireSignature: req.RequireSignature,
+	})
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
+	}
+
+	utils.BuildSuccessResponse(w, constvars.StatusCreated, constvars.CreateAPIKeySuccessMessage, out)
+}
+
+func (ctrl *APIKeyController) List(w http.ResponseWriter, r *http.Request) {
+	out, err := ctrl.Usecase.List(r.Context())
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
+	}
+
+	utils.BuildSuccessResponse(w, constvars.StatusOK, constvars.GetAPIKeysSuccessMessage, out)
+}
+
+// Rotate replaces a key's secret. The body is optional; gracePeriodSeconds keeps the old secret
+// working for a while.
+func (ctrl *APIKeyController) Rotate(w http.ResponseWriter, r *http.Request) {
+	var req rotateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		utils.BuildErrorResponse(ctrl.Log, w, exceptions.ErrCannotParseJSON(err))
+		return
+	}
+
+	out, err := ctrl.Usecase.Rotate(r.Context(), chi.URLParam(r, "id"), contracts.RotateAPIKeyInput{
+		GracePeriod: time.Duration(req.GracePeriodSeconds) * time.Second,
+		ExpiresAt:   req.ExpiresAt,
+	})
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
+	}
+
+	utils.BuildSuccessResponse(w, constvars.StatusOK, constvars.RotateAPIKeySuccessMessage, out)
+}
+
+func (ctrl *APIKeyController) Revoke(w http.ResponseWriter, r *http.Request) {
+	if err := ctrl.Usecase.Revoke(r.Context(), chi.URLParam(r, "id")); err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
+	}
+
+	utils.BuildSuccessResponse(w, constvars.StatusOK, constvars.RevokeAPIKeySuccessMessage, nil)
+}
@@ -0,0 +1,195 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"konsulin-service/internal/app/config"
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+	"konsulin-service/internal/pkg/fhir_dto"
+	"konsulin-service/internal/pkg/utils"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+type BulkExportController struct {
+	Log            *zap.Logger
+	Usecase        contracts.BulkExportUsecase
+	InternalConfig *config.InternalConfig
+}
+
+var (
+	bulkExportControllerInstance *BulkExportController
+	onceBulkExportController     sync.Once
+)
+
+// bulkExportOutputFormats are the accepted _outputFormat values, all meaning NDJSON.
+var bulkExportOutputFormats = []string{constvars.MIMEApplicationFHIRNDJSON, "application/ndjson", "ndjson"}
+
+// bulkExportRetryAfterSeconds is the polling interval suggested to clients of a running job.
+const bulkExportRetryAfterSeconds = "30"
+
+func NewBulkExportController(logger *zap.Logger, uc contracts.BulkExportUsecase, internalConfig *config.InternalConfig) *BulkExportController {
+	onceBulkExportController.Do(func() {
+		bulkExportControllerInstance = &BulkExportController{
+			Log:            logger,
+			Usecase:        uc,
+			InternalConfig: internalConfig,
+		}
+	})
+	return bulkExportControllerInstance
+}
+
+// parseBulkExportKickoff reads a $export kick-off request: the Prefer header, _outputFormat,
+// _since and _type.
+func parseBulkExportKickoff(r *http.Request) (contracts.BulkExportKickoffInput, error) {
+	var in contracts.BulkExportKickoffInput
+
+	if !strings.Contains(r.Header.Get("Prefer"), "respond-async") {
+		return in, fmt.Errorf("$export requires the Prefer: respond-async header")
+	}
+
+	q := r.URL.Query()
+	for name, values := range q {
+		switch name {
+		case "_outputFormat":
+			if !slices.Contains(bulkExportOutputFormats, values[0]) {
+				return in, fmt.Errorf("_outputFormat %s is not supported; use %s", values[0], constvars.MIMEApplicationFHIRNDJSON)
+			}
+		case "_since":
+			since, err := time.Parse(time.RFC3339, values[0])
+			if err != nil {
+				return in, fmt.Errorf("_since must be a FHIR instant, e.g. 2026-01-31T00:00:00Z")
+			}
+			in.Since = &since
+		case "_type":
+			for _, v := range values {
+				for _, t := range strings.Split(v, ",") {
+					if t = strings.TrimSpace(t); t != "" {
+						if !resourceTypePattern.MatchString(t) {
+							return in, fmt.Errorf("_type must list FHIR resource types")
+						}
+						in.Types = append(in.Types, t)
+					}
+				}
+			}
+		default:
+			return in, fmt.Errorf("parameter %s is not supported by $export", name)
+		}
+	}
+	return in, nil
+}
+
+// ExportSystem kicks off an export of every resource of the exported types.
+func (ctrl *BulkExportController) ExportSystem(w http.ResponseWriter, r *http.Request) {
+	ctrl.kickoff(w, r, contracts.BulkExportLevelSystem, "")
+}
+
+// ExportPatients kicks off an export of the compartments of every patient.
+func (ctrl *BulkExportController) ExportPatients(w http.ResponseWriter, r *http.Request) {
+	ctrl.kickoff(w, r, contracts.BulkExportLevelPatient, "")
+}
+
+// ExportGroup kicks off an export of the compartments of the patients in a Group.
+func (ctrl *BulkExportController) ExportGroup(w http.ResponseWriter, r *http.Request) {
+	ctrl.kickoff(w, r, contracts.BulkExportLevelGroup, chi.URLParam(r, "id"))
+}
+
+func (ctrl *BulkExportController) kickoff(w http.ResponseWriter, r *http.Request, level, groupID string) {
+	in, err := parseBulkExportKickoff(r)
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, exceptions.BuildNewCustomError(nil, constvars.StatusBadRequest, err.Error(), err.Error()))
+		return
+	}
+	in.Level = level
+	in.GroupID = groupID
+	in.RequestURL = ctrl.publicURL(r)
+
+	job, err := ctrl.Usecase.Kickoff(r.Context(), in)
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
+	}
+
+	w.Header().Set(constvars.HeaderContentLocation, ctrl.statusURL(job.ID))
+	w.WriteHeader(constvars.StatusAccepted)
+}
+
+// Status reports the progress of a job, and lists its files once it completed.
+func (ctrl *BulkExportController) Status(w http.ResponseWriter, r *http.Request) {
+	out, err := ctrl.Usecase.Status(r.Context(), chi.URLParam(r, "jobID"))
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
+	}
+
+	switch out.Job.Status {
+	case contracts.BulkExportStatusCompleted:
+		w.Header().Set(constvars.HeaderContentType, constvars.MIMEApplicationJSON)
+		w.WriteHeader(constvars.StatusOK)
+		_ = json.NewEncoder(w).Encode(out.Manifest)
+	case contracts.BulkExportStatusFailed:
+		w.Header().Set(constvars.HeaderContentType, constvars.MIMEApplicationFHIRJSON)
+		w.WriteHeader(constvars.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(fhir_dto.OperationOutcome{
+			ResourceType: "OperationOutcome",
+			Issue:        []fhir_dto.Issue{{Severity: "error", Code: "exception", Diagnostics: "export failed: " + out.Job.Error}},
+		})
+	default:
+		progress := out.Job.Progress
+		if progress == "" {
+			progress = out.Job.Status
+		}
+		w.Header().Set("X-Progress", progress)
+		w.Header().Set(constvars.HeaderRetryAfter, bulkExportRetryAfterSeconds)
+		w.WriteHeader(constvars.StatusAccepted)
+	}
+}
+
+// Cancel stops a job and deletes its files.
+func (ctrl *BulkExportController) Cancel(w http.ResponseWriter, r *http.Request) {
+	if err := ctrl.Usecase.Cancel(r.Context(), chi.URLParam(r, "jobID")); err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
+	}
+	w.WriteHeader(constvars.StatusAccepted)
+}
+
+// DownloadFile streams one NDJSON file of a completed job.
+func (ctrl *BulkExportController) DownloadFile(w http.ResponseWriter, r *http.Request) {
+	file, err := ctrl.Usecase.OpenFile(r.Context(), chi.URLParam(r, "jobID"), chi.URLParam(r, "name"))
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set(constvars.HeaderContentType, constvars.MIMEApplicationFHIRNDJSON)
+	w.WriteHeader(constvars.StatusOK)
+	if _, err := io.Copy(w, file); err != nil {
+		ctrl.Log.Warn("BulkExportController.DownloadFile failed writing file", zap.Error(err))
+	}
+}
+
+// publicURL is the URL of r as the client sent it to the gateway.
+func (ctrl *BulkExportController) publicURL(r *http.Request) string {
+	public, err := url.Parse(ctrl.InternalConfig.App.BaseUrl)
+	if err != nil || public.Host == "" {
+		return r.URL.RequestURI()
+	}
+	return public.Scheme + "://" + public.Host + r.URL.RequestURI()
+}
+
+func (ctrl *BulkExportController) statusURL(jobID string) string {
+	app := ctrl.InternalConfig.App
+	return fmt.Sprintf("%s/%s/%s/bulk-export/%s", strings.TrimRight(app.BaseUrl, "/"), app.EndpointPrefix, app.Version, jobID)
+}
@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/utils"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+type HealthController struct {
+	Log         *zap.Logger
+	PolicyStore contracts.RBACPolicyStore
+}
+
+var (
+	healthControllerInstance *HealthController
+	onceHealthController     sync.Once
+)
+
+func NewHealthController(logger *zap.Logger, policyStore contracts.RBACPolicyStore) *HealthController {
+	onceHealthController.Do(func() {
+		healthControllerInstance = &HealthController{
+			Log:         logger,
+			PolicyStore: policyStore,
+		}
+	})
+	return healthControllerInstance
+}
+
+type healthResponse struct {
+	Status string `json:"status"`
+}
+
+// Check reports that the instance is serving. It is public, so it says nothing about the policy.
+func (ctrl *HealthController) Check(w http.ResponseWriter, r *http.Request) {
+	utils.BuildSuccessResponse(w, constvars.StatusOK, constvars.HealthCheckSuccessMessage, healthResponse{Status: "ok"})
+}
+
+// PolicyStatus reports which RBAC policy the instance enforces, so replicas can be compared.
+func (ctrl *HealthController) PolicyStatus(w http.ResponseWriter, r *http.Request) {
+	utils.BuildSuccessResponse(w, constvars.StatusOK, constvars.GetPolicyStatusSuccessMessage, ctrl.PolicyStore.Status())
+}
@@ -1,13 +1,150 @@
 package controllers
 
-import "konsulin-service/internal/app/contracts"
+import (
+	"encoding/json"
+	"io"
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+	"konsulin-service/internal/pkg/utils"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"go.uber.org/zap"
+)
 
 type RoleController struct {
+	Log         *zap.Logger
 	RoleUsecase contracts.RoleUsecase
 }
 
-func NewRoleController(roleUsecase contracts.RoleUsecase) *RoleController {
-	return &RoleController{
-		RoleUsecase: roleUsecase,
+var (
+	roleControllerInstance *RoleController
+	onceRoleController     sync.Once
+)
+
+func NewRoleController(logger *zap.Logger, roleUsecase contracts.RoleUsecase) *RoleController {
+	onceRoleController.Do(func() {
+		roleControllerInstance = &RoleController{
+			Log:         logger,
+			RoleUsecase: roleUsecase,
+		}
+	})
+	return roleControllerInstance
+}
+
+type permissionRequest struct {
+	Role   string `json:"role"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+func (ctrl *RoleController) ListRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := ctrl.RoleUsecase.ListRoles(r.Context())
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
+	}
+	utils.BuildSuccessResponse(w, constvars.StatusOK, constvars.GetRolesSuccessMessage, roles)
+}
+
+// ListPermissions lists the permissions of the role given in the role query parameter, or of
+// every role.
+func (ctrl *RoleController) ListPermissions(w http.ResponseWriter, r *http.Request) {
+	permissions, err := ctrl.RoleUsecase.ListPermissions(r.Context(), r.URL.Query().Get("role"))
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
+	}
+	utils.BuildSuccessResponse(w, constvars.StatusOK, constvars.GetPermissionsSuccessMessage, permissions)
+}
+
+func (ctrl *RoleController) AddPermission(w http.ResponseWriter, r *http.Request) {
+	var req permissionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, exceptions.ErrCannotParseJSON(err))
+		return
+	}
+	change, err := ctrl.RoleUsecase.AddPermission(r.Context(), req.Role, req.Method, req.Path)
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
+	}
+	utils.BuildSuccessResponse(w, constvars.StatusOK, constvars.AddPermissionSuccessMessage, change)
+}
+
+func (ctrl *RoleController) RemovePermission(w http.ResponseWriter, r *http.Request) {
+	var req permissionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, exceptions.ErrCannotParseJSON(err))
+		return
+	}
+	change, err := ctrl.RoleUsecase.RemovePermission(r.Context(), req.Role, req.Method, req.Path)
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
+	}
+	utils.BuildSuccessResponse(w, constvars.StatusOK, constvars.RemovePermissionSuccessMessage, change)
+}
+
+// ExportPolicy downloads the policy as a CSV file that ImportPolicy, or resources/rbac_policy.csv,
+// accepts.
+func (ctrl *RoleController) ExportPolicy(w http.ResponseWriter, r *http.Request) {
+	csv, err := ctrl.RoleUsecase.ExportPolicy(r.Context())
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="rbac_policy.csv"`)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(csv)
+}
+
+// ImportPolicy replaces the policy with the CSV in the request body.
+func (ctrl *RoleController) ImportPolicy(w http.ResponseWriter, r *http.Request) {
+	csv, err := io.ReadAll(r.Body)
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, exceptions.ErrInvalidPolicyRule(err))
+		return
+	}
+	change, err := ctrl.RoleUsecase.ImportPolicy(r.Context(), csv)
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
+	}
+	utils.BuildSuccessResponse(w, constvars.StatusOK, constvars.ImportPolicySuccessMessage, change)
+}
+
+// ListPolicyChanges lists who changed the policy, most recent first. The limit query parameter
+// defaults to 50.
+func (ctrl *RoleController) ListPolicyChanges(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 {
+			utils.BuildErrorResponse(ctrl.Log, w, exceptions.BuildNewCustomError(nil, constvars.StatusBadRequest, constvars.ErrClientCannotProcessRequest, "limit must be a positive integer"))
+			return
+		}
+		limit = parsed
+	}
+
+	changes, err := ctrl.RoleUsecase.ListPolicyChanges(r.Context(), limit)
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
+	}
+	utils.BuildSuccessResponse(w, constvars.StatusOK, constvars.GetPolicyChangesSuccessMessage, changes)
+}
+
+// ReloadPolicy makes every instance reload the policy, e.g. after the policy key was edited in
+// Redis by hand.
+func (ctrl *RoleController) ReloadPolicy(w http.ResponseWriter, r *http.Request) {
+	change, err := ctrl.RoleUsecase.ReloadPolicy(r.Context())
+	if err != nil {
+		utils.BuildErrorResponse(ctrl.Log, w, err)
+		return
 	}
+	utils.BuildSuccessResponse(w, constvars.StatusOK, constvars.ReloadPolicySuccessMessage, change)
 }
@@ -2,6 +2,7 @@ package middlewares
 
 import (
 	"context"
+	"konsulin-service/internal/app/contracts"
 	"konsulin-service/internal/pkg/constvars"
 	"konsulin-service/internal/pkg/exceptions"
 	"konsulin-service/internal/pkg/utils"
@@ -13,6 +14,16 @@ import (
 const (
 	HeaderAPIKey      = "x-api-key"
 	ContextAPIKeyAuth = "api_key_auth"
+	// ContextAPIKeyID and ContextAPIKeyName identify the integrator key a request was made with.
+	// They are not set for the superadmin API key.
+	ContextAPIKeyID   = "api_key_id"
+	ContextAPIKeyName = "api_key_name"
+
+	// superadminAPIKeyUID is the uid of requests made with the superadmin API key.
+	superadminAPIKeyUID = "api-key-superadmin"
+	// integratorAPIKeyUIDPrefix starts the uid of requests made with an integrator key, followed by
+	// the key ID.
+	integratorAPIKeyUIDPrefix = "api-key:"
 )
 
 func (m *Middlewares) APIKeyAuth(next http.Handler) http.Handler {
@@ -24,26 +35,75 @@ func (m *Middlewares) APIKeyAuth(next http.Handler) http.Handler {
 			return
 		}
 
-		if apiKey != m.InternalConfig.App.SuperadminAPIKey {
-			utils.BuildErrorResponse(m.Log, w, exceptions.ErrInvalidAPIKey(nil))
+		if apiKey == m.InternalConfig.App.SuperadminAPIKey {
+			ctx := context.WithValue(r.Context(), ContextAPIKeyAuth, true)
+			ctx = context.WithValue(ctx, keyRoles, []string{constvars.KonsulinRoleSuperadmin})
+			ctx = context.WithValue(ctx, keyUID, superadminAPIKeyUID)
+
+			ctx = context.WithValue(ctx, constvars.CONTEXT_FHIR_ROLE, []string{constvars.KonsulinRoleSuperadmin})
+			ctx = context.WithValue(ctx, constvars.CONTEXT_UID, superadminAPIKeyUID)
+
+			m.Log.Info("API Key authentication successful",
+				zap.String("ip", r.RemoteAddr),
+				zap.String("endpoint", r.URL.Path),
+				zap.String("method", r.Method),
+				zap.String("user_agent", r.UserAgent()))
+
+			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), ContextAPIKeyAuth, true)
-		ctx = context.WithValue(ctx, keyRoles, []string{constvars.KonsulinRoleSuperadmin})
-		ctx = context.WithValue(ctx, keyUID, "api-key-superadmin")
+		if m.APIKeys == nil {
+			utils.BuildErrorResponse(m.Log, w, exceptions.ErrInvalidAPIKey(nil))
+			return
+		}
+		key, err := m.APIKeys.Authenticate(r.Context(), apiKey)
+		if err != nil {
+			m.Log.Warn("Integrator API key rejected",
+				zap.String("ip", r.RemoteAddr),
+				zap.String("endpoint", r.URL.Path),
+				zap.String("method", r.Method),
+				zap.Error(err))
+			utils.BuildErrorResponse(m.Log, w, err)
+			return
+		}
 
-		ctx = context.WithValue(ctx, constvars.CONTEXT_FHIR_ROLE, []string{constvars.KonsulinRoleSuperadmin})
-		ctx = context.WithValue(ctx, constvars.CONTEXT_UID, "api-key-superadmin")
+		next.ServeHTTP(w, r.WithContext(m.withIntegratorKey(r, key, "bearer")))
+	})
+}
 
-		m.Log.Info("API Key authentication successful",
-			zap.String("ip", r.RemoteAddr),
-			zap.String("endpoint", r.URL.Path),
-			zap.String("method", r.Method),
-			zap.String("user_agent", r.UserAgent()))
+// withIntegratorKey authenticates the request as an integrator key. mode is how the key was
+// presented, bearer or signed, for the logs.
+func (m *Middlewares) withIntegratorKey(r *http.Request, key *contracts.APIKey, mode string) context.Context {
+	uid := integratorAPIKeyUIDPrefix + key.ID
+	ctx := context.WithValue(r.Context(), ContextAPIKeyAuth, true)
+	ctx = context.WithValue(ctx, ContextAPIKeyID, key.ID)
+	ctx = context.WithValue(ctx, ContextAPIKeyName, key.Name)
+	ctx = context.WithValue(ctx, keyRoles, key.Roles)
+	ctx = context.WithValue(ctx, keyUID, uid)
+
+	ctx = context.WithValue(ctx, constvars.CONTEXT_FHIR_ROLE, key.Roles)
+	ctx = context.WithValue(ctx, constvars.CONTEXT_UID, uid)
+
+	m.Log.Info("Integrator API key authentication successful",
+		zap.Any(constvars.LoggingRequestIDKey, r.Context().Value(constvars.CONTEXT_REQUEST_ID_KEY)),
+		zap.String("api_key_id", key.ID),
+		zap.String("api_key_name", key.Name),
+		zap.String("api_key_owner", key.Owner),
+		zap.String("mode", mode),
+		zap.Strings("roles", key.Roles),
+		zap.String("ip", r.RemoteAddr),
+		zap.String("endpoint", r.URL.Path),
+		zap.String("method", r.Method),
+		zap.String("user_agent", r.UserAgent()))
+	return ctx
+}
 
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+// isAPIKeyRequest reports whether the request was authenticated with an API key, the superadmin one
+// or an integrator's.
+func isAPIKeyRequest(ctx context.Context) bool {
+	apiKeyAuth, _ := ctx.Value(ContextAPIKeyAuth).(bool)
+	return apiKeyAuth
 }
 
 func (m *Middlewares) RequireSuperadminAPIKey(next http.Handler) http.Handler {
@@ -72,10 +132,10 @@ func (m *Middlewares) RequireSuperadminAPIKey(next http.Handler) http.Handler {
 
 		ctx := context.WithValue(r.Context(), ContextAPIKeyAuth, true)
 		ctx = context.WithValue(ctx, keyRoles, []string{constvars.KonsulinRoleSuperadmin})
-		ctx = context.WithValue(ctx, keyUID, "api-key-superadmin")
+		ctx = context.WithValue(ctx, keyUID, superadminAPIKeyUID)
 		// Add new typed context keys alongside existing ones
 		ctx = context.WithValue(ctx, constvars.CONTEXT_FHIR_ROLE, []string{constvars.KonsulinRoleSuperadmin})
-		ctx = context.WithValue(ctx, constvars.CONTEXT_UID, "api-key-superadmin")
+		ctx = context.WithValue(ctx, constvars.CONTEXT_UID, superadminAPIKeyUID)
 
 		m.Log.Info("Superadmin API key authentication successful",
 			zap.String("ip", r.RemoteAddr),
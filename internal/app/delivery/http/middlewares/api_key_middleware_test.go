@@ -3,7 +3,9 @@ package middlewares
 import (
 	"context"
 	"konsulin-service/internal/app/config"
+	"konsulin-service/internal/app/contracts"
 	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -256,3 +258,61 @@ func TestRequireSuperadminAPIKey_ContextValues(t *testing.T) {
 		assert.Equal(t, "api-key-superadmin", uid, "uid should be api-key-superadmin")
 	})
 }
+
+type stubAPIKeys struct {
+	contracts.APIKeyUsecase
+	key *contracts.APIKey
+}
+
+func (s *stubAPIKeys) Authenticate(_ context.Context, secret string) (*contracts.APIKey, error) {
+	if secret != "kk_0123456789abcdef_secret" {
+		return nil, exceptions.ErrInvalidAPIKey(nil)
+	}
+	return s.key, nil
+}
+
+func TestAPIKeyAuth_IntegratorKey(t *testing.T) {
+	m := &Middlewares{
+		Log:            zap.NewNop(),
+		InternalConfig: &config.InternalConfig{App: config.App{SuperadminAPIKey: "test-superadmin-api-key-12345"}},
+		APIKeys: &stubAPIKeys{key: &contracts.APIKey{
+			ID:    "0123456789abcdef",
+			Name:  "Prodia Lab",
+			Roles: []string{constvars.KonsulinRoleResearcher},
+		}},
+	}
+
+	var captured context.Context
+	handler := m.APIKeyAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		captured = r.Context()
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/fhir/Questionnaire", nil)
+	req.Header.Set(HeaderAPIKey, "kk_0123456789abcdef_secret")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, isAPIKeyRequest(captured))
+	assert.Equal(t, []string{constvars.KonsulinRoleResearcher}, captured.Value(keyRoles))
+	assert.Equal(t, "api-key:0123456789abcdef", captured.Value(keyUID))
+	assert.Equal(t, "Prodia Lab", captured.Value(ContextAPIKeyName))
+	assert.Equal(t, constvars.KonsulinRoleResearcher, apiKeyFHIRRole(captured.Value(keyRoles).([]string)))
+
+	req = httptest.NewRequest(http.MethodGet, "/fhir/Questionnaire", nil)
+	req.Header.Set(HeaderAPIKey, "kk_0123456789abcdef_wrong")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestCheckSingle_IdentityRoleWithoutFHIRID(t *testing.T) {
+	m := patchTestMiddlewares(t, nil)
+	check := func(role, fhirID string) error {
+		return checkSingle(context.Background(), m.Enforcer, http.MethodGet, "/fhir/Observation?subject=Patient/p1", []string{role}, fhirID, nil, nil, nil, nil, nil, nil)
+	}
+
+	assert.NoError(t, check(constvars.KonsulinRolePatient, "p1"))
+	assert.Error(t, check(constvars.KonsulinRolePatient, ""), "a key holding a patient role has no records of its own")
+	assert.Error(t, check(constvars.KonsulinRolePractitioner, ""))
+}
@@ -0,0 +1,368 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/fhir_dto"
+	"konsulin-service/internal/pkg/utils"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+)
+
+const auditObserverDisplay = "konsulin-api"
+
+// AuditTrail writes FHIR AuditEvents for proxied requests. Events are queued and posted to the FHIR
+// server by background workers so request latency never depends on the audit write. When the queue
+// is full new events are dropped and logged rather than blocking the request.
+type AuditTrail struct {
+	log      *zap.Logger
+	client   *http.Client
+	endpoint string
+	queue    chan []byte
+	wg       sync.WaitGroup
+	once     sync.Once
+}
+
+// NewAuditTrail starts workers posting AuditEvents to fhirBaseURL.
+func NewAuditTrail(log *zap.Logger, fhirBaseURL string, queueSize, workers int) *AuditTrail {
+	a := &AuditTrail{
+		log:      log,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		endpoint: strings.TrimRight(fhirBaseURL, "/") + "/AuditEvent",
+		queue:    make(chan []byte, queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		a.wg.Add(1)
+		go a.work()
+	}
+	return a
+}
+
+// Record queues an AuditEvent. It never blocks.
+func (a *AuditTrail) Record(event []byte) {
+	select {
+	case a.queue <- event:
+	default:
+		a.log.Warn("audit queue full; dropping AuditEvent", auditEventSummary(event)...)
+	}
+}
+
+// Close stops accepting events and waits for the queued ones to be written.
+func (a *AuditTrail) Close() {
+	a.once.Do(func() {
+		close(a.queue)
+		a.wg.Wait()
+	})
+}
+
+func (a *AuditTrail) work() {
+	defer a.wg.Done()
+	for event := range a.queue {
+		if err := a.write(event); err != nil {
+			a.log.Error("failed to write AuditEvent", append(auditEventSummary(event), zap.Error(err))...)
+		}
+	}
+}
+
+func (a *AuditTrail) write(event []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, a.endpoint, bytes.NewReader(event))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/fhir+json")
+	req.Header.Set("Prefer", "return=minimal")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		// the OperationOutcome may quote the event, so only its issue codes are kept
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("FHIR server answered %d: %s", resp.StatusCode, gjson.GetBytes(body, "issue.#.code").Raw)
+	}
+	return nil
+}
+
+// auditEventSummary identifies an AuditEvent in application logs. The event itself stays out of
+// them: its query and entities can carry patient data.
+func auditEventSummary(event []byte) []zap.Field {
+	return []zap.Field{
+		zap.String("audit_event_id", gjson.GetBytes(event, "id").String()),
+		zap.String("audit_event_action", gjson.GetBytes(event, "action").String()),
+		zap.String("audit_event_type", gjson.GetBytes(event, "subtype.0.code").String()),
+		zap.String("audit_event_outcome", gjson.GetBytes(event, "outcome").String()),
+	}
+}
+
+// proxyAudit collects what one proxied request touched while it is being served.
+type proxyAudit struct {
+	mu       sync.Mutex
+	entities []string
+	// patients are the Patient compartments the returned resources belong to.
+	patients []string
+	seen     map[string]struct{}
+}
+
+func (pa *proxyAudit) record(ref string) {
+	pa.add(&pa.entities, ref)
+}
+
+func (pa *proxyAudit) recordPatient(ref string) {
+	pa.add(&pa.patients, "patient:"+ref)
+}
+
+func (pa *proxyAudit) add(list *[]string, key string) {
+	if pa == nil || key == "" || key == "patient:" {
+		return
+	}
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if _, ok := pa.seen[key]; ok {
+		return
+	}
+	pa.seen[key] = struct{}{}
+	*list = append(*list, strings.TrimPrefix(key, "patient:"))
+}
+
+// recordEntry records the resource of a Bundle entry that is returned to the client.
+func (pa *proxyAudit) recordEntry(raw []byte) {
+	if pa == nil {
+		return
+	}
+	res := gjson.GetBytes(raw, "resource")
+	if res.Exists() {
+		pa.recordResource([]byte(res.Raw))
+		return
+	}
+	// transaction-response entries carry a location instead of the resource
+	pa.record(locationReference(gjson.GetBytes(raw, "response.location").String()))
+}
+
+func (pa *proxyAudit) recordResource(raw []byte) {
+	rt := gjson.GetBytes(raw, "resourceType").String()
+	id := gjson.GetBytes(raw, "id").String()
+	if rt == "" || id == "" || rt == "OperationOutcome" {
+		return
+	}
+	pa.record(rt + "/" + id)
+
+	for _, patient := range compartmentPatients(raw, rt, id) {
+		pa.recordPatient(patient)
+	}
+}
+
+// recordBody records every resource of an uncompressed response body returned to the client.
+func (pa *proxyAudit) recordBody(body []byte) {
+	if pa == nil || !gjson.ValidBytes(body) {
+		return
+	}
+	if gjson.GetBytes(body, "resourceType").String() != "Bundle" {
+		pa.recordResource(body)
+		return
+	}
+	gjson.GetBytes(body, "entry").ForEach(func(_, entry gjson.Result) bool {
+		pa.recordEntry([]byte(entry.Raw))
+		return true
+	})
+}
+
+// locationReference turns "Patient/1/_history/2", absolute or not, into "Patient/1".
+func locationReference(location string) string {
+	parts := strings.Split(strings.Trim(location, "/"), "/")
+	if i := slices.Index(parts, historySegment); i >= 0 {
+		parts = parts[:i]
+	}
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2] + "/" + parts[len(parts)-1]
+}
+
+func (m *Middlewares) startProxyAudit() *proxyAudit {
+	if m.Audit == nil {
+		return nil
+	}
+	return &proxyAudit{seen: make(map[string]struct{})}
+}
+
+// finishProxyAudit queues the AuditEvent of a served request.
+func (m *Middlewares) finishProxyAudit(pa *proxyAudit, r *http.Request, path string, statusCode int) {
+	if pa == nil {
+		return
+	}
+
+	event, err := json.Marshal(buildAuditEvent(r, path, statusCode, pa.entities, pa.patients, time.Now()))
+	if err != nil {
+		m.Log.Error("failed to build AuditEvent", zap.Error(err))
+		return
+	}
+	m.Audit.Record(event)
+}
+
+// buildAuditEvent describes a proxied request as a FHIR R4 AuditEvent. path is the request path
+// relative to the FHIR base; entities are the resources returned and patients the Patient
+// compartments they belong to.
+func buildAuditEvent(r *http.Request, path string, statusCode int, entities, patients []string, now time.Time) fhir_dto.AuditEvent {
+	ctx := r.Context()
+	uid, _ := ctx.Value(keyUID).(string)
+	roles, _ := ctx.Value(keyRoles).([]string)
+	fhirRole, _ := ctx.Value(keyFHIRRole).(string)
+	fhirID, _ := ctx.Value(keyFHIRID).(string)
+	apiKey, _ := ctx.Value(ContextAPIKeyAuth).(bool)
+	requestID, _ := ctx.Value(constvars.CONTEXT_REQUEST_ID_KEY).(string)
+
+	interaction, action := auditInteraction(r.Method, path)
+
+	agent := fhir_dto.AuditEventAgent{
+		Type:      &fhir_dto.CodeableConcept{Coding: []fhir_dto.Coding{{System: "http://terminology.hl7.org/CodeSystem/extra-security-role-type", Code: "humanuser", Display: "human user"}}},
+		AltID:     uid,
+		Requestor: true,
+		Network:   &fhir_dto.AuditEventNetwork{Address: r.RemoteAddr, Type: "2"},
+	}
+	if apiKey {
+		agent.Type = &fhir_dto.CodeableConcept{Coding: []fhir_dto.Coding{{System: "http://dicom.nema.org/resources/ontology/DCM", Code: constvars.FhirAuditAgentTypeApplication, Display: "Application"}}, Text: "api-key"}
+		agent.Name = uid
+		if name, _ := ctx.Value(ContextAPIKeyName).(string); name != "" {
+			agent.Name = name
+		}
+	}
+	if fhirRole != "" && fhirID != "" {
+		agent.Who = &fhir_dto.Reference{Reference: fhirRole + "/" + fhirID}
+	} else if uid != "" {
+		agent.Who = &fhir_dto.Reference{Identifier: &fhir_dto.Identifier{System: "urn:konsulin:uid", Value: uid}}
+	}
+	for _, role := range roles {
+		agent.Role = append(agent.Role, fhir_dto.CodeableConcept{Text: role})
+	}
+
+	ev := fhir_dto.AuditEvent{
+		ResourceType: constvars.ResourceAuditEvent,
+		Type:         fhir_dto.Coding{System: "http://terminology.hl7.org/CodeSystem/audit-event-type", Code: "rest", Display: "RESTful Operation"},
+		Subtype:      []fhir_dto.Coding{{System: "http://hl7.org/fhir/restful-interaction", Code: interaction}},
+		Action:       action,
+		Recorded:     now.UTC().Format(time.RFC3339Nano),
+		Outcome:      auditOutcome(statusCode),
+		OutcomeDesc:  fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		Agent:        []fhir_dto.AuditEventAgent{agent},
+	}
+	ev.Source.Observer = fhir_dto.Reference{Display: auditObserverDisplay}
+
+	for _, ref := range entities {
+		ev.Entity = append(ev.Entity, resourceAuditEntity(ref))
+	}
+	// Write targets are known from the path even when the response body carries no resource.
+	if target := pathReference(path); target != "" && action != "R" && action != "E" && !slices.Contains(entities, target) {
+		ev.Entity = append(ev.Entity, resourceAuditEntity(target))
+	}
+	for _, ref := range patients {
+		if slices.Contains(entities, ref) {
+			continue
+		}
+		ev.Entity = append(ev.Entity, fhir_dto.AuditEventEntity{
+			What: &fhir_dto.Reference{Reference: ref},
+			Type: &fhir_dto.Coding{System: "http://terminology.hl7.org/CodeSystem/audit-entity-type", Code: "1", Display: "Person"},
+			Role: &fhir_dto.Coding{System: constvars.FhirAuditObjectRoleSystem, Code: constvars.FhirAuditObjectRolePatient, Display: "Patient"},
+		})
+	}
+	if r.URL.RawQuery != "" {
+		ev.Entity = append(ev.Entity, fhir_dto.AuditEventEntity{
+			Type:  &fhir_dto.Coding{System: "http://terminology.hl7.org/CodeSystem/audit-entity-type", Code: "2", Display: "System Object"},
+			What:  &fhir_dto.Reference{Display: path},
+			Query: base64.StdEncoding.EncodeToString([]byte(r.URL.RawQuery)),
+		})
+	}
+	if requestID != "" {
+		ev.Entity = append(ev.Entity, fhir_dto.AuditEventEntity{What: &fhir_dto.Reference{Identifier: &fhir_dto.Identifier{System: constvars.FhirAuditRequestIDSystem, Value: requestID}}})
+	}
+
+	return ev
+}
+
+// resourceAuditEntity describes a returned or written resource. Its type is the FHIR resource type
+// so events can be searched by it.
+func resourceAuditEntity(ref string) fhir_dto.AuditEventEntity {
+	rt, _, _ := strings.Cut(ref, "/")
+	e := fhir_dto.AuditEventEntity{
+		What: &fhir_dto.Reference{Reference: ref},
+		Type: &fhir_dto.Coding{System: constvars.FhirAuditResourceTypeSystem, Code: rt},
+	}
+	if rt == constvars.ResourcePatient {
+		e.Role = &fhir_dto.Coding{System: constvars.FhirAuditObjectRoleSystem, Code: constvars.FhirAuditObjectRolePatient, Display: "Patient"}
+	}
+	return e
+}
+
+// auditInteraction maps a request to its FHIR restful-interaction code and AuditEvent action.
+func auditInteraction(method, path string) (string, string) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if parts[0] == "" {
+		parts = nil
+	}
+	hasOperation := slices.ContainsFunc(parts, func(p string) bool { return strings.HasPrefix(p, "$") })
+
+	switch {
+	case hasOperation:
+		return "operation", "E"
+	case method == http.MethodPost && len(parts) == 0:
+		return "transaction", "E"
+	case method == http.MethodPost && len(parts) > 0 && parts[len(parts)-1] == "_search":
+		return "search-type", "E"
+	case method == http.MethodPost:
+		return "create", "C"
+	case method == http.MethodPut:
+		return "update", "U"
+	case method == http.MethodPatch:
+		return "patch", "U"
+	case method == http.MethodDelete:
+		return "delete", "D"
+	case slices.Contains(parts, historySegment):
+		switch parseHistoryPath(path).level {
+		case historyVersion:
+			return "vread", "R"
+		case historyType:
+			return "history-type", "R"
+		case historySystem:
+			return "history-system", "R"
+		}
+		return "history-instance", "R"
+	case len(parts) == 2:
+		return "read", "R"
+	default:
+		return "search-type", "E"
+	}
+}
+
+func auditOutcome(statusCode int) string {
+	switch {
+	case statusCode < http.StatusBadRequest:
+		return constvars.FhirAuditOutcomeSuccess
+	case statusCode < http.StatusInternalServerError:
+		return constvars.FhirAuditOutcomeMinorFailure
+	default:
+		return constvars.FhirAuditOutcomeSeriousFailure
+	}
+}
+
+// pathReference returns "Type/id" for instance-level paths.
+func pathReference(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 || utils.ExtractResourceTypeFromPath(path) == "" || strings.HasPrefix(parts[1], "$") || strings.HasPrefix(parts[1], "_") {
+		return ""
+	}
+	return parts[0] + "/" + parts[1]
+}
@@ -0,0 +1,210 @@
+package middlewares
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/fhir_dto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// auditUpstream serves FHIR responses and captures the AuditEvents posted back to it.
+type auditUpstream struct {
+	*httptest.Server
+	mu     sync.Mutex
+	events []fhir_dto.AuditEvent
+}
+
+func newAuditUpstream(t *testing.T, handler http.HandlerFunc) *auditUpstream {
+	t.Helper()
+	u := &auditUpstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/AuditEvent" {
+			body, _ := io.ReadAll(r.Body)
+			var ev fhir_dto.AuditEvent
+			if err := json.Unmarshal(body, &ev); err == nil {
+				u.mu.Lock()
+				u.events = append(u.events, ev)
+				u.mu.Unlock()
+			}
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *auditUpstream) recorded() []fhir_dto.AuditEvent {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.events
+}
+
+func auditEntityReferences(ev fhir_dto.AuditEvent) []string {
+	var refs []string
+	for _, e := range ev.Entity {
+		if e.What != nil && e.What.Reference != "" && e.Type != nil && e.Type.System == constvars.FhirAuditResourceTypeSystem {
+			refs = append(refs, e.What.Reference)
+		}
+	}
+	return refs
+}
+
+func TestBridge_AuditsFilteredRead(t *testing.T) {
+	upstream := newAuditUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/fhir+json")
+		_, _ = w.Write([]byte(streamTestBundle))
+	})
+
+	audit := NewAuditTrail(zap.NewNop(), upstream.URL, 10, 1)
+	m := &Middlewares{Log: zap.NewNop(), Audit: audit}
+
+	req := httptest.NewRequest(http.MethodGet, "/fhir/Observation?subject=Patient/p1", nil)
+	ctx := context.WithValue(req.Context(), keyRoles, []string{constvars.KonsulinRolePatient})
+	ctx = context.WithValue(ctx, keyUID, "uid-1")
+	ctx = context.WithValue(ctx, keyFHIRRole, constvars.KonsulinRolePatient)
+	ctx = context.WithValue(ctx, keyFHIRID, "p1")
+	ctx = context.WithValue(ctx, constvars.CONTEXT_REQUEST_ID_KEY, "req-1")
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	m.Bridge(upstream.URL).ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	audit.Close()
+	events := upstream.recorded()
+	require.Len(t, events, 1)
+	ev := events[0]
+
+	assert.Equal(t, "AuditEvent", ev.ResourceType)
+	assert.Equal(t, "E", ev.Action)
+	assert.Equal(t, "search-type", ev.Subtype[0].Code)
+	assert.Equal(t, "0", ev.Outcome)
+
+	require.Len(t, ev.Agent, 1)
+	assert.Equal(t, "Patient/p1", ev.Agent[0].Who.Reference)
+	assert.Equal(t, "uid-1", ev.Agent[0].AltID)
+	assert.Equal(t, "humanuser", ev.Agent[0].Type.Coding[0].Code)
+
+	assert.Equal(t, []string{"Observation/o1", "Observation/o3"}, auditEntityReferences(ev), "only entries returned after filtering are audited")
+	assert.Contains(t, ev.Entity, fhir_dto.AuditEventEntity{
+		What: &fhir_dto.Reference{Reference: "Patient/p1"},
+		Type: &fhir_dto.Coding{System: "http://terminology.hl7.org/CodeSystem/audit-entity-type", Code: "1", Display: "Person"},
+		Role: &fhir_dto.Coding{System: constvars.FhirAuditObjectRoleSystem, Code: constvars.FhirAuditObjectRolePatient, Display: "Patient"},
+	}, "the patient compartment is recorded so the event shows up in the patient's access log")
+	for _, e := range ev.Entity {
+		assert.NotEqual(t, "Patient/p2", e.What.Reference)
+	}
+
+	var query, requestID string
+	for _, e := range ev.Entity {
+		if e.Query != "" {
+			query = e.Query
+		}
+		if e.What != nil && e.What.Identifier != nil && e.What.Identifier.System == constvars.FhirAuditRequestIDSystem {
+			requestID = e.What.Identifier.Value
+		}
+	}
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("subject=Patient/p1")), query)
+	assert.Equal(t, "req-1", requestID)
+}
+
+func TestBridge_AuditsWriteOutcome(t *testing.T) {
+	upstream := newAuditUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			w.Header().Set("Content-Type", "application/fhir+json")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"resourceType":"OperationOutcome","issue":[{"severity":"error","code":"not-found"}]}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/fhir+json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"resourceType":"Observation","id":"o9"}`))
+	})
+
+	audit := NewAuditTrail(zap.NewNop(), upstream.URL, 10, 1)
+	m := &Middlewares{Log: zap.NewNop(), Audit: audit}
+	bridge := m.Bridge(upstream.URL)
+
+	create := httptest.NewRequest(http.MethodPost, "/fhir/Observation", nil)
+	createCtx := context.WithValue(create.Context(), ContextAPIKeyAuth, true)
+	createCtx = context.WithValue(createCtx, ContextAPIKeyName, "Prodia Lab")
+	create = create.WithContext(createCtx)
+	bridge.ServeHTTP(httptest.NewRecorder(), create)
+
+	bridge.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/fhir/Observation/o1", nil))
+
+	audit.Close()
+	events := upstream.recorded()
+	require.Len(t, events, 2)
+
+	byAction := map[string]fhir_dto.AuditEvent{}
+	for _, ev := range events {
+		byAction[ev.Action] = ev
+	}
+
+	created := byAction["C"]
+	assert.Equal(t, "0", created.Outcome)
+	assert.Equal(t, []string{"Observation/o9"}, auditEntityReferences(created))
+	assert.Equal(t, "110150", created.Agent[0].Type.Coding[0].Code)
+	assert.Equal(t, "Prodia Lab", created.Agent[0].Name, "integrator keys are named by their key name")
+
+	deleted := byAction["D"]
+	assert.Equal(t, "4", deleted.Outcome)
+	assert.Equal(t, []string{"Observation/o1"}, auditEntityReferences(deleted))
+}
+
+func TestAuditInteraction(t *testing.T) {
+	cases := []struct {
+		method, path        string
+		interaction, action string
+	}{
+		{http.MethodGet, "Patient/1", "read", "R"},
+		{http.MethodGet, "Patient", "search-type", "E"},
+		{http.MethodGet, "Patient/1/_history/2", "vread", "R"},
+		{http.MethodGet, "Patient/1/_history", "history-instance", "R"},
+		{http.MethodGet, "Patient/_history", "history-type", "R"},
+		{http.MethodGet, "_history", "history-system", "R"},
+		{http.MethodGet, "Patient/1/$everything", "operation", "E"},
+		{http.MethodPost, "", "transaction", "E"},
+		{http.MethodPost, "Patient/_search", "search-type", "E"},
+		{http.MethodPost, "Patient", "create", "C"},
+		{http.MethodPut, "Patient/1", "update", "U"},
+		{http.MethodPatch, "Patient/1", "patch", "U"},
+		{http.MethodDelete, "Patient/1", "delete", "D"},
+	}
+	for _, c := range cases {
+		interaction, action := auditInteraction(c.method, c.path)
+		assert.Equal(t, c.interaction, interaction, "%s %s", c.method, c.path)
+		assert.Equal(t, c.action, action, "%s %s", c.method, c.path)
+	}
+}
+
+func TestAuditTrail_DropsWhenQueueIsFull(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	a := &AuditTrail{log: zap.New(core), queue: make(chan []byte, 1)}
+	a.Record([]byte("1"))
+	a.Record([]byte(`{"resourceType":"AuditEvent","action":"R","subtype":[{"code":"search-type"}],"outcome":"0","entity":[{"what":{"reference":"Patient/p1"}}]}`))
+	assert.Len(t, a.queue, 1)
+
+	require.Equal(t, 1, logs.Len())
+	fields := logs.All()[0].ContextMap()
+	assert.Equal(t, "R", fields["audit_event_action"])
+	assert.Equal(t, "search-type", fields["audit_event_type"])
+	for _, value := range fields {
+		assert.NotContains(t, value, "Patient/p1", "dropped events stay out of application logs")
+	}
+}
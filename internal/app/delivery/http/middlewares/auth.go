@@ -3,6 +3,7 @@ package middlewares
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"konsulin-service/internal/app/contracts"
@@ -11,6 +12,7 @@ import (
 	"konsulin-service/internal/pkg/utils"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
 
@@ -89,12 +91,16 @@ func (m *Middlewares) Auth(next http.Handler) http.Handler {
 		roles, _ := ctxIface.Value(keyRoles).([]string)
 		uid, _ := ctxIface.Value(keyUID).(string)
 
-		if len(roles) == 1 && roles[0] == constvars.KonsulinRoleSuperadmin && uid == "api-key-superadmin" {
-
-			fhirRole = constvars.KonsulinRoleSuperadmin
+		if uid == superadminAPIKeyUID || isAPIKeyRequest(ctxIface) {
+			// API keys have no FHIR resource of their own
+			fhirRole = apiKeyFHIRRole(roles)
 			fhirID = ""
 		} else if !isOnlyGuest(roles) {
 			fhirRole, fhirID, err = m.resolveFHIRIdentity(ctxIface, uid)
+			if errors.Is(err, errNoFHIRIdentity) && slices.Contains(roles, constvars.KonsulinRoleResearcher) {
+				// researchers need no FHIR resource of their own; what they read is de-identified
+				fhirRole, fhirID, err = constvars.KonsulinRoleResearcher, "", nil
+			}
 			if err != nil {
 				m.Log.Error("Auth.resolveFHIRIdentity", zap.Error(err))
 				utils.BuildErrorResponse(m.Log, w, exceptions.ErrAuthInvalidRole(err))
@@ -107,6 +113,8 @@ func (m *Middlewares) Auth(next http.Handler) http.Handler {
 
 		ctxIface = context.WithValue(ctxIface, keyFHIRRole, fhirRole)
 		ctxIface = context.WithValue(ctxIface, keyFHIRID, fhirID)
+		ctxIface = context.WithValue(ctxIface, constvars.CONTEXT_FHIR_IDENTITY_ROLE, fhirRole)
+		ctxIface = context.WithValue(ctxIface, constvars.CONTEXT_FHIR_IDENTITY_ID, fhirID)
 
 		r = r.WithContext(ctxIface)
 
@@ -126,17 +134,69 @@ func (m *Middlewares) Auth(next http.Handler) http.Handler {
 			body, _ := io.ReadAll(r.Body)
 			r.Body.Close()
 
-			if err := scanBundle(ctxIface, m.Enforcer, body, roles, ctxIface.Value(keyFHIRID).(string), m.PatientFhirClient, m.PractitionerFhirClient, m.PractitionerRoleFhirClient, m.ScheduleFhirClient, m.QuestionnaireResponseFhirClient); err != nil {
+			denials, err := scanBundle(ctxIface, m.Enforcer, body, roles, ctxIface.Value(keyFHIRID).(string), m.PatientFhirClient, m.PractitionerFhirClient, m.PractitionerRoleFhirClient, m.ScheduleFhirClient, m.QuestionnaireResponseFhirClient)
+			if err != nil {
 				utils.BuildErrorResponse(m.Log, w, exceptions.ErrAuthInvalidRole(err))
 				return
 			}
-			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			denials = m.SearchPolicy.checkBundle(body, roles, denials)
+
+			patchedBody, denials, err := m.applyBundlePatches(ctxIface, body, roles, fhirRole, fhirID, denials)
+			if err != nil {
+				utils.BuildErrorResponse(m.Log, w, err)
+				return
+			}
+
+			if len(denials) > 0 {
+				slices.SortFunc(denials, func(a, b bundleEntryDenial) int { return a.index - b.index })
+
+				// A transaction is all or nothing, so the first entry the caller may not perform
+				// refuses it. A batch goes ahead without the denied entries.
+				if !isBatchBundle(body) {
+					m.Log.Info("Auth refused transaction entry", zap.Int("entry", denials[0].index), zap.String("diagnostics", denials[0].diagnostics))
+					m.writeOperationOutcome(w, denials[0].status, denials[0].outcome())
+					return
+				}
+
+				patchedBody, err = withoutBundleEntries(patchedBody, denials)
+				if err != nil {
+					utils.BuildErrorResponse(m.Log, w, exceptions.ErrCannotParseJSON(err))
+					return
+				}
+				ctxIface = context.WithValue(ctxIface, constvars.CONTEXT_BUNDLE_ENTRY_DENIALS, denials)
+			}
+
+			if !bytes.Equal(patchedBody, body) {
+				ctxIface = context.WithValue(ctxIface, constvars.CONTEXT_RAW_BODY, patchedBody)
+				r = r.WithContext(ctxIface)
+				r.ContentLength = int64(len(patchedBody))
+			}
+			r.Body = io.NopCloser(bytes.NewReader(patchedBody))
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		fullURL := r.URL.RequestURI()
 
+		// A PATCH is checked on the resource it produces and forwarded as an update of that resource.
+		if r.Method == http.MethodPatch {
+			body, _ := io.ReadAll(r.Body)
+			r.Body.Close()
+
+			current, patched, err := m.patchedResource(ctxIface, r.URL.RequestURI(), r.Header.Get(constvars.HeaderContentType), body)
+			if err != nil {
+				utils.BuildErrorResponse(m.Log, w, err)
+				return
+			}
+			if err := m.checkPatch(ctxIface, fullURL, roles, fhirRole, fhirID, current, patched); err != nil {
+				utils.BuildErrorResponse(m.Log, w, exceptions.ErrAuthInvalidRole(err))
+				return
+			}
+			next.ServeHTTP(w, asPatchedUpdate(r, current, patched))
+			return
+		}
+
 		var resourceBody []byte
 		if r.Method == "PUT" || r.Method == "POST" {
 			body, _ := io.ReadAll(r.Body)
@@ -153,6 +213,50 @@ func (m *Middlewares) Auth(next http.Handler) http.Handler {
 	})
 }
 
+// ResolveFHIRIdentity resolves the signed-in user's own Practitioner or Patient resource the same way
+// Auth does for the FHIR proxy, for API routes that act on the caller's own records. Guests and API
+// keys have no such resource and are rejected.
+func (m *Middlewares) ResolveFHIRIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		roles, _ := ctx.Value(keyRoles).([]string)
+		uid, _ := ctx.Value(keyUID).(string)
+		apiKeyAuth, _ := ctx.Value(ContextAPIKeyAuth).(bool)
+
+		if apiKeyAuth || uid == "" || len(roles) == 0 || isOnlyGuest(roles) {
+			utils.BuildErrorResponse(m.Log, w, exceptions.ErrTokenMissing(nil))
+			return
+		}
+
+		fhirRole, fhirID, err := m.resolveFHIRIdentity(ctx, uid)
+		if err != nil {
+			m.Log.Error("ResolveFHIRIdentity.resolveFHIRIdentity", zap.Error(err))
+			utils.BuildErrorResponse(m.Log, w, exceptions.ErrAuthInvalidRole(err))
+			return
+		}
+
+		ctx = context.WithValue(ctx, keyFHIRRole, fhirRole)
+		ctx = context.WithValue(ctx, keyFHIRID, fhirID)
+		ctx = context.WithValue(ctx, constvars.CONTEXT_FHIR_IDENTITY_ROLE, fhirRole)
+		ctx = context.WithValue(ctx, constvars.CONTEXT_FHIR_IDENTITY_ID, fhirID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// apiKeyFHIRRole picks the role an API key acts as on the FHIR proxy: Superadmin when the key holds
+// it, then Researcher so what the key reads is de-identified, otherwise its first role.
+func apiKeyFHIRRole(roles []string) string {
+	for _, role := range []string{constvars.KonsulinRoleSuperadmin, constvars.KonsulinRoleResearcher} {
+		if slices.Contains(roles, role) {
+			return role
+		}
+	}
+	if len(roles) == 0 {
+		return constvars.KonsulinRoleGuest
+	}
+	return roles[0]
+}
+
 func isOnlyGuest(roles []string) bool {
 	if len(roles) != 1 {
 		return false
@@ -194,6 +298,15 @@ func (m *Middlewares) validatePatientOwnershipInBody(body []byte, patientID stri
 		}
 	}
 
+	if patient := gjson.GetBytes(body, "patient.reference").String(); patient != "" {
+		if !strings.HasPrefix(patient, "Patient/") {
+			return fmt.Errorf("invalid patient reference format: %s", patient)
+		}
+		if refID := strings.TrimPrefix(patient, "Patient/"); refID != patientID {
+			return fmt.Errorf("patient %s is trying to create resource for different patient %s", patientID, refID)
+		}
+	}
+
 	performers := gjson.GetBytes(body, "performer").Array()
 	for _, performer := range performers {
 		if ref := performer.Get("reference").String(); ref != "" {
@@ -249,6 +362,9 @@ func (m *Middlewares) validatePractitionerOwnershipInBody(body []byte, practitio
 	return nil
 }
 
+// errNoFHIRIdentity is returned by resolveFHIRIdentity when the user has no Practitioner or Patient.
+var errNoFHIRIdentity = errors.New("no Practitioner/Patient found")
+
 func (m *Middlewares) resolveFHIRIdentity(ctx context.Context, uid string) (role string, id string, err error) {
 	pracs, err := m.PractitionerFhirClient.FindPractitionerByIdentifier(
 		ctx,
@@ -276,7 +392,7 @@ func (m *Middlewares) resolveFHIRIdentity(ctx context.Context, uid string) (role
 		return "", "", err
 	}
 	if len(pats) == 0 {
-		return "", "", fmt.Errorf("no Practitioner/Patient found for uid %s", uid)
+		return "", "", fmt.Errorf("%w for uid %s", errNoFHIRIdentity, uid)
 	}
 
 	// supress error for multiple patients found
@@ -304,26 +420,44 @@ func resolveIdentifierToPatientID(ctx context.Context, identifier string, patien
 	return patients[0].ID, nil
 }
 
-func scanBundle(ctx context.Context, e *casbin.Enforcer, raw []byte, roles []string, uid string, patientClient contracts.PatientFhirClient, practitionerClient contracts.PractitionerFhirClient, practitionerRoleClient contracts.PractitionerRoleFhirClient, scheduleClient contracts.ScheduleFhirClient, questionnaireResponseClient contracts.QuestionnaireResponseFhirClient) error {
+// scanBundle checks every entry of a batch or transaction Bundle and returns the entries the caller
+// may not perform. The error is only set when raw is not a Bundle.
+func scanBundle(ctx context.Context, e *casbin.Enforcer, raw []byte, roles []string, uid string, patientClient contracts.PatientFhirClient, practitionerClient contracts.PractitionerFhirClient, practitionerRoleClient contracts.PractitionerRoleFhirClient, scheduleClient contracts.ScheduleFhirClient, questionnaireResponseClient contracts.QuestionnaireResponseFhirClient) ([]bundleEntryDenial, error) {
 	if gjson.GetBytes(raw, "resourceType").String() != "Bundle" {
-		return fmt.Errorf("invalid bundle")
+		return nil, fmt.Errorf("invalid bundle")
 	}
+	var denials []bundleEntryDenial
 	entries := gjson.GetBytes(raw, "entry").Array()
-	for _, entry := range entries {
+	for i, entry := range entries {
 		method := entry.Get("request.method").String()
+		if strings.EqualFold(method, http.MethodPatch) {
+			// checked on the patched resource by applyBundlePatches
+			continue
+		}
 		url := entry.Get("request.url").String()
 		resource := entry.Get("resource").Raw
 		if err := checkSingle(ctx, e, method, url, roles, uid, patientClient, practitionerClient, practitionerRoleClient, scheduleClient, questionnaireResponseClient, []byte(resource)); err != nil {
-			return err
+			denials = append(denials, newBundleEntryDenial(i, err))
 		}
 	}
-	return nil
+	return denials, nil
 }
 
 func checkSingle(ctx context.Context, e *casbin.Enforcer, method, url string, roles []string, fhirID string, patientClient contracts.PatientFhirClient, practitionerClient contracts.PractitionerFhirClient, practitionerRoleClient contracts.PractitionerRoleFhirClient, scheduleClient contracts.ScheduleFhirClient, questionnaireResponseClient contracts.QuestionnaireResponseFhirClient, resource []byte) error {
 	normalizedPath := normalizePath(url)
 	resourceType := utils.ExtractResourceTypeFromPath(normalizedPath)
 
+	// history requests are authorized on their resource type; the versions they return are
+	// filtered one by one on the way back
+	if h := parseHistoryPath(url); h.level != historyNone {
+		if err := checkHistory(h, method, roles); err != nil {
+			return err
+		}
+		if h.level == historySystem {
+			return nil
+		}
+	}
+
 	// direct request to public resource is allowed to bypass RBAC checks
 	// but only for GET requests to avoid unwanted modifications
 	if utils.IsPublicResource(resourceType) && method == http.MethodGet {
@@ -334,6 +468,10 @@ func checkSingle(ctx context.Context, e *casbin.Enforcer, method, url string, ro
 		if allowed(e, role, method, normalizedPath) {
 
 			if role == constvars.KonsulinRolePatient || role == constvars.KonsulinRolePractitioner {
+				// these roles only reach the caller's own records, and API keys have none
+				if fhirID == "" {
+					continue
+				}
 				ok := ownsResource(ctx, fhirID, url, role, method, patientClient, practitionerClient, practitionerRoleClient, scheduleClient, questionnaireResponseClient, resource)
 				if ok {
 					return nil
@@ -371,192 +509,18 @@ func firstSeg(raw string) string {
 	return ""
 }
 func validateResourceOwnership(ctx context.Context, fhirID, role, resourceType string, resource []byte, practitionerRoleClient contracts.PractitionerRoleFhirClient, scheduleClient contracts.ScheduleFhirClient, questionnaireResponseClient contracts.QuestionnaireResponseFhirClient) bool {
-	if role == constvars.KonsulinRolePatient {
-		resourceStr := string(resource)
-
-		if resourceType == "Condition" {
-			subjectRef := gjson.Get(resourceStr, "subject.reference").String()
-			if strings.HasPrefix(subjectRef, "Patient/") {
-				patientID := strings.TrimPrefix(subjectRef, "Patient/")
-				return patientID == fhirID
-			}
-		}
-
-		if resourceType == "Appointment" {
-			participants := gjson.Get(resourceStr, "participant").Array()
-			for _, participant := range participants {
-				actorRef := participant.Get("actor.reference").String()
-				if strings.HasPrefix(actorRef, "Patient/") {
-					patientID := strings.TrimPrefix(actorRef, "Patient/")
-					if patientID == fhirID {
-						return true
-					}
-				}
-			}
-		}
-
-		if resourceType == "Slot" {
-			status := gjson.Get(resourceStr, "status").String()
-
-			if status == "busy" || status == "busy-unavailable" {
-				return true
-			}
-		}
-
-		if resourceType == constvars.ResourceQuestionnaireResponse {
-			questionnaireResponseID := gjson.Get(resourceStr, "id").String()
-
-			// will directly reject the request if the questionnaire response id is not found
-			if questionnaireResponseID == "" {
-				return false
-			}
-
-			questionnaireResponse, err := questionnaireResponseClient.FindQuestionnaireResponseByID(ctx, questionnaireResponseID)
-			if err != nil {
-				return false
-			}
-
-			authorRef := questionnaireResponse.Author.Reference
-			subjectRef := questionnaireResponse.Subject.Reference
-
-			if authorRef == "" && subjectRef == "" {
-				return true
-			}
-
-			sameOwner := true
-			if strings.HasPrefix(authorRef, "Patient/") {
-				authorID := strings.TrimPrefix(authorRef, "Patient/")
-				if authorID != fhirID {
-					sameOwner = false
-				}
-			}
-
-			if strings.HasPrefix(subjectRef, "Patient/") {
-				subjectID := strings.TrimPrefix(subjectRef, "Patient/")
-				if subjectID != fhirID {
-					sameOwner = false
-				}
-			}
-
-			if sameOwner {
-				return true
-			}
-		}
-
-		// this checks below is to allow patient to update their own patient resource
-		if resourceType == constvars.ResourcePatient {
-			patientID := gjson.Get(resourceStr, "id").String()
-			if patientID == fhirID {
-				return true
-			}
-		}
-
-		patientRefs := []string{
-			gjson.Get(resourceStr, "subject.reference").String(),
-			gjson.Get(resourceStr, "patient.reference").String(),
-			gjson.Get(resourceStr, "actor.reference").String(),
-		}
-
-		for _, ref := range patientRefs {
-			if strings.HasPrefix(ref, "Patient/") {
-				patientID := strings.TrimPrefix(ref, "Patient/")
-				if patientID == fhirID {
-					return true
-				}
-			}
-		}
-	}
-
-	if role == constvars.KonsulinRolePractitioner {
-		resourceStr := string(resource)
-		if resourceType == "Invoice" {
-			participants := gjson.Get(resourceStr, "participant").Array()
-			for _, participant := range participants {
-				actorRef := participant.Get("actor.reference").String()
-				if strings.HasPrefix(actorRef, "PractitionerRole/") {
-					return true
-				}
-				if strings.HasPrefix(actorRef, "Practitioner/") {
-					practitionerID := strings.TrimPrefix(actorRef, "Practitioner/")
-					if practitionerID == fhirID {
-						return true
-					}
-				}
-			}
-		}
-
-		// this checks below is to allow practitioner to update their own practitioner resource
-		if resourceType == constvars.ResourcePractitioner {
-			practitionerID := gjson.Get(resourceStr, "id").String()
-			if practitionerID == fhirID {
-				return true
-			}
-		}
-
-		// schedule ownership check via first actor -> PractitionerRole -> Practitioner
-		if resourceType == constvars.ResourceSchedule {
-			scheduleID := gjson.Get(resourceStr, "id").String()
-			if scheduleID == "" {
-				return false
-			}
-
-			schedules, err := scheduleClient.Search(ctx, contracts.ScheduleSearchParams{ID: scheduleID})
-			if err != nil {
-				return false
-			}
-			if len(schedules) != 1 {
-				return false
-			}
-			sch := schedules[0]
-			if len(sch.Actor) < 1 {
-				return false
-			}
-
-			for _, actor := range sch.Actor {
-				actorRef := actor.Reference
-
-				if strings.HasPrefix(actorRef, "PractitionerRole/") {
-					roleID := strings.TrimPrefix(actorRef, "PractitionerRole/")
-					pr, err := practitionerRoleClient.FindPractitionerRoleByID(ctx, roleID)
-					if err != nil {
-						continue
-					}
-					pracRef := pr.Practitioner.Reference
-					if strings.HasPrefix(pracRef, "Practitioner/") {
-						pid := strings.TrimPrefix(pracRef, "Practitioner/")
-						if pid == fhirID {
-							return true
-						}
-					}
-				}
-
-				if strings.HasPrefix(actorRef, "Practitioner/") {
-					practitionerID := strings.TrimPrefix(actorRef, "Practitioner/")
-					if practitionerID == fhirID {
-						return true
-					}
-				}
-			}
-
-		}
-
-		practitionerRefs := []string{
-			gjson.Get(resourceStr, "practitioner.reference").String(),
-			gjson.Get(resourceStr, "actor.reference").String(),
-			gjson.Get(resourceStr, "performer.reference").String(),
-			gjson.Get(resourceStr, "author.reference").String(),
-		}
-		for _, ref := range practitionerRefs {
-			if strings.HasPrefix(ref, "Practitioner/") {
-				practitionerID := strings.TrimPrefix(ref, "Practitioner/")
-				if practitionerID == fhirID {
-					return true
-				}
-			}
-		}
+	var identity string
+	switch role {
+	case constvars.KonsulinRolePatient:
+		identity = constvars.ResourcePatient
+	case constvars.KonsulinRolePractitioner:
+		identity = constvars.ResourcePractitioner
+	default:
+		return false
 	}
 
-	return false
+	granted, _ := writeOwnership(ctx, identity, fhirID, resourceType, resource, practitionerRoleClient, scheduleClient, questionnaireResponseClient)
+	return granted
 }
 
 func ownsResource(ctx context.Context, fhirID, rawURL, role, method string, patientClient contracts.PatientFhirClient, practitionerClient contracts.PractitionerFhirClient, practitionerRoleClient contracts.PractitionerRoleFhirClient, scheduleClient contracts.ScheduleFhirClient, questionnaireResponseClient contracts.QuestionnaireResponseFhirClient, resource []byte) bool {
@@ -577,7 +541,7 @@ func ownsResource(ctx context.Context, fhirID, rawURL, role, method string, pati
 		return true
 	}
 
-	if method == "PUT" && len(resource) > 0 {
+	if (method == http.MethodPut || method == http.MethodPatch) && len(resource) > 0 {
 		return validateResourceOwnership(ctx, fhirID, role, resourceType, resource, practitionerRoleClient, scheduleClient, questionnaireResponseClient)
 	}
 
@@ -0,0 +1,251 @@
+package middlewares
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+	"konsulin-service/internal/pkg/fhir_dto"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+)
+
+const (
+	bundleTypeBatch               = "batch"
+	bundleTypeBatchResponse       = "batch-response"
+	bundleTypeTransactionResponse = "transaction-response"
+)
+
+// bundleEntryDenial is an entry of an incoming Bundle the caller may not perform. A transaction is
+// refused as a whole on its first denial; a batch is proxied without the denied entries, which are
+// answered with an OperationOutcome at their position in the batch-response.
+type bundleEntryDenial struct {
+	index       int
+	status      int
+	code        string // OperationOutcome issue type
+	diagnostics string
+}
+
+func newBundleEntryDenial(index int, err error) bundleEntryDenial {
+	d := bundleEntryDenial{index: index, status: http.StatusForbidden, code: "forbidden", diagnostics: err.Error()}
+
+	var customErr *exceptions.CustomError
+	if !errors.As(err, &customErr) {
+		return d
+	}
+	d.diagnostics = customErr.DevMessage
+	// refused by RBAC or ownership checks, which report an unauthorized role
+	if customErr.StatusCode != http.StatusUnauthorized && customErr.StatusCode != http.StatusForbidden {
+		d.status = customErr.StatusCode
+		switch {
+		case d.status == http.StatusNotFound:
+			d.code = "not-found"
+		case d.status == http.StatusPreconditionFailed:
+			d.code = "conflict"
+		case d.status < http.StatusInternalServerError:
+			d.code = "invalid"
+		default:
+			d.code = "exception"
+		}
+	}
+	return d
+}
+
+func (d bundleEntryDenial) expression() string {
+	return fmt.Sprintf("Bundle.entry[%d]", d.index)
+}
+
+func (d bundleEntryDenial) outcome() fhir_dto.OperationOutcome {
+	return fhir_dto.OperationOutcome{
+		ResourceType: "OperationOutcome",
+		Issue: []fhir_dto.Issue{{
+			Severity:    "error",
+			Code:        d.code,
+			Diagnostics: fmt.Sprintf("entry %d: %s", d.index, d.diagnostics),
+			Expression:  []string{d.expression()},
+		}},
+	}
+}
+
+// responseEntry is the batch-response entry answering the denied request entry.
+func (d bundleEntryDenial) responseEntry() map[string]any {
+	return map[string]any{
+		"response": map[string]any{
+			"status":  fmt.Sprintf("%d %s", d.status, http.StatusText(d.status)),
+			"outcome": d.outcome(),
+		},
+	}
+}
+
+// writeOperationOutcome answers a request with a single-issue OperationOutcome.
+func (m *Middlewares) writeOperationOutcome(w http.ResponseWriter, status int, outcome fhir_dto.OperationOutcome) {
+	body, _ := json.Marshal(outcome)
+
+	w.Header().Set("Content-Type", "application/fhir+json")
+	w.WriteHeader(status)
+	if _, werr := w.Write(body); werr != nil {
+		m.Log.Warn("failed writing response body", zap.Error(werr))
+	}
+}
+
+// withoutBundleEntries removes the denied entries from an incoming Bundle.
+func withoutBundleEntries(raw []byte, denials []bundleEntryDenial) ([]byte, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(doc["entry"], &entries); err != nil {
+		return nil, err
+	}
+
+	kept := make([]json.RawMessage, 0, len(entries))
+	for i, e := range entries {
+		if !slices.ContainsFunc(denials, func(d bundleEntryDenial) bool { return d.index == i }) {
+			kept = append(kept, e)
+		}
+	}
+
+	b, err := json.Marshal(kept)
+	if err != nil {
+		return nil, err
+	}
+	doc["entry"] = b
+	return json.Marshal(doc)
+}
+
+// isBatchBundle reports whether an incoming Bundle is a batch, whose entries succeed or fail alone.
+func isBatchBundle(raw []byte) bool {
+	return gjson.GetBytes(raw, "type").String() == bundleTypeBatch
+}
+
+// isBatchEndpoint reports whether the request posts a batch or transaction to the FHIR base.
+func isBatchEndpoint(r *http.Request) bool {
+	return r.Method == http.MethodPost && strings.Trim(strings.TrimPrefix(r.URL.Path, "/fhir"), "/") == ""
+}
+
+// filterBatchResponse applies the response filters to each entry.resource of a batch-response or
+// transaction-response and puts the OperationOutcomes of denied batch entries back in place. The
+// entries keep their position, since it is how clients match them to their requests: a resource
+// the caller may not read is dropped from its entry, and a searchset returned by a search entry is
+// filtered like any search. ok is false when body is not such a Bundle.
+func (m *Middlewares) filterBatchResponse(ctx context.Context, body []byte, scope responseFilterScope) (filtered []byte, mutated, ok bool, err error) {
+	bundleType := gjson.GetBytes(body, "type").String()
+	if gjson.GetBytes(body, "resourceType").String() != "Bundle" || (bundleType != bundleTypeBatchResponse && bundleType != bundleTypeTransactionResponse) {
+		return body, false, false, nil
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, false, true, err
+	}
+	var entries []map[string]json.RawMessage
+	if raw, ok := doc["entry"]; ok {
+		if err := json.Unmarshal(raw, &entries); err != nil {
+			return nil, false, true, err
+		}
+	}
+
+	var oc *ownershipContext
+	if scope.needsOwnership {
+		oc = m.buildOwnershipContext(ctx, scope.roles, scope.fhirRole, scope.fhirID)
+	}
+
+	for i, entry := range entries {
+		resource, ok := entry["resource"]
+		if !ok {
+			continue
+		}
+
+		if bundle, isBundle, _ := decodeBundle(resource); isBundle {
+			removed := m.filterBundleEntries(bundle, scope, oc)
+			if removed == 0 {
+				continue
+			}
+			if bundle.Total != nil {
+				v := len(bundle.Entry)
+				bundle.Total = &v
+			}
+			if entries[i]["resource"], err = encodeBundle(bundle); err != nil {
+				return nil, false, true, err
+			}
+			mutated = true
+			continue
+		}
+
+		if (scope.needsRBAC && !m.entryAllowedByRBAC(resource, scope.roles)) || (oc != nil && !m.entryOwned(resource, oc)) {
+			m.Log.Info("removing resource from batch response", zap.Int("entry", i), zap.String("resourceType", gjson.GetBytes(resource, "resourceType").String()))
+			delete(entries[i], "resource")
+			mutated = true
+		}
+	}
+
+	denials, _ := ctx.Value(constvars.CONTEXT_BUNDLE_ENTRY_DENIALS).([]bundleEntryDenial)
+	if len(denials) > 0 {
+		out := make([]any, 0, len(entries)+len(denials))
+		next := 0
+		for _, d := range denials {
+			for len(out) < d.index && next < len(entries) {
+				out = append(out, entries[next])
+				next++
+			}
+			out = append(out, d.responseEntry())
+		}
+		for ; next < len(entries); next++ {
+			out = append(out, entries[next])
+		}
+		if doc["entry"], err = json.Marshal(out); err != nil {
+			return nil, false, true, err
+		}
+		mutated = true
+	} else if mutated {
+		if doc["entry"], err = json.Marshal(entries); err != nil {
+			return nil, false, true, err
+		}
+	}
+
+	if !mutated {
+		return body, false, true, nil
+	}
+	filtered, err = json.Marshal(doc)
+	return filtered, true, true, err
+}
+
+// filterBundleEntries removes the entries of a nested search Bundle the caller may not read.
+func (m *Middlewares) filterBundleEntries(bundle *Bundle, scope responseFilterScope, oc *ownershipContext) int {
+	removed := 0
+	if scope.needsRBAC {
+		kept := bundle.Entry[:0]
+		for _, e := range bundle.Entry {
+			if m.entryAllowedByRBAC(e.Resource, scope.roles) {
+				kept = append(kept, e)
+			} else {
+				removed++
+			}
+		}
+		bundle.Entry = kept
+	}
+	if oc != nil {
+		removed += m.filterOwnedEntries(bundle, scope.roles, oc)
+	}
+	return removed
+}
+
+// entryOwned applies the ownership filter to a single resource.
+func (m *Middlewares) entryOwned(resource json.RawMessage, oc *ownershipContext) bool {
+	var env struct {
+		ResourceType string `json:"resourceType"`
+		ID           string `json:"id,omitempty"`
+	}
+	if err := json.Unmarshal(resource, &env); err != nil || env.ResourceType == "" {
+		return !m.failClosedOnErrorFromResource(env.ResourceType, env.ID)
+	}
+	return m.resourceOwnedByContext(resource, env.ResourceType, env.ID, oc)
+}
@@ -0,0 +1,119 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"konsulin-service/internal/pkg/constvars"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+// superadmin may update Conditions and read Invoices, but not update Observations
+func superadminBundle(bundleType string) string {
+	return `{"resourceType":"Bundle","type":"` + bundleType + `","entry":[
+		{"request":{"method":"PUT","url":"Condition/c1"},"resource":{"resourceType":"Condition","id":"c1"}},
+		{"request":{"method":"PUT","url":"Observation/o1"},"resource":{"resourceType":"Observation","id":"o1","status":"final"}},
+		{"request":{"method":"GET","url":"Invoice/i1"}}
+	]}`
+}
+
+func serveSuperadminBundle(t *testing.T, m *Middlewares, body string) (*httptest.ResponseRecorder, *http.Request) {
+	t.Helper()
+	var forwarded *http.Request
+	handler := m.Auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/fhir", strings.NewReader(body))
+	ctx := context.WithValue(req.Context(), keyRoles, []string{constvars.KonsulinRoleSuperadmin})
+	ctx = context.WithValue(ctx, keyUID, "api-key-superadmin")
+	ctx = context.WithValue(ctx, constvars.CONTEXT_RAW_BODY, []byte(body))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req.WithContext(ctx))
+	return rec, forwarded
+}
+
+func TestAuth_BatchDeniesEntriesAlone(t *testing.T) {
+	m := patchTestMiddlewares(t, nil)
+
+	rec, forwarded := serveSuperadminBundle(t, m, superadminBundle(bundleTypeBatch))
+	require.NotNil(t, forwarded, "the allowed entries are still performed")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	sent, _ := forwarded.Context().Value(constvars.CONTEXT_RAW_BODY).([]byte)
+	assert.Equal(t, []string{"Condition/c1", "Invoice/i1"}, stringsOf(gjson.GetBytes(sent, "entry.#.request.url").Array()))
+
+	upstream := []byte(`{"resourceType":"Bundle","type":"batch-response","entry":[
+		{"response":{"status":"200 OK"},"resource":{"resourceType":"Condition","id":"c1"}},
+		{"response":{"status":"200 OK"},"resource":{"resourceType":"Invoice","id":"i1"}}
+	]}`)
+	out, mutated, err := m.applyResponseFilters(forwarded, upstream, m.newResponseFilterScope(forwarded))
+	require.NoError(t, err)
+	assert.True(t, mutated)
+
+	entries := gjson.GetBytes(out, "entry").Array()
+	require.Len(t, entries, 3, "the denied entry is answered in place")
+	assert.Equal(t, "200 OK", entries[0].Get("response.status").String())
+	assert.False(t, entries[0].Get("resource").Exists(), "superadmin may not read Conditions")
+	assert.Equal(t, "403 Forbidden", entries[1].Get("response.status").String())
+	assert.Equal(t, "Bundle.entry[1]", entries[1].Get("response.outcome.issue.0.expression.0").String())
+	assert.Equal(t, "Invoice", entries[2].Get("resource.resourceType").String())
+}
+
+func TestAuth_TransactionDeniedAtomically(t *testing.T) {
+	m := patchTestMiddlewares(t, nil)
+
+	rec, forwarded := serveSuperadminBundle(t, m, superadminBundle("transaction"))
+	assert.Nil(t, forwarded)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, "OperationOutcome", gjson.Get(rec.Body.String(), "resourceType").String())
+	assert.Equal(t, "Bundle.entry[1]", gjson.Get(rec.Body.String(), "issue.0.expression.0").String())
+	assert.True(t, strings.HasPrefix(gjson.Get(rec.Body.String(), "issue.0.diagnostics").String(), "entry 1:"))
+}
+
+func TestFilterBatchResponse_Ownership(t *testing.T) {
+	m := patchTestMiddlewares(t, nil)
+	scope := responseFilterScope{
+		roles:          []string{constvars.KonsulinRolePatient},
+		fhirRole:       constvars.KonsulinRolePatient,
+		fhirID:         "p1",
+		needsOwnership: true,
+		batch:          true,
+	}
+
+	out, mutated, ok, err := m.filterBatchResponse(context.Background(), []byte(`{"resourceType":"Bundle","type":"transaction-response","entry":[
+		{"response":{"status":"200 OK"},"resource":{"resourceType":"Observation","id":"o1","subject":{"reference":"Patient/p1"}}},
+		{"response":{"status":"200 OK"},"resource":{"resourceType":"Observation","id":"o2","subject":{"reference":"Patient/p2"}}},
+		{"response":{"status":"200 OK"},"resource":{"resourceType":"Bundle","type":"searchset","total":2,"entry":[
+			{"resource":{"resourceType":"Observation","id":"o3","subject":{"reference":"Patient/p2"}}},
+			{"resource":{"resourceType":"Observation","id":"o4","subject":{"reference":"Patient/p1"}}}
+		]}}
+	]}`), scope)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.True(t, mutated)
+
+	assert.Equal(t, "o1", gjson.GetBytes(out, "entry.0.resource.id").String())
+	assert.False(t, gjson.GetBytes(out, "entry.1.resource").Exists())
+	assert.Equal(t, "200 OK", gjson.GetBytes(out, "entry.1.response.status").String())
+	assert.Equal(t, []string{"o4"}, stringsOf(gjson.GetBytes(out, "entry.2.resource.entry.#.resource.id").Array()))
+	assert.Equal(t, int64(1), gjson.GetBytes(out, "entry.2.resource.total").Int())
+
+	_, _, ok, err = m.filterBatchResponse(context.Background(), []byte(`{"resourceType":"Bundle","type":"searchset"}`), scope)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func stringsOf(results []gjson.Result) []string {
+	out := make([]string, len(results))
+	for i, r := range results {
+		out[i] = r.String()
+	}
+	return out
+}
@@ -0,0 +1,50 @@
+package middlewares
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/utils"
+)
+
+// careTeamPatients looks up the active CareTeams listing one of members as a participant and
+// returns the IDs of their subject Patients.
+func careTeamPatients(ctx context.Context, client contracts.CareTeamFhirClient, members []string, at time.Time) (map[string]struct{}, error) {
+	teams, err := client.Search(ctx, contracts.CareTeamSearchParams{Participants: members, Status: "active"})
+	if err != nil {
+		return nil, err
+	}
+
+	patients := make(map[string]struct{})
+	for _, ct := range teams {
+		if ct.Subject == nil || !strings.HasPrefix(ct.Subject.Reference, "Patient/") {
+			continue
+		}
+		if !ct.HasMember(members, at) {
+			continue
+		}
+		patients[strings.TrimPrefix(ct.Subject.Reference, "Patient/")] = struct{}{}
+	}
+	return patients, nil
+}
+
+// careTeamCovers reports whether every patient a Patient-compartment resource belongs to has the
+// caller on an active CareTeam. CareTeam membership only grants read access.
+func careTeamCovers(raw []byte, resourceType, id string, careTeamPatients map[string]struct{}) bool {
+	if len(careTeamPatients) == 0 || !utils.RequiresPatientOwnership(resourceType) {
+		return false
+	}
+
+	patients := compartmentPatients(raw, resourceType, id)
+	if len(patients) == 0 {
+		return false
+	}
+	for _, p := range patients {
+		if _, ok := careTeamPatients[strings.TrimPrefix(p, "Patient/")]; !ok {
+			return false
+		}
+	}
+	return true
+}
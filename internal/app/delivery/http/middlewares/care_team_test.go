@@ -0,0 +1,98 @@
+package middlewares
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/fhir_dto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type fakeCareTeamClient struct {
+	teams    []fhir_dto.CareTeam
+	searches []contracts.CareTeamSearchParams
+}
+
+func (f *fakeCareTeamClient) Search(_ context.Context, params contracts.CareTeamSearchParams) ([]fhir_dto.CareTeam, error) {
+	f.searches = append(f.searches, params)
+	return f.teams, nil
+}
+
+const careTeamTestTeams = `[
+	{"resourceType":"CareTeam","id":"ct1","status":"active","subject":{"reference":"Patient/p1"},"participant":[
+		{"member":{"reference":"PractitionerRole/role1"}},
+		{"member":{"reference":"Practitioner/pr2"}}
+	]},
+	{"resourceType":"CareTeam","id":"ct2","status":"active","subject":{"reference":"Patient/p2"},"participant":[
+		{"member":{"reference":"Practitioner/pr1"},"period":{"end":"2020-01-01"}}
+	]},
+	{"resourceType":"CareTeam","id":"ct3","status":"inactive","subject":{"reference":"Patient/p3"},"participant":[
+		{"member":{"reference":"Practitioner/pr1"}}
+	]},
+	{"resourceType":"CareTeam","id":"ct4","status":"active","subject":{"reference":"Patient/p4"},"participant":[
+		{"member":{"reference":"Practitioner/pr1"}}
+	]}
+]`
+
+func careTeamTestClient(t *testing.T) *fakeCareTeamClient {
+	t.Helper()
+	var teams []fhir_dto.CareTeam
+	require.NoError(t, json.Unmarshal([]byte(careTeamTestTeams), &teams))
+	return &fakeCareTeamClient{teams: teams}
+}
+
+func TestCareTeamPatients(t *testing.T) {
+	client := careTeamTestClient(t)
+
+	patients, err := careTeamPatients(context.Background(), client, []string{"Practitioner/pr1", "PractitionerRole/role1"}, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{"p1": {}, "p4": {}}, patients, "ended and inactive memberships are ignored")
+	assert.Equal(t, "active", client.searches[0].Status)
+}
+
+func TestResourceOwnedByContext_CareTeam(t *testing.T) {
+	m := &Middlewares{Log: zap.NewNop()}
+	oc := &ownershipContext{
+		HasPractitionerRole: true,
+		PatientIDs:          map[string]struct{}{},
+		PractitionerIDs:     map[string]struct{}{"pr1": {}},
+		CareTeamPatients:    map[string]struct{}{"p1": {}},
+	}
+
+	condition := json.RawMessage(`{"resourceType":"Condition","id":"c1","subject":{"reference":"Patient/p1"}}`)
+	assert.True(t, m.resourceOwnedByContext(condition, "Condition", "c1", oc))
+
+	patient := json.RawMessage(`{"resourceType":"Patient","id":"p1"}`)
+	assert.True(t, m.resourceOwnedByContext(patient, "Patient", "p1", oc))
+
+	other := json.RawMessage(`{"resourceType":"Condition","id":"c2","subject":{"reference":"Patient/p2"}}`)
+	assert.False(t, m.resourceOwnedByContext(other, "Condition", "c2", oc))
+
+	group := json.RawMessage(`{"resourceType":"Appointment","id":"a1","participant":[{"actor":{"reference":"Patient/p1"}},{"actor":{"reference":"Patient/p2"}}]}`)
+	assert.False(t, m.resourceOwnedByContext(group, "Appointment", "a1", oc), "every patient of the resource must be covered")
+}
+
+func TestCheckSingle_CareTeamWritesStayWithinPolicy(t *testing.T) {
+	m := patchTestMiddlewares(t, nil)
+	check := func(role, method, url string, body []byte) error {
+		return checkSingle(context.Background(), m.Enforcer, method, url, []string{role}, "", nil, nil, nil, nil, nil, body)
+	}
+
+	// a clinic admin can't add a practitioner to the CareTeam of another organization's patient
+	team := []byte(`{"resourceType":"CareTeam","id":"ct1","status":"active","managingOrganization":[{"reference":"Organization/other-clinic"}],"subject":{"reference":"Patient/p1"},"participant":[{"member":{"reference":"Practitioner/pr1"}}]}`)
+	assert.NoError(t, check(constvars.KonsulinRoleClinicAdmin, http.MethodGet, "/fhir/CareTeam?subject=Patient/p1", nil))
+	assert.Error(t, check(constvars.KonsulinRoleClinicAdmin, http.MethodPost, "/fhir/CareTeam", team))
+	assert.Error(t, check(constvars.KonsulinRoleClinicAdmin, http.MethodPut, "/fhir/CareTeam/ct1", team))
+	assert.Error(t, check(constvars.KonsulinRoleClinicAdmin, http.MethodPatch, "/fhir/CareTeam/ct1", team))
+
+	observation := []byte(`{"resourceType":"Observation","id":"o1","status":"final","subject":{"reference":"Patient/p1"}}`)
+	assert.Error(t, check(constvars.KonsulinRolePractitioner, http.MethodPut, "/fhir/Observation/o1", observation))
+}
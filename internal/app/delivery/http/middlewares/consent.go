@@ -0,0 +1,164 @@
+package middlewares
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/fhir_dto"
+	"konsulin-service/internal/pkg/utils"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+)
+
+// consentStatusActive is the only Consent.status that grants access.
+const consentStatusActive = "active"
+
+// patientReferencePaths locate the Patient a resource belongs to.
+var patientReferencePaths = []string{
+	"[subject.reference,patient.reference,beneficiary.reference]",
+	"participant.#.actor.reference",
+}
+
+// compartmentPatients returns the Patient references ("Patient/{id}") whose compartment the resource
+// belongs to. A Patient resource belongs to its own compartment.
+func compartmentPatients(raw []byte, resourceType, id string) []string {
+	if resourceType == constvars.ResourcePatient {
+		if id == "" {
+			return nil
+		}
+		return []string{constvars.ResourcePatient + "/" + id}
+	}
+
+	var patients []string
+	for _, path := range patientReferencePaths {
+		gjson.GetBytes(raw, path).ForEach(func(_, ref gjson.Result) bool {
+			if s := ref.String(); strings.HasPrefix(s, "Patient/") && !slices.Contains(patients, s) {
+				patients = append(patients, s)
+			}
+			return true
+		})
+	}
+	return patients
+}
+
+// consentGrants answers whether patients have consented to the requesting practitioner, or an
+// Organization they hold a PractitionerRole at, seeing their records. Active Consents are fetched
+// once per patient and decisions are cached for the rest of the request.
+type consentGrants struct {
+	ctx    context.Context
+	client contracts.ConsentFhirClient
+	log    *zap.Logger
+	actors []string
+	at     time.Time
+
+	mu        sync.Mutex
+	consents  map[string][]fhir_dto.Consent
+	decisions map[string]bool
+}
+
+func newConsentGrants(ctx context.Context, client contracts.ConsentFhirClient, log *zap.Logger, actors []string) *consentGrants {
+	return &consentGrants{
+		ctx:       ctx,
+		client:    client,
+		log:       log,
+		actors:    actors,
+		at:        time.Now(),
+		consents:  make(map[string][]fhir_dto.Consent),
+		decisions: make(map[string]bool),
+	}
+}
+
+// permits reports whether patientRef has an active Consent letting one of the actors see its
+// resources of resourceType. A failed Consent lookup grants nothing.
+func (g *consentGrants) permits(patientRef, resourceType string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := patientRef + "|" + resourceType
+	if ok, cached := g.decisions[key]; cached {
+		return ok
+	}
+
+	consents, fetched := g.consents[patientRef]
+	if !fetched {
+		var err error
+		consents, err = g.client.Search(g.ctx, contracts.ConsentSearchParams{
+			Actors:  g.actors,
+			Patient: patientRef,
+			Status:  consentStatusActive,
+		})
+		if err != nil {
+			g.log.Warn("failed to look up patient consents; treating as not consented",
+				zap.String("patient", patientRef),
+				zap.Strings("actors", g.actors),
+				zap.Error(err),
+			)
+			consents = nil
+		}
+		g.consents[patientRef] = consents
+	}
+
+	ok := false
+	for _, c := range consents {
+		for _, actor := range g.actors {
+			if c.Permits(patientRef, actor, resourceType, g.at) {
+				ok = true
+				break
+			}
+		}
+		if ok {
+			break
+		}
+	}
+	g.decisions[key] = ok
+	return ok
+}
+
+// consentDecision is the outcome of checking a resource against patient consents.
+type consentDecision int
+
+const (
+	// consentNotApplicable: the resource is not gated by consent for this caller.
+	consentNotApplicable consentDecision = iota
+	// consentGranted: every patient the resource belongs to has consented.
+	consentGranted
+	// consentMissing: at least one patient the resource belongs to has not consented.
+	consentMissing
+)
+
+// consentFor checks a Patient-compartment resource shown to a practitioner against the patients'
+// Consents. Resources outside the patient compartment, the practitioner's own patient records and
+// the Consent and CareTeam resources that grant access are not gated.
+func consentFor(raw []byte, resourceType, id string, oc *ownershipContext) consentDecision {
+	if oc.Consents == nil || resourceType == constvars.ResourceConsent || resourceType == constvars.ResourceCareTeam || !utils.RequiresPatientOwnership(resourceType) {
+		return consentNotApplicable
+	}
+
+	patients := compartmentPatients(raw, resourceType, id)
+	if len(patients) == 0 {
+		return consentNotApplicable
+	}
+	for _, p := range patients {
+		if _, own := oc.PatientIDs[strings.TrimPrefix(p, "Patient/")]; own {
+			return consentNotApplicable
+		}
+	}
+
+	for _, p := range patients {
+		if !oc.Consents.permits(p, resourceType) {
+			return consentMissing
+		}
+	}
+	return consentGranted
+}
+
+// consentRequired reports whether practitioners may only see other patients' records with consent.
+func (m *Middlewares) consentRequired() bool {
+	return m.InternalConfig != nil && m.InternalConfig.FHIR.ConsentRequired
+}
@@ -0,0 +1,159 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"konsulin-service/internal/app/config"
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/fhir_dto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type fakeConsentClient struct {
+	consents []fhir_dto.Consent
+	searches []contracts.ConsentSearchParams
+}
+
+func (f *fakeConsentClient) Search(_ context.Context, params contracts.ConsentSearchParams) ([]fhir_dto.Consent, error) {
+	f.searches = append(f.searches, params)
+	var out []fhir_dto.Consent
+	for _, c := range f.consents {
+		if c.Patient != nil && c.Patient.Reference == params.Patient {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+func mustConsent(t *testing.T, raw string) fhir_dto.Consent {
+	t.Helper()
+	var c fhir_dto.Consent
+	require.NoError(t, json.Unmarshal([]byte(raw), &c))
+	return c
+}
+
+func consentTestMiddlewares(required bool) *Middlewares {
+	return &Middlewares{
+		Log:            zap.NewNop(),
+		InternalConfig: &config.InternalConfig{FHIR: config.AppFHIR{ConsentRequired: required}},
+	}
+}
+
+func practitionerOwnership(client contracts.ConsentFhirClient) *ownershipContext {
+	return &ownershipContext{
+		HasPractitionerRole: true,
+		PatientIDs:          map[string]struct{}{},
+		PractitionerIDs:     map[string]struct{}{"pr1": {}},
+		Consents:            newConsentGrants(context.Background(), client, zap.NewNop(), []string{"Practitioner/pr1", "Organization/org1"}),
+	}
+}
+
+func TestResourceOwnedByContext_Consent(t *testing.T) {
+	client := &fakeConsentClient{consents: []fhir_dto.Consent{
+		mustConsent(t, `{"resourceType":"Consent","id":"c1","status":"active","patient":{"reference":"Patient/p1"},
+			"provision":{"type":"permit","actor":[{"reference":{"reference":"Organization/org1"}}],
+				"class":[{"system":"http://hl7.org/fhir/resource-types","code":"Observation"}]}}`),
+		mustConsent(t, `{"resourceType":"Consent","id":"c2","status":"active","patient":{"reference":"Patient/p2"},
+			"provision":{"type":"permit","actor":[{"reference":{"reference":"Practitioner/pr1"}}],"period":{"end":"2020-01-01"}}}`),
+		mustConsent(t, `{"resourceType":"Consent","id":"c3","status":"inactive","patient":{"reference":"Patient/p3"},
+			"provision":{"type":"permit","actor":[{"reference":{"reference":"Practitioner/pr1"}}]}}`),
+	}}
+
+	observation := func(patient string) json.RawMessage {
+		return json.RawMessage(`{"resourceType":"Observation","id":"o1","subject":{"reference":"` + patient + `"}}`)
+	}
+
+	t.Run("Consent to the practitioner's organization grants the consented resource type", func(t *testing.T) {
+		m := consentTestMiddlewares(false)
+		oc := practitionerOwnership(client)
+		assert.True(t, m.resourceOwnedByContext(observation("Patient/p1"), "Observation", "o1", oc))
+
+		condition := json.RawMessage(`{"resourceType":"Condition","id":"c9","subject":{"reference":"Patient/p1"}}`)
+		assert.False(t, m.resourceOwnedByContext(condition, "Condition", "c9", oc), "Condition is outside the consented classes")
+	})
+
+	t.Run("Expired and inactive consents grant nothing", func(t *testing.T) {
+		m := consentTestMiddlewares(false)
+		oc := practitionerOwnership(client)
+		assert.False(t, m.resourceOwnedByContext(observation("Patient/p2"), "Observation", "o1", oc))
+		assert.False(t, m.resourceOwnedByContext(observation("Patient/p3"), "Observation", "o1", oc))
+	})
+
+	t.Run("Consent decisions are cached per request", func(t *testing.T) {
+		client.searches = nil
+		m := consentTestMiddlewares(false)
+		oc := practitionerOwnership(client)
+		for range 3 {
+			m.resourceOwnedByContext(observation("Patient/p1"), "Observation", "o1", oc)
+			m.resourceOwnedByContext(observation("Patient/p2"), "Observation", "o1", oc)
+		}
+		assert.Len(t, client.searches, 2)
+		assert.Equal(t, []string{"Practitioner/pr1", "Organization/org1"}, client.searches[0].Actors)
+		assert.Equal(t, "active", client.searches[0].Status)
+	})
+
+	t.Run("Required consent overrides other ownership rules", func(t *testing.T) {
+		authored := json.RawMessage(`{"resourceType":"Observation","id":"o2","subject":{"reference":"Patient/p2"},"performer":[{"reference":"Practitioner/pr1"}]}`)
+
+		assert.True(t, consentTestMiddlewares(false).resourceOwnedByContext(authored, "Observation", "o2", practitionerOwnership(client)))
+		assert.False(t, consentTestMiddlewares(true).resourceOwnedByContext(authored, "Observation", "o2", practitionerOwnership(client)))
+	})
+
+	t.Run("Practitioner's own patient records and Consents naming them are not gated", func(t *testing.T) {
+		m := consentTestMiddlewares(true)
+		oc := practitionerOwnership(client)
+		oc.PatientIDs["p9"] = struct{}{}
+		assert.True(t, m.resourceOwnedByContext(observation("Patient/p9"), "Observation", "o1", oc))
+
+		consent := json.RawMessage(`{"resourceType":"Consent","id":"c4","status":"active","patient":{"reference":"Patient/p5"},
+			"provision":{"actor":[{"reference":{"reference":"Practitioner/pr1"}}]}}`)
+		assert.True(t, m.resourceOwnedByContext(consent, "Consent", "c4", oc))
+	})
+}
+
+func TestStreamFilterBundle_ConsentRequired(t *testing.T) {
+	body := `{"resourceType":"Bundle","type":"searchset","entry":[
+		{"resource":{"resourceType":"Patient","id":"p2"}},
+		{"resource":{"resourceType":"Observation","id":"o1","performer":[{"reference":"Practitioner/pr1"}],"subject":{"reference":"Patient/p2"}}},
+		{"resource":{"resourceType":"Observation","id":"o2","subject":{"reference":"Patient/p1"}}}
+	]}`
+	client := &fakeConsentClient{consents: []fhir_dto.Consent{
+		mustConsent(t, `{"resourceType":"Consent","id":"c1","status":"active","patient":{"reference":"Patient/p1"},
+			"provision":{"actor":[{"reference":{"reference":"Practitioner/pr1"}}],"class":[{"code":"Observation"}]}}`),
+	}}
+
+	f := &bundleEntryFilter{
+		m:           consentTestMiddlewares(true),
+		oc:          practitionerOwnership(client),
+		allowedRefs: map[string]struct{}{},
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, streamFilterBundle(bytes.NewReader([]byte(body)), &out, f, nil))
+
+	b := decodeStreamedBundle(t, out.Bytes())
+	require.Len(t, b.Entry, 1, "unconsented records stay hidden even when referenced by or naming the practitioner")
+	assert.Contains(t, string(b.Entry[0].Resource), `"o2"`)
+}
+
+func TestConsentPermits_Period(t *testing.T) {
+	c := mustConsent(t, `{"resourceType":"Consent","status":"active","patient":{"reference":"Patient/p1"},
+		"provision":{"period":{"start":"2026-01-01","end":"2026-01-31"},"actor":[{"reference":{"reference":"Practitioner/pr1"}}]}}`)
+
+	at := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		require.NoError(t, err)
+		return v
+	}
+	assert.False(t, c.Permits("Patient/p1", "Practitioner/pr1", "Observation", at("2025-12-31T23:59:59Z")))
+	assert.True(t, c.Permits("Patient/p1", "Practitioner/pr1", "Observation", at("2026-01-31T23:00:00Z")))
+	assert.False(t, c.Permits("Patient/p1", "Practitioner/pr1", "Observation", at("2026-02-01T00:00:00Z")))
+	assert.False(t, c.Permits("Patient/p1", "Practitioner/pr2", "Observation", at("2026-01-15T00:00:00Z")))
+}
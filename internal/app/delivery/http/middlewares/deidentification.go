@@ -0,0 +1,40 @@
+package middlewares
+
+import (
+	"errors"
+
+	"konsulin-service/internal/app/services/shared/deidentify"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+
+	"go.uber.org/zap"
+)
+
+// deidentificationPolicyFile holds the de-identification rules for research roles. It lives next to
+// rbac_policy.csv and is hot-reloaded the same way.
+const deidentificationPolicyFile = "resources/deidentification_policy.json"
+
+// deidentifierFor returns the de-identification engine when data sent to a caller with roles must be
+// de-identified, and nil otherwise.
+func (m *Middlewares) deidentifierFor(roles []string) *deidentify.Engine {
+	if !m.Deidentifier.AppliesTo(roles) {
+		return nil
+	}
+	return m.Deidentifier
+}
+
+// deidentifyResponse de-identifies a filtered response body. A single resource that small-cell
+// suppression withholds is refused; any other failure fails closed.
+func (m *Middlewares) deidentifyResponse(body []byte, scope responseFilterScope) ([]byte, bool, error) {
+	out, err := scope.deid.Body(body)
+	if errors.Is(err, deidentify.ErrSuppressed) {
+		return nil, false, exceptions.BuildNewCustomError(err, constvars.StatusForbidden,
+			"this resource is withheld to protect patient privacy",
+			"resource forms a cell below the minimum cell size of de-identified data")
+	}
+	if err != nil {
+		m.Log.Warn("de-identification failed; failing closed", zap.Error(err))
+		return nil, false, exceptions.ErrServerProcess(err)
+	}
+	return out, true, nil
+}
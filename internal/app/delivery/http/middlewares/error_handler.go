@@ -10,6 +10,11 @@ func (m *Middlewares) ErrorHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if rec := recover(); rec != nil {
+				// a handler that already started the response aborts it this way; let net/http drop the connection
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+
 				var err error
 				switch x := rec.(type) {
 				case string:
@@ -0,0 +1,197 @@
+package middlewares
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+	"konsulin-service/internal/pkg/utils"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+)
+
+// operationEverything is the Patient operation returning the patient's whole compartment.
+const operationEverything = "$everything"
+
+const defaultEverythingMaxFetches = 100
+
+// everythingParams are the parameters of Patient/$everything the gateway forwards. _count only sets
+// the size of the upstream pages, the response holds every page.
+var everythingParams = []string{"_since", "_type", "start", "end", "_count"}
+
+// defaultEverythingPractitionerResourceTypes are the clinical types a practitioner receives from
+// Patient/$everything unless EverythingPractitionerResourceTypes is set.
+var defaultEverythingPractitionerResourceTypes = []string{
+	"Patient", "AllergyIntolerance", "Appointment", "CarePlan", "CareTeam", "Condition", "DiagnosticReport",
+	"Encounter", "Goal", "Immunization", "MedicationRequest", "MedicationStatement", "Observation",
+	"Procedure", "QuestionnaireResponse", "ServiceRequest",
+}
+
+// everythingPatientID reports whether a request to path, relative to the FHIR base, is a
+// Patient/{id}/$everything and returns the patient ID.
+func everythingPatientID(method, path string) (string, bool) {
+	if method != http.MethodGet {
+		return "", false
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 3 || parts[0] != constvars.ResourcePatient || parts[1] == "" || parts[2] != operationEverything {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// everythingTypes returns the resource types the caller may receive from Patient/$everything, nil
+// meaning every type the caller may read.
+func (m *Middlewares) everythingTypes(scope responseFilterScope) []string {
+	if scope.fhirRole != constvars.KonsulinRolePractitioner {
+		return nil
+	}
+	if m.InternalConfig != nil && len(m.InternalConfig.FHIR.EverythingPractitionerResourceTypes) > 0 {
+		return m.InternalConfig.FHIR.EverythingPractitionerResourceTypes
+	}
+	return defaultEverythingPractitionerResourceTypes
+}
+
+// everythingQuery builds the upstream query of a Patient/$everything. A _type asking for types the
+// caller may not receive is narrowed to the ones it may; when none are left, there is nothing to
+// fetch and the second result is false.
+func everythingQuery(params url.Values, types []string) (url.Values, bool, *PreFHIRProxyHookError) {
+	query := url.Values{}
+	for name, values := range params {
+		if !slices.Contains(everythingParams, name) {
+			return nil, false, NewPreFHIRProxyHookError(http.StatusBadRequest, "not-supported", fmt.Sprintf("parameter %s is not supported by %s", name, operationEverything))
+		}
+		query[name] = values
+	}
+
+	if types == nil || !query.Has("_type") {
+		return query, true, nil
+	}
+	var asked []string
+	for _, v := range query["_type"] {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); slices.Contains(types, t) && !slices.Contains(asked, t) {
+				asked = append(asked, t)
+			}
+		}
+	}
+	if len(asked) == 0 {
+		return query, false, nil
+	}
+	query.Set("_type", strings.Join(asked, ","))
+	return query, true, nil
+}
+
+// serveEverything answers Patient/{id}/$everything by following the upstream next links until the
+// whole compartment was read, and streams the entries that pass the caller's filters back as a
+// single searchset Bundle without paging links.
+//
+// Errors on the first upstream page are turned into an error response. Headers are sent once it was
+// read, so a failure on a later page, or a compartment larger than EverythingMaxFetches pages, aborts
+// the connection like a failing streamed Bundle does.
+func (m *Middlewares) serveEverything(w http.ResponseWriter, r *http.Request, client *http.Client, target, patientID string, reqBody []byte, scope responseFilterScope) {
+	// a patient's only compartment is their own; the filters would leave nothing of another one
+	if scope.needsOwnership && scope.fhirRole == constvars.KonsulinRolePatient && patientID != scope.fhirID {
+		m.writeOperationOutcome(w, http.StatusForbidden, NewPreFHIRProxyHookError(http.StatusForbidden, "forbidden", "patients may only export their own record").outcome())
+		return
+	}
+
+	types := m.everythingTypes(scope)
+	query, fetch, violation := everythingQuery(r.URL.Query(), types)
+	if violation != nil {
+		m.writeOperationOutcome(w, violation.StatusCode, violation.outcome())
+		return
+	}
+
+	base, err := url.Parse(strings.TrimRight(target, "/"))
+	if err != nil {
+		utils.BuildErrorResponse(m.Log, w, exceptions.ErrServerProcess(err))
+		return
+	}
+
+	page := constvars.ResourcePatient + "/" + url.PathEscape(patientID) + "/" + operationEverything
+	if len(query) > 0 {
+		page += "?" + query.Encode()
+	}
+
+	var sp searchPage
+	if fetch {
+		if sp, err = m.fetchSearchPage(r.Context(), client, r.Header, base.String()+"/"+page); err != nil {
+			utils.BuildErrorResponse(m.Log, w, err)
+			return
+		}
+	}
+
+	postHookErrMsgs := m.runPostFHIRProxyHooks(r, reqBody, http.StatusOK, nil)
+
+	w.Header().Set("Content-Type", "application/fhir+json")
+	setPostFHIRHookErrorHeader(w, postHookErrMsgs)
+	w.WriteHeader(http.StatusOK)
+
+	self, _ := json.Marshal(m.gatewayFHIRBase() + strings.TrimPrefix(r.URL.Path, "/fhir") + "?" + r.URL.RawQuery)
+	bw := bufio.NewWriter(w)
+	bw.WriteString(`{"resourceType":"Bundle","type":"searchset","link":[{"relation":"self","url":`)
+	bw.Write(self)
+	bw.WriteString(`}],"entry":[`)
+
+	f := m.newBundleEntryFilter(r, scope)
+	kept, removedType := 0, 0
+	write := func(raw json.RawMessage) {
+		if kept > 0 {
+			bw.WriteByte(',')
+		}
+		kept++
+		bw.Write(raw)
+	}
+
+	maxFetches := defaultEverythingMaxFetches
+	if m.InternalConfig != nil && m.InternalConfig.FHIR.EverythingMaxFetches > 0 {
+		maxFetches = m.InternalConfig.FHIR.EverythingMaxFetches
+	}
+
+	for fetches := 1; fetch; fetches++ {
+		for _, entry := range sp.Entry {
+			// the compartment holds types no search of the caller would reach, e.g. AuditEvent
+			resourceType := gjson.GetBytes(entry, "resource.resourceType").String()
+			if (types != nil && !slices.Contains(types, resourceType)) || !m.typeReadable(scope.roles, resourceType) {
+				removedType++
+				continue
+			}
+			if raw, ok := f.keep(entry); ok {
+				write(raw)
+			}
+		}
+
+		next, ok := relativeToBase(base, sp.next())
+		if !ok {
+			break
+		}
+		if fetches == maxFetches {
+			m.Log.Warn("Patient $everything exceeds the page limit; aborting response", zap.String("patientID", patientID), zap.Int("maxFetches", maxFetches))
+			panic(http.ErrAbortHandler)
+		}
+		if sp, err = m.fetchSearchPage(r.Context(), client, r.Header, base.String()+"/"+next); err != nil {
+			m.Log.Warn("Patient $everything page failed; aborting response", zap.String("patientID", patientID), zap.Error(err))
+			panic(http.ErrAbortHandler)
+		}
+	}
+	for _, raw := range f.release() {
+		write(raw)
+	}
+
+	bw.WriteString(`],"total":` + strconv.Itoa(kept) + `}`)
+	if err := bw.Flush(); err != nil {
+		m.Log.Warn("failed writing response body", zap.Error(err))
+		return
+	}
+
+	m.logFilteredEntries(r, scope, f.removedRBAC+removedType, f.removedOwnership)
+}
@@ -0,0 +1,144 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"konsulin-service/internal/app/config"
+	"konsulin-service/internal/pkg/constvars"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// everythingUpstream serves Patient/p1/$everything in two pages, the second holding a resource of
+// another patient and an AuditEvent the patient may not read.
+func everythingUpstream(t *testing.T, queries *[]url.Values) *httptest.Server {
+	pages := map[string][]string{
+		"": {
+			`{"resourceType":"Patient","id":"p1"}`,
+			`{"resourceType":"Observation","id":"o1","subject":{"reference":"Patient/p1"}}`,
+		},
+		"2": {
+			`{"resourceType":"Observation","id":"o2","subject":{"reference":"Patient/p2"}}`,
+			`{"resourceType":"Condition","id":"c1","subject":{"reference":"Patient/p1"}}`,
+			`{"resourceType":"AuditEvent","id":"ae1","entity":[{"what":{"reference":"Patient/p1"}},{"what":{"reference":"Patient/p2"}}]}`,
+		},
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/fhir/Patient/p1/$everything", r.URL.Path)
+		*queries = append(*queries, r.URL.Query())
+
+		pageID := r.URL.Query().Get("__page-offset")
+		var entries []string
+		for _, res := range pages[pageID] {
+			entries = append(entries, `{"resource":`+res+`,"search":{"mode":"match"}}`)
+		}
+		links := `{"relation":"self","url":"http://blaze-internal/fhir/Patient/p1/$everything"}`
+		if pageID == "" {
+			links += `,{"relation":"next","url":"http://blaze-internal/fhir/Patient/p1/$everything?__t=1&__page-offset=2"}`
+		}
+
+		w.Header().Set("Content-Type", "application/fhir+json")
+		_, _ = fmt.Fprintf(w, `{"resourceType":"Bundle","type":"searchset","link":[%s],"entry":[%s]}`, links, strings.Join(entries, ","))
+	}))
+}
+
+func TestBridge_PatientEverything(t *testing.T) {
+	var queries []url.Values
+	upstream := everythingUpstream(t, &queries)
+	defer upstream.Close()
+
+	m := &Middlewares{
+		Log: zap.NewNop(),
+		InternalConfig: &config.InternalConfig{
+			App:  config.App{BaseUrl: "https://api.konsulin.care/api/v1"},
+			FHIR: config.AppFHIR{BaseUrl: upstream.URL + "/fhir/"},
+		},
+		Enforcer: patchTestMiddlewares(t, nil).Enforcer,
+	}
+
+	t.Run("Gathers every page and keeps the caller's entries", func(t *testing.T) {
+		queries = nil
+		rr := httptest.NewRecorder()
+		m.Bridge(upstream.URL+"/fhir/").ServeHTTP(rr, pageFillRequest("/fhir/Patient/p1/$everything?_since=2025-01-01"))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+		var b struct {
+			Type  string           `json:"type"`
+			Total int              `json:"total"`
+			Link  []pageFilledLink `json:"link"`
+			Entry []struct {
+				Resource struct {
+					ID string `json:"id"`
+				} `json:"resource"`
+			} `json:"entry"`
+		}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &b), rr.Body.String())
+
+		var ids []string
+		for _, e := range b.Entry {
+			ids = append(ids, e.Resource.ID)
+		}
+		assert.Equal(t, "searchset", b.Type)
+		assert.Equal(t, []string{"p1", "o1", "c1"}, ids, "types the patient may not read are left out")
+		assert.Equal(t, 3, b.Total)
+		assert.Equal(t, []pageFilledLink{{Relation: "self", URL: "https://api.konsulin.care/fhir/Patient/p1/$everything?_since=2025-01-01"}}, b.Link)
+
+		require.Len(t, queries, 2)
+		assert.Equal(t, "2025-01-01", queries[0].Get("_since"))
+	})
+
+	t.Run("Rejects another patient's record", func(t *testing.T) {
+		queries = nil
+		rr := httptest.NewRecorder()
+		m.Bridge(upstream.URL+"/fhir/").ServeHTTP(rr, pageFillRequest("/fhir/Patient/p2/$everything"))
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.Empty(t, queries)
+	})
+
+	t.Run("Rejects unsupported parameters", func(t *testing.T) {
+		queries = nil
+		rr := httptest.NewRecorder()
+		m.Bridge(upstream.URL+"/fhir/").ServeHTTP(rr, pageFillRequest("/fhir/Patient/p1/$everything?_include=*"))
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Empty(t, queries)
+	})
+}
+
+func TestEverythingTypes_PractitionerDefault(t *testing.T) {
+	m := &Middlewares{InternalConfig: &config.InternalConfig{}}
+	types := m.everythingTypes(responseFilterScope{fhirRole: constvars.KonsulinRolePractitioner})
+	assert.Contains(t, types, "Observation")
+	assert.NotContains(t, types, "AuditEvent")
+	assert.NotContains(t, types, "Provenance")
+
+	m.InternalConfig.FHIR.EverythingPractitionerResourceTypes = []string{"Observation"}
+	assert.Equal(t, []string{"Observation"}, m.everythingTypes(responseFilterScope{fhirRole: constvars.KonsulinRolePractitioner}))
+	assert.Nil(t, m.everythingTypes(responseFilterScope{fhirRole: constvars.KonsulinRolePatient}))
+}
+
+func TestEverythingQuery_NarrowsTypes(t *testing.T) {
+	practitioner := []string{"Patient", "Observation"}
+
+	query, fetch, v := everythingQuery(url.Values{"_type": {"Observation,Condition"}}, practitioner)
+	require.Nil(t, v)
+	assert.True(t, fetch)
+	assert.Equal(t, "Observation", query.Get("_type"))
+
+	_, fetch, v = everythingQuery(url.Values{"_type": {"Condition"}}, practitioner)
+	require.Nil(t, v)
+	assert.False(t, fetch, "nothing the practitioner may receive was asked for")
+
+	query, fetch, v = everythingQuery(url.Values{"_type": {"Condition"}}, nil)
+	require.Nil(t, v)
+	assert.True(t, fetch)
+	assert.Equal(t, "Condition", query.Get("_type"))
+}
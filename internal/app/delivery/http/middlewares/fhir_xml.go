@@ -0,0 +1,247 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/fhirxml"
+
+	"go.uber.org/zap"
+)
+
+// formatParam is the FHIR query parameter that overrides the Accept header.
+const formatParam = "_format"
+
+// FHIRXML lets clients exchange FHIR XML with the /fhir routes, which otherwise speak JSON only.
+// XML request bodies are converted to JSON before Auth and the Bridge validate and filter them, and
+// when Accept or _format asks for XML the filtered JSON response is converted back on the way out.
+// JSON requests pass through untouched.
+func (m *Middlewares) FHIRXML(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wantXML, format := negotiateFHIRFormat(r)
+		if format != "" {
+			// the FHIR server would honour _format over the Bridge's Accept header
+			query := r.URL.Query()
+			query.Del(formatParam)
+			r.URL.RawQuery = query.Encode()
+		}
+
+		if wantXML {
+			// responses are converted in full, so ask for them uncompressed
+			r.Header.Del("Accept-Encoding")
+			xw := &xmlResponseWriter{ResponseWriter: w, status: http.StatusOK, format: format}
+			w = xw
+			defer func() {
+				// an aborted response is never sent, half-converted or otherwise
+				if p := recover(); p != nil {
+					panic(p)
+				}
+				xw.finish(m.Log)
+			}()
+		}
+
+		if isXMLMediaType(r.Header.Get("Content-Type")) {
+			var ok bool
+			if r, ok = m.convertXMLRequest(w, r); !ok {
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// convertXMLRequest replaces an XML request body with its JSON equivalent. It answers the request
+// itself and returns false when the body cannot be converted.
+func (m *Middlewares) convertXMLRequest(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if r.Method == http.MethodPatch {
+		m.writeOperationOutcome(w, http.StatusUnsupportedMediaType,
+			NewPreFHIRProxyHookError(http.StatusUnsupportedMediaType, "not-supported", "PATCH bodies must be JSON Patch or FHIRPath Patch in JSON").outcome())
+		return nil, false
+	}
+
+	bodyBytes, _ := r.Context().Value(constvars.CONTEXT_RAW_BODY).([]byte)
+	if len(bytes.TrimSpace(bodyBytes)) == 0 {
+		return r, true
+	}
+	converted, err := fhirxml.ToJSON(bodyBytes)
+	if err != nil {
+		m.writeOperationOutcome(w, http.StatusBadRequest,
+			NewPreFHIRProxyHookError(http.StatusBadRequest, "structure", "invalid FHIR XML: "+err.Error()).outcome())
+		return nil, false
+	}
+
+	ctx := context.WithValue(r.Context(), constvars.CONTEXT_RAW_BODY, converted)
+	r = r.WithContext(ctx)
+	r.Body = io.NopCloser(bytes.NewReader(converted))
+	r.ContentLength = int64(len(converted))
+	r.Header.Set("Content-Type", constvars.MIMEApplicationFHIRJSON)
+	r.Header.Del("Content-Length")
+	return r, true
+}
+
+// negotiateFHIRFormat reports whether the client wants FHIR XML back. _format takes precedence over
+// Accept; format is the _format value when the parameter was used, so it can be carried over to
+// paging links.
+func negotiateFHIRFormat(r *http.Request) (wantXML bool, format string) {
+	if format := r.URL.Query().Get(formatParam); format != "" {
+		switch strings.ToLower(format) {
+		case "xml":
+			return true, format
+		case "json":
+			return false, format
+		}
+		if isXMLMediaType(format) {
+			return true, format
+		}
+		if isJSONMediaType(format) {
+			return false, format
+		}
+		return false, ""
+	}
+
+	// XML wins only when the client prefers it to JSON; */* and unlisted types fall back to JSON
+	xmlQ, jsonQ := -1.0, -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if raw, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(raw, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch {
+		case isXMLMediaType(mediaType):
+			xmlQ = max(xmlQ, q)
+		case isJSONMediaType(mediaType), mediaType == "*/*", mediaType == "application/*":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return xmlQ > 0 && xmlQ > jsonQ, ""
+}
+
+func isXMLMediaType(value string) bool {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case constvars.MIMEApplicationFHIRXML, constvars.MIMEApplicationXML, constvars.MIMETextXML:
+		return true
+	}
+	return false
+}
+
+func isJSONMediaType(value string) bool {
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return false
+	}
+	return mediaType == constvars.MIMEApplicationFHIRJSON || mediaType == constvars.MIMEApplicationJSON
+}
+
+// xmlResponseWriter buffers a response so a FHIR JSON body can be converted to XML once complete.
+// Bodies that are not FHIR resources, such as the gateway's own error responses, are sent as they
+// are.
+type xmlResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	// format is the client's _format value, added to Bundle paging links.
+	format string
+}
+
+func (xw *xmlResponseWriter) WriteHeader(code int) { xw.status = code }
+
+func (xw *xmlResponseWriter) Write(p []byte) (int, error) { return xw.body.Write(p) }
+
+// Flush is a no-op: streamed responses are held until finish.
+func (xw *xmlResponseWriter) Flush() {}
+
+func (xw *xmlResponseWriter) finish(log *zap.Logger) {
+	header := xw.Header()
+	body := xw.body.Bytes()
+
+	if isJSONMediaType(header.Get("Content-Type")) && len(body) > 0 {
+		if converted, err := xw.toXML(body, header.Get("Content-Encoding")); err != nil {
+			log.Warn("failed converting FHIR response to XML; sending JSON", zap.Error(err))
+		} else if converted != nil {
+			body = converted
+			header.Set("Content-Type", constvars.MIMEApplicationFHIRXML+"; charset=utf-8")
+			header.Del("Content-Encoding")
+		}
+	}
+
+	header.Del("Content-Length")
+	xw.ResponseWriter.WriteHeader(xw.status)
+	if _, err := xw.ResponseWriter.Write(body); err != nil {
+		log.Warn("failed writing response body", zap.Error(err))
+	}
+}
+
+// toXML converts a JSON response body to FHIR XML. It returns nil when the body is not a FHIR
+// resource.
+func (xw *xmlResponseWriter) toXML(body []byte, contentEncoding string) ([]byte, error) {
+	decoded, _, err := decodeBodyForFiltering(body, contentEncoding)
+	if err != nil {
+		return nil, err
+	}
+	if !fhirxml.IsResource(decoded) {
+		return nil, nil
+	}
+	if xw.format != "" {
+		if decoded, err = withFormatInLinks(decoded, xw.format); err != nil {
+			return nil, err
+		}
+	}
+	return fhirxml.FromJSON(decoded)
+}
+
+// withFormatInLinks adds _format to a Bundle's links so clients that chose XML through the
+// parameter keep getting XML while paging. Other resources are returned unchanged.
+func withFormatInLinks(body []byte, format string) ([]byte, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	raw, ok := doc["link"]
+	if !ok {
+		return body, nil
+	}
+
+	var links []map[string]json.RawMessage
+	err := json.Unmarshal(raw, &links)
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		var u string
+		if err := json.Unmarshal(link["url"], &u); err != nil {
+			continue
+		}
+		parsed, err := url.Parse(u)
+		if err != nil {
+			continue
+		}
+		query := parsed.Query()
+		query.Set(formatParam, format)
+		parsed.RawQuery = query.Encode()
+		link["url"], _ = json.Marshal(parsed.String())
+	}
+
+	if doc["link"], err = json.Marshal(links); err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
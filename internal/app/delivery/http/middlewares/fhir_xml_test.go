@@ -0,0 +1,122 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"konsulin-service/internal/pkg/constvars"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNegotiateFHIRFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		accept  string
+		wantXML bool
+		format  string
+	}{
+		{"default is JSON", "/fhir/Patient", "", false, ""},
+		{"FHIR XML accept", "/fhir/Patient", "application/fhir+xml", true, ""},
+		{"JSON preferred by q", "/fhir/Patient", "application/fhir+xml;q=0.5, application/fhir+json", false, ""},
+		{"XML preferred by q", "/fhir/Patient", "application/fhir+json;q=0.2, text/xml", true, ""},
+		{"wildcard falls back to JSON", "/fhir/Patient", "*/*", false, ""},
+		{"_format overrides Accept", "/fhir/Patient?_format=xml", "application/fhir+json", true, "xml"},
+		{"_format as a media type", "/fhir/Patient?_format=application/fhir%2Bxml", "", true, "application/fhir+xml"},
+		{"_format json", "/fhir/Patient?_format=json", "application/fhir+xml", false, "json"},
+		{"unknown _format is ignored", "/fhir/Patient?_format=turtle", "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			r.Header.Set("Accept", tt.accept)
+			wantXML, format := negotiateFHIRFormat(r)
+			assert.Equal(t, tt.wantXML, wantXML)
+			assert.Equal(t, tt.format, format)
+		})
+	}
+}
+
+func TestFHIRXML(t *testing.T) {
+	m := &Middlewares{Log: zap.NewNop()}
+
+	t.Run("XML in, XML out", func(t *testing.T) {
+		var upstreamBody []byte
+		handler := m.FHIRXML(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, constvars.MIMEApplicationFHIRJSON, r.Header.Get("Content-Type"))
+			assert.Empty(t, r.Header.Get("Accept-Encoding"))
+			assert.Empty(t, r.URL.Query().Get("_format"), "_format is not forwarded")
+			upstreamBody, _ = r.Context().Value(constvars.CONTEXT_RAW_BODY).([]byte)
+			body, _ := io.ReadAll(r.Body)
+			assert.Equal(t, upstreamBody, body)
+
+			w.Header().Set("Content-Type", "application/fhir+json;charset=utf-8")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"resourceType":"Patient","id":"p1","gender":"female"}`))
+			w.(http.Flusher).Flush()
+		}))
+
+		body := []byte(`<Patient xmlns="http://hl7.org/fhir"><gender value="female"/></Patient>`)
+		r := httptest.NewRequest(http.MethodPost, "/fhir/Patient?_format=xml", bytes.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), constvars.CONTEXT_RAW_BODY, body))
+		r.Header.Set("Content-Type", "application/fhir+xml; charset=utf-8")
+		r.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		assert.JSONEq(t, `{"resourceType":"Patient","gender":"female"}`, string(upstreamBody))
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.Equal(t, "application/fhir+xml; charset=utf-8", rec.Header().Get("Content-Type"))
+		assert.Equal(t, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+			`<Patient xmlns="http://hl7.org/fhir"><id value="p1"/><gender value="female"/></Patient>`, rec.Body.String())
+	})
+
+	t.Run("paging links keep _format", func(t *testing.T) {
+		handler := m.FHIRXML(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", constvars.MIMEApplicationFHIRJSON)
+			_, _ = w.Write([]byte(`{"resourceType":"Bundle","type":"searchset","link":[{"relation":"next","url":"https://api.konsulin.care/fhir/Patient?__page-id=abc"}]}`))
+		}))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fhir/Patient?_format=xml", nil))
+
+		assert.Contains(t, rec.Body.String(), `<url value="https://api.konsulin.care/fhir/Patient?__page-id=abc&amp;_format=xml"/>`)
+	})
+
+	t.Run("non-FHIR bodies pass through", func(t *testing.T) {
+		handler := m.FHIRXML(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", constvars.MIMEApplicationJSON)
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"success":false}`))
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/fhir/Patient", nil)
+		r.Header.Set("Accept", constvars.MIMEApplicationFHIRXML)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Equal(t, `{"success":false}`, rec.Body.String())
+	})
+
+	t.Run("invalid XML is refused", func(t *testing.T) {
+		handler := m.FHIRXML(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("the request must not reach the next handler")
+		}))
+		body := []byte(`<Patient xmlns="http://hl7.org/fhir"><active value="maybe"/></Patient>`)
+		r := httptest.NewRequest(http.MethodPut, "/fhir/Patient/p1", bytes.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), constvars.CONTEXT_RAW_BODY, body))
+		r.Header.Set("Content-Type", constvars.MIMEApplicationFHIRXML)
+		r.Header.Set("Accept", constvars.MIMEApplicationFHIRXML)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), `<OperationOutcome xmlns="http://hl7.org/fhir"><issue><severity value="error"/><code value="structure"/>`)
+	})
+}
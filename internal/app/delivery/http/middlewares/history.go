@@ -0,0 +1,113 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"konsulin-service/internal/pkg/constvars"
+)
+
+// historySegment is the path segment of the FHIR history interactions.
+const historySegment = "_history"
+
+// historyLevel is the scope of a FHIR history request.
+type historyLevel int
+
+const (
+	historyNone historyLevel = iota
+	// historySystem is the history of every resource on the server: _history
+	historySystem
+	// historyType is the history of every resource of a type: Observation/_history
+	historyType
+	// historyInstance is the history of one resource: Observation/123/_history
+	historyInstance
+	// historyVersion is a versioned read: Observation/123/_history/2
+	historyVersion
+)
+
+// historyRequest is a history request parsed from its path.
+type historyRequest struct {
+	level        historyLevel
+	resourceType string
+	id           string
+	version      string
+}
+
+// parseHistoryPath parses rawURL, absolute or relative to the FHIR base, as a history request. The
+// level is historyNone for anything else.
+func parseHistoryPath(rawURL string) historyRequest {
+	path := strings.SplitN(rawURL, "?", 2)[0]
+	path = strings.TrimPrefix(path, "/")
+	path = strings.TrimPrefix(path, "fhir")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == historySegment:
+		return historyRequest{level: historySystem}
+	case len(parts) == 2 && parts[1] == historySegment:
+		return historyRequest{level: historyType, resourceType: parts[0]}
+	case len(parts) == 3 && parts[2] == historySegment:
+		return historyRequest{level: historyInstance, resourceType: parts[0], id: parts[1]}
+	case len(parts) == 4 && parts[2] == historySegment:
+		return historyRequest{level: historyVersion, resourceType: parts[0], id: parts[1], version: parts[3]}
+	}
+	return historyRequest{}
+}
+
+// checkHistory applies the rules specific to history requests, before the usual RBAC check on the
+// resource type. History is read-only through the gateway, and the history of the whole server,
+// which mixes every patient's resources, is left to superadmins.
+func checkHistory(h historyRequest, method string, roles []string) error {
+	if method != http.MethodGet {
+		return fmt.Errorf("history is read-only")
+	}
+	if h.level == historySystem && !slices.Contains(roles, constvars.KonsulinRoleSuperadmin) {
+		return fmt.Errorf("system history is restricted to superadmin")
+	}
+	return nil
+}
+
+// historyVersions decides on the entries of a history Bundle. Each version is judged on its own
+// ownership, since an older version may reference another patient than the current one. A deleted
+// version carries no resource, only its request; it is kept when a version of the same resource is,
+// so the history of a resource the caller may see is complete without revealing others' deletions.
+type historyVersions struct {
+	kept map[string]struct{}
+}
+
+func newHistoryVersions() *historyVersions {
+	return &historyVersions{kept: make(map[string]struct{})}
+}
+
+// isHistoryEntry reports whether a search Bundle entry is a version in a history Bundle, which is
+// the only kind of read response whose entries carry a request.
+func isHistoryEntry(mode string, request json.RawMessage) bool {
+	return mode == "" && len(request) > 0
+}
+
+// add records a kept version.
+func (h *historyVersions) add(resourceType, id string) {
+	if resourceType != "" && id != "" {
+		h.kept[resourceType+"/"+id] = struct{}{}
+	}
+}
+
+// deletedResource returns the "Type/id" a deleted version's request points to.
+func deletedResource(request json.RawMessage) string {
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(request, &req); err != nil {
+		return ""
+	}
+	return locationReference(req.URL)
+}
+
+// allowsDeleted reports whether the deleted version of ref can be kept given the versions kept.
+func (h *historyVersions) allowsDeleted(ref string) bool {
+	_, ok := h.kept[ref]
+	return ref != "" && ok
+}
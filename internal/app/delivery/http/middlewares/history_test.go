@@ -0,0 +1,135 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"konsulin-service/internal/pkg/constvars"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHistoryPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want historyRequest
+	}{
+		{"/fhir/_history", historyRequest{level: historySystem}},
+		{"/fhir/Observation/_history?_count=10", historyRequest{level: historyType, resourceType: "Observation"}},
+		{"Observation/o1/_history", historyRequest{level: historyInstance, resourceType: "Observation", id: "o1"}},
+		{"/fhir/Observation/o1/_history/2", historyRequest{level: historyVersion, resourceType: "Observation", id: "o1", version: "2"}},
+		{"/fhir/Observation/o1", historyRequest{}},
+		{"/fhir/Observation?_history=1", historyRequest{}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, parseHistoryPath(tt.path), tt.path)
+	}
+}
+
+func TestCheckSingle_History(t *testing.T) {
+	m := patchTestMiddlewares(t, nil)
+	check := func(method, url, role string) error {
+		return checkSingle(context.Background(), m.Enforcer, method, url, []string{role}, "pr1", nil, nil, nil, nil, nil, nil)
+	}
+
+	assert.NoError(t, check(http.MethodGet, "/fhir/_history", constvars.KonsulinRoleSuperadmin))
+	assert.Error(t, check(http.MethodGet, "/fhir/_history", constvars.KonsulinRolePractitioner))
+	assert.Error(t, check(http.MethodGet, "/fhir/_history", constvars.KonsulinRolePatient))
+
+	assert.NoError(t, check(http.MethodGet, "/fhir/Observation/_history", constvars.KonsulinRolePractitioner))
+	assert.NoError(t, check(http.MethodGet, "/fhir/Observation/o1/_history/2", constvars.KonsulinRolePractitioner))
+	assert.Error(t, check(http.MethodGet, "/fhir/Device/d1/_history", constvars.KonsulinRolePractitioner), "RBAC on the resource type still applies")
+	assert.Error(t, check(http.MethodDelete, "/fhir/Condition/c1/_history", constvars.KonsulinRoleSuperadmin), "history is read-only")
+}
+
+func TestOwnershipFilter_History(t *testing.T) {
+	m := patchTestMiddlewares(t, nil)
+
+	version := func(id, patient string) string {
+		return `{"resource":{"resourceType":"Observation","id":"` + id + `","subject":{"reference":"Patient/` + patient + `"}},"request":{"method":"PUT","url":"Observation/` + id + `"},"response":{"status":"200"}}`
+	}
+	deleted := func(id string) string {
+		return `{"request":{"method":"DELETE","url":"Observation/` + id + `"},"response":{"status":"204"}}`
+	}
+
+	tests := []struct {
+		name    string
+		oc      func() *ownershipContext
+		entries []string
+		want    []string
+	}{
+		{
+			name: "each version is judged on the patient it references",
+			oc: func() *ownershipContext {
+				return &ownershipContext{HasPatientRole: true, PatientIDs: map[string]struct{}{"p1": {}}, PractitionerIDs: map[string]struct{}{}}
+			},
+			entries: []string{version("o1", "p1"), version("o1", "p2"), version("o1", "p1")},
+			want:    []string{"Observation/o1", "Observation/o1"},
+		},
+		{
+			name: "a deleted version is kept with the history of a resource the caller may see",
+			oc: func() *ownershipContext {
+				return &ownershipContext{HasPatientRole: true, PatientIDs: map[string]struct{}{"p1": {}}, PractitionerIDs: map[string]struct{}{}}
+			},
+			entries: []string{deleted("o1"), version("o1", "p1"), deleted("o2"), version("o2", "p2")},
+			want:    []string{"Observation/o1", "deleted Observation/o1"},
+		},
+		{
+			name: "a version referenced by an owned version is not revealed to practitioners",
+			oc: func() *ownershipContext {
+				return &ownershipContext{HasPractitionerRole: true, PatientIDs: map[string]struct{}{}, PractitionerIDs: map[string]struct{}{"pr1": {}}}
+			},
+			entries: []string{
+				`{"resource":{"resourceType":"Observation","id":"o1","performer":[{"reference":"Practitioner/pr1"}],"hasMember":[{"reference":"Observation/o2"}]},"request":{"method":"PUT","url":"Observation/o1"}}`,
+				version("o2", "p9"),
+			},
+			want: []string{"Observation/o1"},
+		},
+	}
+
+	for _, tt := range tests {
+		body := `{"resourceType":"Bundle","type":"history","entry":[` + strings.Join(tt.entries, ",") + `]}`
+
+		t.Run(tt.name+" (buffered)", func(t *testing.T) {
+			bundle, ok, err := decodeBundle([]byte(body))
+			require.NoError(t, err)
+			require.True(t, ok)
+			m.filterOwnedEntries(bundle, []string{constvars.KonsulinRolePatient}, tt.oc())
+			assert.ElementsMatch(t, tt.want, historyEntries(t, bundle))
+		})
+
+		t.Run(tt.name+" (streamed)", func(t *testing.T) {
+			f := &bundleEntryFilter{m: m, roles: []string{constvars.KonsulinRolePatient}, oc: tt.oc(), allowedRefs: map[string]struct{}{}, versions: newHistoryVersions()}
+
+			var out bytes.Buffer
+			require.NoError(t, streamFilterBundle(strings.NewReader(body), &out, f, nil))
+			bundle := decodeStreamedBundle(t, out.Bytes())
+			assert.ElementsMatch(t, tt.want, historyEntries(t, &bundle))
+		})
+	}
+}
+
+// historyEntries describes the entries of a history Bundle, checking each kept its request.
+func historyEntries(t *testing.T, bundle *Bundle) []string {
+	t.Helper()
+	out := []string{}
+	for _, e := range bundle.Entry {
+		require.NotEmpty(t, e.Request, "history entries keep their request")
+		if len(e.Resource) == 0 {
+			out = append(out, "deleted "+deletedResource(e.Request))
+			continue
+		}
+		var res struct {
+			ResourceType string `json:"resourceType"`
+			ID           string `json:"id"`
+		}
+		require.NoError(t, json.Unmarshal(e.Resource, &res))
+		out = append(out, res.ResourceType+"/"+res.ID)
+	}
+	return out
+}
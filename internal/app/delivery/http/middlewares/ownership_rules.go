@@ -0,0 +1,217 @@
+package middlewares
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/utils"
+
+	"github.com/tidwall/gjson"
+)
+
+// ownershipRulesFile declares which resources are public and which reference paths prove ownership.
+// It lives next to rbac_policy.csv and is hot-reloaded the same way; without it the rules built into
+// the binary apply.
+const ownershipRulesFile = "resources/ownership_rules.json"
+
+var errUnreadableResource = errors.New("resource is not valid JSON")
+
+// readOwnership evaluates the read rules of resourceType against one resource. An error means the
+// resource could not be evaluated and the caller decides whether to fail closed.
+func readOwnership(raw json.RawMessage, resourceType, id string, oc *ownershipContext) (bool, error) {
+	rules := utils.CurrentOwnershipRules()
+	valid := json.Valid(raw)
+
+	for _, rule := range rules.ReadRules(resourceType) {
+		if rule.Match == utils.OwnershipMatchID {
+			if id != "" && matchesOwnedRef(resourceType+"/"+id, oc) {
+				return true, nil
+			}
+			continue
+		}
+		if !valid {
+			return false, errUnreadableResource
+		}
+
+		for _, v := range ruleValues(raw, rule) {
+			switch {
+			case rule.Match == utils.OwnershipMatchValue:
+				if slices.Contains(rule.In, v) {
+					return true, nil
+				}
+			case matchesOwnedRef(v, oc), slices.Contains(rule.ReferenceTo, referenceType(v)):
+				return true, nil
+			}
+		}
+	}
+
+	// A resource referencing nobody but the listed types, e.g. an Invoice issued between
+	// practitioners, is not anyone's private record.
+	if allowed := rules.Resources[resourceType].PublicWhenAllReferencesTo; len(allowed) > 0 {
+		if !valid {
+			return false, errUnreadableResource
+		}
+		refs := allReferences(raw)
+		if len(refs) == 0 {
+			return false, nil
+		}
+		for _, ref := range refs {
+			if !slices.Contains(allowed, referenceType(ref)) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// writeOwnership evaluates the write rules of resourceType for a Patient or Practitioner identity.
+// decided is set when a rule settled the outcome, so no other means of access may be tried.
+func writeOwnership(
+	ctx context.Context,
+	identity, fhirID, resourceType string,
+	resource []byte,
+	practitionerRoleClient contracts.PractitionerRoleFhirClient,
+	scheduleClient contracts.ScheduleFhirClient,
+	questionnaireResponseClient contracts.QuestionnaireResponseFhirClient,
+) (granted, decided bool) {
+	for _, rule := range utils.CurrentOwnershipRules().WriteRules(resourceType, identity) {
+		switch rule.Check {
+		case utils.OwnershipCheckQuestionnaireResponse:
+			granted, decided = questionnaireResponseOwnership(ctx, fhirID, resource, questionnaireResponseClient)
+		case utils.OwnershipCheckSchedule:
+			granted, decided = scheduleOwnership(ctx, fhirID, resource, scheduleClient, practitionerRoleClient)
+		default:
+			granted, decided = writeRuleGrants(rule, identity, fhirID, resource)
+		}
+		if granted || decided {
+			return granted, decided
+		}
+	}
+	return false, false
+}
+
+func writeRuleGrants(rule utils.OwnershipRule, identity, fhirID string, resource []byte) (granted, decided bool) {
+	for _, v := range ruleValues(resource, rule) {
+		switch rule.Match {
+		case utils.OwnershipMatchID:
+			granted = v == fhirID
+		case utils.OwnershipMatchValue:
+			granted = slices.Contains(rule.In, v)
+		default:
+			if id, ok := strings.CutPrefix(v, identity+"/"); ok {
+				granted = id == fhirID
+				decided = decided || rule.Decisive
+			}
+			granted = granted || slices.Contains(rule.ReferenceTo, referenceType(v))
+		}
+		if granted {
+			return true, true
+		}
+	}
+	return false, decided
+}
+
+// ruleValues returns the strings found at the rule's path, flattening arrays.
+func ruleValues(raw []byte, rule utils.OwnershipRule) []string {
+	if rule.Path == utils.OwnershipRecursiveReferences {
+		return allReferences(raw)
+	}
+
+	var out []string
+	var flatten func(r gjson.Result)
+	flatten = func(r gjson.Result) {
+		if r.IsArray() {
+			for _, item := range r.Array() {
+				flatten(item)
+			}
+			return
+		}
+		if r.Exists() {
+			out = append(out, r.String())
+		}
+	}
+	flatten(gjson.GetBytes(raw, rule.Path))
+	return out
+}
+
+func allReferences(raw []byte) []string {
+	var res map[string]any
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil
+	}
+	var refs []string
+	collectReferences(res, &refs, 0)
+	return refs
+}
+
+func referenceType(ref string) string {
+	rt, _, _ := strings.Cut(ref, "/")
+	return rt
+}
+
+// questionnaireResponseOwnership lets a patient update a stored QuestionnaireResponse that is theirs
+// or nobody's. Responses that cannot be found are refused outright.
+func questionnaireResponseOwnership(ctx context.Context, fhirID string, resource []byte, client contracts.QuestionnaireResponseFhirClient) (granted, decided bool) {
+	questionnaireResponseID := gjson.GetBytes(resource, "id").String()
+	if questionnaireResponseID == "" {
+		return false, true
+	}
+
+	questionnaireResponse, err := client.FindQuestionnaireResponseByID(ctx, questionnaireResponseID)
+	if err != nil {
+		return false, true
+	}
+
+	authorRef := questionnaireResponse.Author.Reference
+	subjectRef := questionnaireResponse.Subject.Reference
+	if authorRef == "" && subjectRef == "" {
+		return true, true
+	}
+
+	for _, ref := range []string{authorRef, subjectRef} {
+		if id, ok := strings.CutPrefix(ref, constvars.ResourcePatient+"/"); ok && id != fhirID {
+			return false, false
+		}
+	}
+	return true, true
+}
+
+// scheduleOwnership lets a practitioner update a stored Schedule whose actor is them or one of their
+// PractitionerRoles.
+func scheduleOwnership(ctx context.Context, fhirID string, resource []byte, scheduleClient contracts.ScheduleFhirClient, practitionerRoleClient contracts.PractitionerRoleFhirClient) (granted, decided bool) {
+	scheduleID := gjson.GetBytes(resource, "id").String()
+	if scheduleID == "" {
+		return false, true
+	}
+
+	schedules, err := scheduleClient.Search(ctx, contracts.ScheduleSearchParams{ID: scheduleID})
+	if err != nil || len(schedules) != 1 || len(schedules[0].Actor) < 1 {
+		return false, true
+	}
+
+	for _, actor := range schedules[0].Actor {
+		actorRef := actor.Reference
+
+		if roleID, ok := strings.CutPrefix(actorRef, constvars.ResourcePractitionerRole+"/"); ok {
+			pr, err := practitionerRoleClient.FindPractitionerRoleByID(ctx, roleID)
+			if err != nil {
+				continue
+			}
+			if pid, ok := strings.CutPrefix(pr.Practitioner.Reference, constvars.ResourcePractitioner+"/"); ok && pid == fhirID {
+				return true, true
+			}
+		}
+
+		if pid, ok := strings.CutPrefix(actorRef, constvars.ResourcePractitioner+"/"); ok && pid == fhirID {
+			return true, true
+		}
+	}
+	return false, false
+}
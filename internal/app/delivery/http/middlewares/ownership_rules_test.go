@@ -0,0 +1,231 @@
+package middlewares
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/fhir_dto"
+	"konsulin-service/internal/pkg/utils"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// The tests in this file pin the ownership behaviour as it was before the rules moved out of Go code
+// into resources/ownership_rules.json. Changing the rules file should be a deliberate change here too.
+
+func TestOwnershipRules_ResourceClassification(t *testing.T) {
+	patientOwned := []string{"Patient", "Appointment", "Observation", "Encounter", "Condition", "AllergyIntolerance", "MedicationRequest", "Procedure", "DiagnosticReport", "ImagingStudy", "DocumentReference", "CarePlan", "Goal", "RiskAssessment", "FamilyMemberHistory", "Immunization", "MedicationAdministration", "MedicationDispense", "MedicationStatement", "Coverage", "Claim", "ExplanationOfBenefit", "PaymentNotice", "PaymentReconciliation", "Account", "ChargeItem", "Invoice", "Consent", "CareTeam"}
+	practitionerOwned := []string{"Practitioner", "Schedule", "Encounter", "Observation", "DiagnosticReport", "Procedure", "MedicationRequest", "CarePlan", "DocumentReference", "Communication", "CommunicationRequest", "Task", "Consent", "Contract", "CoverageEligibilityRequest", "CoverageEligibilityResponse", "Claim", "ClaimResponse", "ExplanationOfBenefit", "PaymentNotice", "PaymentReconciliation", "Account", "ChargeItem", "Invoice"}
+	public := []string{"Practitioner", "Questionnaire", "ResearchStudy", "Organization", "Location", "HealthcareService", "PractitionerRole", "Slot", "CodeSystem", "ValueSet", "ConceptMap", "StructureDefinition", "OperationDefinition", "SearchParameter", "CompartmentDefinition", "GraphDefinition", "ImplementationGuide", "CapabilityStatement", "MessageDefinition", "ActivityDefinition", "PlanDefinition", "Schedule", "Library", "Measure", "MeasureReport", "TestScript", "TestReport", "Subscription", "SubscriptionTopic", "VerificationResult", "Requirements", "ExampleScenario", "SpecimenDefinition", "NamingSystem", "TerminologyCapabilities", "Media"}
+
+	all := append(append(append([]string{"Group", "Bundle", "AuditEvent", "QuestionnaireResponse", "ServiceRequest"}, patientOwned...), practitionerOwned...), public...)
+	for _, rt := range all {
+		assert.Equal(t, contains(patientOwned, rt), utils.RequiresPatientOwnership(rt), "patient ownership of %s", rt)
+		assert.Equal(t, contains(practitionerOwned, rt), utils.RequiresPractitionerOwnership(rt), "practitioner ownership of %s", rt)
+		assert.Equal(t, contains(public, rt), utils.IsPublicResource(rt), "public %s", rt)
+	}
+
+	m := &Middlewares{Log: zap.NewNop()}
+	failClosed := []string{"Patient", "Condition", "Observation", "MedicationRequest", "AllergyIntolerance", "Procedure", "CarePlan", "MedicationAdministration"}
+	for _, rt := range all {
+		assert.Equal(t, contains(failClosed, rt), m.failClosedOnErrorFromResource(rt, "x"), "fail closed on %s", rt)
+	}
+	assert.True(t, m.failClosedOnErrorFromResource("", "x"))
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOwnershipRules_ReadOwnership(t *testing.T) {
+	m := &Middlewares{Log: zap.NewNop()}
+	patient := &ownershipContext{HasPatientRole: true, PatientIDs: map[string]struct{}{"p1": {}}, PractitionerIDs: map[string]struct{}{}}
+	practitioner := &ownershipContext{HasPractitionerRole: true, PatientIDs: map[string]struct{}{}, PractitionerIDs: map[string]struct{}{"pr1": {}}, PractitionerRoleIDs: []string{"r1"}}
+	nobody := &ownershipContext{PatientIDs: map[string]struct{}{}, PractitionerIDs: map[string]struct{}{}}
+
+	cases := []struct {
+		name string
+		raw  string
+		oc   *ownershipContext
+		want bool
+	}{
+		{"public resource", `{"resourceType":"Questionnaire","id":"q1"}`, nobody, true},
+		{"public practitioner-owned resource", `{"resourceType":"Schedule","id":"s1","actor":[{"reference":"Practitioner/pr9"}]}`, nobody, true},
+		{"type without owners", `{"resourceType":"Group","id":"g1"}`, nobody, true},
+		{"own patient", `{"resourceType":"Patient","id":"p1"}`, patient, true},
+		{"other patient", `{"resourceType":"Patient","id":"p2"}`, patient, false},
+		{"subject", `{"resourceType":"Observation","id":"o1","subject":{"reference":"Patient/p1"}}`, patient, true},
+		{"subject of another patient", `{"resourceType":"Observation","id":"o1","subject":{"reference":"Patient/p2"}}`, patient, false},
+		{"patient", `{"resourceType":"AllergyIntolerance","id":"a1","patient":{"reference":"Patient/p1"}}`, patient, true},
+		{"recipient", `{"resourceType":"Communication","id":"c1","recipient":{"reference":"Practitioner/pr1"}}`, practitioner, true},
+		{"actor", `{"resourceType":"Task","id":"t1","actor":{"reference":"Practitioner/pr1"}}`, practitioner, true},
+		{"participant actor", `{"resourceType":"Encounter","id":"e1","participant":[{"actor":{"reference":"Practitioner/pr1"}}]}`, practitioner, true},
+		{"participant practitioner role", `{"resourceType":"Encounter","id":"e1","participant":[{"individual":{"reference":"PractitionerRole/r1"}}]}`, practitioner, true},
+		{"any nested reference", `{"resourceType":"Observation","id":"o1","focus":[{"reference":"Patient/p1"}]}`, patient, true},
+		{"patient-only type without patient identity", `{"resourceType":"Appointment","id":"a1","participant":[{"actor":{"reference":"Practitioner/pr1"}}]}`, practitioner, false},
+		{"practitioner-only type without practitioner identity", `{"resourceType":"Task","id":"t1","for":{"reference":"Patient/p1"}}`, &ownershipContext{PatientIDs: map[string]struct{}{"p1": {}}, PractitionerIDs: map[string]struct{}{}}, false},
+		{"invoice referencing only practitioners", `{"resourceType":"Invoice","id":"i1","participant":[{"actor":{"reference":"PractitionerRole/r9"}}],"issuer":{"reference":"Practitioner/pr9"}}`, patient, true},
+		{"invoice referencing a device", `{"resourceType":"Invoice","id":"i1","participant":[{"actor":{"reference":"Device/d9"}}]}`, patient, true},
+		{"invoice referencing an organization", `{"resourceType":"Invoice","id":"i1","participant":[{"actor":{"reference":"PractitionerRole/r9"}}],"issuer":{"reference":"Organization/o9"}}`, patient, false},
+		{"invoice of another patient", `{"resourceType":"Invoice","id":"i1","subject":{"reference":"Patient/p2"}}`, patient, false},
+		{"invoice without references", `{"resourceType":"Invoice","id":"i1"}`, patient, false},
+		{"unreadable fail-closed type", `{"resourceType":"Observation","id":"o1",`, patient, false},
+		{"unreadable fail-open type", `{"resourceType":"Encounter","id":"e1",`, patient, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var env struct {
+				ResourceType string `json:"resourceType"`
+				ID           string `json:"id"`
+			}
+			_ = json.Unmarshal([]byte(tc.raw), &env)
+			if env.ResourceType == "" {
+				// unreadable bodies: take the type from the test name's fixture
+				env.ResourceType = map[bool]string{true: "Observation", false: "Encounter"}[tc.name == "unreadable fail-closed type"]
+			}
+			assert.Equal(t, tc.want, m.resourceOwnedByContext(json.RawMessage(tc.raw), env.ResourceType, env.ID, tc.oc))
+		})
+	}
+}
+
+type pinQuestionnaireResponseClient struct {
+	contracts.QuestionnaireResponseFhirClient
+	stored map[string]*fhir_dto.QuestionnaireResponse
+}
+
+func (f *pinQuestionnaireResponseClient) FindQuestionnaireResponseByID(_ context.Context, id string) (*fhir_dto.QuestionnaireResponse, error) {
+	if qr, ok := f.stored[id]; ok {
+		return qr, nil
+	}
+	return nil, errors.New("not found")
+}
+
+type pinScheduleClient struct {
+	contracts.ScheduleFhirClient
+	stored map[string]fhir_dto.Schedule
+}
+
+func (f *pinScheduleClient) Search(_ context.Context, params contracts.ScheduleSearchParams) ([]fhir_dto.Schedule, error) {
+	if s, ok := f.stored[params.ID]; ok {
+		return []fhir_dto.Schedule{s}, nil
+	}
+	return nil, nil
+}
+
+type pinPractitionerRoleClient struct {
+	contracts.PractitionerRoleFhirClient
+	stored map[string]*fhir_dto.PractitionerRole
+}
+
+func (f *pinPractitionerRoleClient) FindPractitionerRoleByID(_ context.Context, id string) (*fhir_dto.PractitionerRole, error) {
+	if pr, ok := f.stored[id]; ok {
+		return pr, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func TestOwnershipRules_WriteOwnership(t *testing.T) {
+	qrs := &pinQuestionnaireResponseClient{stored: map[string]*fhir_dto.QuestionnaireResponse{
+		"qr-own":     {Author: fhir_dto.Reference{Reference: "Patient/p1"}},
+		"qr-blank":   {},
+		"qr-foreign": {Subject: fhir_dto.Reference{Reference: "Patient/p2"}},
+	}}
+	schedules := &pinScheduleClient{stored: map[string]fhir_dto.Schedule{
+		"s-role":    {Actor: []fhir_dto.Reference{{Reference: "PractitionerRole/r1"}}},
+		"s-direct":  {Actor: []fhir_dto.Reference{{Reference: "Practitioner/pr1"}}},
+		"s-foreign": {Actor: []fhir_dto.Reference{{Reference: "Practitioner/pr2"}}},
+		"s-empty":   {},
+	}}
+	roles := &pinPractitionerRoleClient{stored: map[string]*fhir_dto.PractitionerRole{
+		"r1": {Practitioner: fhir_dto.Reference{Reference: "Practitioner/pr1"}},
+	}}
+
+	cases := []struct {
+		name, role, fhirID, resourceType, body string
+		want                                   bool
+	}{
+		{"condition subject", "Patient", "p1", "Condition", `{"subject":{"reference":"Patient/p1"}}`, true},
+		{"condition of another patient is final", "Patient", "p1", "Condition", `{"subject":{"reference":"Patient/p2"},"patient":{"reference":"Patient/p1"}}`, false},
+		{"condition without subject", "Patient", "p1", "Condition", `{"patient":{"reference":"Patient/p1"}}`, true},
+		{"appointment participant", "Patient", "p1", "Appointment", `{"participant":[{"actor":{"reference":"Practitioner/pr1"}},{"actor":{"reference":"Patient/p1"}}]}`, true},
+		{"appointment of another patient", "Patient", "p1", "Appointment", `{"participant":[{"actor":{"reference":"Patient/p2"}}]}`, false},
+		{"busy slot", "Patient", "p1", "Slot", `{"status":"busy"}`, true},
+		{"busy-unavailable slot", "Patient", "p1", "Slot", `{"status":"busy-unavailable"}`, true},
+		{"free slot", "Patient", "p1", "Slot", `{"status":"free"}`, false},
+		{"questionnaire response without id is final", "Patient", "p1", "QuestionnaireResponse", `{"subject":{"reference":"Patient/p1"}}`, false},
+		{"unknown questionnaire response is final", "Patient", "p1", "QuestionnaireResponse", `{"id":"qr-missing","subject":{"reference":"Patient/p1"}}`, false},
+		{"own stored questionnaire response", "Patient", "p1", "QuestionnaireResponse", `{"id":"qr-own"}`, true},
+		{"unowned stored questionnaire response", "Patient", "p1", "QuestionnaireResponse", `{"id":"qr-blank"}`, true},
+		{"foreign stored questionnaire response falls back to body", "Patient", "p1", "QuestionnaireResponse", `{"id":"qr-foreign","subject":{"reference":"Patient/p1"}}`, true},
+		{"foreign stored questionnaire response", "Patient", "p1", "QuestionnaireResponse", `{"id":"qr-foreign","subject":{"reference":"Patient/p2"}}`, false},
+		{"own patient", "Patient", "p1", "Patient", `{"id":"p1"}`, true},
+		{"other patient", "Patient", "p1", "Patient", `{"id":"p2"}`, false},
+		{"subject", "Patient", "p1", "Observation", `{"subject":{"reference":"Patient/p1"}}`, true},
+		{"patient", "Patient", "p1", "AllergyIntolerance", `{"patient":{"reference":"Patient/p1"}}`, true},
+		{"actor", "Patient", "p1", "Task", `{"actor":{"reference":"Patient/p1"}}`, true},
+		{"performer is not a patient path", "Patient", "p1", "Observation", `{"performer":[{"reference":"Patient/p1"}]}`, false},
+
+		{"invoice with any practitioner role", "Practitioner", "pr1", "Invoice", `{"participant":[{"actor":{"reference":"PractitionerRole/r9"}}]}`, true},
+		{"invoice participant", "Practitioner", "pr1", "Invoice", `{"participant":[{"actor":{"reference":"Practitioner/pr1"}}]}`, true},
+		{"invoice of another practitioner", "Practitioner", "pr1", "Invoice", `{"participant":[{"actor":{"reference":"Practitioner/pr2"}}]}`, false},
+		{"own practitioner", "Practitioner", "pr1", "Practitioner", `{"id":"pr1"}`, true},
+		{"other practitioner", "Practitioner", "pr1", "Practitioner", `{"id":"pr2"}`, false},
+		{"schedule without id is final", "Practitioner", "pr1", "Schedule", `{"practitioner":{"reference":"Practitioner/pr1"}}`, false},
+		{"unknown schedule is final", "Practitioner", "pr1", "Schedule", `{"id":"s-missing","practitioner":{"reference":"Practitioner/pr1"}}`, false},
+		{"schedule without actors is final", "Practitioner", "pr1", "Schedule", `{"id":"s-empty","practitioner":{"reference":"Practitioner/pr1"}}`, false},
+		{"schedule through practitioner role", "Practitioner", "pr1", "Schedule", `{"id":"s-role"}`, true},
+		{"schedule actor", "Practitioner", "pr1", "Schedule", `{"id":"s-direct"}`, true},
+		{"foreign schedule", "Practitioner", "pr1", "Schedule", `{"id":"s-foreign"}`, false},
+		{"practitioner", "Practitioner", "pr1", "PractitionerRole", `{"practitioner":{"reference":"Practitioner/pr1"}}`, true},
+		{"author", "Practitioner", "pr1", "QuestionnaireResponse", `{"author":{"reference":"Practitioner/pr1"}}`, true},
+		{"single performer", "Practitioner", "pr1", "Task", `{"performer":{"reference":"Practitioner/pr1"}}`, true},
+		{"performer list", "Practitioner", "pr1", "Observation", `{"performer":[{"reference":"Practitioner/pr1"}]}`, false},
+		{"subject is not a practitioner path", "Practitioner", "pr1", "Observation", `{"subject":{"reference":"Practitioner/pr1"}}`, false},
+
+		{"other roles own nothing", "Clinic Admin", "pr1", "Practitioner", `{"id":"pr1"}`, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.role+" "+tc.name, func(t *testing.T) {
+			got := validateResourceOwnership(context.Background(), tc.fhirID, tc.role, tc.resourceType, []byte(tc.body), roles, schedules, qrs)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestOwnershipRules_Reload(t *testing.T) {
+	defer utils.SetOwnershipRules(utils.CurrentOwnershipRules())
+
+	path := filepath.Join(t.TempDir(), "ownership_rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"public": ["Group"],
+		"resources": {"Observation": {"owners": ["Patient"], "read": [{"path": "focus.#.reference"}]}}
+	}`), 0o600))
+	require.NoError(t, utils.LoadOwnershipRules(path))
+
+	assert.True(t, utils.IsPublicResource("Group"))
+	assert.False(t, utils.IsPublicResource("Questionnaire"))
+	assert.False(t, utils.RequiresPractitionerOwnership("Observation"))
+
+	m := &Middlewares{Log: zap.NewNop()}
+	patient := &ownershipContext{HasPatientRole: true, PatientIDs: map[string]struct{}{"p1": {}}, PractitionerIDs: map[string]struct{}{}}
+	assert.True(t, m.resourceOwnedByContext(json.RawMessage(`{"resourceType":"Observation","id":"o1","focus":[{"reference":"Patient/p1"}]}`), "Observation", "o1", patient))
+	assert.False(t, m.resourceOwnedByContext(json.RawMessage(`{"resourceType":"Observation","id":"o1","subject":{"reference":"Patient/p1"}}`), "Observation", "o1", patient))
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"resources": {"Observation": {"read": [{"check": "schedule"}]}}}`), 0o600))
+	assert.Error(t, utils.LoadOwnershipRules(path), "checks only apply to write rules")
+	assert.True(t, utils.IsPublicResource("Group"), "invalid rules keep the current ones")
+}
@@ -0,0 +1,616 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+
+	"github.com/tidwall/gjson"
+)
+
+// PATCH bodies are applied by the gateway so that ownership is checked on the resource as it will
+// be stored. Two formats are understood: JSON Patch (RFC 6902, application/json-patch+json) and
+// FHIRPath Patch (a Parameters resource). FHIRPath Patch paths are limited to element navigation
+// with optional indexes, e.g. "Patient.name[0].given"; functions such as where() are rejected.
+
+var errPatchPathNotFound = errors.New("patch path not found")
+
+// applyJSONPatch applies a JSON Patch document to resource.
+func applyJSONPatch(resource, patch []byte) ([]byte, error) {
+	var doc any
+	if err := json.Unmarshal(resource, &doc); err != nil {
+		return nil, err
+	}
+
+	var ops []struct {
+		Op    string          `json:"op"`
+		Path  *string         `json:"path"`
+		From  string          `json:"from"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("invalid JSON Patch: %w", err)
+	}
+
+	for i, op := range ops {
+		if op.Path == nil {
+			return nil, fmt.Errorf("JSON Patch operation %d: path is required", i)
+		}
+		path, err := parseJSONPointer(*op.Path)
+		if err != nil {
+			return nil, fmt.Errorf("JSON Patch operation %d: %w", i, err)
+		}
+
+		var value any
+		switch op.Op {
+		case "add", "replace", "test":
+			if len(op.Value) == 0 {
+				return nil, fmt.Errorf("JSON Patch operation %d: value is required", i)
+			}
+			if err := json.Unmarshal(op.Value, &value); err != nil {
+				return nil, fmt.Errorf("JSON Patch operation %d: %w", i, err)
+			}
+		case "move", "copy":
+			from, err := parseJSONPointer(op.From)
+			if err != nil {
+				return nil, fmt.Errorf("JSON Patch operation %d: %w", i, err)
+			}
+			if value, err = patchGet(doc, from); err != nil {
+				return nil, fmt.Errorf("JSON Patch operation %d: %s: %w", i, op.From, err)
+			}
+			if op.Op == "move" {
+				if doc, err = patchRemove(doc, from); err != nil {
+					return nil, fmt.Errorf("JSON Patch operation %d: %s: %w", i, op.From, err)
+				}
+			} else {
+				value = deepCopy(value)
+			}
+		}
+
+		switch op.Op {
+		case "add", "move", "copy":
+			doc, err = patchAdd(doc, path, value)
+		case "remove":
+			doc, err = patchRemove(doc, path)
+		case "replace":
+			doc, err = patchReplace(doc, path, value)
+		case "test":
+			var current any
+			if current, err = patchGet(doc, path); err == nil && !reflect.DeepEqual(current, value) {
+				err = errors.New("test failed")
+			}
+		default:
+			err = fmt.Errorf("unsupported op %q", op.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("JSON Patch operation %d: %s: %w", i, *op.Path, err)
+		}
+	}
+
+	return json.Marshal(doc)
+}
+
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// fhirPathSegment matches one step of a supported FHIRPath Patch path, e.g. "name" or "name[0]".
+var fhirPathSegment = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9_]*)(?:\[(\d+)\])?$`)
+
+// applyFHIRPathPatch applies a FHIRPath Patch Parameters resource to resource.
+func applyFHIRPathPatch(resource, patch []byte) ([]byte, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(resource, &doc); err != nil {
+		return nil, err
+	}
+
+	var params struct {
+		ResourceType string           `json:"resourceType"`
+		Parameter    []map[string]any `json:"parameter"`
+	}
+	if err := json.Unmarshal(patch, &params); err != nil || params.ResourceType != "Parameters" {
+		return nil, errors.New("FHIRPath Patch must be a Parameters resource")
+	}
+
+	resourceType, _ := doc["resourceType"].(string)
+	var root any = doc
+	for i, param := range params.Parameter {
+		if param["name"] != "operation" {
+			continue
+		}
+		op := patchParts(param)
+
+		opType, _ := op["type"].(string)
+		path, err := resolveFHIRPath(root, resourceType, stringPart(op, "path"))
+		if err != nil {
+			if errors.Is(err, errPatchPathNotFound) && opType == "delete" {
+				continue
+			}
+			return nil, fmt.Errorf("FHIRPath Patch operation %d: %w", i, err)
+		}
+		// every append below must copy the path
+		path = slices.Clip(path)
+
+		switch opType {
+		case "add":
+			name := stringPart(op, "name")
+			if name == "" {
+				return nil, fmt.Errorf("FHIRPath Patch operation %d: name is required", i)
+			}
+			child := append(path, name)
+			if existing, err := patchGet(root, child); err == nil {
+				if _, isList := existing.([]any); isList {
+					child = append(child, "-")
+				}
+			}
+			root, err = patchAdd(root, child, op["value"])
+		case "insert":
+			var index int
+			if index, err = intPart(op, "index"); err == nil {
+				root, err = patchAdd(root, append(path, strconv.Itoa(index)), op["value"])
+			}
+		case "delete":
+			root, err = patchRemove(root, path)
+		case "replace":
+			root, err = patchReplace(root, path, op["value"])
+		case "move":
+			var source, destination int
+			if source, err = intPart(op, "source"); err != nil {
+				break
+			}
+			if destination, err = intPart(op, "destination"); err != nil {
+				break
+			}
+			var moved any
+			if moved, err = patchGet(root, append(path, strconv.Itoa(source))); err != nil {
+				break
+			}
+			if root, err = patchRemove(root, append(path, strconv.Itoa(source))); err != nil {
+				break
+			}
+			root, err = patchAdd(root, append(path, strconv.Itoa(destination)), moved)
+		default:
+			err = fmt.Errorf("unsupported type %q", opType)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("FHIRPath Patch operation %d: %w", i, err)
+		}
+	}
+
+	return json.Marshal(root)
+}
+
+// patchParts flattens the parts of a Parameters parameter into name → value. Values given as value[x]
+// are taken as is and values given as nested parts become objects.
+func patchParts(param map[string]any) map[string]any {
+	out := make(map[string]any)
+	parts, _ := param["part"].([]any)
+	for _, p := range parts {
+		part, ok := p.(map[string]any)
+		if !ok {
+			continue
+		}
+		name, _ := part["name"].(string)
+		out[name] = partValue(part)
+	}
+	return out
+}
+
+func partValue(part map[string]any) any {
+	for k, v := range part {
+		if strings.HasPrefix(k, "value") {
+			return v
+		}
+	}
+	if _, ok := part["part"]; ok {
+		return patchParts(part)
+	}
+	if resource, ok := part["resource"]; ok {
+		return resource
+	}
+	return nil
+}
+
+func stringPart(op map[string]any, name string) string {
+	s, _ := op[name].(string)
+	return s
+}
+
+func intPart(op map[string]any, name string) (int, error) {
+	n, ok := op[name].(float64)
+	if !ok || n < 0 || n != float64(int(n)) {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return int(n), nil
+}
+
+// resolveFHIRPath turns a FHIRPath Patch path into JSON pointer tokens. Lists are only stepped into
+// implicitly when they hold a single element, since the operations apply to exactly one element.
+func resolveFHIRPath(root any, resourceType, path string) ([]string, error) {
+	segments := strings.Split(path, ".")
+	if len(segments) == 0 || segments[0] != resourceType {
+		return nil, fmt.Errorf("path %q must start with %s", path, resourceType)
+	}
+
+	var tokens []string
+	node := root
+	for i, seg := range segments[1:] {
+		m := fhirPathSegment.FindStringSubmatch(seg)
+		if m == nil {
+			return nil, fmt.Errorf("unsupported path %q", path)
+		}
+		tokens = append(tokens, m[1])
+		next, err := patchGet(node, []string{m[1]})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, errPatchPathNotFound)
+		}
+
+		list, isList := next.([]any)
+		switch {
+		case m[2] != "":
+			index, _ := strconv.Atoi(m[2])
+			if !isList || index >= len(list) {
+				return nil, fmt.Errorf("%s: %w", path, errPatchPathNotFound)
+			}
+			tokens = append(tokens, m[2])
+			next = list[index]
+		case isList && i < len(segments)-2:
+			if len(list) != 1 {
+				return nil, fmt.Errorf("path %q matches more than one element", path)
+			}
+			tokens = append(tokens, "0")
+			next = list[0]
+		}
+		node = next
+	}
+	return tokens, nil
+}
+
+func patchGet(node any, path []string) (any, error) {
+	for _, token := range path {
+		switch c := node.(type) {
+		case map[string]any:
+			v, ok := c[token]
+			if !ok {
+				return nil, errPatchPathNotFound
+			}
+			node = v
+		case []any:
+			i, err := arrayIndex(token, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			node = c[i]
+		default:
+			return nil, errPatchPathNotFound
+		}
+	}
+	return node, nil
+}
+
+func patchAdd(root any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return patchContainer(root, path, func(container any, key string) (any, error) {
+		switch c := container.(type) {
+		case map[string]any:
+			c[key] = value
+			return c, nil
+		case []any:
+			i := len(c)
+			if key != "-" {
+				var err error
+				if i, err = arrayIndex(key, len(c)); err != nil {
+					return nil, err
+				}
+			}
+			return append(c[:i], append([]any{value}, c[i:]...)...), nil
+		}
+		return nil, errPatchPathNotFound
+	})
+}
+
+func patchRemove(root any, path []string) (any, error) {
+	if len(path) == 0 {
+		return nil, errors.New("cannot remove the whole resource")
+	}
+	return patchContainer(root, path, func(container any, key string) (any, error) {
+		switch c := container.(type) {
+		case map[string]any:
+			if _, ok := c[key]; !ok {
+				return nil, errPatchPathNotFound
+			}
+			delete(c, key)
+			return c, nil
+		case []any:
+			i, err := arrayIndex(key, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, errPatchPathNotFound
+	})
+}
+
+func patchReplace(root any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return patchContainer(root, path, func(container any, key string) (any, error) {
+		switch c := container.(type) {
+		case map[string]any:
+			if _, ok := c[key]; !ok {
+				return nil, errPatchPathNotFound
+			}
+			c[key] = value
+			return c, nil
+		case []any:
+			i, err := arrayIndex(key, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			c[i] = value
+			return c, nil
+		}
+		return nil, errPatchPathNotFound
+	})
+}
+
+// patchContainer walks to the container of the last path token, applies op to it and stores the
+// container op returns in its parent, since inserting into a list may reallocate it.
+func patchContainer(node any, path []string, op func(container any, key string) (any, error)) (any, error) {
+	if len(path) == 1 {
+		return op(node, path[0])
+	}
+
+	switch c := node.(type) {
+	case map[string]any:
+		child, ok := c[path[0]]
+		if !ok {
+			return nil, errPatchPathNotFound
+		}
+		updated, err := patchContainer(child, path[1:], op)
+		if err != nil {
+			return nil, err
+		}
+		c[path[0]] = updated
+		return c, nil
+	case []any:
+		i, err := arrayIndex(path[0], len(c)-1)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := patchContainer(c[i], path[1:], op)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = updated
+		return c, nil
+	}
+	return nil, errPatchPathNotFound
+}
+
+func arrayIndex(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > max || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return i, nil
+}
+
+func deepCopy(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, vv := range t {
+			out[k] = deepCopy(vv)
+		}
+		return out
+	case []any:
+		out := make([]any, len(t))
+		for i, vv := range t {
+			out[i] = deepCopy(vv)
+		}
+		return out
+	}
+	return v
+}
+
+// patchedResource fetches the resource a PATCH addresses and applies the patch to it. Errors are
+// ready for utils.BuildErrorResponse.
+func (m *Middlewares) patchedResource(ctx context.Context, rawURL, contentType string, patch []byte) (current, patched []byte, err error) {
+	resourceType, id, err := patchTarget(rawURL)
+	if err != nil {
+		return nil, nil, exceptions.ErrInvalidFormat(err, "patch")
+	}
+
+	target := strings.TrimRight(m.InternalConfig.FHIR.BaseUrl, "/") + "/" + resourceType + "/" + id
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, nil, exceptions.ErrCreateHTTPRequest(err)
+	}
+	req.Header.Set(constvars.HeaderAccept, constvars.MIMEApplicationFHIRJSON)
+
+	resp, err := m.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, exceptions.ErrSendHTTPRequest(err)
+	}
+	defer resp.Body.Close()
+
+	current, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, exceptions.ErrReadBody(err)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, nil, upstreamFHIRError(resp.StatusCode, current)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == constvars.MIMEApplicationJSONPatch {
+		patched, err = applyJSONPatch(current, patch)
+	} else {
+		patched, err = applyFHIRPathPatch(current, patch)
+	}
+	if err != nil {
+		return nil, nil, exceptions.ErrInvalidFormat(err, "patch")
+	}
+	return current, patched, nil
+}
+
+// patchTarget extracts ResourceType/id from a PATCH url. Conditional patches are not supported.
+func patchTarget(rawURL string) (string, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+	if u.RawQuery != "" {
+		return "", "", errors.New("conditional patch is not supported")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(strings.Trim(u.Path, "/"), "fhir/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("patch must address a single resource: %s", rawURL)
+	}
+	return parts[0], parts[1], nil
+}
+
+// versionIfMatch returns the If-Match value that makes an update fail when resource has been changed
+// since it was read, or "" when the server reported no version.
+func versionIfMatch(resource []byte) string {
+	if v := gjson.GetBytes(resource, "meta.versionId").String(); v != "" {
+		return `W/"` + v + `"`
+	}
+	return ""
+}
+
+// asPatchedUpdate turns a checked PATCH into an update with the patched resource, so the FHIR
+// server stores exactly what was checked and refuses it if the resource changed in between.
+func asPatchedUpdate(r *http.Request, current, patched []byte) *http.Request {
+	r = r.WithContext(context.WithValue(r.Context(), constvars.CONTEXT_RAW_BODY, patched))
+	r.Method = http.MethodPut
+	r.Body = io.NopCloser(bytes.NewReader(patched))
+	r.ContentLength = int64(len(patched))
+	r.Header = r.Header.Clone()
+	r.Header.Set(constvars.HeaderContentType, constvars.MIMEApplicationFHIRJSON)
+	if ifMatch := versionIfMatch(current); ifMatch != "" {
+		r.Header.Set(constvars.HeaderIfMatch, ifMatch)
+	}
+	return r
+}
+
+// checkPatch runs the ownership and body checks of a PATCH on the resource before and after it is
+// patched: the caller must own it now and still own it afterwards.
+func (m *Middlewares) checkPatch(ctx context.Context, rawURL string, roles []string, fhirRole, fhirID string, current, patched []byte) error {
+	if err := m.validatePostRequestBody(ctx, patched, fhirRole, fhirID); err != nil {
+		return err
+	}
+	for _, resource := range [][]byte{current, patched} {
+		if err := checkSingle(ctx, m.Enforcer, http.MethodPatch, rawURL, roles, fhirID, m.PatientFhirClient, m.PractitionerFhirClient, m.PractitionerRoleFhirClient, m.ScheduleFhirClient, m.QuestionnaireResponseFhirClient, resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyBundlePatches checks the PATCH entries of a batch or transaction Bundle and replaces each with
+// an update of the patched resource, like asPatchedUpdate. The patch is the entry's Parameters
+// resource (FHIRPath Patch) or a Binary holding a JSON Patch. Entries that are already denied are
+// left alone; the PATCH entries that cannot be applied or performed are added to the denials. The
+// Bundle is returned unchanged when it has no PATCH entries.
+func (m *Middlewares) applyBundlePatches(ctx context.Context, raw []byte, roles []string, fhirRole, fhirID string, denials []bundleEntryDenial) ([]byte, []bundleEntryDenial, error) {
+	if !slices.ContainsFunc(gjson.GetBytes(raw, "entry.#.request.method").Array(), func(v gjson.Result) bool {
+		return strings.EqualFold(v.String(), http.MethodPatch)
+	}) {
+		return raw, denials, nil
+	}
+
+	var bundle map[string]any
+	if err := json.Unmarshal(raw, &bundle); err != nil {
+		return nil, denials, exceptions.ErrCannotParseJSON(err)
+	}
+	entries, _ := bundle["entry"].([]any)
+	for i, e := range entries {
+		entry, _ := e.(map[string]any)
+		request, _ := entry["request"].(map[string]any)
+		if method, _ := request["method"].(string); !strings.EqualFold(method, http.MethodPatch) {
+			continue
+		}
+		if slices.ContainsFunc(denials, func(d bundleEntryDenial) bool { return d.index == i }) {
+			continue
+		}
+		entryURL, _ := request["url"].(string)
+
+		patch, contentType, err := bundleEntryPatch(entry["resource"])
+		if err != nil {
+			denials = append(denials, newBundleEntryDenial(i, exceptions.ErrInvalidFormat(err, "patch")))
+			continue
+		}
+		current, patched, err := m.patchedResource(ctx, entryURL, contentType, patch)
+		if err != nil {
+			denials = append(denials, newBundleEntryDenial(i, err))
+			continue
+		}
+		if err := m.checkPatch(ctx, entryURL, roles, fhirRole, fhirID, current, patched); err != nil {
+			denials = append(denials, newBundleEntryDenial(i, exceptions.ErrAuthInvalidRole(err)))
+			continue
+		}
+
+		entry["resource"] = json.RawMessage(patched)
+		request["method"] = http.MethodPut
+		if ifMatch := versionIfMatch(current); ifMatch != "" {
+			request["ifMatch"] = ifMatch
+		}
+	}
+
+	out, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, denials, exceptions.ErrCannotMarshalJSON(err)
+	}
+	return out, denials, nil
+}
+
+// bundleEntryPatch returns the patch carried by a Bundle PATCH entry and its content type.
+func bundleEntryPatch(resource any) ([]byte, string, error) {
+	res, _ := resource.(map[string]any)
+	switch res["resourceType"] {
+	case "Parameters":
+		raw, err := json.Marshal(res)
+		return raw, constvars.MIMEApplicationFHIRJSON, err
+	case "Binary":
+		data, _ := res["data"].(string)
+		raw, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, "", err
+		}
+		contentType, _ := res["contentType"].(string)
+		return raw, contentType, nil
+	}
+	return nil, "", errors.New("PATCH entries must carry a Parameters or Binary resource")
+}
@@ -0,0 +1,171 @@
+package middlewares
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"konsulin-service/internal/app/config"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/utils"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+)
+
+func TestApplyJSONPatch(t *testing.T) {
+	resource := []byte(`{"resourceType":"Patient","id":"p1","name":[{"family":"Doe"}],"gender":"female"}`)
+
+	patched, err := applyJSONPatch(resource, []byte(`[
+		{"op":"test","path":"/gender","value":"female"},
+		{"op":"replace","path":"/gender","value":"other"},
+		{"op":"add","path":"/name/-","value":{"family":"Roe"}},
+		{"op":"copy","from":"/name/0","path":"/name/0/previous"},
+		{"op":"move","from":"/name/1","path":"/name/0"},
+		{"op":"remove","path":"/name/1/previous"},
+		{"op":"add","path":"/birthDate","value":"1990-01-01"}
+	]`))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"resourceType":"Patient","id":"p1","name":[{"family":"Roe"},{"family":"Doe"}],"gender":"other","birthDate":"1990-01-01"}`, string(patched))
+
+	_, err = applyJSONPatch(resource, []byte(`[{"op":"test","path":"/gender","value":"male"}]`))
+	assert.Error(t, err)
+	_, err = applyJSONPatch(resource, []byte(`[{"op":"replace","path":"/telecom/0","value":{}}]`))
+	assert.Error(t, err)
+}
+
+func TestApplyFHIRPathPatch(t *testing.T) {
+	resource := []byte(`{"resourceType":"Patient","id":"p1","name":[{"given":["Ann","Bea"]}],"telecom":[{"value":"1"}]}`)
+	operation := func(parts string) string {
+		return `{"name":"operation","part":[` + parts + `]}`
+	}
+
+	patched, err := applyFHIRPathPatch(resource, []byte(`{"resourceType":"Parameters","parameter":[`+
+		operation(`{"name":"type","valueCode":"replace"},{"name":"path","valueString":"Patient.name.given[1]"},{"name":"value","valueString":"Cat"}`)+`,`+
+		operation(`{"name":"type","valueCode":"add"},{"name":"path","valueString":"Patient"},{"name":"name","valueString":"telecom"},
+			{"name":"value","part":[{"name":"system","valueCode":"email"},{"name":"value","valueString":"a@b.c"}]}`)+`,`+
+		operation(`{"name":"type","valueCode":"insert"},{"name":"path","valueString":"Patient.name.given"},{"name":"index","valueInteger":0},{"name":"value","valueString":"Dee"}`)+`,`+
+		operation(`{"name":"type","valueCode":"move"},{"name":"path","valueString":"Patient.telecom"},{"name":"source","valueInteger":1},{"name":"destination","valueInteger":0}`)+`,`+
+		operation(`{"name":"type","valueCode":"delete"},{"name":"path","valueString":"Patient.birthDate"}`)+
+		`]}`))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"resourceType":"Patient","id":"p1","name":[{"given":["Dee","Ann","Cat"]}],"telecom":[{"system":"email","value":"a@b.c"},{"value":"1"}]}`, string(patched))
+
+	_, err = applyFHIRPathPatch(resource, []byte(`{"resourceType":"Parameters","parameter":[`+
+		operation(`{"name":"type","valueCode":"delete"},{"name":"path","valueString":"Patient.telecom.where(value='1')"}`)+`]}`))
+	assert.Error(t, err, "FHIRPath functions are not supported")
+}
+
+func patchTestMiddlewares(t *testing.T, stored map[string]string) *Middlewares {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := stored[strings.TrimPrefix(r.URL.Path, "/fhir/")]
+		if !ok || r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(upstream.Close)
+
+	enforcer, err := casbin.NewEnforcer("../../../../../resources/rbac_model.conf", "../../../../../resources/rbac_policy.csv")
+	require.NoError(t, err)
+	enforcer.AddFunction("pathMatch", func(args ...interface{}) (interface{}, error) {
+		return utils.PathMatch(args[0].(string), args[1].(string)), nil
+	})
+
+	return &Middlewares{
+		Log:            zap.NewNop(),
+		InternalConfig: &config.InternalConfig{FHIR: config.AppFHIR{BaseUrl: upstream.URL + "/fhir/"}},
+		Enforcer:       enforcer,
+		HTTPClient:     upstream.Client(),
+	}
+}
+
+func TestCheckPatch_Ownership(t *testing.T) {
+	m := patchTestMiddlewares(t, map[string]string{
+		"Observation/o1": `{"resourceType":"Observation","id":"o1","meta":{"versionId":"3"},"status":"preliminary","subject":{"reference":"Patient/p1"}}`,
+		"Observation/o2": `{"resourceType":"Observation","id":"o2","status":"preliminary","subject":{"reference":"Patient/p2"}}`,
+	})
+	roles := []string{constvars.KonsulinRolePatient}
+
+	patch := func(id, ops string) error {
+		current, patched, err := m.patchedResource(context.Background(), "/fhir/Observation/"+id, constvars.MIMEApplicationJSONPatch, []byte(ops))
+		require.NoError(t, err)
+		return m.checkPatch(context.Background(), "/fhir/Observation/"+id, roles, constvars.KonsulinRolePatient, "p1", current, patched)
+	}
+
+	assert.NoError(t, patch("o1", `[{"op":"replace","path":"/status","value":"final"}]`))
+	assert.Error(t, patch("o1", `[{"op":"replace","path":"/subject/reference","value":"Patient/p2"}]`), "the patched resource must still be owned")
+	assert.Error(t, patch("o2", `[{"op":"replace","path":"/subject/reference","value":"Patient/p1"}]`), "the resource must be owned before it is patched")
+
+	_, _, err := m.patchedResource(context.Background(), "/fhir/Observation/o9", constvars.MIMEApplicationJSONPatch, []byte(`[]`))
+	assert.Error(t, err)
+	_, _, err = m.patchedResource(context.Background(), "/fhir/Observation?subject=Patient/p1", constvars.MIMEApplicationJSONPatch, []byte(`[]`))
+	assert.Error(t, err, "conditional patch is not supported")
+}
+
+func TestAuth_PatchForwardedAsVersionedUpdate(t *testing.T) {
+	m := patchTestMiddlewares(t, map[string]string{
+		"Condition/c1": `{"resourceType":"Condition","id":"c1","meta":{"versionId":"3"},"clinicalStatus":{"text":"active"}}`,
+	})
+
+	var forwarded *http.Request
+	var body []byte
+	handler := m.Auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+		body, _ = r.Context().Value(constvars.CONTEXT_RAW_BODY).([]byte)
+	}))
+
+	req := httptest.NewRequest(http.MethodPatch, "/fhir/Condition/c1", strings.NewReader(`[{"op":"replace","path":"/clinicalStatus/text","value":"resolved"}]`))
+	req.Header.Set(constvars.HeaderContentType, constvars.MIMEApplicationJSONPatch)
+	ctx := context.WithValue(req.Context(), keyRoles, []string{constvars.KonsulinRoleSuperadmin})
+	ctx = context.WithValue(ctx, keyUID, "api-key-superadmin")
+	handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+
+	require.NotNil(t, forwarded)
+	assert.Equal(t, http.MethodPut, forwarded.Method)
+	assert.Equal(t, `W/"3"`, forwarded.Header.Get(constvars.HeaderIfMatch))
+	assert.Equal(t, constvars.MIMEApplicationFHIRJSON, forwarded.Header.Get(constvars.HeaderContentType))
+	assert.Equal(t, "resolved", gjson.GetBytes(body, "clinicalStatus.text").String())
+	sent, _ := io.ReadAll(forwarded.Body)
+	assert.Equal(t, body, sent)
+}
+
+func TestApplyBundlePatches(t *testing.T) {
+	m := patchTestMiddlewares(t, map[string]string{
+		"Observation/o1": `{"resourceType":"Observation","id":"o1","meta":{"versionId":"7"},"status":"preliminary","subject":{"reference":"Patient/p1"}}`,
+	})
+	jsonPatch := base64.StdEncoding.EncodeToString([]byte(`[{"op":"replace","path":"/status","value":"final"}]`))
+	bundle := []byte(`{"resourceType":"Bundle","type":"transaction","entry":[
+		{"request":{"method":"POST","url":"Observation"},"resource":{"resourceType":"Observation","status":"final","subject":{"reference":"Patient/p1"}}},
+		{"request":{"method":"PATCH","url":"Observation/o1"},"resource":{"resourceType":"Binary","contentType":"application/json-patch+json","data":"` + jsonPatch + `"}}
+	]}`)
+
+	out, denials, err := m.applyBundlePatches(context.Background(), bundle, []string{constvars.KonsulinRolePatient}, constvars.KonsulinRolePatient, "p1", nil)
+	require.NoError(t, err)
+	assert.Empty(t, denials)
+	assert.Equal(t, "POST", gjson.GetBytes(out, "entry.0.request.method").String())
+	assert.Equal(t, "PUT", gjson.GetBytes(out, "entry.1.request.method").String())
+	assert.Equal(t, `W/"7"`, gjson.GetBytes(out, "entry.1.request.ifMatch").String())
+	assert.Equal(t, "final", gjson.GetBytes(out, "entry.1.resource.status").String())
+
+	_, denials, err = m.applyBundlePatches(context.Background(), bundle, []string{constvars.KonsulinRolePatient}, constvars.KonsulinRolePatient, "p2", nil)
+	require.NoError(t, err)
+	require.Len(t, denials, 1, "another patient cannot patch the Observation")
+	assert.Equal(t, 1, denials[0].index)
+	assert.Equal(t, http.StatusForbidden, denials[0].status)
+
+	unchanged := []byte(`{"resourceType":"Bundle","type":"batch","entry":[{"request":{"method":"GET","url":"Observation/o1"}}]}`)
+	out, denials, err = m.applyBundlePatches(context.Background(), unchanged, nil, "", "", nil)
+	require.NoError(t, err)
+	assert.Empty(t, denials)
+	assert.Equal(t, unchanged, out)
+}
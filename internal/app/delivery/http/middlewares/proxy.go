@@ -13,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"konsulin-service/internal/app/services/shared/deidentify"
 	"konsulin-service/internal/pkg/constvars"
 	"konsulin-service/internal/pkg/exceptions"
 	"konsulin-service/internal/pkg/utils"
@@ -145,6 +146,47 @@ func (m *Middlewares) Bridge(target string) http.Handler {
 			path = ""
 		}
 
+		scope := m.newResponseFilterScope(r)
+
+		if scope.audit != nil {
+			rec := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+			w = rec
+			auditedRequest := r
+			defer func() {
+				if p := recover(); p != nil {
+					// an aborted stream never reached the client intact
+					m.finishProxyAudit(scope.audit, auditedRequest, path, http.StatusInternalServerError)
+					panic(p)
+				}
+				m.finishProxyAudit(scope.audit, auditedRequest, path, rec.statusCode)
+			}()
+		}
+
+		bodyBytes, _ := r.Context().Value(constvars.CONTEXT_RAW_BODY).([]byte)
+		if bodyBytes == nil {
+			bodyBytes = []byte{}
+		}
+
+		if violation := m.SearchPolicy.checkRequest(r, path, bodyBytes); violation != nil {
+			m.Log.Info("Search policy rejected request", zap.String("url", r.URL.RequestURI()), zap.String("diagnostics", violation.Diagnostics))
+			m.writeOperationOutcome(w, violation.StatusCode, violation.outcome())
+			return
+		}
+
+		if len(m.PreFHIRProxyHooks) > 0 {
+			var hookErr error
+			r, bodyBytes, hookErr = m.runPreFHIRProxyHooks(r, bodyBytes)
+			if hookErr != nil {
+				m.writePreFHIRProxyHookError(w, hookErr)
+				return
+			}
+		}
+
+		if patientID, ok := everythingPatientID(r.Method, path); ok {
+			m.serveEverything(w, r, client, target, patientID, bodyBytes, scope)
+			return
+		}
+
 		fullURL := target
 		if path != "" {
 			if !strings.HasSuffix(target, "/") && !strings.HasPrefix(path, "/") {
@@ -156,9 +198,17 @@ func (m *Middlewares) Bridge(target string) http.Handler {
 			fullURL += "?" + r.URL.RawQuery
 		}
 
-		bodyBytes, _ := r.Context().Value(constvars.CONTEXT_RAW_BODY).([]byte)
-		if bodyBytes == nil {
-			bodyBytes = []byte{}
+		if count, ok := m.pageFillCount(r, path, scope); ok {
+			m.servePageFilledSearch(w, r, client, target, path, count, bodyBytes, scope)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			resourceType := utils.ExtractResourceTypeFromPath(path)
+			if ttl, ok := m.responseCacheTTL(resourceType); ok {
+				m.serveCachedRead(w, r, client, fullURL, resourceType, ttl, bodyBytes, scope)
+				return
+			}
 		}
 
 		req, err := http.NewRequestWithContext(r.Context(), r.Method, fullURL, bytes.NewReader(bodyBytes))
@@ -187,8 +237,19 @@ func (m *Middlewares) Bridge(target string) http.Handler {
 				return
 			}
 
-			fhirErr := exceptions.BuildNewCustomError(fmt.Errorf("%s", string(body)), resp.StatusCode, string(body), constvars.ErrDevServerProcess)
-			utils.BuildErrorResponse(m.Log, w, fhirErr)
+			utils.BuildErrorResponse(m.Log, w, upstreamFHIRError(resp.StatusCode, body))
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			m.invalidateResponseCache(r.Context(), path, bodyBytes)
+		}
+
+		// Read responses are the only ones large enough to matter, so Bundles among them are
+		// streamed. Post-FHIR-proxy hooks that run for reads need the whole body, so they keep
+		// reads buffered.
+		if r.Method == http.MethodGet && !m.hasPostFHIRProxyHooksFor(r.Method) {
+			m.serveReadResponse(w, r, resp, bodyBytes, scope)
 			return
 		}
 
@@ -198,176 +259,334 @@ func (m *Middlewares) Bridge(target string) http.Handler {
 			return
 		}
 
-		// Post-FHIR-proxy hooks: run synchronously after successful response, before filtering.
-		// Collect all hook error messages so we can expose them in a single response header (capped).
-		var postHookErrMsgs []string
-		for _, hook := range m.PostFHIRProxyHooks {
-			reqDetail := PostFHIRProxyUserRequestDetail{
-				Context: r.Context(),
-				Method:  r.Method,
-				Path:    r.URL.Path,
-				Body:    bodyBytes,
-			}
-			respDetail := PostFHIRProxyFHIRServerResponse{
-				StatusCode: resp.StatusCode,
-				Body:       respBody,
-			}
-			if err := hook(reqDetail, respDetail); err != nil {
-				m.Log.Warn("PostFHIRProxyHook error", zap.Error(err))
-				postHookErrMsgs = append(postHookErrMsgs, err.Error())
-			}
-		}
+		m.serveBufferedResponse(w, r, resp, respBody, bodyBytes, scope)
+	})
+}
+
+// responseFilterScope captures who the caller is and which response filters apply to them.
+type responseFilterScope struct {
+	roles          []string
+	fhirRole       string
+	fhirID         string
+	needsRBAC      bool
+	needsOwnership bool
+	// batch is set for batch and transaction requests, whose response entries are filtered one by one.
+	batch bool
+	// redactor is nil when no field redaction applies to the caller.
+	redactor *fieldRedactor
+	// deid is nil unless the caller only receives de-identified data.
+	deid *deidentify.Engine
+	// audit collects the resources returned to the caller; nil when the audit trail is disabled.
+	audit *proxyAudit
+}
 
-		roles, _ := r.Context().Value(keyRoles).([]string)
-		fhirRole, _ := r.Context().Value(keyFHIRRole).(string)
-		fhirID, _ := r.Context().Value(keyFHIRID).(string)
+func (m *Middlewares) newResponseFilterScope(r *http.Request) responseFilterScope {
+	roles, _ := r.Context().Value(keyRoles).([]string)
+	fhirRole, _ := r.Context().Value(keyFHIRRole).(string)
+	fhirID, _ := r.Context().Value(keyFHIRID).(string)
+	batch := isBatchEndpoint(r)
 
-		originalBody := respBody
-		bodyForFilters := respBody
-		encForFilters := bodyEncodingIdentity
+	redactor := m.Redactions.forCaller(roles, fhirRole, fhirID)
+	if redactor != nil && fhirRole == constvars.KonsulinRolePractitioner && fhirID != "" && m.PractitionerRoleFhirClient != nil && redactor.exceptsSameOrganization() {
+		redactor.sameOrganization = m.organizationMembers(r.Context(), fhirID)
+	}
 
-		filteringRole := determineFilteringRole(roles)
-		needsRBAC := filteringRole != ""
-		needsOwnership := r.Method == http.MethodGet && fhirID != ""
+	return responseFilterScope{
+		roles:          roles,
+		fhirRole:       fhirRole,
+		fhirID:         fhirID,
+		needsRBAC:      determineFilteringRole(roles) != "",
+		needsOwnership: (r.Method == http.MethodGet || batch) && fhirID != "",
+		batch:          batch,
+		redactor:       redactor,
+		deid:           m.deidentifierFor(roles),
+		audit:          m.startProxyAudit(),
+	}
+}
 
-		if needsRBAC || needsOwnership {
-			decoded, enc, derr := decodeBodyForFiltering(respBody, resp.Header.Get("Content-Encoding"))
-			if derr != nil {
-				m.Log.Warn("failed to decode response body for filtering; failing closed", zap.Error(derr))
-				utils.BuildErrorResponse(m.Log, w, exceptions.ErrServerProcess(derr))
-				return
-			}
+func (s responseFilterScope) filtersBody() bool {
+	return s.needsRBAC || s.needsOwnership || s.batch || s.redactor != nil || s.deid != nil
+}
+
+// serveBufferedResponse filters a fully read upstream response body and writes it to the client.
+func (m *Middlewares) serveBufferedResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, respBody, reqBody []byte, scope responseFilterScope) {
+	postHookErrMsgs := m.runPostFHIRProxyHooks(r, reqBody, resp.StatusCode, respBody)
+
+	originalBody := respBody
+	bodyForFilters := respBody
+	encForFilters := bodyEncodingIdentity
+	links := m.newBundleLinkRewriter()
+	decodedOK := false
+
+	if scope.filtersBody() || links != nil || scope.audit != nil {
+		decoded, enc, derr := decodeBodyForFiltering(respBody, resp.Header.Get("Content-Encoding"))
+		if derr != nil && scope.filtersBody() {
+			m.Log.Warn("failed to decode response body for filtering; failing closed", zap.Error(derr))
+			utils.BuildErrorResponse(m.Log, w, exceptions.ErrServerProcess(derr))
+			return
+		}
+		if derr == nil {
 			bodyForFilters = decoded
 			encForFilters = enc
+			decodedOK = true
 		}
+	}
 
-		bodyAfterRBAC := bodyForFilters
-		filteredRBAC := false
-		removedRBAC := 0
+	filteredBody, mutated, ferr := m.applyResponseFilters(r, bodyForFilters, scope)
+	if ferr != nil {
+		utils.BuildErrorResponse(m.Log, w, ferr)
+		return
+	}
 
-		if needsRBAC {
-			switch filteringRole {
-			case constvars.KonsulinRoleSuperadmin:
-				b, removed, err := m.filterResponseResourceAgainstRBAC(bodyAfterRBAC, roles)
-				if err != nil {
-					m.Log.Warn("RBAC response filtering failed; failing closed", zap.Error(err))
-					utils.BuildErrorResponse(m.Log, w, exceptions.ErrServerProcess(err))
-					return
-				}
+	if decodedOK {
+		rewritten, changed, lerr := links.rewriteBody(filteredBody)
+		if lerr != nil {
+			m.Log.Warn("failed to rewrite bundle links", zap.Error(lerr))
+			utils.BuildErrorResponse(m.Log, w, exceptions.ErrServerProcess(lerr))
+			return
+		}
+		filteredBody = rewritten
+		mutated = mutated || changed
+		scope.audit.recordBody(filteredBody)
+	}
 
-				bodyAfterRBAC = b
-				removedRBAC = removed
-				if removed > 0 {
-					filteredRBAC = true
-				}
-			default:
-				// other roles: no RBAC response filtering
-			}
+	finalBody := originalBody
+	if mutated {
+		encoded, eerr := encodeBodyFromFiltering(filteredBody, encForFilters)
+		if eerr != nil {
+			m.Log.Warn("failed to encode filtered response body; failing closed", zap.Error(eerr))
+			utils.BuildErrorResponse(m.Log, w, exceptions.ErrServerProcess(eerr))
+			return
 		}
+		finalBody = encoded
+	}
 
-		// Ownership-based filtering
-		bodyAfterOwnership := bodyAfterRBAC
-		filteredOwnership := false
-		removedOwnership := 0
+	copyProxyResponseHeaders(w, resp)
 
-		if needsOwnership {
-			if bundle, isBundle, _ := decodeBundle(bodyAfterRBAC); isBundle {
-				removedOwnership = m.applyOwnershipFilterToBundle(r.Context(), bundle, roles, fhirRole, fhirID)
-				if removedOwnership > 0 {
-					filteredOwnership = true
+	if mutated {
+		w.Header().Del("ETag")
+	}
 
-					if bundle.Total != nil {
-						v := len(bundle.Entry)
-						bundle.Total = &v
-					}
+	setPostFHIRHookErrorHeader(w, postHookErrMsgs)
 
-					fb, eerr := encodeBundle(bundle)
-					if eerr != nil {
-						m.Log.Warn("encodeBundle after ownership filtering failed; failing closed", zap.Error(eerr))
-						utils.BuildErrorResponse(m.Log, w, exceptions.ErrServerProcess(eerr))
-						return
-					}
+	w.Header().Set("Content-Length", strconv.Itoa(len(finalBody)))
+	w.WriteHeader(resp.StatusCode)
+	if _, err := w.Write(finalBody); err != nil {
+		m.Log.Warn("failed writing response body", zap.Error(err))
+	}
+}
 
-					bodyAfterOwnership = fb
-				}
-			} else {
-				filteredBody, allowed, ferr := m.filterSingleResourceByOwnership(r.Context(), bodyAfterRBAC, roles, fhirRole, fhirID)
-				if ferr != nil {
-					m.Log.Info(fmt.Sprintf("single-resource ownership filtering failed for {%s/%s}; failing closed", fhirRole, fhirID), zap.Error(ferr))
-					utils.BuildErrorResponse(m.Log, w, exceptions.ErrServerProcess(ferr))
-					return
-				}
+// runPreFHIRProxyHooks runs the registered Pre-FHIR-proxy hooks in order and returns the request and
+// body to forward. The first hook error stops the chain and rejects the request. Hooks that change
+// the headers or query get a copy of the request, never the caller's.
+func (m *Middlewares) runPreFHIRProxyHooks(r *http.Request, body []byte) (*http.Request, []byte, error) {
+	preq := &PreFHIRProxyRequest{
+		Context: r.Context(),
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		Query:   r.URL.Query(),
+		Header:  r.Header.Clone(),
+		Body:    body,
+	}
+	for _, hook := range m.PreFHIRProxyHooks {
+		if err := hook(preq); err != nil {
+			return r, body, err
+		}
+	}
 
-				if !allowed {
-					// Deny access when ownership cannot be proven.
-					utils.BuildErrorResponse(m.Log, w, exceptions.ErrAuthInvalidRole(fmt.Errorf("forbidden: ownership cannot be proven")))
-					return
-				}
+	r = r.Clone(r.Context())
+	r.Header = preq.Header
+	if encoded := preq.Query.Encode(); encoded != r.URL.Query().Encode() {
+		r.URL.RawQuery = encoded
+	}
+	return r, preq.Body, nil
+}
 
-				if filteredBody != nil {
-					bodyAfterOwnership = filteredBody
-				}
-			}
+// writePreFHIRProxyHookError answers a request rejected by a Pre-FHIR-proxy hook with an
+// OperationOutcome. Errors that are not a *PreFHIRProxyHookError are treated as hook failures.
+func (m *Middlewares) writePreFHIRProxyHookError(w http.ResponseWriter, err error) {
+	var hookErr *PreFHIRProxyHookError
+	if !errors.As(err, &hookErr) {
+		m.Log.Error("PreFHIRProxyHook failed", zap.Error(err))
+		hookErr = NewPreFHIRProxyHookError(http.StatusInternalServerError, "exception", "request could not be processed")
+	} else {
+		m.Log.Info("PreFHIRProxyHook rejected request", zap.Int("status", hookErr.StatusCode), zap.String("diagnostics", hookErr.Diagnostics))
+	}
+
+	m.writeOperationOutcome(w, hookErr.StatusCode, hookErr.outcome())
+}
+
+// runPostFHIRProxyHooks runs the registered Post-FHIR-proxy hooks synchronously after a successful
+// response, before filtering, and collects all hook error messages so they can be exposed in a single
+// response header.
+func (m *Middlewares) runPostFHIRProxyHooks(r *http.Request, reqBody []byte, statusCode int, respBody []byte) []string {
+	var postHookErrMsgs []string
+	for _, hook := range m.PostFHIRProxyHooks {
+		if !hook.appliesTo(r.Method) {
+			continue
+		}
+		reqDetail := PostFHIRProxyUserRequestDetail{
+			Context: r.Context(),
+			Method:  r.Method,
+			Path:    r.URL.Path,
+			Body:    reqBody,
+		}
+		respDetail := PostFHIRProxyFHIRServerResponse{
+			StatusCode: statusCode,
+			Body:       respBody,
+		}
+		if err := hook.Run(reqDetail, respDetail); err != nil {
+			m.Log.Warn("PostFHIRProxyHook error", zap.Error(err))
+			postHookErrMsgs = append(postHookErrMsgs, err.Error())
 		}
+	}
+	return postHookErrMsgs
+}
 
-		if filteredRBAC && removedRBAC > 0 {
-			m.Log.Info("RBAC filtered response entries",
-				zap.Int("removed", removedRBAC),
-				zap.String("method", r.Method),
-				zap.String("url", r.URL.RequestURI()),
-				zap.Strings("roles", roles),
-			)
-		}
-		if filteredOwnership && removedOwnership > 0 {
-			m.Log.Info("Ownership filtered response entries",
-				zap.Int("removed", removedOwnership),
-				zap.String("method", r.Method),
-				zap.String("url", r.URL.RequestURI()),
-				zap.String("fhirRole", fhirRole),
-				zap.String("fhirID", fhirID),
-			)
-		}
-
-		mutated := filteredRBAC || filteredOwnership
-
-		finalBody := originalBody
-		if mutated {
-			encoded, eerr := encodeBodyFromFiltering(bodyAfterOwnership, encForFilters)
-			if eerr != nil {
-				m.Log.Warn("failed to encode filtered response body; failing closed", zap.Error(eerr))
-				utils.BuildErrorResponse(m.Log, w, exceptions.ErrServerProcess(eerr))
-				return
-			}
-			finalBody = encoded
+// hasPostFHIRProxyHooksFor reports whether any post-FHIR-proxy hook runs for the method.
+func (m *Middlewares) hasPostFHIRProxyHooksFor(method string) bool {
+	for _, hook := range m.PostFHIRProxyHooks {
+		if hook.appliesTo(method) {
+			return true
 		}
+	}
+	return false
+}
 
-		for k, v := range resp.Header {
+// setPostFHIRHookErrorHeader sets headerPostFHIRHookError to all error messages joined with "; ",
+// capped to maxPostFHIRHookErrorHeaderLen.
+func setPostFHIRHookErrorHeader(w http.ResponseWriter, postHookErrMsgs []string) {
+	if len(postHookErrMsgs) == 0 {
+		return
+	}
+	joined := strings.Join(postHookErrMsgs, "; ")
+	if len(joined) > maxPostFHIRHookErrorHeaderLen {
+		joined = joined[:maxPostFHIRHookErrorHeaderLen-3] + "..."
+	}
+	w.Header().Set(headerPostFHIRHookError, joined)
+}
 
-			if strings.EqualFold(k, "Content-Length") {
-				continue
-			}
-			w.Header()[k] = v
+// copyProxyResponseHeaders copies the upstream response headers except Content-Length,
+// which the caller sets (or omits) according to the body it actually writes.
+func copyProxyResponseHeaders(w http.ResponseWriter, resp *http.Response) {
+	for k, v := range resp.Header {
+		if strings.EqualFold(k, "Content-Length") {
+			continue
 		}
+		w.Header()[k] = v
+	}
+}
+
+// applyResponseFilters runs RBAC and ownership filtering over an uncompressed response body.
+// It returns the body to send, whether it differs from the input, and an error that is ready
+// to be passed to utils.BuildErrorResponse.
+func (m *Middlewares) applyResponseFilters(r *http.Request, body []byte, scope responseFilterScope) ([]byte, bool, error) {
+	roles, fhirRole, fhirID := scope.roles, scope.fhirRole, scope.fhirID
 
-		if mutated {
-			w.Header().Del("ETag")
+	if scope.batch {
+		filtered, mutated, ok, err := m.filterBatchResponse(r.Context(), body, scope)
+		if err != nil {
+			m.Log.Warn("batch response filtering failed; failing closed", zap.Error(err))
+			return nil, false, exceptions.ErrServerProcess(err)
 		}
+		if ok {
+			return m.redactResponse(filtered, mutated, scope)
+		}
+	}
+
+	bodyAfterRBAC := body
+	removedRBAC := 0
+
+	if scope.needsRBAC {
+		b, removed, err := m.filterResponseResourceAgainstRBAC(bodyAfterRBAC, roles)
+		if err != nil {
+			m.Log.Warn("RBAC response filtering failed; failing closed", zap.Error(err))
+			return nil, false, exceptions.ErrServerProcess(err)
+		}
+		bodyAfterRBAC = b
+		removedRBAC = removed
+	}
+
+	// Ownership-based filtering
+	bodyAfterOwnership := bodyAfterRBAC
+	removedOwnership := 0
+
+	if scope.needsOwnership {
+		if bundle, isBundle, _ := decodeBundle(bodyAfterRBAC); isBundle {
+			removedOwnership = m.applyOwnershipFilterToBundle(r.Context(), bundle, roles, fhirRole, fhirID)
+			if removedOwnership > 0 {
+				if bundle.Total != nil {
+					v := len(bundle.Entry)
+					bundle.Total = &v
+				}
+
+				fb, eerr := encodeBundle(bundle)
+				if eerr != nil {
+					m.Log.Warn("encodeBundle after ownership filtering failed; failing closed", zap.Error(eerr))
+					return nil, false, exceptions.ErrServerProcess(eerr)
+				}
 
-		// Value is all error messages joined with "; ", capped to maxPostFHIRHookErrorHeaderLen.
-		if len(postHookErrMsgs) > 0 {
-			joined := strings.Join(postHookErrMsgs, "; ")
-			if len(joined) > maxPostFHIRHookErrorHeaderLen {
-				joined = joined[:maxPostFHIRHookErrorHeaderLen-3] + "..."
+				bodyAfterOwnership = fb
+			}
+		} else {
+			filteredBody, allowed, ferr := m.filterSingleResourceByOwnership(r.Context(), bodyAfterRBAC, roles, fhirRole, fhirID)
+			if ferr != nil {
+				m.Log.Info(fmt.Sprintf("single-resource ownership filtering failed for {%s/%s}; failing closed", fhirRole, fhirID), zap.Error(ferr))
+				return nil, false, exceptions.ErrServerProcess(ferr)
+			}
+
+			if !allowed {
+				// Deny access when ownership cannot be proven.
+				return nil, false, exceptions.ErrAuthInvalidRole(fmt.Errorf("forbidden: ownership cannot be proven"))
+			}
+
+			if filteredBody != nil {
+				bodyAfterOwnership = filteredBody
 			}
-			w.Header().Set(headerPostFHIRHookError, joined)
 		}
+	}
 
-		w.Header().Set("Content-Length", strconv.Itoa(len(finalBody)))
-		w.WriteHeader(resp.StatusCode)
-		if _, err := w.Write(finalBody); err != nil {
-			m.Log.Warn("failed writing response body", zap.Error(err))
+	m.logFilteredEntries(r, scope, removedRBAC, removedOwnership)
+
+	return m.redactResponse(bodyAfterOwnership, removedRBAC > 0 || removedOwnership > 0, scope)
+}
+
+// redactResponse applies the caller's field redactions and de-identification to a filtered
+// response body.
+func (m *Middlewares) redactResponse(body []byte, mutated bool, scope responseFilterScope) ([]byte, bool, error) {
+	if scope.redactor != nil {
+		redacted, changed, err := scope.redactor.redactBody(body)
+		if err != nil {
+			m.Log.Warn("field redaction failed; failing closed", zap.Error(err))
+			return nil, false, exceptions.ErrServerProcess(err)
 		}
-	})
+		body, mutated = redacted, mutated || changed
+	}
+	if scope.deid != nil {
+		return m.deidentifyResponse(body, scope)
+	}
+	return body, mutated, nil
+}
+
+// logFilteredEntries records how many response entries were removed by each filter.
+func (m *Middlewares) logFilteredEntries(r *http.Request, scope responseFilterScope, removedRBAC, removedOwnership int) {
+	if removedRBAC > 0 {
+		m.Log.Info("RBAC filtered response entries",
+			zap.Int("removed", removedRBAC),
+			zap.String("method", r.Method),
+			zap.String("url", r.URL.RequestURI()),
+			zap.Strings("roles", scope.roles),
+		)
+	}
+	if removedOwnership > 0 {
+		m.Log.Info("Ownership filtered response entries",
+			zap.Int("removed", removedOwnership),
+			zap.String("method", r.Method),
+			zap.String("url", r.URL.RequestURI()),
+			zap.String("fhirRole", scope.fhirRole),
+			zap.String("fhirID", scope.fhirID),
+		)
+	}
 }
 
 func determineFilteringRole(roles []string) string {
@@ -406,8 +625,10 @@ func (m *Middlewares) filterResponseResourceAgainstRBAC(body []byte, roles []str
 
 	type entry struct {
 		FullURL  string          `json:"fullUrl,omitempty"`
-		Resource json.RawMessage `json:"resource"`
+		Resource json.RawMessage `json:"resource,omitempty"`
 		Search   map[string]any  `json:"search,omitempty"`
+		Request  json.RawMessage `json:"request,omitempty"`
+		Response json.RawMessage `json:"response,omitempty"`
 	}
 	var bundle struct {
 		ResourceType string  `json:"resourceType"`
@@ -425,27 +646,7 @@ func (m *Middlewares) filterResponseResourceAgainstRBAC(body []byte, roles []str
 	removed := 0
 	filtered := make([]entry, 0, len(bundle.Entry))
 	for _, e := range bundle.Entry {
-		var resEnv struct {
-			ResourceType string `json:"resourceType"`
-		}
-		if err := json.Unmarshal(e.Resource, &resEnv); err != nil {
-			filtered = append(filtered, e)
-			continue
-		}
-		if resEnv.ResourceType == "" {
-			filtered = append(filtered, e)
-			continue
-		}
-
-		allowedForAnyRole := false
-		for _, role := range roles {
-
-			if allowed(m.Enforcer, role, http.MethodGet, "/fhir/"+resEnv.ResourceType) {
-				allowedForAnyRole = true
-				break
-			}
-		}
-		if allowedForAnyRole {
+		if m.entryAllowedByRBAC(e.Resource, roles) {
 			filtered = append(filtered, e)
 		} else {
 			removed++
@@ -466,11 +667,35 @@ func (m *Middlewares) filterResponseResourceAgainstRBAC(body []byte, roles []str
 	return filteredJSON, removed, nil
 }
 
+// entryAllowedByRBAC reports whether any of roles may read the resource type of a bundle entry.
+// Entries whose resource cannot be inspected are kept.
+func (m *Middlewares) entryAllowedByRBAC(resource json.RawMessage, roles []string) bool {
+	var resEnv struct {
+		ResourceType string `json:"resourceType"`
+	}
+	if err := json.Unmarshal(resource, &resEnv); err != nil {
+		return true
+	}
+	if resEnv.ResourceType == "" {
+		return true
+	}
+
+	for _, role := range roles {
+		if allowed(m.Enforcer, role, http.MethodGet, "/fhir/"+resEnv.ResourceType) {
+			return true
+		}
+	}
+	return false
+}
+
 // BundleEntry and Bundle represent a minimal FHIR Bundle envelope for filtering.
 type BundleEntry struct {
 	FullURL  string          `json:"fullUrl,omitempty"`
-	Resource json.RawMessage `json:"resource"`
+	Resource json.RawMessage `json:"resource,omitempty"`
 	Search   map[string]any  `json:"search,omitempty"`
+	// Request and Response are set on the entries of a history Bundle.
+	Request  json.RawMessage `json:"request,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
 }
 
 type Bundle struct {
@@ -521,6 +746,10 @@ type ownershipContext struct {
 	PatientIDs          map[string]struct{}
 	PractitionerIDs     map[string]struct{}
 	PractitionerRoleIDs []string
+	// Consents is set for practitioner callers when Consent checks are available.
+	Consents *consentGrants
+	// CareTeamPatients holds the IDs of patients whose active CareTeam includes the caller.
+	CareTeamPatients map[string]struct{}
 }
 
 // buildOwnershipContext resolves owned Patient / Practitioner IDs once per request.
@@ -568,62 +797,41 @@ func (m *Middlewares) buildOwnershipContext(
 			}
 		}
 
+		// consents may be granted to the practitioner or to an organization they work for
+		consentActors := []string{constvars.ResourcePractitioner + "/" + fhirID}
+
 		practitionerRoles, err := m.PractitionerRoleFhirClient.FindPractitionerRoleByPractitionerID(ctx, fhirID)
 		if err != nil {
 			m.Log.Warn("failed to find practitioner roles by practitioner ID. skipping practitioner role population", zap.String("practitionerID", fhirID), zap.Error(err))
-			return oc
 		}
 
 		for _, pr := range practitionerRoles {
 			if pr.ID != "" {
 				oc.PractitionerRoleIDs = append(oc.PractitionerRoleIDs, pr.ID)
 			}
-		}
-	}
-
-	return oc
-}
-
-// ownershipChecker is a resource-specific, last-resort ownership function.
-type ownershipChecker func(raw json.RawMessage, oc *ownershipContext) (bool, error)
-
-// resourceSpecificOwnershipCheckers holds resource-specific ownership logic.
-// add your own custom ownership checkers here if needed
-var resourceSpecificOwnershipCheckers = map[string]ownershipChecker{
-	constvars.ResourceInvoice: func(raw json.RawMessage, oc *ownershipContext) (bool, error) {
-		// Invoice is public only if ALL references point to whitelisted resource types.
-		publicResourceIfOwnedByTheseActors := map[string]struct{}{
-			constvars.ResourcePractitioner:     {},
-			constvars.ResourcePractitionerRole: {},
-			constvars.ResourceDevice:           {},
+			if org := pr.Organization.Reference; strings.HasPrefix(org, constvars.ResourceOrganization+"/") && !slices.Contains(consentActors, org) {
+				consentActors = append(consentActors, org)
+			}
 		}
 
-		var resMap map[string]any
-		if err := json.Unmarshal(raw, &resMap); err != nil {
-			return false, err
+		if m.ConsentFhirClient != nil && fhirRole == constvars.KonsulinRolePractitioner {
+			oc.Consents = newConsentGrants(ctx, m.ConsentFhirClient, m.Log, consentActors)
 		}
+	}
 
-		var refs []string
-		collectReferences(resMap, &refs, 0)
-		if len(refs) == 0 {
-			return false, nil
+	if m.CareTeamFhirClient != nil && fhirRole == constvars.KonsulinRolePractitioner && fhirID != "" {
+		members := []string{constvars.ResourcePractitioner + "/" + fhirID}
+		for _, id := range oc.PractitionerRoleIDs {
+			members = append(members, constvars.ResourcePractitionerRole+"/"+id)
 		}
-
-		for _, ref := range refs {
-			parts := strings.SplitN(ref, "/", 2)
-			if len(parts) == 0 {
-				return false, nil
-			}
-
-			if _, ok := publicResourceIfOwnedByTheseActors[parts[0]]; !ok {
-				// Found a non-whitelisted reference
-				return false, nil
-			}
+		patients, err := careTeamPatients(ctx, m.CareTeamFhirClient, members, time.Now())
+		if err != nil {
+			m.Log.Warn("failed to find care teams of practitioner. skipping care team access", zap.String("practitionerID", fhirID), zap.Error(err))
 		}
+		oc.CareTeamPatients = patients
+	}
 
-		// All references are whitelisted means the invoice is public.
-		return true, nil
-	},
+	return oc
 }
 
 // resourceOwnedByContext centralizes ownership checks for a single FHIR resource.
@@ -644,6 +852,22 @@ func (m *Middlewares) resourceOwnedByContext(
 		return true
 	}
 
+	// A patient's Consent lets a practitioner see that patient's records. When consent is required,
+	// none of the rules below can expose another patient's records without it.
+	switch consentFor(raw, resourceType, id, oc) {
+	case consentGranted:
+		return true
+	case consentMissing:
+		if m.consentRequired() {
+			return false
+		}
+	}
+
+	// Members of a patient's active CareTeam can read the patient's records.
+	if careTeamCovers(raw, resourceType, id, oc.CareTeamPatients) {
+		return true
+	}
+
 	// If a resource requires *only* patient or *only* practitioner ownership,
 	// and we lack the corresponding IDs/roles, we can't prove ownership.
 	if requiresPatient && !requiresPract && len(oc.PatientIDs) == 0 && !oc.HasPatientRole {
@@ -653,13 +877,8 @@ func (m *Middlewares) resourceOwnedByContext(
 		return false
 	}
 
-	if simpleOwnershipCheck(resourceType, id, oc) {
-		return true
-	}
-
-	if ok, err := genericOwnershipPatterns(raw, oc); err == nil && ok {
-		return true
-	} else if err != nil {
+	owned, err := readOwnership(raw, resourceType, id, oc)
+	if err != nil {
 		if m.failClosedOnErrorFromResource(resourceType, id) {
 			return false
 		}
@@ -671,25 +890,7 @@ func (m *Middlewares) resourceOwnedByContext(
 		)
 		return true
 	}
-
-	if checker, ok := resourceSpecificOwnershipCheckers[resourceType]; ok {
-		if ok2, err := checker(raw, oc); err == nil && ok2 {
-			return true
-		} else if err != nil {
-			if m.failClosedOnErrorFromResource(resourceType, id) {
-				return false
-			}
-
-			m.Log.Warn("resorting to fail open on error from resource",
-				zap.String("resourceType", resourceType),
-				zap.String("id", id),
-				zap.Error(err),
-			)
-		}
-	}
-
-	// If we reach here, we couldn't prove ownership.
-	return false
+	return owned
 }
 
 // failClosedOnErrorFromResource is a function that determines if we should fail closed on error from a resource.
@@ -700,18 +901,7 @@ func (m *Middlewares) failClosedOnErrorFromResource(resourceType string, resourc
 		return true
 	}
 
-	defaultDenyResources := []string{
-		constvars.ResourcePatient,
-		constvars.ResourceCondition,
-		constvars.ResourceObservation,
-		constvars.ResourceMedicationRequest,
-		constvars.ResourceAllergyIntolerance,
-		constvars.ResourceProcedure,
-		constvars.ResourceCarePlan,
-		constvars.ResourceMedicationAdministration,
-	}
-
-	if slices.Contains(defaultDenyResources, resourceType) {
+	if utils.CurrentOwnershipRules().FailsClosed(resourceType) {
 		// if the resource is in the default deny list, we fail closed
 		m.Log.Info(fmt.Sprintf("Denying an unauthorized request to {%s/%s}", resourceType, resourceID),
 			zap.String("resourceType", resourceType),
@@ -723,6 +913,63 @@ func (m *Middlewares) failClosedOnErrorFromResource(resourceType string, resourc
 	return false
 }
 
+// entryOwnership caches what was learned about one bundle entry so the resource is unmarshalled once.
+type entryOwnership struct {
+	owned        bool
+	resourceType string
+	id           string
+	// consentMissing is set when the entry needs a patient's Consent the caller does not have.
+	consentMissing bool
+}
+
+// referencedBy reports whether the entry's relative reference (ResourceType/ID) was
+// collected from an owned resource.
+func (e entryOwnership) referencedBy(allowedRefs map[string]struct{}) bool {
+	if e.consentMissing {
+		return false
+	}
+	refKey := fmt.Sprintf("%s/%s", e.resourceType, e.id)
+	_, isReferenced := allowedRefs[refKey]
+	return isReferenced
+}
+
+// evaluateEntryOwnership determines direct ownership of one bundle entry resource. If the entry is
+// owned, we should also be allowed to see resources it references, so its outgoing references are
+// added to allowedRefs. However, this feature is only available if the requester has a practitioner
+// role as per the requirement, and not for search results, whose included resources are judged by
+// searchIncludes; allowedRefs is nil for those.
+func (m *Middlewares) evaluateEntryOwnership(resource json.RawMessage, oc *ownershipContext, allowedRefs map[string]struct{}) entryOwnership {
+	var env struct {
+		ResourceType string `json:"resourceType"`
+		ID           string `json:"id,omitempty"`
+	}
+	if err := json.Unmarshal(resource, &env); err != nil || env.ResourceType == "" {
+		return entryOwnership{owned: !m.failClosedOnErrorFromResource(env.ResourceType, env.ID)}
+	}
+
+	info := entryOwnership{
+		owned:        m.resourceOwnedByContext(resource, env.ResourceType, env.ID, oc),
+		resourceType: env.ResourceType,
+		id:           env.ID,
+	}
+	if !info.owned && m.consentRequired() {
+		info.consentMissing = consentFor(resource, env.ResourceType, env.ID, oc) == consentMissing
+	}
+
+	if info.owned && oc.HasPractitionerRole && allowedRefs != nil {
+		var resMap map[string]any
+		if err := json.Unmarshal(resource, &resMap); err == nil {
+			var refs []string
+			collectReferences(resMap, &refs, 0)
+			for _, r := range refs {
+				allowedRefs[r] = struct{}{}
+			}
+		}
+	}
+
+	return info
+}
+
 // applyOwnershipFilterToBundle mutates bundle.Entry in-place, keeping only owned resources.
 func (m *Middlewares) applyOwnershipFilterToBundle(
 	ctx context.Context,
@@ -730,85 +977,84 @@ func (m *Middlewares) applyOwnershipFilterToBundle(
 	roles []string,
 	fhirRole, fhirID string,
 ) int {
-	oc := m.buildOwnershipContext(ctx, roles, fhirRole, fhirID)
-
-	// struct to cache resource info to avoid double unmarshalling
-	type entryInfo struct {
-		idx          int
-		owned        bool
-		resourceType string
-		id           string
-	}
+	return m.filterOwnedEntries(bundle, roles, m.buildOwnershipContext(ctx, roles, fhirRole, fhirID))
+}
 
-	infos := make([]entryInfo, len(bundle.Entry))
+// filterOwnedEntries is applyOwnershipFilterToBundle for an already resolved ownership context.
+// Search results are judged by their search.mode: matches on their own ownership, included entries
+// by the entries they are linked to. Entries without a mode are kept for practitioners when an
+// owned entry references them, except the versions of a history Bundle, see historyVersions.
+func (m *Middlewares) filterOwnedEntries(bundle *Bundle, roles []string, oc *ownershipContext) int {
+	infos := make([]entryOwnership, len(bundle.Entry))
+	keep := make([]bool, len(bundle.Entry))
 	// allowedRefs tracks the IDs of resources that are referenced by owned resources
 	allowedRefs := make(map[string]struct{})
 
+	hasIncludes := slices.ContainsFunc(bundle.Entry, func(e BundleEntry) bool {
+		return entrySearchMode(e.Search) == searchModeInclude
+	})
+	includes := newSearchIncludes(m, roles, oc)
+	var pending []includedEntry
+	var pendingResources []json.RawMessage
+	var pendingIndex []int
+	versions := newHistoryVersions()
+	deleted := make(map[int]string)
+
 	// Determine direct ownership and collect outgoing references from owned resources
 	for i, e := range bundle.Entry {
-		var env struct {
-			ResourceType string `json:"resourceType"`
-			ID           string `json:"id,omitempty"`
-		}
-		if err := json.Unmarshal(e.Resource, &env); err != nil || env.ResourceType == "" {
-			if m.failClosedOnErrorFromResource(env.ResourceType, env.ID) {
-				infos[i] = entryInfo{idx: i, owned: false}
-			} else {
-				infos[i] = entryInfo{idx: i, owned: true}
+		mode := entrySearchMode(e.Search)
+		switch {
+		case isHistoryEntry(mode, e.Request) && len(e.Resource) == 0:
+			deleted[i] = deletedResource(e.Request)
+			continue
+		case isHistoryEntry(mode, e.Request):
+			infos[i] = m.evaluateEntryOwnership(e.Resource, oc, nil)
+			if infos[i].owned {
+				versions.add(infos[i].resourceType, infos[i].id)
 			}
+		case mode == searchModeInclude:
+			info := includes.entry(e.Resource)
+			infos[i] = entryOwnership{resourceType: info.resourceType, id: info.id}
+			pending = append(pending, info)
+			pendingResources = append(pendingResources, e.Resource)
+			pendingIndex = append(pendingIndex, i)
 			continue
+		case mode == "":
+			infos[i] = m.evaluateEntryOwnership(e.Resource, oc, allowedRefs)
+		default:
+			infos[i] = m.evaluateEntryOwnership(e.Resource, oc, nil)
 		}
+		keep[i] = infos[i].owned
+		if keep[i] && hasIncludes {
+			includes.add(e.Resource, infos[i].resourceType, infos[i].id)
+		}
+	}
 
-		owned := m.resourceOwnedByContext(e.Resource, env.ResourceType, env.ID, oc)
-		infos[i] = entryInfo{
-			idx:          i,
-			owned:        owned,
-			resourceType: env.ResourceType,
-			id:           env.ID,
+	// Keep entries without a mode that are referenced by an owned resource
+	for i, e := range bundle.Entry {
+		if !keep[i] && entrySearchMode(e.Search) == "" && len(e.Request) == 0 {
+			keep[i] = infos[i].referencedBy(allowedRefs)
 		}
+	}
 
-		if owned {
-			// If we own this resource, we should also be allowed to see resources it references.
-			// We scan the owned resource for all "reference" fields.
-			// however, this feature will only be available if the requester has a practitioner role
-			// as per the requirement
-			if !oc.HasPractitionerRole {
-				continue
-			}
+	// Keep the deleted versions of resources with a kept version
+	for i, ref := range deleted {
+		resourceType, id, _ := strings.Cut(ref, "/")
+		infos[i] = entryOwnership{resourceType: resourceType, id: id}
+		keep[i] = versions.allowsDeleted(ref)
+	}
 
-			var resMap map[string]any
-			if err := json.Unmarshal(e.Resource, &resMap); err == nil {
-				var refs []string
-				collectReferences(resMap, &refs, 0)
-				for _, r := range refs {
-					allowedRefs[r] = struct{}{}
-				}
-			}
-		}
+	for j, kept := range includes.resolve(pending, pendingResources) {
+		keep[pendingIndex[j]] = kept
 	}
 
 	removed := 0
 	filtered := make([]BundleEntry, 0, len(bundle.Entry))
-
-	// Filter based on direct ownership OR if referenced by an owned resource
 	for i, e := range bundle.Entry {
-		info := infos[i]
-		if info.owned {
-			filtered = append(filtered, e)
-			continue
-		}
-
-		// If not directly owned, check if this resource was referenced by an owned resource.
-		// We check standard "ResourceType/ID" format.
-		refKey := fmt.Sprintf("%s/%s", info.resourceType, info.id)
-
-		// Check if the resource's relative reference (ResourceType/ID) is in allowed list
-		_, isReferenced := allowedRefs[refKey]
-
-		if isReferenced {
+		if keep[i] {
 			filtered = append(filtered, e)
 		} else {
-			m.Log.Info("removing resource from bundle", zap.String("resourceType", info.resourceType), zap.String("resourceID", info.id))
+			m.Log.Info("removing resource from bundle", zap.String("resourceType", infos[i].resourceType), zap.String("resourceID", infos[i].id))
 			removed++
 		}
 	}
@@ -817,101 +1063,6 @@ func (m *Middlewares) applyOwnershipFilterToBundle(
 	return removed
 }
 
-// simpleOwnershipCheck performs direct ownership based on resourceType + id.
-func simpleOwnershipCheck(resourceType, id string, oc *ownershipContext) bool {
-	if id == "" {
-		return false
-	}
-
-	switch resourceType {
-	case constvars.ResourcePatient:
-		_, ok := oc.PatientIDs[id]
-		return ok
-	case constvars.ResourcePractitioner:
-		_, ok := oc.PractitionerIDs[id]
-		return ok
-	default:
-		return false
-	}
-}
-
-// genericOwnershipPatterns covers:
-// - subject.reference
-// - patient.reference
-// - recipient.reference
-// - actor.reference
-// - participant[*].actor.reference
-// - plus a full recursive "reference" walk as a safety net.
-func genericOwnershipPatterns(raw json.RawMessage, oc *ownershipContext) (bool, error) {
-	var res map[string]any
-	if err := json.Unmarshal(raw, &res); err != nil {
-		return false, err
-	}
-
-	extractRef := func(v any) string {
-		if m, ok := v.(map[string]any); ok {
-			if s, ok := m["reference"].(string); ok {
-				return s
-			}
-		}
-		return ""
-	}
-
-	// subject.reference
-	if subj, ok := res["subject"]; ok {
-		if ref := extractRef(subj); ref != "" && matchesOwnedRef(ref, oc) {
-			return true, nil
-		}
-	}
-
-	// patient.reference
-	if pat, ok := res["patient"]; ok {
-		if ref := extractRef(pat); ref != "" && matchesOwnedRef(ref, oc) {
-			return true, nil
-		}
-	}
-
-	// recipient.reference
-	if rec, ok := res["recipient"]; ok {
-		if ref := extractRef(rec); ref != "" && matchesOwnedRef(ref, oc) {
-			return true, nil
-		}
-	}
-
-	// actor.reference at root
-	if act, ok := res["actor"]; ok {
-		if ref := extractRef(act); ref != "" && matchesOwnedRef(ref, oc) {
-			return true, nil
-		}
-	}
-
-	// participant[*].actor.reference
-	if parts, ok := res["participant"]; ok {
-		if arr, ok := parts.([]any); ok {
-			for _, item := range arr {
-				if pm, ok := item.(map[string]any); ok {
-					if actor, ok := pm["actor"]; ok {
-						if ref := extractRef(actor); ref != "" && matchesOwnedRef(ref, oc) {
-							return true, nil
-						}
-					}
-				}
-			}
-		}
-	}
-
-	// Fallback: recursive scan of all "reference" fields.
-	var refs []string
-	collectReferences(res, &refs, 0)
-	for _, ref := range refs {
-		if matchesOwnedRef(ref, oc) {
-			return true, nil
-		}
-	}
-
-	return false, nil
-}
-
 // filterSingleResourceByOwnership applies the same ownership rules as the bundle
 // filter, but for a single FHIR resource response body.
 //
@@ -1027,10 +1178,29 @@ func (m *Middlewares) TxProxy(target string) http.Handler {
 			bodyBytes = []byte{}
 		}
 
+		ctx := r.Context()
+		operation := txOperation(relativePath)
+		cacheTTL, cacheable := m.txCacheTTL(r.Method, operation)
+		var cacheKey string
+		if cacheable {
+			cacheKey = txCacheKey(relativePath, q)
+			if entry, ok := m.loadCachedResponse(ctx, cacheKey); ok && time.Since(entry.StoredAt) < cacheTTL {
+				m.writeTxResponse(w, entry.StatusCode, entry.ContentType, entry.Body, txSourceCache)
+				return
+			}
+		}
+
 		// Hard timeout for upstream terminology server requests.
 		// If a request/connection is ongoing for > 5 minutes, cancel it and return 504.
 		// this behaviour is requested here: https://github.com/konsulin-care/konsulin-api/pull/291#issuecomment-3728978396
-		proxyCtx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+		// Requests the local fallback can answer get a much shorter deadline before it steps in.
+		timeout := 5 * time.Minute
+		expandReq, canFallback := txExpandRequest(relativePath, q)
+		canFallback = canFallback && r.Method == http.MethodGet && m.TerminologyFallback.CanExpand(expandReq)
+		if canFallback {
+			timeout = time.Duration(m.InternalConfig.FHIR.TerminologyFallbackTimeoutSeconds) * time.Second
+		}
+		proxyCtx, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
 
 		req, err := http.NewRequestWithContext(proxyCtx, r.Method, fullURL, bytes.NewReader(bodyBytes))
@@ -1047,6 +1217,9 @@ func (m *Middlewares) TxProxy(target string) http.Handler {
 
 		resp, err := m.HTTPClient.Do(req)
 		if err != nil {
+			if canFallback && m.serveTxFallback(w, expandReq, err) {
+				return
+			}
 			// Return 504 on deadline exceeded.
 			if errors.Is(err, context.DeadlineExceeded) || errors.Is(proxyCtx.Err(), context.DeadlineExceeded) {
 				utils.BuildErrorResponse(m.Log, w, exceptions.ErrServerDeadlineExceeded(err))
@@ -1057,19 +1230,37 @@ func (m *Middlewares) TxProxy(target string) http.Handler {
 		}
 		defer resp.Body.Close()
 
-		for k, v := range resp.Header {
-			if strings.HasPrefix(k, "Access-Control-") {
-				continue
-			}
-			if k == "Content-Length" || k == "Connection" {
-				continue
-			}
+		if resp.StatusCode >= http.StatusInternalServerError && canFallback &&
+			m.serveTxFallback(w, expandReq, fmt.Errorf("terminology server answered %d", resp.StatusCode)) {
+			return
+		}
 
-			for _, val := range v {
-				w.Header().Add(k, val)
+		// Cached and fallback-eligible responses are read in full first: the former to be stored,
+		// the latter so a body that stalls past the deadline can still be replaced.
+		if cacheable || canFallback {
+			body, readErr := io.ReadAll(resp.Body)
+			if readErr != nil {
+				if canFallback && m.serveTxFallback(w, expandReq, readErr) {
+					return
+				}
+				utils.BuildErrorResponse(m.Log, w, exceptions.ErrReadBody(readErr))
+				return
+			}
+			if cacheable && resp.StatusCode == http.StatusOK {
+				m.storeTxResponse(ctx, cacheKey, &cachedFHIRResponse{
+					StatusCode:  resp.StatusCode,
+					ContentType: resp.Header.Get("Content-Type"),
+					Body:        body,
+					StoredAt:    time.Now(),
+				}, cacheTTL)
 			}
+			copyTxHeaders(w, resp.Header)
+			m.writeTxResponse(w, resp.StatusCode, "", body, txSourceUpstream)
+			return
 		}
 
+		copyTxHeaders(w, resp.Header)
+		w.Header().Set(headerTerminologySource, txSourceUpstream)
 		w.WriteHeader(resp.StatusCode)
 		_, err = io.Copy(w, resp.Body)
 		if err != nil {
@@ -1088,11 +1279,10 @@ func collectReferences(v any, out *[]string, depth int) {
 	switch t := v.(type) {
 	case map[string]any:
 		for k, vv := range t {
-			if k == "reference" {
-				if s, ok := vv.(string); ok {
-					*out = append(*out, s)
-				}
+			if s, ok := vv.(string); ok && k == "reference" {
+				*out = append(*out, s)
 			} else {
+				// elements named "reference" may hold a Reference, e.g. Consent.provision.actor.reference
 				collectReferences(vv, out, depth+1)
 			}
 		}
@@ -0,0 +1,270 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+	"konsulin-service/internal/pkg/utils"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+)
+
+const (
+	responseCacheKeyPrefix           = "fhir:response-cache:"
+	responseCacheGenerationKeyPrefix = "fhir:response-cache-gen:"
+
+	// responseCacheRetentionFactor keeps entries in Redis for this many TTLs past their freshness so
+	// they can still be revalidated upstream with a conditional request instead of refetched.
+	responseCacheRetentionFactor = 10
+
+	defaultResponseCacheTTL = 300 * time.Second
+
+	// headerGatewayCache reports how a cacheable response was served: HIT, REVALIDATED or MISS.
+	headerGatewayCache = "X-Gateway-Cache"
+)
+
+// cachedFHIRResponse is an uncompressed upstream response of a public resource as stored in Redis.
+// Response filters still run on every serve, the cache only saves the upstream round trip.
+type cachedFHIRResponse struct {
+	StatusCode   int       `json:"status"`
+	ContentType  string    `json:"contentType,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Body         []byte    `json:"body"`
+	StoredAt     time.Time `json:"storedAt"`
+}
+
+// responseCacheTTL reports whether responses for resourceType may be cached and for how long they
+// are served without revalidation. Only public resource types are ever cached: their responses do
+// not depend on the caller.
+func (m *Middlewares) responseCacheTTL(resourceType string) (time.Duration, bool) {
+	if m.InternalConfig == nil || m.RedisRepository == nil || !m.InternalConfig.FHIR.ResponseCacheEnabled {
+		return 0, false
+	}
+	if resourceType == "" || !utils.IsPublicResource(resourceType) {
+		return 0, false
+	}
+
+	cfg := m.InternalConfig.FHIR
+	if len(cfg.ResponseCacheResourceTypes) > 0 && !slices.Contains(cfg.ResponseCacheResourceTypes, resourceType) {
+		return 0, false
+	}
+
+	if secs, ok := cfg.ResponseCacheTTLOverrides[resourceType]; ok && secs > 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if cfg.ResponseCacheTTLSeconds > 0 {
+		return time.Duration(cfg.ResponseCacheTTLSeconds) * time.Second, true
+	}
+	return defaultResponseCacheTTL, true
+}
+
+// responseCacheKey builds the Redis key of a read. The query is normalised so parameter order does
+// not matter, and the key embeds the resource type's generation so a write through the proxy makes
+// every earlier entry of that type unreachable.
+func (m *Middlewares) responseCacheKey(ctx context.Context, resourceType string, r *http.Request) string {
+	gen, err := m.RedisRepository.Get(ctx, responseCacheGenerationKeyPrefix+resourceType)
+	if err != nil || gen == "" {
+		gen = "0"
+	}
+
+	normalized := r.URL.Path
+	if q := r.URL.Query(); len(q) > 0 {
+		normalized += "?" + q.Encode()
+	}
+	sum := sha256.Sum256([]byte(normalized))
+
+	return responseCacheKeyPrefix + resourceType + ":" + gen + ":" + hex.EncodeToString(sum[:])
+}
+
+func (m *Middlewares) loadCachedResponse(ctx context.Context, key string) (*cachedFHIRResponse, bool) {
+	raw, err := m.RedisRepository.Get(ctx, key)
+	if err != nil || raw == "" {
+		return nil, false
+	}
+
+	var entry cachedFHIRResponse
+	if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+		m.Log.Warn("discarding unreadable FHIR response cache entry", zap.String("key", key), zap.Error(err))
+		return nil, false
+	}
+	return &entry, true
+}
+
+func (m *Middlewares) storeCachedResponse(ctx context.Context, key string, entry *cachedFHIRResponse, ttl time.Duration) {
+	if err := m.RedisRepository.Set(ctx, key, entry, ttl*responseCacheRetentionFactor); err != nil {
+		m.Log.Warn("failed to store FHIR response cache entry", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// serveCachedRead answers a GET on a public resource type from the response cache. Fresh entries
+// are served as they are, stale ones are revalidated upstream with If-None-Match/If-Modified-Since,
+// and misses are fetched and stored. Redis failures only cost the cache, never the request.
+func (m *Middlewares) serveCachedRead(w http.ResponseWriter, r *http.Request, client *http.Client, fullURL, resourceType string, ttl time.Duration, reqBody []byte, scope responseFilterScope) {
+	ctx := r.Context()
+	key := m.responseCacheKey(ctx, resourceType, r)
+
+	entry, cached := m.loadCachedResponse(ctx, key)
+	if cached && time.Since(entry.StoredAt) < ttl {
+		m.writeCachedResponse(w, r, entry, "HIT", reqBody, scope)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fullURL, nil)
+	if err != nil {
+		utils.BuildErrorResponse(m.Log, w, exceptions.ErrCreateHTTPRequest(err))
+		return
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set("Accept", "application/fhir+json")
+	// Entries are stored uncompressed; leaving Accept-Encoding unset lets the transport negotiate
+	// and undo gzip on its own.
+	req.Header.Del("Accept-Encoding")
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	if cached {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		utils.BuildErrorResponse(m.Log, w, exceptions.ErrSendHTTPRequest(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if cached && resp.StatusCode == http.StatusNotModified {
+		entry.StoredAt = time.Now()
+		m.storeCachedResponse(ctx, key, entry, ttl)
+		m.writeCachedResponse(w, r, entry, "REVALIDATED", reqBody, scope)
+		return
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		utils.BuildErrorResponse(m.Log, w, exceptions.ErrReadBody(err))
+		return
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		utils.BuildErrorResponse(m.Log, w, upstreamFHIRError(resp.StatusCode, body))
+		return
+	}
+
+	decoded, _, err := decodeBodyForFiltering(body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		m.Log.Warn("failed to decode response body for caching; failing closed", zap.Error(err))
+		utils.BuildErrorResponse(m.Log, w, exceptions.ErrServerProcess(err))
+		return
+	}
+
+	entry = &cachedFHIRResponse{
+		StatusCode:   resp.StatusCode,
+		ContentType:  resp.Header.Get("Content-Type"),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Body:         decoded,
+		StoredAt:     time.Now(),
+	}
+	if resp.StatusCode == http.StatusOK {
+		m.storeCachedResponse(ctx, key, entry, ttl)
+	}
+	m.writeCachedResponse(w, r, entry, "MISS", reqBody, scope)
+}
+
+// writeCachedResponse answers If-None-Match from the entry's ETag and otherwise serves the entry
+// through the regular buffered response path.
+func (m *Middlewares) writeCachedResponse(w http.ResponseWriter, r *http.Request, entry *cachedFHIRResponse, status string, reqBody []byte, scope responseFilterScope) {
+	w.Header().Set(headerGatewayCache, status)
+
+	if entry.ETag != "" && etagMatches(r.Header.Get("If-None-Match"), entry.ETag) {
+		w.Header().Set("ETag", entry.ETag)
+		if entry.LastModified != "" {
+			w.Header().Set("Last-Modified", entry.LastModified)
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	resp := &http.Response{StatusCode: entry.StatusCode, Header: http.Header{}}
+	if entry.ContentType != "" {
+		resp.Header.Set("Content-Type", entry.ContentType)
+	}
+	if entry.ETag != "" {
+		resp.Header.Set("ETag", entry.ETag)
+	}
+	if entry.LastModified != "" {
+		resp.Header.Set("Last-Modified", entry.LastModified)
+	}
+
+	m.serveBufferedResponse(w, r, resp, entry.Body, reqBody, scope)
+}
+
+// etagMatches implements the weak comparison If-None-Match uses.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == want {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidateResponseCache bumps the cache generation of every cacheable resource type a successful
+// write touched. Writes to the FHIR base are batches or transactions, whose entries name their types.
+func (m *Middlewares) invalidateResponseCache(ctx context.Context, path string, reqBody []byte) {
+	if m.RedisRepository == nil {
+		return
+	}
+
+	var types []string
+	if rt := utils.ExtractResourceTypeFromPath(path); rt != "" {
+		types = append(types, rt)
+	} else {
+		for _, u := range gjson.GetBytes(reqBody, "entry.#.request.url").Array() {
+			if parsed, err := url.Parse(u.String()); err == nil {
+				types = append(types, utils.ExtractResourceTypeFromPath(parsed.Path))
+			}
+		}
+	}
+
+	seen := make(map[string]struct{}, len(types))
+	for _, rt := range types {
+		if _, dup := seen[rt]; dup {
+			continue
+		}
+		seen[rt] = struct{}{}
+		if _, ok := m.responseCacheTTL(rt); !ok {
+			continue
+		}
+		if err := m.RedisRepository.Increment(ctx, responseCacheGenerationKeyPrefix+rt); err != nil {
+			m.Log.Warn("failed to invalidate FHIR response cache", zap.String("resourceType", rt), zap.Error(err))
+		}
+	}
+}
+
+// upstreamFHIRError turns an upstream error response into an error ready for utils.BuildErrorResponse.
+func upstreamFHIRError(statusCode int, body []byte) error {
+	return exceptions.BuildNewCustomError(fmt.Errorf("%s", string(body)), statusCode, string(body), constvars.ErrDevServerProcess)
+}
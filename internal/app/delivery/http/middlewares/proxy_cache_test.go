@@ -0,0 +1,234 @@
+package middlewares
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"konsulin-service/internal/app/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// memoryRedis is an in-memory stand-in for the Redis repository; expirations are ignored.
+type memoryRedis struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func newMemoryRedis() *memoryRedis { return &memoryRedis{data: map[string]string{}} }
+
+func (r *memoryRedis) Delete(_ context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.data, key)
+	return nil
+}
+
+func (r *memoryRedis) Set(_ context.Context, key string, value interface{}, _ time.Duration) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.data[key] = string(b)
+	return nil
+}
+
+func (r *memoryRedis) Get(_ context.Context, key string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.data[key], nil
+}
+
+func (r *memoryRedis) Increment(ctx context.Context, key string) error {
+	_, err := r.IncrementWithTTL(ctx, key, 0)
+	return err
+}
+
+func (r *memoryRedis) IncrementWithTTL(_ context.Context, key string, _ time.Duration) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, _ := strconv.Atoi(r.data[key])
+	n++
+	r.data[key] = strconv.Itoa(n)
+	return n, nil
+}
+
+func (r *memoryRedis) PushToList(context.Context, string, ...interface{}) error { return nil }
+func (r *memoryRedis) PopFromList(context.Context, string) error                { return nil }
+func (r *memoryRedis) AddToSet(context.Context, string, ...interface{}) error   { return nil }
+func (r *memoryRedis) GetSetMembers(context.Context, string) ([]string, error)  { return nil, nil }
+func (r *memoryRedis) RemoveFromSet(context.Context, string, ...interface{}) error {
+	return nil
+}
+
+func (r *memoryRedis) TrySetNX(ctx context.Context, key string, value interface{}, exp time.Duration) (bool, error) {
+	r.mu.Lock()
+	_, exists := r.data[key]
+	r.mu.Unlock()
+	if exists {
+		return false, nil
+	}
+	return true, r.Set(ctx, key, value, exp)
+}
+
+func (r *memoryRedis) Publish(context.Context, string, string) error { return nil }
+func (r *memoryRedis) Subscribe(context.Context, string) (<-chan string, error) {
+	return nil, nil
+}
+
+func TestBridge_ResponseCache(t *testing.T) {
+	var (
+		upstreamGETs      int
+		lastIfNoneMatch   string
+		questionnaireETag = `W/"1"`
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(`{"resourceType":"Questionnaire","id":"q1"}`))
+			return
+		}
+		upstreamGETs++
+		lastIfNoneMatch = r.Header.Get("If-None-Match")
+		if lastIfNoneMatch == questionnaireETag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/fhir+json")
+		w.Header().Set("ETag", questionnaireETag)
+		_, _ = w.Write([]byte(`{"resourceType":"Questionnaire","id":"q1"}`))
+	}))
+	defer upstream.Close()
+
+	redis := newMemoryRedis()
+	m := &Middlewares{
+		Log:             zap.NewNop(),
+		RedisRepository: redis,
+		InternalConfig: &config.InternalConfig{
+			FHIR: config.AppFHIR{BaseUrl: upstream.URL + "/fhir/", ResponseCacheEnabled: true, ResponseCacheTTLSeconds: 60},
+		},
+	}
+	bridge := m.Bridge(upstream.URL + "/fhir/")
+
+	get := func(target string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		bridge.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/fhir/Questionnaire?status=active&_count=5", nil)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "MISS", rr.Header().Get(headerGatewayCache))
+	assert.JSONEq(t, `{"resourceType":"Questionnaire","id":"q1"}`, rr.Body.String())
+
+	t.Run("Reordered query hits the same entry", func(t *testing.T) {
+		rr := get("/fhir/Questionnaire?_count=5&status=active", nil)
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "HIT", rr.Header().Get(headerGatewayCache))
+		assert.Equal(t, questionnaireETag, rr.Header().Get("ETag"))
+		assert.Equal(t, 1, upstreamGETs)
+	})
+
+	t.Run("Matching If-None-Match gets 304", func(t *testing.T) {
+		rr := get("/fhir/Questionnaire?status=active&_count=5", map[string]string{"If-None-Match": questionnaireETag})
+		assert.Equal(t, http.StatusNotModified, rr.Code)
+		assert.Empty(t, rr.Body.String())
+		assert.Equal(t, 1, upstreamGETs)
+	})
+
+	t.Run("Stale entry is revalidated with a conditional request", func(t *testing.T) {
+		for k, v := range redis.data {
+			if strings.HasPrefix(k, responseCacheKeyPrefix) {
+				var entry cachedFHIRResponse
+				require.NoError(t, json.Unmarshal([]byte(v), &entry))
+				entry.StoredAt = time.Now().Add(-time.Hour)
+				require.NoError(t, redis.Set(context.Background(), k, entry, 0))
+			}
+		}
+
+		rr := get("/fhir/Questionnaire?status=active&_count=5", nil)
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "REVALIDATED", rr.Header().Get(headerGatewayCache))
+		assert.Equal(t, questionnaireETag, lastIfNoneMatch)
+		assert.JSONEq(t, `{"resourceType":"Questionnaire","id":"q1"}`, rr.Body.String())
+		assert.Equal(t, 2, upstreamGETs)
+	})
+
+	t.Run("Writes through the proxy invalidate the type", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPut, "/fhir/Questionnaire/q1", nil)
+		bridge.ServeHTTP(httptest.NewRecorder(), req)
+
+		rr := get("/fhir/Questionnaire?status=active&_count=5", nil)
+		assert.Equal(t, "MISS", rr.Header().Get(headerGatewayCache))
+		assert.Equal(t, 3, upstreamGETs)
+	})
+
+	t.Run("Non-public types are never cached", func(t *testing.T) {
+		rr := get("/fhir/Observation", nil)
+		assert.Empty(t, rr.Header().Get(headerGatewayCache))
+	})
+}
+
+func TestResponseCacheTTL(t *testing.T) {
+	m := &Middlewares{
+		Log:             zap.NewNop(),
+		RedisRepository: newMemoryRedis(),
+		InternalConfig: &config.InternalConfig{
+			FHIR: config.AppFHIR{
+				ResponseCacheEnabled:       true,
+				ResponseCacheTTLSeconds:    60,
+				ResponseCacheTTLOverrides:  map[string]int{"ValueSet": 3600},
+				ResponseCacheResourceTypes: []string{"ValueSet", "Questionnaire", "Observation"},
+			},
+		},
+	}
+
+	ttl, ok := m.responseCacheTTL("ValueSet")
+	assert.True(t, ok)
+	assert.Equal(t, time.Hour, ttl)
+
+	ttl, ok = m.responseCacheTTL("Questionnaire")
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, ttl)
+
+	_, ok = m.responseCacheTTL("Organization")
+	assert.False(t, ok, "not in the configured list")
+
+	_, ok = m.responseCacheTTL("Observation")
+	assert.False(t, ok, "configured but not public")
+}
+
+func TestInvalidateResponseCache_TransactionEntries(t *testing.T) {
+	redis := newMemoryRedis()
+	m := &Middlewares{
+		Log:             zap.NewNop(),
+		RedisRepository: redis,
+		InternalConfig:  &config.InternalConfig{FHIR: config.AppFHIR{ResponseCacheEnabled: true}},
+	}
+
+	body := []byte(`{"resourceType":"Bundle","type":"transaction","entry":[
+		{"request":{"method":"PUT","url":"Questionnaire/q1"}},
+		{"request":{"method":"POST","url":"Organization?identifier=x"}},
+		{"request":{"method":"POST","url":"Observation"}}
+	]}`)
+	m.invalidateResponseCache(context.Background(), "", body)
+
+	assert.Equal(t, "1", redis.data[responseCacheGenerationKeyPrefix+"Questionnaire"])
+	assert.Equal(t, "1", redis.data[responseCacheGenerationKeyPrefix+"Organization"])
+	assert.NotContains(t, redis.data, responseCacheGenerationKeyPrefix+"Observation")
+}
@@ -0,0 +1,181 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"konsulin-service/internal/pkg/utils"
+)
+
+// searchModeInclude is the Bundle.entry.search.mode of resources returned for _include or _revinclude.
+const searchModeInclude = "include"
+
+// searchIncludes decides on the entries a search returned because of _include or _revinclude. Such an
+// entry is not judged on its own: it is kept only when it is linked to a kept entry, either referenced
+// by it (_include, by reference or canonical URL) or referencing it (_revinclude), and the caller may
+// read its resource type. Entries kept this way link further included entries, which covers :iterate.
+type searchIncludes struct {
+	m     *Middlewares
+	roles []string
+	oc    *ownershipContext
+	// kept holds the "Type/id" of every kept entry; refs and canonicals what they point to.
+	kept       map[string]struct{}
+	refs       map[string]struct{}
+	canonicals map[string]struct{}
+}
+
+// includedEntry is what is known of an included entry while it waits for the entries it links to.
+type includedEntry struct {
+	resourceType string
+	id           string
+	// url is the canonical URL of a definitional resource, e.g. a Questionnaire.
+	url  string
+	refs []string
+	// withheld is set when the entry may not be shown whatever it is linked to.
+	withheld bool
+}
+
+func newSearchIncludes(m *Middlewares, roles []string, oc *ownershipContext) *searchIncludes {
+	return &searchIncludes{
+		m:          m,
+		roles:      roles,
+		oc:         oc,
+		kept:       make(map[string]struct{}),
+		refs:       make(map[string]struct{}),
+		canonicals: make(map[string]struct{}),
+	}
+}
+
+// add records a kept entry so the entries it links to can be kept too.
+func (s *searchIncludes) add(resource json.RawMessage, resourceType, id string) {
+	if resourceType != "" && id != "" {
+		s.kept[resourceType+"/"+id] = struct{}{}
+	}
+	refs, canonicals := resourceLinks(resource)
+	for _, ref := range refs {
+		s.refs[ref] = struct{}{}
+	}
+	for _, c := range canonicals {
+		s.canonicals[c] = struct{}{}
+	}
+}
+
+// entry evaluates an included resource.
+func (s *searchIncludes) entry(resource json.RawMessage) includedEntry {
+	var env struct {
+		ResourceType string `json:"resourceType"`
+		ID           string `json:"id,omitempty"`
+		URL          string `json:"url,omitempty"`
+	}
+	if err := json.Unmarshal(resource, &env); err != nil || env.ResourceType == "" {
+		return includedEntry{withheld: true}
+	}
+
+	e := includedEntry{resourceType: env.ResourceType, id: env.ID, url: env.URL}
+	e.refs, _ = resourceLinks(resource)
+	e.withheld = !s.typeVisible(env.ResourceType) ||
+		(s.m.consentRequired() && consentFor(resource, env.ResourceType, env.ID, s.oc) == consentMissing)
+	return e
+}
+
+// typeVisible reports whether the caller may read resources of resourceType at all.
+func (s *searchIncludes) typeVisible(resourceType string) bool {
+	return s.m.typeReadable(s.roles, resourceType)
+}
+
+// typeReadable reports whether roles may read resources of resourceType at all.
+func (m *Middlewares) typeReadable(roles []string, resourceType string) bool {
+	if utils.IsPublicResource(resourceType) {
+		return true
+	}
+	for _, role := range roles {
+		if allowed(m.Enforcer, role, http.MethodGet, "/fhir/"+resourceType) {
+			return true
+		}
+	}
+	return false
+}
+
+// linked reports whether e is referenced by, or references, a kept entry.
+func (s *searchIncludes) linked(e includedEntry) bool {
+	if _, ok := s.refs[e.resourceType+"/"+e.id]; ok {
+		return true
+	}
+	if _, ok := s.canonicals[e.url]; ok && e.url != "" {
+		return true
+	}
+	for _, ref := range e.refs {
+		if _, ok := s.kept[ref]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether e can be kept given the entries kept so far.
+func (s *searchIncludes) allows(e includedEntry) bool {
+	return !e.withheld && e.id != "" && s.linked(e)
+}
+
+// resolve decides on included entries that waited for the rest of the Bundle, keeping entries that
+// become linked through other kept included entries. resources[i] is the resource of pending[i].
+func (s *searchIncludes) resolve(pending []includedEntry, resources []json.RawMessage) []bool {
+	keep := make([]bool, len(pending))
+	for changed := true; changed; {
+		changed = false
+		for i, e := range pending {
+			if keep[i] || !s.allows(e) {
+				continue
+			}
+			keep[i] = true
+			s.add(resources[i], e.resourceType, e.id)
+			changed = true
+		}
+	}
+	return keep
+}
+
+// entrySearchMode returns the search.mode of a Bundle entry.
+func entrySearchMode(search map[string]any) string {
+	mode, _ := search["mode"].(string)
+	return mode
+}
+
+// resourceLinks returns the references a resource makes and the canonical URLs it mentions, without
+// their version.
+func resourceLinks(resource json.RawMessage) (refs, canonicals []string) {
+	var res any
+	if err := json.Unmarshal(resource, &res); err != nil {
+		return nil, nil
+	}
+
+	var walk func(v any, depth int)
+	walk = func(v any, depth int) {
+		// same arbitrary bound as collectReferences
+		if depth > 30 {
+			return
+		}
+		switch t := v.(type) {
+		case map[string]any:
+			for k, vv := range t {
+				s, ok := vv.(string)
+				switch {
+				case ok && k == "reference":
+					refs = append(refs, s)
+				case ok && (strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "urn:")):
+					url, _, _ := strings.Cut(s, "|")
+					canonicals = append(canonicals, url)
+				default:
+					walk(vv, depth+1)
+				}
+			}
+		case []any:
+			for _, vv := range t {
+				walk(vv, depth+1)
+			}
+		}
+	}
+	walk(res, 0)
+	return refs, canonicals
+}
@@ -0,0 +1,147 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"konsulin-service/internal/pkg/constvars"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOwnershipFilter_SearchIncludes(t *testing.T) {
+	m := patchTestMiddlewares(t, nil)
+
+	patient := func() *ownershipContext {
+		return &ownershipContext{HasPatientRole: true, PatientIDs: map[string]struct{}{"p1": {}}, PractitionerIDs: map[string]struct{}{}}
+	}
+	practitioner := func() *ownershipContext {
+		return &ownershipContext{HasPractitionerRole: true, PatientIDs: map[string]struct{}{}, PractitionerIDs: map[string]struct{}{"pr1": {}}}
+	}
+	match := func(resource string) string {
+		return `{"search":{"mode":"match"},"resource":` + resource + `}`
+	}
+	include := func(resource string) string {
+		return `{"search":{"mode":"include"},"resource":` + resource + `}`
+	}
+
+	tests := []struct {
+		name    string
+		role    string
+		oc      func() *ownershipContext
+		entries []string
+		want    []string
+	}{
+		{
+			name: "Appointment to Patient: participants of the caller's Appointment are kept",
+			role: constvars.KonsulinRolePatient,
+			oc:   patient,
+			entries: []string{
+				match(`{"resourceType":"Appointment","id":"a1","participant":[{"actor":{"reference":"Patient/p1"}},{"actor":{"reference":"Practitioner/pr1"}}]}`),
+				include(`{"resourceType":"Patient","id":"p1"}`),
+				include(`{"resourceType":"Practitioner","id":"pr1"}`),
+			},
+			want: []string{"a1", "p1", "pr1"},
+		},
+		{
+			name: "Appointment to Patient: participants of a hidden Appointment are dropped",
+			role: constvars.KonsulinRolePatient,
+			oc:   patient,
+			entries: []string{
+				match(`{"resourceType":"Appointment","id":"a1","participant":[{"actor":{"reference":"Patient/p1"}}]}`),
+				match(`{"resourceType":"Appointment","id":"a2","participant":[{"actor":{"reference":"Patient/p2"}},{"actor":{"reference":"Practitioner/pr2"}}]}`),
+				include(`{"resourceType":"Patient","id":"p2"}`),
+				include(`{"resourceType":"Practitioner","id":"pr2"}`),
+			},
+			want: []string{"a1"},
+		},
+		{
+			name: "Appointment to Patient: a revincluded Appointment is kept with the caller's Patient",
+			role: constvars.KonsulinRolePatient,
+			oc:   patient,
+			entries: []string{
+				match(`{"resourceType":"Patient","id":"p1"}`),
+				include(`{"resourceType":"Appointment","id":"a1","participant":[{"actor":{"reference":"Patient/p1"}}]}`),
+			},
+			want: []string{"p1", "a1"},
+		},
+		{
+			name: "QuestionnaireResponse to Questionnaire: the answered Questionnaire is kept",
+			role: constvars.KonsulinRolePatient,
+			oc:   patient,
+			entries: []string{
+				match(`{"resourceType":"QuestionnaireResponse","id":"qr1","questionnaire":"https://konsulin.care/q/phq9|1.0","subject":{"reference":"Patient/p1"}}`),
+				include(`{"resourceType":"Questionnaire","id":"q1","url":"https://konsulin.care/q/phq9"}`),
+			},
+			want: []string{"qr1", "q1"},
+		},
+		{
+			name: "QuestionnaireResponse to Questionnaire: a Questionnaire no kept response answers is dropped",
+			role: constvars.KonsulinRolePatient,
+			oc:   patient,
+			entries: []string{
+				match(`{"resourceType":"QuestionnaireResponse","id":"qr1","questionnaire":"https://konsulin.care/q/phq9","subject":{"reference":"Patient/p1"}}`),
+				include(`{"resourceType":"Questionnaire","id":"q2","url":"https://konsulin.care/q/gad7"}`),
+			},
+			want: []string{"qr1"},
+		},
+		{
+			name: "included resource of a type the caller may not read is dropped",
+			role: constvars.KonsulinRolePatient,
+			oc:   patient,
+			entries: []string{
+				match(`{"resourceType":"Observation","id":"o1","subject":{"reference":"Patient/p1"},"device":{"reference":"Device/d1"}}`),
+				include(`{"resourceType":"Device","id":"d1"}`),
+			},
+			want: []string{"o1"},
+		},
+		{
+			name: "an owned included resource does not reveal the match it references",
+			role: constvars.KonsulinRolePractitioner,
+			oc:   practitioner,
+			entries: []string{
+				match(`{"resourceType":"Patient","id":"p9"}`),
+				include(`{"resourceType":"Observation","id":"o1","subject":{"reference":"Patient/p9"},"performer":[{"reference":"Practitioner/pr1"}]}`),
+			},
+			want: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		body := `{"resourceType":"Bundle","type":"searchset","entry":[` + strings.Join(tt.entries, ",") + `]}`
+
+		t.Run(tt.name+" (buffered)", func(t *testing.T) {
+			bundle, ok, err := decodeBundle([]byte(body))
+			require.NoError(t, err)
+			require.True(t, ok)
+			m.filterOwnedEntries(bundle, []string{tt.role}, tt.oc())
+			assert.ElementsMatch(t, tt.want, entryIDs(t, bundle))
+		})
+
+		t.Run(tt.name+" (streamed)", func(t *testing.T) {
+			f := &bundleEntryFilter{m: m, roles: []string{tt.role}, oc: tt.oc(), allowedRefs: map[string]struct{}{}, trackIncludes: true}
+			f.includes = newSearchIncludes(m, f.roles, f.oc)
+
+			var out bytes.Buffer
+			require.NoError(t, streamFilterBundle(strings.NewReader(body), &out, f, nil))
+			bundle := decodeStreamedBundle(t, out.Bytes())
+			assert.ElementsMatch(t, tt.want, entryIDs(t, &bundle))
+		})
+	}
+}
+
+func entryIDs(t *testing.T, bundle *Bundle) []string {
+	t.Helper()
+	ids := []string{}
+	for _, e := range bundle.Entry {
+		var res struct {
+			ID string `json:"id"`
+		}
+		require.NoError(t, json.Unmarshal(e.Resource, &res))
+		ids = append(ids, res.ID)
+	}
+	return ids
+}
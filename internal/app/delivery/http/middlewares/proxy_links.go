@@ -0,0 +1,131 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+)
+
+// bundleLinkRewriter rewrites Bundle.link URLs that point at the upstream FHIR server so that
+// clients follow paging links through the gateway instead of hitting the FHIR server directly.
+// Query strings, including Blaze's __t and __page-id cursors, are kept as they are.
+// A nil rewriter leaves links untouched.
+type bundleLinkRewriter struct {
+	from string
+	to   string
+}
+
+// newBundleLinkRewriter builds a rewriter from FHIR.BaseUrl to the public /fhir mount. It returns
+// nil when either URL is not configured.
+func (m *Middlewares) newBundleLinkRewriter() *bundleLinkRewriter {
+	to := m.gatewayFHIRBase()
+	if to == "" {
+		return nil
+	}
+
+	from := strings.TrimRight(m.InternalConfig.FHIR.BaseUrl, "/")
+	if from == "" || from == to {
+		return nil
+	}
+	return &bundleLinkRewriter{from: from, to: to}
+}
+
+// gatewayFHIRBase returns the public base URL of the /fhir routes. They are mounted at the root of
+// the router, so only the scheme and host of App.BaseUrl are used. It returns "" when App.BaseUrl
+// is not configured.
+func (m *Middlewares) gatewayFHIRBase() string {
+	if m.InternalConfig == nil {
+		return ""
+	}
+
+	public, err := url.Parse(m.InternalConfig.App.BaseUrl)
+	if err != nil || public.Scheme == "" || public.Host == "" {
+		return ""
+	}
+	return public.Scheme + "://" + public.Host + "/fhir"
+}
+
+// rewriteURL replaces the upstream base of u with the gateway base. URLs that merely share a
+// prefix with the upstream base (e.g. /fhir2) are left alone.
+func (lr *bundleLinkRewriter) rewriteURL(u string) (string, bool) {
+	if !strings.HasPrefix(u, lr.from) {
+		return u, false
+	}
+	rest := u[len(lr.from):]
+	if rest != "" && rest[0] != '/' && rest[0] != '?' {
+		return u, false
+	}
+	return lr.to + rest, true
+}
+
+// rewrite returns the Bundle.link array with every upstream URL rewritten. Links are returned
+// unchanged when nothing matched so the upstream bytes are preserved.
+func (lr *bundleLinkRewriter) rewrite(raw json.RawMessage) (json.RawMessage, error) {
+	if lr == nil {
+		return raw, nil
+	}
+
+	var links []map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &links); err != nil {
+		return nil, err
+	}
+
+	changed := false
+	for _, link := range links {
+		var u string
+		if err := json.Unmarshal(link["url"], &u); err != nil {
+			continue
+		}
+		rewritten, ok := lr.rewriteURL(u)
+		if !ok {
+			continue
+		}
+		b, err := json.Marshal(rewritten)
+		if err != nil {
+			return nil, err
+		}
+		link["url"] = b
+		changed = true
+	}
+
+	if !changed {
+		return raw, nil
+	}
+	return json.Marshal(links)
+}
+
+// rewriteBody rewrites the links of an uncompressed Bundle body. Bodies that are not Bundles or
+// carry no links are returned as-is with changed set to false.
+func (lr *bundleLinkRewriter) rewriteBody(body []byte) ([]byte, bool, error) {
+	if lr == nil {
+		return body, false, nil
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return body, false, nil
+	}
+	var resourceType string
+	if err := json.Unmarshal(doc["resourceType"], &resourceType); err != nil || resourceType != "Bundle" {
+		return body, false, nil
+	}
+	link, ok := doc["link"]
+	if !ok {
+		return body, false, nil
+	}
+
+	rewritten, err := lr.rewrite(link)
+	if err != nil {
+		return nil, false, err
+	}
+	if string(rewritten) == string(link) {
+		return body, false, nil
+	}
+
+	doc["link"] = rewritten
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false, err
+	}
+	return out, true, nil
+}
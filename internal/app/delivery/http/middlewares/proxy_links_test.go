@@ -0,0 +1,174 @@
+package middlewares
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"konsulin-service/internal/app/config"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBundleLinkRewriter_RewriteURL(t *testing.T) {
+	lr := &bundleLinkRewriter{from: "http://blaze:8080/fhir", to: "https://api.konsulin.care/fhir"}
+
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		changed bool
+	}{
+		{"base only", "http://blaze:8080/fhir", "https://api.konsulin.care/fhir", true},
+		{"query kept", "http://blaze:8080/fhir?_count=10", "https://api.konsulin.care/fhir?_count=10", true},
+		{"paging cursor kept", "http://blaze:8080/fhir/Observation?__t=42&__page-id=abc&_count=20", "https://api.konsulin.care/fhir/Observation?__t=42&__page-id=abc&_count=20", true},
+		{"sibling path untouched", "http://blaze:8080/fhir2/Observation", "http://blaze:8080/fhir2/Observation", false},
+		{"foreign host untouched", "http://other/fhir/Observation", "http://other/fhir/Observation", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed := lr.rewriteURL(tt.in)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.changed, changed)
+		})
+	}
+}
+
+func TestNewBundleLinkRewriter(t *testing.T) {
+	m := &Middlewares{Log: zap.NewNop()}
+	assert.Nil(t, m.newBundleLinkRewriter(), "no config means no rewriting")
+
+	m.InternalConfig = &config.InternalConfig{
+		App:  config.App{BaseUrl: "https://api.konsulin.care/api/v1"},
+		FHIR: config.AppFHIR{BaseUrl: "http://blaze:8080/fhir/"},
+	}
+	lr := m.newBundleLinkRewriter()
+	require.NotNil(t, lr)
+	assert.Equal(t, "http://blaze:8080/fhir", lr.from)
+	assert.Equal(t, "https://api.konsulin.care/fhir", lr.to)
+
+	var nilRewriter *bundleLinkRewriter
+	raw := json.RawMessage(`[{"relation":"self","url":"http://blaze:8080/fhir/Patient"}]`)
+	out, err := nilRewriter.rewrite(raw)
+	require.NoError(t, err)
+	assert.Equal(t, string(raw), string(out))
+}
+
+func encodeForTest(t *testing.T, enc string, body []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch enc {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		require.NoError(t, err)
+		w = zw
+	default:
+		return body
+	}
+	_, err := w.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func decodeForTest(t *testing.T, enc string, body []byte) []byte {
+	t.Helper()
+	var r io.Reader
+	switch enc {
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		r = gr
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		defer zr.Close()
+		r = zr
+	default:
+		return body
+	}
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return out
+}
+
+func TestBridge_RewritesBundleLinks(t *testing.T) {
+	const pagedBundle = `{
+		"resourceType": "Bundle",
+		"type": "searchset",
+		"link": [
+			{"relation": "self", "url": "%[1]s/Observation?_count=1&__t=7"},
+			{"relation": "next", "url": "%[1]s/Observation?_count=1&__t=7&__page-id=o2"}
+		],
+		"entry": [{"resource": {"resourceType": "Observation", "id": "o1"}}]
+	}`
+
+	for _, enc := range []string{"identity", "gzip", "br", "zstd"} {
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			t.Run(enc+" "+method, func(t *testing.T) {
+				var upstreamURL string
+				upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					body := []byte(fmt.Sprintf(pagedBundle, upstreamURL+"/fhir"))
+					w.Header().Set("Content-Type", "application/fhir+json")
+					if enc != "identity" {
+						w.Header().Set("Content-Encoding", enc)
+					}
+					w.WriteHeader(http.StatusOK)
+					_, _ = w.Write(encodeForTest(t, enc, body))
+				}))
+				defer upstream.Close()
+				upstreamURL = upstream.URL
+
+				m := &Middlewares{
+					Log: zap.NewNop(),
+					InternalConfig: &config.InternalConfig{
+						App:  config.App{BaseUrl: "https://api.konsulin.care/api/v1"},
+						FHIR: config.AppFHIR{BaseUrl: upstream.URL + "/fhir/"},
+					},
+				}
+
+				path := "/fhir/Observation?_count=1"
+				if method == http.MethodPost {
+					path = "/fhir/Observation/_search"
+				}
+				req := httptest.NewRequest(method, path, nil)
+				req.Header.Set("Accept-Encoding", enc)
+
+				rr := httptest.NewRecorder()
+				m.Bridge(upstream.URL+"/fhir/").ServeHTTP(rr, req)
+				require.Equal(t, http.StatusOK, rr.Code)
+
+				var b struct {
+					Link []struct {
+						Relation string `json:"relation"`
+						URL      string `json:"url"`
+					} `json:"link"`
+					Entry []json.RawMessage `json:"entry"`
+				}
+				require.NoError(t, json.Unmarshal(decodeForTest(t, enc, rr.Body.Bytes()), &b))
+				links := b.Link
+				require.Len(t, links, 2)
+				assert.Equal(t, "https://api.konsulin.care/fhir/Observation?_count=1&__t=7", links[0].URL)
+				assert.Equal(t, "https://api.konsulin.care/fhir/Observation?_count=1&__t=7&__page-id=o2", links[1].URL)
+				assert.Len(t, b.Entry, 1)
+			})
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"konsulin-service/internal/pkg/exceptions"
+	"konsulin-service/internal/pkg/utils"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+)
+
+// pageFillCursorParam is the query parameter carrying the gateway-issued continuation cursor of a
+// page-filled search. It is consumed by the gateway and never forwarded to the FHIR server.
+const pageFillCursorParam = "__gw-cursor"
+
+const defaultPageFillMaxFetches = 5
+
+// pageFillCursor tells the gateway where a page-filled search left off: the upstream page to fetch,
+// relative to the FHIR base URL, and how many of its entries were already consumed.
+type pageFillCursor struct {
+	Page string `json:"p"`
+	Skip int    `json:"s,omitempty"`
+	// MAC binds the cursor to the resource type and caller it was issued for.
+	MAC string `json:"m,omitempty"`
+}
+
+func (c pageFillCursor) mac(key []byte, resourceType, uid string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join([]string{resourceType, uid, c.Page, strconv.Itoa(c.Skip)}, "\n")))
+	return mac.Sum(nil)
+}
+
+// encode signs the cursor for a search of resourceType by uid.
+func (c pageFillCursor) encode(key []byte, resourceType, uid string) string {
+	c.MAC = base64.RawURLEncoding.EncodeToString(c.mac(key, resourceType, uid))
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodePageFillCursor parses a cursor the gateway issued to uid for a search of resourceType. The
+// page must be a search of that type relative to the FHIR base URL, so a cursor cannot point the
+// gateway at another host or resource type.
+func decodePageFillCursor(s string, key []byte, resourceType, uid string) (pageFillCursor, error) {
+	var c pageFillCursor
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(c.MAC)
+	if err != nil || !hmac.Equal(sig, c.mac(key, resourceType, uid)) {
+		return c, errors.New("cursor was not issued for this search")
+	}
+
+	u, err := url.Parse(c.Page)
+	if err != nil {
+		return c, err
+	}
+	if u.Scheme != "" || u.Host != "" || strings.Contains(u.Path, "..") || c.Skip < 0 || !isSearchPageOf(c.Page, resourceType) {
+		return c, fmt.Errorf("invalid page in cursor: %q", c.Page)
+	}
+	return c, nil
+}
+
+// isSearchPageOf reports whether page is a search of resourceType: "Type?query", or a paging link
+// Blaze generates in the "Type/__page" form.
+func isSearchPageOf(page, resourceType string) bool {
+	if resourceType == "" {
+		return false
+	}
+	if strings.HasPrefix(page, resourceType+"?") {
+		return true
+	}
+	rest, ok := strings.CutPrefix(page, resourceType+"/__page")
+	return ok && (rest == "" || strings.HasPrefix(rest, "?") || strings.HasPrefix(rest, "/"))
+}
+
+// pageFillCursorKey signs the cursors of page-filled searches; without one, searches are not
+// page-filled.
+func (m *Middlewares) pageFillCursorKey() []byte {
+	if m.InternalConfig == nil {
+		return nil
+	}
+	return []byte(m.InternalConfig.FHIR.PageFillCursorKey)
+}
+
+// pageFillCount reports whether the request should be page-filled and how many visible entries it
+// asks for. Only filtered type-level searches that carry an explicit _count are page-filled, and only
+// when enabled in the FHIR config.
+func (m *Middlewares) pageFillCount(r *http.Request, path string, scope responseFilterScope) (int, bool) {
+	if m.InternalConfig == nil || !m.InternalConfig.FHIR.PageFillEnabled || len(m.pageFillCursorKey()) == 0 {
+		return 0, false
+	}
+	if r.Method != http.MethodGet || !scope.filtersBody() {
+		return 0, false
+	}
+	if path == "" || strings.Contains(path, "/") || strings.HasPrefix(path, "_") || strings.HasPrefix(path, "$") {
+		return 0, false
+	}
+	// Public resources are never removed by the filters, so there is nothing to fill.
+	if utils.IsPublicResource(path) {
+		return 0, false
+	}
+
+	count, err := strconv.Atoi(r.URL.Query().Get("_count"))
+	if err != nil || count <= 0 {
+		return 0, false
+	}
+	return count, true
+}
+
+// searchPage is the part of an upstream search Bundle page-filling needs.
+type searchPage struct {
+	Link []struct {
+		Relation string `json:"relation"`
+		URL      string `json:"url"`
+	} `json:"link"`
+	Entry []json.RawMessage `json:"entry"`
+}
+
+func (p searchPage) next() string {
+	for _, l := range p.Link {
+		if l.Relation == "next" {
+			return l.URL
+		}
+	}
+	return ""
+}
+
+// pageFilledBundle is the stitched searchset returned to the client.
+type pageFilledBundle struct {
+	ResourceType string            `json:"resourceType"`
+	Type         string            `json:"type"`
+	Link         []pageFilledLink  `json:"link,omitempty"`
+	Entry        []json.RawMessage `json:"entry"`
+}
+
+type pageFilledLink struct {
+	Relation string `json:"relation"`
+	URL      string `json:"url"`
+}
+
+// servePageFilledSearch answers a filtered search by following the upstream next links until count
+// visible matches are collected or PageFillMaxFetches pages were fetched. The stitched Bundle links
+// to the rest of the results through a gateway cursor instead of the upstream paging links, and has
+// no total since the number of visible matches is unknown.
+func (m *Middlewares) servePageFilledSearch(w http.ResponseWriter, r *http.Request, client *http.Client, target, resourceType string, count int, reqBody []byte, scope responseFilterScope) {
+	base, err := url.Parse(strings.TrimRight(target, "/"))
+	if err != nil {
+		utils.BuildErrorResponse(m.Log, w, exceptions.ErrServerProcess(err))
+		return
+	}
+
+	key := m.pageFillCursorKey()
+	uid, _ := r.Context().Value(keyUID).(string)
+	query := r.URL.Query()
+	page := pageFillCursor{Page: resourceType + "?" + r.URL.RawQuery}
+	if raw := query.Get(pageFillCursorParam); raw != "" {
+		if page, err = decodePageFillCursor(raw, key, resourceType, uid); err != nil {
+			utils.BuildErrorResponse(m.Log, w, exceptions.ErrInvalidFormat(err, pageFillCursorParam))
+			return
+		}
+		// the search policy saw only the cursor, so the search it continues is checked here
+		if m.SearchPolicy != nil {
+			pageURL, _ := url.Parse(page.Page)
+			roles, _ := r.Context().Value(keyRoles).([]string)
+			if violation := m.SearchPolicy.check(roles, resourceType, pageURL.Query()); violation != nil {
+				m.writeOperationOutcome(w, violation.StatusCode, violation.outcome())
+				return
+			}
+		}
+	}
+
+	f := m.newBundleEntryFilter(r, scope)
+
+	var entries []json.RawMessage
+	matches := 0
+	var resume *pageFillCursor
+
+	maxFetches := m.InternalConfig.FHIR.PageFillMaxFetches
+	if maxFetches <= 0 {
+		maxFetches = defaultPageFillMaxFetches
+	}
+
+	for fetches := 0; ; fetches++ {
+		if fetches == maxFetches {
+			resume = &page
+			break
+		}
+
+		sp, err := m.fetchSearchPage(r.Context(), client, r.Header, base.String()+"/"+page.Page)
+		if err != nil {
+			utils.BuildErrorResponse(m.Log, w, err)
+			return
+		}
+
+		for i := page.Skip; i < len(sp.Entry); i++ {
+			raw, ok := f.keep(sp.Entry[i])
+			if !ok {
+				continue
+			}
+			entries = append(entries, raw)
+			if gjson.GetBytes(raw, "search.mode").String() != "include" {
+				matches++
+			}
+			if matches >= count && i+1 < len(sp.Entry) {
+				resume = &pageFillCursor{Page: page.Page, Skip: i + 1}
+				break
+			}
+		}
+		entries = append(entries, f.release()...)
+
+		if resume != nil {
+			break
+		}
+
+		next, ok := relativeToBase(base, sp.next())
+		if !ok {
+			break
+		}
+		page = pageFillCursor{Page: next}
+		if matches >= count {
+			resume = &page
+			break
+		}
+	}
+
+	gateway := m.gatewayFHIRBase()
+	out := pageFilledBundle{
+		ResourceType: "Bundle",
+		Type:         "searchset",
+		Link:         []pageFilledLink{{Relation: "self", URL: gateway + strings.TrimPrefix(r.URL.Path, "/fhir") + "?" + r.URL.RawQuery}},
+		Entry:        entries,
+	}
+	if entries == nil {
+		out.Entry = []json.RawMessage{}
+	}
+	if resume != nil {
+		q := url.Values{}
+		q.Set("_count", strconv.Itoa(count))
+		q.Set(pageFillCursorParam, resume.encode(key, resourceType, uid))
+		out.Link = append(out.Link, pageFilledLink{Relation: "next", URL: gateway + "/" + resourceType + "?" + q.Encode()})
+	}
+
+	body, err := json.Marshal(out)
+	if err != nil {
+		utils.BuildErrorResponse(m.Log, w, exceptions.ErrServerProcess(err))
+		return
+	}
+
+	postHookErrMsgs := m.runPostFHIRProxyHooks(r, reqBody, http.StatusOK, body)
+
+	w.Header().Set("Content-Type", "application/fhir+json")
+	setPostFHIRHookErrorHeader(w, postHookErrMsgs)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(body); err != nil {
+		m.Log.Warn("failed writing response body", zap.Error(err))
+	}
+
+	m.logFilteredEntries(r, scope, f.removedRBAC, f.removedOwnership)
+}
+
+// fetchSearchPage reads one upstream search page. The returned error is ready to be passed to
+// utils.BuildErrorResponse.
+func (m *Middlewares) fetchSearchPage(ctx context.Context, client *http.Client, header http.Header, pageURL string) (searchPage, error) {
+	var sp searchPage
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return sp, exceptions.ErrCreateHTTPRequest(err)
+	}
+	req.Header = header.Clone()
+	req.Header.Set("Accept", "application/fhir+json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return sp, exceptions.ErrSendHTTPRequest(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return sp, exceptions.ErrReadBody(err)
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return sp, upstreamFHIRError(resp.StatusCode, body)
+	}
+
+	decoded, _, err := decodeBodyForFiltering(body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return sp, exceptions.ErrServerProcess(err)
+	}
+	if gjson.GetBytes(decoded, "resourceType").String() != "Bundle" {
+		return sp, exceptions.ErrServerProcess(fmt.Errorf("search returned a non-Bundle response"))
+	}
+	if err := json.Unmarshal(decoded, &sp); err != nil {
+		return sp, exceptions.ErrServerProcess(err)
+	}
+	return sp, nil
+}
+
+// relativeToBase turns an upstream paging link into a page relative to base. The FHIR server may
+// know itself under a different host than the one the gateway uses, so only the path is compared.
+func relativeToBase(base *url.URL, link string) (string, bool) {
+	if link == "" {
+		return "", false
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", false
+	}
+
+	prefix := strings.TrimRight(base.Path, "/") + "/"
+	if !strings.HasPrefix(u.Path, prefix) {
+		return "", false
+	}
+
+	page := strings.TrimPrefix(u.Path, prefix)
+	if u.RawQuery != "" {
+		page += "?" + u.RawQuery
+	}
+	return page, page != ""
+}
@@ -0,0 +1,223 @@
+package middlewares
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"konsulin-service/internal/app/config"
+	"konsulin-service/internal/pkg/constvars"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// pagedUpstream serves three search pages of Observations. Blaze advertises itself under a different
+// host than the gateway uses, as it does behind docker networking.
+func pagedUpstream(t *testing.T, fetched *[]string) *httptest.Server {
+	pages := map[string][]string{
+		"":  {"p2", "p1"},
+		"2": {"p2", "p2"},
+		"3": {"p1", "p1", "p1"},
+	}
+	next := map[string]string{"": "2", "2": "3"}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.URL.Query().Get(pageFillCursorParam), "gateway cursor must not reach the FHIR server")
+
+		pageID := r.URL.Query().Get("__page-id")
+		*fetched = append(*fetched, pageID)
+
+		var entries []string
+		for i, patient := range pages[pageID] {
+			entries = append(entries, fmt.Sprintf(`{"resource":{"resourceType":"Observation","id":"o%s-%d","subject":{"reference":"Patient/%s"}},"search":{"mode":"match"}}`, pageID, i, patient))
+		}
+		links := `{"relation":"self","url":"http://blaze-internal/fhir/Observation"}`
+		if n, ok := next[pageID]; ok {
+			links += fmt.Sprintf(`,{"relation":"next","url":"http://blaze-internal/fhir/Observation?_count=2&__t=1&__page-id=%s"}`, n)
+		}
+
+		w.Header().Set("Content-Type", "application/fhir+json")
+		_, _ = fmt.Fprintf(w, `{"resourceType":"Bundle","type":"searchset","link":[%s],"entry":[%s]}`, links, strings.Join(entries, ","))
+	}))
+}
+
+var pageFillTestKey = []byte("page-fill-test-key")
+
+func pageFillRequest(target string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	ctx := context.WithValue(req.Context(), keyRoles, []string{constvars.KonsulinRolePatient})
+	ctx = context.WithValue(ctx, keyUID, "st-user-1")
+	ctx = context.WithValue(ctx, keyFHIRRole, constvars.KonsulinRolePatient)
+	ctx = context.WithValue(ctx, keyFHIRID, "p1")
+	return req.WithContext(ctx)
+}
+
+func decodePageFilled(t *testing.T, rr *httptest.ResponseRecorder) (ids []string, next string) {
+	t.Helper()
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var b struct {
+		Total *int             `json:"total"`
+		Link  []pageFilledLink `json:"link"`
+		Entry []struct {
+			Resource struct {
+				ID string `json:"id"`
+			} `json:"resource"`
+		} `json:"entry"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &b))
+	assert.Nil(t, b.Total)
+
+	for _, e := range b.Entry {
+		ids = append(ids, e.Resource.ID)
+	}
+	for _, l := range b.Link {
+		if l.Relation == "next" {
+			next = l.URL
+		}
+	}
+	return ids, next
+}
+
+func TestBridge_PageFill(t *testing.T) {
+	var fetched []string
+	upstream := pagedUpstream(t, &fetched)
+	defer upstream.Close()
+
+	newMiddlewares := func(maxFetches int) *Middlewares {
+		return &Middlewares{
+			Log: zap.NewNop(),
+			InternalConfig: &config.InternalConfig{
+				App:  config.App{BaseUrl: "https://api.konsulin.care/api/v1"},
+				FHIR: config.AppFHIR{BaseUrl: upstream.URL + "/fhir/", PageFillEnabled: true, PageFillMaxFetches: maxFetches, PageFillCursorKey: string(pageFillTestKey)},
+			},
+		}
+	}
+
+	t.Run("Fills the page and resumes mid-page through the cursor", func(t *testing.T) {
+		fetched = nil
+		m := newMiddlewares(5)
+
+		rr := httptest.NewRecorder()
+		m.Bridge(upstream.URL+"/fhir/").ServeHTTP(rr, pageFillRequest("/fhir/Observation?_count=2"))
+
+		ids, next := decodePageFilled(t, rr)
+		assert.Equal(t, []string{"o-1", "o3-0"}, ids)
+		assert.Equal(t, []string{"", "2", "3"}, fetched)
+		require.True(t, strings.HasPrefix(next, "https://api.konsulin.care/fhir/Observation?"), next)
+
+		u, err := url.Parse(next)
+		require.NoError(t, err)
+
+		fetched = nil
+		rr = httptest.NewRecorder()
+		m.Bridge(upstream.URL+"/fhir/").ServeHTTP(rr, pageFillRequest(u.RequestURI()))
+
+		ids, next = decodePageFilled(t, rr)
+		assert.Equal(t, []string{"o3-1", "o3-2"}, ids)
+		assert.Equal(t, []string{"3"}, fetched)
+		assert.Empty(t, next, "no further pages upstream")
+	})
+
+	t.Run("Stops at the fetch budget and links to the next upstream page", func(t *testing.T) {
+		fetched = nil
+		m := newMiddlewares(1)
+
+		rr := httptest.NewRecorder()
+		m.Bridge(upstream.URL+"/fhir/").ServeHTTP(rr, pageFillRequest("/fhir/Observation?_count=2"))
+
+		ids, next := decodePageFilled(t, rr)
+		assert.Equal(t, []string{"o-1"}, ids)
+		assert.Equal(t, []string{""}, fetched)
+
+		u, err := url.Parse(next)
+		require.NoError(t, err)
+		c, err := decodePageFillCursor(u.Query().Get(pageFillCursorParam), pageFillTestKey, "Observation", "st-user-1")
+		require.NoError(t, err)
+		assert.Equal(t, "Observation?_count=2&__t=1&__page-id=2", c.Page)
+		assert.Zero(t, c.Skip)
+	})
+
+	t.Run("Disabled by default", func(t *testing.T) {
+		fetched = nil
+		m := newMiddlewares(5)
+		m.InternalConfig.FHIR.PageFillEnabled = false
+
+		rr := httptest.NewRecorder()
+		m.Bridge(upstream.URL+"/fhir/").ServeHTTP(rr, pageFillRequest("/fhir/Observation?_count=2"))
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, []string{""}, fetched)
+	})
+
+	t.Run("Disabled without a cursor key", func(t *testing.T) {
+		fetched = nil
+		m := newMiddlewares(5)
+		m.InternalConfig.FHIR.PageFillCursorKey = ""
+
+		rr := httptest.NewRecorder()
+		m.Bridge(upstream.URL+"/fhir/").ServeHTTP(rr, pageFillRequest("/fhir/Observation?_count=2"))
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, []string{""}, fetched)
+	})
+
+	t.Run("Rejects cursors it did not issue", func(t *testing.T) {
+		fetched = nil
+		m := newMiddlewares(5)
+		forged := pageFillCursor{Page: "AuditEvent?_count=2"}.encode([]byte("another-key"), "Observation", "st-user-1")
+
+		rr := httptest.NewRecorder()
+		m.Bridge(upstream.URL+"/fhir/").ServeHTTP(rr, pageFillRequest("/fhir/Observation?_count=2&"+pageFillCursorParam+"="+forged))
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Empty(t, fetched)
+	})
+
+	t.Run("Checks the continued search against the search policy", func(t *testing.T) {
+		fetched = nil
+		m := newMiddlewares(5)
+		m.SearchPolicy = &SearchPolicy{rules: []SearchRule{{Role: constvars.KonsulinRolePatient, ResourceType: "Observation", Params: []string{"subject"}}}}
+		cursor := pageFillCursor{Page: "Observation?_count=2&code=1234"}.encode(pageFillTestKey, "Observation", "st-user-1")
+
+		rr := httptest.NewRecorder()
+		m.Bridge(upstream.URL+"/fhir/").ServeHTTP(rr, pageFillRequest("/fhir/Observation?_count=2&"+pageFillCursorParam+"="+cursor))
+
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.Empty(t, fetched)
+	})
+}
+
+func TestDecodePageFillCursor_RejectsForeignPages(t *testing.T) {
+	decode := func(c pageFillCursor, resourceType, uid string) error {
+		_, err := decodePageFillCursor(c.encode(pageFillTestKey, "Observation", "st-user-1"), pageFillTestKey, resourceType, uid)
+		return err
+	}
+
+	for _, page := range []string{"", "http://evil/fhir/Observation?a=1", "//evil/Observation?a=1", "/Observation?a=1", "../admin", "AuditEvent?patient=p2", "Observation/o1", "Observation/__page/../AuditEvent", "ObservationDefinition?a=1"} {
+		assert.Error(t, decode(pageFillCursor{Page: page}, "Observation", "st-user-1"), page)
+	}
+	assert.NoError(t, decode(pageFillCursor{Page: "Observation?_count=2"}, "Observation", "st-user-1"))
+	assert.NoError(t, decode(pageFillCursor{Page: "Observation/__page?__t=1&__page-id=2"}, "Observation", "st-user-1"))
+
+	page := pageFillCursor{Page: "Observation?_count=2"}
+	assert.Error(t, decode(page, "Condition", "st-user-1"), "cursors are bound to the resource type")
+	assert.Error(t, decode(page, "Observation", "st-user-2"), "cursors are bound to the caller")
+
+	tampered := pageFillCursor{Page: "Observation?_count=2", Skip: 1}
+	tampered.MAC = base64.RawURLEncoding.EncodeToString(page.mac(pageFillTestKey, "Observation", "st-user-1"))
+	raw, _ := json.Marshal(tampered)
+	_, err := decodePageFillCursor(base64.RawURLEncoding.EncodeToString(raw), pageFillTestKey, "Observation", "st-user-1")
+	assert.Error(t, err)
+
+	_, err = decodePageFillCursor("not base64!", pageFillTestKey, "Observation", "st-user-1")
+	assert.Error(t, err)
+}
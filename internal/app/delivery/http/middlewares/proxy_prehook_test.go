@@ -0,0 +1,112 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/fhir_dto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestBridge_PreFHIRProxyHooks(t *testing.T) {
+	var forwarded struct {
+		body   string
+		query  string
+		header string
+		calls  int
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		forwarded.body = string(b)
+		forwarded.query = r.URL.RawQuery
+		forwarded.header = r.Header.Get("X-Provenance")
+		forwarded.calls++
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(b)
+	}))
+	defer upstream.Close()
+
+	newRequest := func() *http.Request {
+		body := []byte(`{"resourceType":"Observation"}`)
+		req := httptest.NewRequest(http.MethodPost, "/fhir/Observation?_pretty=true", bytes.NewReader(body))
+		return req.WithContext(context.WithValue(req.Context(), constvars.CONTEXT_RAW_BODY, body))
+	}
+
+	t.Run("Hooks mutate the forwarded request in order", func(t *testing.T) {
+		forwarded.calls = 0
+		m := &Middlewares{Log: zap.NewNop()}
+		m.PreFHIRProxyHooks = []PreFHIRProxyHook{
+			func(req *PreFHIRProxyRequest) error {
+				req.Body = []byte(`{"resourceType":"Observation","meta":{"tag":[{"code":"gateway"}]}}`)
+				req.Header.Set("X-Provenance", "gateway")
+				return nil
+			},
+			func(req *PreFHIRProxyRequest) error {
+				assert.Contains(t, string(req.Body), "gateway", "later hooks see earlier changes")
+				req.Query.Del("_pretty")
+				return nil
+			},
+		}
+
+		req := newRequest()
+		rr := httptest.NewRecorder()
+		m.Bridge(upstream.URL).ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusCreated, rr.Code)
+		assert.JSONEq(t, `{"resourceType":"Observation","meta":{"tag":[{"code":"gateway"}]}}`, forwarded.body)
+		assert.Empty(t, forwarded.query)
+		assert.Equal(t, "gateway", forwarded.header)
+		assert.Empty(t, req.Header.Get("X-Provenance"), "the caller's request is not modified")
+	})
+
+	t.Run("Rejection answers with an OperationOutcome and skips the rest", func(t *testing.T) {
+		forwarded.calls = 0
+		secondRan := false
+		m := &Middlewares{Log: zap.NewNop()}
+		m.PreFHIRProxyHooks = []PreFHIRProxyHook{
+			func(*PreFHIRProxyRequest) error {
+				return NewPreFHIRProxyHookError(http.StatusUnprocessableEntity, "business-rule", "not allowed", "Observation.status")
+			},
+			func(*PreFHIRProxyRequest) error {
+				secondRan = true
+				return nil
+			},
+		}
+
+		rr := httptest.NewRecorder()
+		m.Bridge(upstream.URL).ServeHTTP(rr, newRequest())
+
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+		assert.Equal(t, "application/fhir+json", rr.Header().Get("Content-Type"))
+		assert.False(t, secondRan)
+		assert.Zero(t, forwarded.calls)
+
+		var outcome fhir_dto.OperationOutcome
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &outcome))
+		assert.Equal(t, "OperationOutcome", outcome.ResourceType)
+		require.Len(t, outcome.Issue, 1)
+		assert.Equal(t, "business-rule", outcome.Issue[0].Code)
+		assert.Equal(t, []string{"Observation.status"}, outcome.Issue[0].Expression)
+	})
+
+	t.Run("Plain errors are internal failures", func(t *testing.T) {
+		m := &Middlewares{Log: zap.NewNop()}
+		m.PreFHIRProxyHooks = []PreFHIRProxyHook{func(*PreFHIRProxyRequest) error { return errors.New("db down") }}
+
+		rr := httptest.NewRecorder()
+		m.Bridge(upstream.URL).ServeHTTP(rr, newRequest())
+
+		assert.Equal(t, http.StatusInternalServerError, rr.Code)
+		assert.NotContains(t, rr.Body.String(), "db down")
+	})
+}
@@ -0,0 +1,621 @@
+package middlewares
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"konsulin-service/internal/app/services/shared/deidentify"
+	"konsulin-service/internal/pkg/exceptions"
+	"konsulin-service/internal/pkg/utils"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+)
+
+// streamPeekSize is how many decoded bytes are inspected to detect whether a response is a Bundle.
+// FHIR servers emit resourceType as the first member, so a few KB is plenty.
+const streamPeekSize = 4096
+
+// newDecodingReader wraps body with a streaming decoder for the given Content-Encoding.
+// Unknown encodings result in an error so the caller can fail closed.
+func newDecodingReader(body io.Reader, contentEncoding string) (io.ReadCloser, bodyEncoding, error) {
+	ce := strings.ToLower(strings.TrimSpace(contentEncoding))
+
+	switch ce {
+	case "br":
+		return io.NopCloser(brotli.NewReader(body)), bodyEncodingBrotli, nil
+	case "gzip":
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, "", err
+		}
+		return gr, bodyEncodingGzip, nil
+	case "identity", "":
+		return io.NopCloser(body), bodyEncodingIdentity, nil
+	case "zstd":
+		zr, err := zstd.NewReader(body)
+		if err != nil {
+			return nil, "", err
+		}
+		return zr.IOReadCloser(), bodyEncodingZstd, nil
+	default:
+		return nil, "", fmt.Errorf("unknown content encoding: %s", ce)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newEncodingWriter wraps w with a streaming encoder for enc. Close must be called to flush
+// the trailing compressed frame.
+func newEncodingWriter(w io.Writer, enc bodyEncoding) (io.WriteCloser, error) {
+	switch enc {
+	case bodyEncodingBrotli:
+		// BestCompression is too slow to keep up with a streamed multi-megabyte body.
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression), nil
+	case bodyEncodingGzip:
+		return gzip.NewWriter(w), nil
+	case bodyEncodingZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// bundleEntryFilter applies the RBAC and ownership response rules to bundle entries one at a time.
+//
+// Practitioners may see a resource that is not directly owned when an owned resource references it,
+// and the referencing entry can come later in the stream. Such entries are held back and emitted at
+// the end of the entry array once every owned resource has been seen; only denied entries are held,
+// so memory stays bounded by what the caller is not allowed to see. Entries a search included are
+// held the same way until the entries they are linked to have been seen.
+type bundleEntryFilter struct {
+	m     *Middlewares
+	roles []string
+	rbac  bool
+	// oc is nil when ownership filtering is not required.
+	oc          *ownershipContext
+	allowedRefs map[string]struct{}
+	held        []heldEntry
+	includes    *searchIncludes
+	// trackIncludes is set when the search asked for included resources, so kept matches are recorded.
+	trackIncludes bool
+	heldIncludes  []heldInclude
+	versions      *historyVersions
+	heldDeleted   []heldDeletion
+	// redactor is nil when no redaction rule applies to the caller.
+	redactor *fieldRedactor
+	// deid is nil unless the caller only receives de-identified data. Entries counted in cells are
+	// held until the whole Bundle is seen, so small cells can be suppressed.
+	deid      *deidentify.Engine
+	cells     *deidentify.Cells
+	heldCells []heldCell
+	// audit is nil when the audit trail is disabled.
+	audit *proxyAudit
+
+	removedRBAC       int
+	removedOwnership  int
+	removedRedaction  int
+	removedSuppressed int
+	redacted          int
+}
+
+type heldEntry struct {
+	raw  json.RawMessage
+	info entryOwnership
+}
+
+type heldInclude struct {
+	raw      json.RawMessage
+	resource json.RawMessage
+	info     includedEntry
+}
+
+// heldCell is a de-identified entry waiting for the size of its cell to be known.
+type heldCell struct {
+	raw  json.RawMessage
+	cell string
+}
+
+// heldDeletion is a deleted version of a history Bundle, waiting for a version of ref to be kept.
+type heldDeletion struct {
+	raw json.RawMessage
+	ref string
+}
+
+// newBundleEntryFilter builds the entry filter for the caller described by scope.
+func (m *Middlewares) newBundleEntryFilter(r *http.Request, scope responseFilterScope) *bundleEntryFilter {
+	f := &bundleEntryFilter{
+		m:           m,
+		roles:       scope.roles,
+		rbac:        scope.needsRBAC,
+		allowedRefs: make(map[string]struct{}),
+		redactor:    scope.redactor,
+		deid:        scope.deid,
+		audit:       scope.audit,
+	}
+	if f.deid != nil {
+		f.cells = f.deid.NewCells()
+	}
+	if scope.needsOwnership {
+		f.oc = m.buildOwnershipContext(r.Context(), scope.roles, scope.fhirRole, scope.fhirID)
+		f.includes = newSearchIncludes(m, scope.roles, f.oc)
+		f.versions = newHistoryVersions()
+		for name := range r.URL.Query() {
+			if strings.HasPrefix(name, searchParamInclude) || strings.HasPrefix(name, searchParamRevinclude) {
+				f.trackIncludes = true
+			}
+		}
+	}
+	return f
+}
+
+// keep reports whether an entry may be written immediately and returns it with the caller's
+// redactions applied. Entries that are denied by ownership are held and reconsidered by release.
+func (f *bundleEntryFilter) keep(raw json.RawMessage) (json.RawMessage, bool) {
+	var e struct {
+		Resource json.RawMessage `json:"resource"`
+		Search   struct {
+			Mode string `json:"mode"`
+		} `json:"search"`
+		Request json.RawMessage `json:"request"`
+	}
+	if err := json.Unmarshal(raw, &e); err != nil {
+		// an entry that is not even an object cannot be judged; treat like an unreadable resource
+		e.Resource = nil
+	}
+
+	if f.rbac && !f.m.entryAllowedByRBAC(e.Resource, f.roles) {
+		f.removedRBAC++
+		return nil, false
+	}
+
+	if f.oc == nil {
+		return f.accept(raw)
+	}
+
+	switch {
+	case isHistoryEntry(e.Search.Mode, e.Request):
+		return f.keepVersion(raw, e.Resource, e.Request)
+	case e.Search.Mode == searchModeInclude:
+		return f.keepIncluded(raw, e.Resource)
+	case e.Search.Mode == "":
+		return f.keepOwnedOrReferenced(raw, e.Resource)
+	default:
+		return f.keepMatch(raw, e.Resource)
+	}
+}
+
+// keepMatch judges a search result on its own ownership.
+func (f *bundleEntryFilter) keepMatch(raw, resource json.RawMessage) (json.RawMessage, bool) {
+	info := f.m.evaluateEntryOwnership(resource, f.oc, nil)
+	if !info.owned {
+		f.m.Log.Info("removing resource from bundle", zap.String("resourceType", info.resourceType), zap.String("resourceID", info.id))
+		f.removedOwnership++
+		return nil, false
+	}
+	if f.trackIncludes {
+		f.includes.add(resource, info.resourceType, info.id)
+	}
+	return f.accept(raw)
+}
+
+// keepVersion judges a version of a history Bundle on its own ownership, and holds a deleted version
+// until it is known whether a version of the same resource is kept.
+func (f *bundleEntryFilter) keepVersion(raw, resource, request json.RawMessage) (json.RawMessage, bool) {
+	if len(resource) == 0 {
+		f.heldDeleted = append(f.heldDeleted, heldDeletion{raw: raw, ref: deletedResource(request)})
+		return nil, false
+	}
+	info := f.m.evaluateEntryOwnership(resource, f.oc, nil)
+	if !info.owned {
+		f.m.Log.Info("removing resource from bundle", zap.String("resourceType", info.resourceType), zap.String("resourceID", info.id))
+		f.removedOwnership++
+		return nil, false
+	}
+	f.versions.add(info.resourceType, info.id)
+	return f.accept(raw)
+}
+
+// keepIncluded keeps an included resource linked to an entry already kept, and holds it otherwise.
+func (f *bundleEntryFilter) keepIncluded(raw, resource json.RawMessage) (json.RawMessage, bool) {
+	inc := f.includes.entry(resource)
+	if f.includes.allows(inc) {
+		f.includes.add(resource, inc.resourceType, inc.id)
+		return f.accept(raw)
+	}
+	f.heldIncludes = append(f.heldIncludes, heldInclude{raw: raw, resource: resource, info: inc})
+	return nil, false
+}
+
+// keepOwnedOrReferenced keeps an owned entry, and holds it for practitioners until it is known
+// whether an owned entry references it.
+func (f *bundleEntryFilter) keepOwnedOrReferenced(raw, resource json.RawMessage) (json.RawMessage, bool) {
+	info := f.m.evaluateEntryOwnership(resource, f.oc, f.allowedRefs)
+	if info.owned {
+		return f.accept(raw)
+	}
+
+	if f.oc.HasPractitionerRole {
+		f.held = append(f.held, heldEntry{raw: raw, info: info})
+		return nil, false
+	}
+
+	f.m.Log.Info("removing resource from bundle", zap.String("resourceType", info.resourceType), zap.String("resourceID", info.id))
+	f.removedOwnership++
+	return nil, false
+}
+
+// release returns the held entries that turned out to be referenced by an owned resource, the
+// included entries that turned out to be linked to a kept one, and the deleted versions of resources
+// with a kept version.
+func (f *bundleEntryFilter) release() []json.RawMessage {
+	var out []json.RawMessage
+	for _, h := range f.held {
+		if h.info.referencedBy(f.allowedRefs) {
+			if raw, ok := f.accept(h.raw); ok {
+				out = append(out, raw)
+			}
+			continue
+		}
+		f.m.Log.Info("removing resource from bundle", zap.String("resourceType", h.info.resourceType), zap.String("resourceID", h.info.id))
+		f.removedOwnership++
+	}
+	f.held = nil
+
+	if len(f.heldIncludes) > 0 {
+		pending := make([]includedEntry, len(f.heldIncludes))
+		resources := make([]json.RawMessage, len(f.heldIncludes))
+		for i, h := range f.heldIncludes {
+			pending[i], resources[i] = h.info, h.resource
+		}
+		for i, kept := range f.includes.resolve(pending, resources) {
+			if kept {
+				if raw, ok := f.accept(f.heldIncludes[i].raw); ok {
+					out = append(out, raw)
+				}
+				continue
+			}
+			f.m.Log.Info("removing resource from bundle", zap.String("resourceType", pending[i].resourceType), zap.String("resourceID", pending[i].id))
+			f.removedOwnership++
+		}
+		f.heldIncludes = nil
+	}
+
+	for _, h := range f.heldDeleted {
+		if f.versions.allowsDeleted(h.ref) {
+			if raw, ok := f.accept(h.raw); ok {
+				out = append(out, raw)
+			}
+			continue
+		}
+		f.m.Log.Info("removing deleted version from bundle", zap.String("resource", h.ref))
+		f.removedOwnership++
+	}
+	f.heldDeleted = nil
+	return append(out, f.releaseCells()...)
+}
+
+// accept applies the caller's field redactions to an entry that passed the filters and records it
+// for the audit trail. An entry that cannot be redacted is dropped rather than sent unmasked.
+func (f *bundleEntryFilter) accept(raw json.RawMessage) (json.RawMessage, bool) {
+	if f.redactor != nil {
+		redacted, changed, err := f.redactor.redactEntry(raw)
+		if err != nil {
+			f.m.Log.Warn("failed to redact bundle entry; dropping it", zap.Error(err))
+			f.removedRedaction++
+			return nil, false
+		}
+		if changed {
+			f.redacted++
+		}
+		raw = redacted
+	}
+	if f.deid != nil {
+		deidentified, cell, err := f.deid.Entry(raw)
+		if err != nil {
+			f.m.Log.Warn("failed to de-identify bundle entry; dropping it", zap.Error(err))
+			f.removedRedaction++
+			return nil, false
+		}
+		raw = deidentified
+		if cell != "" {
+			f.cells.Add(cell)
+			f.heldCells = append(f.heldCells, heldCell{raw: raw, cell: cell})
+			return nil, false
+		}
+	}
+	f.audit.recordEntry(raw)
+	return raw, true
+}
+
+// releaseCells returns the held de-identified entries whose cell reached the minimum cell size.
+func (f *bundleEntryFilter) releaseCells() []json.RawMessage {
+	var out []json.RawMessage
+	for _, h := range f.heldCells {
+		if !f.cells.Keeps(h.cell) {
+			f.removedSuppressed++
+			continue
+		}
+		f.audit.recordEntry(h.raw)
+		out = append(out, h.raw)
+	}
+	if f.removedSuppressed > 0 {
+		f.m.Log.Info("suppressed small cells from bundle", zap.Int("removed", f.removedSuppressed))
+	}
+	f.heldCells = nil
+	return out
+}
+
+func (f *bundleEntryFilter) removed() int {
+	return f.removedRBAC + f.removedOwnership + f.removedRedaction + f.removedSuppressed
+}
+
+// streamFilterBundle copies a FHIR Bundle JSON document from src to dst, passing every element of
+// the top-level "entry" array through f. "link" is passed through links, other members are copied
+// verbatim. "total" is written last so it can reflect the number of entries kept when anything was
+// removed.
+func streamFilterBundle(src io.Reader, dst io.Writer, f *bundleEntryFilter, links *bundleLinkRewriter) error {
+	dec := json.NewDecoder(src)
+	bw := bufio.NewWriter(dst)
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	if err := bw.WriteByte('{'); err != nil {
+		return err
+	}
+
+	var total json.RawMessage
+	kept := 0
+	first := true
+	writeKey := func(key string) error {
+		if !first {
+			if err := bw.WriteByte(','); err != nil {
+				return err
+			}
+		}
+		first = false
+		k, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		if _, err := bw.Write(k); err != nil {
+			return err
+		}
+		return bw.WriteByte(':')
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("unexpected token %v in bundle", tok)
+		}
+
+		switch key {
+		case "total":
+			if err := dec.Decode(&total); err != nil {
+				return err
+			}
+		case "entry":
+			if err := writeKey(key); err != nil {
+				return err
+			}
+			n, err := streamFilterEntries(dec, bw, f)
+			if err != nil {
+				return err
+			}
+			kept = n
+		default:
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return err
+			}
+			if key == "link" {
+				if raw, err = links.rewrite(raw); err != nil {
+					return err
+				}
+			}
+			if err := writeKey(key); err != nil {
+				return err
+			}
+			if _, err := bw.Write(raw); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return err
+	}
+
+	if total != nil {
+		if err := writeKey("total"); err != nil {
+			return err
+		}
+		if f.removed() > 0 {
+			total = json.RawMessage(strconv.Itoa(kept))
+		}
+		if _, err := bw.Write(total); err != nil {
+			return err
+		}
+	}
+
+	if err := bw.WriteByte('}'); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// streamFilterEntries copies the entry array the decoder is positioned at and returns how many
+// entries were written.
+func streamFilterEntries(dec *json.Decoder, bw *bufio.Writer, f *bundleEntryFilter) (int, error) {
+	if err := expectDelim(dec, '['); err != nil {
+		return 0, err
+	}
+	if err := bw.WriteByte('['); err != nil {
+		return 0, err
+	}
+
+	kept := 0
+	write := func(raw json.RawMessage) error {
+		if kept > 0 {
+			if err := bw.WriteByte(','); err != nil {
+				return err
+			}
+		}
+		kept++
+		_, err := bw.Write(raw)
+		return err
+	}
+
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return 0, err
+		}
+		entry, ok := f.keep(raw)
+		if !ok {
+			continue
+		}
+		if err := write(entry); err != nil {
+			return 0, err
+		}
+	}
+	if err := expectDelim(dec, ']'); err != nil {
+		return 0, err
+	}
+
+	for _, raw := range f.release() {
+		if err := write(raw); err != nil {
+			return 0, err
+		}
+	}
+
+	return kept, bw.WriteByte(']')
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("expected %q in bundle, got %v", want, tok)
+	}
+	return nil
+}
+
+// recordingReader remembers every byte read through it while recording is on, so a body that turns
+// out not to need streaming can be replayed exactly as the upstream sent it.
+type recordingReader struct {
+	r         io.Reader
+	buf       bytes.Buffer
+	recording bool
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if rr.recording && n > 0 {
+		rr.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// serveReadResponse serves a successful read response. Bundles are decoded, filtered entry by entry,
+// have their paging links rewritten and are re-encoded straight to the client without being buffered
+// whole; anything else is handed to serveBufferedResponse with the original upstream bytes.
+//
+// Headers are sent before a streamed Bundle has been fully read, so a decode error in the middle of
+// it cannot be turned into an error response. In that case the connection is aborted: the client only
+// ever receives a truncated, invalid document made of entries that already passed the filters.
+func (m *Middlewares) serveReadResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, reqBody []byte, scope responseFilterScope) {
+	raw := &recordingReader{r: resp.Body, recording: true}
+
+	decoded, enc, err := newDecodingReader(raw, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		if !scope.filtersBody() {
+			m.serveRecordedResponse(w, r, resp, raw, reqBody, scope)
+			return
+		}
+		m.Log.Warn("failed to decode response body for filtering; failing closed", zap.Error(err))
+		utils.BuildErrorResponse(m.Log, w, exceptions.ErrServerProcess(err))
+		return
+	}
+	defer decoded.Close()
+
+	br := bufio.NewReaderSize(decoded, streamPeekSize)
+	peek, perr := br.Peek(streamPeekSize)
+	if perr != nil && perr != io.EOF && perr != bufio.ErrBufferFull {
+		if !scope.filtersBody() {
+			m.serveRecordedResponse(w, r, resp, raw, reqBody, scope)
+			return
+		}
+		m.Log.Warn("failed to decode response body for filtering; failing closed", zap.Error(perr))
+		utils.BuildErrorResponse(m.Log, w, exceptions.ErrServerProcess(perr))
+		return
+	}
+
+	if !strings.EqualFold(gjson.GetBytes(peek, "resourceType").String(), "Bundle") {
+		m.serveRecordedResponse(w, r, resp, raw, reqBody, scope)
+		return
+	}
+	raw.recording = false
+	raw.buf = bytes.Buffer{}
+
+	postHookErrMsgs := m.runPostFHIRProxyHooks(r, reqBody, resp.StatusCode, nil)
+
+	f := m.newBundleEntryFilter(r, scope)
+
+	copyProxyResponseHeaders(w, resp)
+	// Whether anything is removed is only known at the end, so validators cannot be trusted.
+	w.Header().Del("ETag")
+	setPostFHIRHookErrorHeader(w, postHookErrMsgs)
+	w.WriteHeader(resp.StatusCode)
+
+	ew, err := newEncodingWriter(w, enc)
+	if err != nil {
+		m.Log.Warn("failed to encode filtered response body; failing closed", zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+
+	if err := streamFilterBundle(br, ew, f, m.newBundleLinkRewriter()); err != nil {
+		m.Log.Warn("streaming bundle filter failed; aborting response", zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+	if err := ew.Close(); err != nil {
+		m.Log.Warn("failed writing response body", zap.Error(err))
+		return
+	}
+
+	m.logFilteredEntries(r, scope, f.removedRBAC, f.removedOwnership)
+}
+
+// serveRecordedResponse reassembles the original upstream body from what the peek consumed plus the
+// unread remainder and serves it through the buffered path.
+func (m *Middlewares) serveRecordedResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, raw *recordingReader, reqBody []byte, scope responseFilterScope) {
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		utils.BuildErrorResponse(m.Log, w, exceptions.ErrReadBody(err))
+		return
+	}
+	respBody := append(raw.buf.Bytes(), rest...)
+
+	m.serveBufferedResponse(w, r, resp, respBody, reqBody, scope)
+}
@@ -0,0 +1,171 @@
+package middlewares
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"konsulin-service/internal/pkg/constvars"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const streamTestBundle = `{
+	"resourceType": "Bundle",
+	"type": "searchset",
+	"total": 3,
+	"link": [{"relation": "self", "url": "http://blaze/fhir/Observation"}],
+	"entry": [
+		{"fullUrl": "Observation/o1", "resource": {"resourceType": "Observation", "id": "o1", "subject": {"reference": "Patient/p1"}}},
+		{"fullUrl": "Observation/o2", "resource": {"resourceType": "Observation", "id": "o2", "subject": {"reference": "Patient/p2"}}},
+		{"fullUrl": "Observation/o3", "resource": {"resourceType": "Observation", "id": "o3", "subject": {"reference": "Patient/p1"}}}
+	]
+}`
+
+func decodeStreamedBundle(t *testing.T, body []byte) Bundle {
+	t.Helper()
+	var b Bundle
+	require.NoError(t, json.Unmarshal(body, &b), "streamed output should be valid JSON: %s", string(body))
+	return b
+}
+
+func TestStreamFilterBundle_Ownership(t *testing.T) {
+	m := &Middlewares{Log: zap.NewNop()}
+
+	t.Run("Patient sees only owned entries and total is fixed", func(t *testing.T) {
+		f := &bundleEntryFilter{
+			m:           m,
+			oc:          &ownershipContext{HasPatientRole: true, PatientIDs: map[string]struct{}{"p1": {}}, PractitionerIDs: map[string]struct{}{}},
+			allowedRefs: map[string]struct{}{},
+		}
+
+		var out bytes.Buffer
+		require.NoError(t, streamFilterBundle(bytes.NewReader([]byte(streamTestBundle)), &out, f, nil))
+
+		b := decodeStreamedBundle(t, out.Bytes())
+		assert.Len(t, b.Entry, 2)
+		require.NotNil(t, b.Total)
+		assert.Equal(t, 2, *b.Total)
+		assert.NotNil(t, b.Link, "non-entry members should be copied")
+		assert.Equal(t, 1, f.removedOwnership)
+	})
+
+	t.Run("Total is untouched when nothing is removed", func(t *testing.T) {
+		f := &bundleEntryFilter{m: m, allowedRefs: map[string]struct{}{}}
+
+		var out bytes.Buffer
+		require.NoError(t, streamFilterBundle(bytes.NewReader([]byte(streamTestBundle)), &out, f, nil))
+
+		b := decodeStreamedBundle(t, out.Bytes())
+		assert.Len(t, b.Entry, 3)
+		assert.Equal(t, 3, *b.Total)
+	})
+
+	t.Run("Practitioner keeps entries referenced by a later owned entry", func(t *testing.T) {
+		body := `{"resourceType":"Bundle","type":"searchset","entry":[
+			{"resource":{"resourceType":"Patient","id":"p9"}},
+			{"resource":{"resourceType":"Patient","id":"p8"}},
+			{"resource":{"resourceType":"Observation","id":"o1","performer":[{"reference":"Practitioner/pr1"}],"subject":{"reference":"Patient/p9"}}}
+		]}`
+		f := &bundleEntryFilter{
+			m:           m,
+			oc:          &ownershipContext{HasPractitionerRole: true, PatientIDs: map[string]struct{}{}, PractitionerIDs: map[string]struct{}{"pr1": {}}},
+			allowedRefs: map[string]struct{}{},
+		}
+
+		var out bytes.Buffer
+		require.NoError(t, streamFilterBundle(bytes.NewReader([]byte(body)), &out, f, nil))
+
+		b := decodeStreamedBundle(t, out.Bytes())
+		require.Len(t, b.Entry, 2)
+		assert.Contains(t, string(b.Entry[0].Resource), `"o1"`)
+		assert.Contains(t, string(b.Entry[1].Resource), `"p9"`)
+		assert.Nil(t, b.Total, "total must not be invented when upstream omitted it")
+	})
+
+	t.Run("Truncated input is an error", func(t *testing.T) {
+		f := &bundleEntryFilter{m: m, allowedRefs: map[string]struct{}{}}
+
+		var out bytes.Buffer
+		err := streamFilterBundle(bytes.NewReader([]byte(streamTestBundle[:200])), &out, f, nil)
+		assert.Error(t, err)
+	})
+}
+
+func TestBridge_StreamsFilteredBundle(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		_, _ = gw.Write([]byte(streamTestBundle))
+		_ = gw.Close()
+
+		w.Header().Set("Content-Type", "application/fhir+json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(buf.Bytes())
+	}))
+	defer upstream.Close()
+
+	m := &Middlewares{Log: zap.NewNop()}
+
+	req := httptest.NewRequest(http.MethodGet, "/fhir/Observation?subject=Patient/p1", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	ctx := context.WithValue(req.Context(), keyRoles, []string{constvars.KonsulinRolePatient})
+	ctx = context.WithValue(ctx, keyFHIRRole, constvars.KonsulinRolePatient)
+	ctx = context.WithValue(ctx, keyFHIRID, "p1")
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	m.Bridge(upstream.URL).ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+	assert.Empty(t, rr.Header().Get("Content-Length"))
+
+	gr, err := gzip.NewReader(rr.Body)
+	require.NoError(t, err)
+	decoded, err := io.ReadAll(gr)
+	require.NoError(t, err)
+
+	b := decodeStreamedBundle(t, decoded)
+	assert.Len(t, b.Entry, 2)
+	assert.Equal(t, 2, *b.Total)
+}
+
+func TestBridge_PostHooksSeeReadBundles(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/fhir+json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(streamTestBundle))
+	}))
+	defer upstream.Close()
+
+	var hookBody []byte
+	m := &Middlewares{Log: zap.NewNop(), PostFHIRProxyHooks: []PostFHIRProxyHook{{
+		Run: func(_ PostFHIRProxyUserRequestDetail, resp PostFHIRProxyFHIRServerResponse) error {
+			hookBody = resp.Body
+			return nil
+		},
+	}}}
+
+	req := httptest.NewRequest(http.MethodGet, "/fhir/Observation?subject=Patient/p1", nil)
+	ctx := context.WithValue(req.Context(), keyRoles, []string{constvars.KonsulinRolePatient})
+	ctx = context.WithValue(ctx, keyFHIRRole, constvars.KonsulinRolePatient)
+	ctx = context.WithValue(ctx, keyFHIRID, "p1")
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	m.Bridge(upstream.URL).ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NotNil(t, hookBody, "hooks get the search results instead of a streamed nil body")
+	assert.JSONEq(t, streamTestBundle, string(hookBody))
+	assert.Len(t, decodeStreamedBundle(t, rr.Body.Bytes()).Entry, 2, "the caller still gets the filtered bundle")
+}
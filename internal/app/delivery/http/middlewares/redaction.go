@@ -0,0 +1,363 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"konsulin-service/internal/pkg/constvars"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+)
+
+// redactionPolicyFile holds the field-level redaction rules. It lives next to rbac_policy.csv and is
+// hot-reloaded the same way.
+const redactionPolicyFile = "resources/redaction_policy.json"
+
+const (
+	generalizeYear  = "year"
+	generalizeMonth = "month"
+)
+
+// RedactionRule masks fields of one resource type for one role. Paths are dot-separated JSON member
+// names and descend through arrays, e.g. "contact.telecom".
+type RedactionRule struct {
+	Role         string `json:"role"`
+	ResourceType string `json:"resourceType"` // "*" matches every resource type
+	// Remove lists the paths deleted from the resource.
+	Remove []string `json:"remove,omitempty"`
+	// Generalize maps date paths to the precision they are cut down to: "year" or "month".
+	Generalize map[string]string `json:"generalize,omitempty"`
+	// ExceptSelf skips the rule when the resource is the caller's own FHIR resource.
+	ExceptSelf bool `json:"exceptSelf,omitempty"`
+	// ExceptSameOrganization skips the rule for the Practitioners and PractitionerRoles of the
+	// organizations the calling practitioner has a PractitionerRole in.
+	ExceptSameOrganization bool `json:"exceptSameOrganization,omitempty"`
+}
+
+// RedactionPolicy is the set of redaction rules currently in force. It is safe for concurrent use
+// and can be reloaded while requests are served.
+type RedactionPolicy struct {
+	mu    sync.RWMutex
+	rules []RedactionRule
+}
+
+// LoadRedactionPolicy reads the policy at path. A missing file yields an empty policy.
+func LoadRedactionPolicy(path string) (*RedactionPolicy, error) {
+	p := &RedactionPolicy{}
+	if err := p.Reload(path); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload replaces the rules with the ones at path. On error the current rules are kept.
+func (p *RedactionPolicy) Reload(path string) error {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		raw = []byte(`{"rules":[]}`)
+	} else if err != nil {
+		return err
+	}
+
+	var doc struct {
+		Rules []RedactionRule `json:"rules"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+	for i, rule := range doc.Rules {
+		if rule.Role == "" || rule.ResourceType == "" {
+			return fmt.Errorf("redaction rule %d: role and resourceType are required", i)
+		}
+		for path, precision := range rule.Generalize {
+			if precision != generalizeYear && precision != generalizeMonth {
+				return fmt.Errorf("redaction rule %d: unsupported precision %q for %s", i, precision, path)
+			}
+		}
+	}
+
+	p.mu.Lock()
+	p.rules = doc.Rules
+	p.mu.Unlock()
+	return nil
+}
+
+// forCaller returns a redactor with the rules that apply to any of roles, or nil when none do.
+func (p *RedactionPolicy) forCaller(roles []string, fhirRole, fhirID string) *fieldRedactor {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var fr *fieldRedactor
+	for _, rule := range p.rules {
+		if !slices.Contains(roles, rule.Role) {
+			continue
+		}
+		if fr == nil {
+			fr = &fieldRedactor{rules: make(map[string][]RedactionRule)}
+			if fhirRole != "" && fhirID != "" {
+				fr.self = fhirRole + "/" + fhirID
+			}
+		}
+		fr.rules[rule.ResourceType] = append(fr.rules[rule.ResourceType], rule)
+	}
+	return fr
+}
+
+// fieldRedactor applies the redaction rules of one caller to response bodies.
+type fieldRedactor struct {
+	rules map[string][]RedactionRule
+	// self is the caller's own resource reference, e.g. "Practitioner/123".
+	self string
+	// sameOrganization reports whether a reference, e.g. "Practitioner/123", belongs to one of the
+	// caller's organizations; nil when the caller has none.
+	sameOrganization func(ref string) bool
+}
+
+// exceptsSameOrganization reports whether any rule of the redactor spares the caller's organizations.
+func (fr *fieldRedactor) exceptsSameOrganization() bool {
+	for _, rules := range fr.rules {
+		if slices.ContainsFunc(rules, func(rule RedactionRule) bool { return rule.ExceptSameOrganization }) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactBody redacts a single resource or every entry of a Bundle.
+func (fr *fieldRedactor) redactBody(body []byte) ([]byte, bool, error) {
+	if gjson.GetBytes(body, "resourceType").String() != "Bundle" {
+		return fr.redactResource(body)
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, false, err
+	}
+	var entries []json.RawMessage
+	if raw, ok := doc["entry"]; ok {
+		if err := json.Unmarshal(raw, &entries); err != nil {
+			return nil, false, err
+		}
+	}
+
+	changed := false
+	for i, entry := range entries {
+		redacted, ok, err := fr.redactEntry(entry)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			entries[i] = redacted
+			changed = true
+		}
+	}
+	if !changed {
+		return body, false, nil
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return nil, false, err
+	}
+	doc["entry"] = b
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false, err
+	}
+	return out, true, nil
+}
+
+// redactEntry redacts the resource of a Bundle entry.
+func (fr *fieldRedactor) redactEntry(raw json.RawMessage) (json.RawMessage, bool, error) {
+	var entry map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return nil, false, err
+	}
+	resource, ok := entry["resource"]
+	if !ok {
+		return raw, false, nil
+	}
+
+	redacted, changed, err := fr.redactResource(resource)
+	if err != nil || !changed {
+		return raw, false, err
+	}
+
+	entry["resource"] = redacted
+	out, err := json.Marshal(entry)
+	if err != nil {
+		return nil, false, err
+	}
+	return out, true, nil
+}
+
+// redactResource applies the rules for the resource's type. The input is returned unchanged when
+// no rule applies.
+func (fr *fieldRedactor) redactResource(raw []byte) ([]byte, bool, error) {
+	rt := gjson.GetBytes(raw, "resourceType").String()
+	rules := append(slices.Clone(fr.rules[rt]), fr.rules["*"]...)
+	if len(rules) == 0 {
+		return raw, false, nil
+	}
+
+	ref := rt + "/" + gjson.GetBytes(raw, "id").String()
+	isSelf := fr.self != "" && fr.self == ref
+
+	var resource map[string]any
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&resource); err != nil {
+		return nil, false, err
+	}
+
+	changed := false
+	for _, rule := range rules {
+		if rule.ExceptSelf && isSelf {
+			continue
+		}
+		if rule.ExceptSameOrganization && fr.sameOrganization != nil && fr.sameOrganization(ref) {
+			continue
+		}
+		for _, path := range rule.Remove {
+			if removePath(resource, strings.Split(path, ".")) {
+				changed = true
+			}
+		}
+		for path, precision := range rule.Generalize {
+			if generalizePath(resource, strings.Split(path, "."), precision) {
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return raw, false, nil
+	}
+
+	out, err := json.Marshal(resource)
+	if err != nil {
+		return nil, false, err
+	}
+	return out, true, nil
+}
+
+// organizationMembers returns a check of whether a reference is a Practitioner or PractitionerRole
+// of one of the organizations practitionerID has a PractitionerRole in. The organizations are only
+// looked up when the check is first used; when the lookup fails nobody counts as a member.
+func (m *Middlewares) organizationMembers(ctx context.Context, practitionerID string) func(ref string) bool {
+	members := sync.OnceValue(func() map[string]struct{} {
+		refs := make(map[string]struct{})
+		roles, err := m.PractitionerRoleFhirClient.FindPractitionerRoleByPractitionerID(ctx, practitionerID)
+		if err != nil {
+			m.Log.Warn("failed to find practitioner roles by practitioner ID. redacting colleagues as strangers", zap.String("practitionerID", practitionerID), zap.Error(err))
+			return refs
+		}
+
+		var organizations []string
+		for _, pr := range roles {
+			if id, ok := strings.CutPrefix(pr.Organization.Reference, constvars.ResourceOrganization+"/"); ok && id != "" && !slices.Contains(organizations, id) {
+				organizations = append(organizations, id)
+			}
+		}
+		for _, id := range organizations {
+			colleagues, err := m.PractitionerRoleFhirClient.FindPractitionerRoleByOrganizationID(ctx, id)
+			if err != nil {
+				m.Log.Warn("failed to find practitioner roles by organization ID. redacting its members", zap.String("organizationID", id), zap.Error(err))
+				continue
+			}
+			for _, pr := range colleagues {
+				if pr.ID != "" {
+					refs[constvars.ResourcePractitionerRole+"/"+pr.ID] = struct{}{}
+				}
+				if pr.Practitioner.Reference != "" {
+					refs[pr.Practitioner.Reference] = struct{}{}
+				}
+			}
+		}
+		return refs
+	})
+
+	return func(ref string) bool {
+		_, ok := members()[ref]
+		return ok
+	}
+}
+
+func removePath(node any, segs []string) bool {
+	switch n := node.(type) {
+	case map[string]any:
+		child, ok := n[segs[0]]
+		if !ok {
+			return false
+		}
+		if len(segs) == 1 {
+			delete(n, segs[0])
+			return true
+		}
+		return removePath(child, segs[1:])
+	case []any:
+		changed := false
+		for _, elem := range n {
+			if removePath(elem, segs) {
+				changed = true
+			}
+		}
+		return changed
+	}
+	return false
+}
+
+func generalizePath(node any, segs []string, precision string) bool {
+	switch n := node.(type) {
+	case map[string]any:
+		child, ok := n[segs[0]]
+		if !ok {
+			return false
+		}
+		if len(segs) > 1 {
+			return generalizePath(child, segs[1:], precision)
+		}
+		s, ok := child.(string)
+		if !ok {
+			return false
+		}
+		g := generalizeDate(s, precision)
+		if g == s {
+			return false
+		}
+		n[segs[0]] = g
+		return true
+	case []any:
+		changed := false
+		for _, elem := range n {
+			if generalizePath(elem, segs, precision) {
+				changed = true
+			}
+		}
+		return changed
+	}
+	return false
+}
+
+// generalizeDate cuts a FHIR date, dateTime or instant down to a year or year-month.
+func generalizeDate(s, precision string) string {
+	n := 4
+	if precision == generalizeMonth {
+		n = 7
+	}
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
@@ -0,0 +1,200 @@
+package middlewares
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/fhir_dto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func writeRedactionPolicy(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "redaction_policy.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestRedactionPolicy_ShippedPolicyLoads(t *testing.T) {
+	p, err := LoadRedactionPolicy(filepath.Join("..", "..", "..", "..", "..", redactionPolicyFile))
+	require.NoError(t, err)
+	assert.NotEmpty(t, p.rules)
+}
+
+func TestRedactionPolicy_Reload(t *testing.T) {
+	dir := t.TempDir()
+
+	p, err := LoadRedactionPolicy(filepath.Join(dir, "missing.json"))
+	require.NoError(t, err)
+	assert.Nil(t, p.forCaller([]string{constvars.KonsulinRoleResearcher}, "", ""), "missing file means no redaction")
+
+	path := writeRedactionPolicy(t, dir, `{"rules":[{"role":"Researcher","resourceType":"Patient","remove":["name"]}]}`)
+	require.NoError(t, p.Reload(path))
+	assert.NotNil(t, p.forCaller([]string{constvars.KonsulinRoleResearcher}, "", ""))
+	assert.Nil(t, p.forCaller([]string{constvars.KonsulinRolePatient}, "", ""))
+
+	writeRedactionPolicy(t, dir, `{"rules":[{"role":"Researcher","resourceType":"Patient","generalize":{"birthDate":"day"}}]}`)
+	assert.Error(t, p.Reload(path))
+	assert.NotNil(t, p.forCaller([]string{constvars.KonsulinRoleResearcher}, "", ""), "invalid policy keeps the previous rules")
+}
+
+func TestFieldRedactor_RedactResource(t *testing.T) {
+	p := &RedactionPolicy{rules: []RedactionRule{
+		{Role: "Researcher", ResourceType: "Patient", Remove: []string{"name", "address", "contact.telecom"}, Generalize: map[string]string{"birthDate": "year"}},
+		{Role: "Practitioner", ResourceType: "Practitioner", Remove: []string{"telecom", "identifier"}, ExceptSelf: true},
+	}}
+
+	t.Run("Researcher sees a masked Patient", func(t *testing.T) {
+		fr := p.forCaller([]string{"Researcher"}, "", "")
+		in := `{"resourceType":"Patient","id":"p1","name":[{"family":"Doe"}],"birthDate":"1990-04-12","gender":"female",
+			"address":[{"city":"Jakarta"}],"contact":[{"telecom":[{"value":"1"}],"relationship":[{"text":"mother"}]}],"multipleBirthInteger":2}`
+
+		out, changed, err := fr.redactResource([]byte(in))
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.JSONEq(t, `{"resourceType":"Patient","id":"p1","birthDate":"1990","gender":"female",
+			"contact":[{"relationship":[{"text":"mother"}]}],"multipleBirthInteger":2}`, string(out))
+	})
+
+	t.Run("Rules for other types leave the resource untouched", func(t *testing.T) {
+		fr := p.forCaller([]string{"Researcher"}, "", "")
+		in := []byte(`{"resourceType":"Observation","id":"o1"}`)
+		out, changed, err := fr.redactResource(in)
+		require.NoError(t, err)
+		assert.False(t, changed)
+		assert.Equal(t, in, out)
+	})
+
+	t.Run("ExceptSelf spares the caller's own resource", func(t *testing.T) {
+		fr := p.forCaller([]string{"Practitioner"}, "Practitioner", "pr1")
+
+		own := `{"resourceType":"Practitioner","id":"pr1","telecom":[{"value":"1"}]}`
+		_, changed, err := fr.redactResource([]byte(own))
+		require.NoError(t, err)
+		assert.False(t, changed)
+
+		other := `{"resourceType":"Practitioner","id":"pr2","telecom":[{"value":"1"}],"identifier":[{"value":"x"}],"name":[{"family":"Lee"}]}`
+		out, changed, err := fr.redactResource([]byte(other))
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.JSONEq(t, `{"resourceType":"Practitioner","id":"pr2","name":[{"family":"Lee"}]}`, string(out))
+	})
+
+	t.Run("Bundle entries are redacted", func(t *testing.T) {
+		fr := p.forCaller([]string{"Researcher"}, "", "")
+		in := `{"resourceType":"Bundle","type":"searchset","total":1,"entry":[{"fullUrl":"Patient/p1","resource":{"resourceType":"Patient","id":"p1","name":[{"family":"Doe"}]}}]}`
+
+		out, changed, err := fr.redactBody([]byte(in))
+		require.NoError(t, err)
+		assert.True(t, changed)
+		assert.JSONEq(t, `{"resourceType":"Bundle","type":"searchset","total":1,"entry":[{"fullUrl":"Patient/p1","resource":{"resourceType":"Patient","id":"p1"}}]}`, string(out))
+	})
+}
+
+type clinicPractitionerRoleClient struct {
+	contracts.PractitionerRoleFhirClient
+	roles []fhir_dto.PractitionerRole
+}
+
+func (f *clinicPractitionerRoleClient) FindPractitionerRoleByPractitionerID(_ context.Context, practitionerID string) ([]fhir_dto.PractitionerRole, error) {
+	var out []fhir_dto.PractitionerRole
+	for _, pr := range f.roles {
+		if pr.Practitioner.Reference == "Practitioner/"+practitionerID {
+			out = append(out, pr)
+		}
+	}
+	return out, nil
+}
+
+func (f *clinicPractitionerRoleClient) FindPractitionerRoleByOrganizationID(_ context.Context, organizationID string) ([]fhir_dto.PractitionerRole, error) {
+	var out []fhir_dto.PractitionerRole
+	for _, pr := range f.roles {
+		if pr.Organization.Reference == "Organization/"+organizationID {
+			out = append(out, pr)
+		}
+	}
+	return out, nil
+}
+
+func TestFieldRedactor_ExceptSameOrganization(t *testing.T) {
+	role := func(id, practitioner, organization string) fhir_dto.PractitionerRole {
+		return fhir_dto.PractitionerRole{
+			ID:           id,
+			Practitioner: fhir_dto.Reference{Reference: "Practitioner/" + practitioner},
+			Organization: fhir_dto.Reference{Reference: "Organization/" + organization},
+		}
+	}
+	m := &Middlewares{
+		Log: zap.NewNop(),
+		Redactions: &RedactionPolicy{rules: []RedactionRule{
+			{Role: "Practitioner", ResourceType: "Practitioner", Remove: []string{"telecom"}, ExceptSelf: true, ExceptSameOrganization: true},
+		}},
+		PractitionerRoleFhirClient: &clinicPractitionerRoleClient{roles: []fhir_dto.PractitionerRole{
+			role("r1", "pr1", "clinic-a"),
+			role("r2", "pr2", "clinic-a"),
+			role("r3", "pr3", "clinic-b"),
+		}},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/fhir/Practitioner", nil)
+	ctx := context.WithValue(req.Context(), keyRoles, []string{constvars.KonsulinRolePractitioner})
+	ctx = context.WithValue(ctx, keyFHIRRole, constvars.KonsulinRolePractitioner)
+	ctx = context.WithValue(ctx, keyFHIRID, "pr1")
+	scope := m.newResponseFilterScope(req.WithContext(ctx))
+	require.NotNil(t, scope.redactor)
+
+	colleague := []byte(`{"resourceType":"Practitioner","id":"pr2","telecom":[{"value":"1"}]}`)
+	_, changed, err := scope.redactor.redactResource(colleague)
+	require.NoError(t, err)
+	assert.False(t, changed, "a practitioner of the same clinic keeps their contact details")
+
+	stranger := []byte(`{"resourceType":"Practitioner","id":"pr3","telecom":[{"value":"1"}]}`)
+	out, changed, err := scope.redactor.redactResource(stranger)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.JSONEq(t, `{"resourceType":"Practitioner","id":"pr3"}`, string(out))
+}
+
+func TestBridge_RedactsStreamedBundle(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/fhir+json")
+		w.Header().Set("ETag", `W/"1"`)
+		_, _ = w.Write([]byte(`{"resourceType":"Bundle","type":"searchset","entry":[
+			{"resource":{"resourceType":"Patient","id":"p1","name":[{"family":"Doe"}],"birthDate":"1990-04-12"}}
+		]}`))
+	}))
+	defer upstream.Close()
+
+	m := &Middlewares{
+		Log:        zap.NewNop(),
+		Redactions: &RedactionPolicy{rules: []RedactionRule{{Role: "Researcher", ResourceType: "Patient", Remove: []string{"name"}, Generalize: map[string]string{"birthDate": "year"}}}},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/fhir/Patient", nil)
+	req = req.WithContext(context.WithValue(req.Context(), keyRoles, []string{constvars.KonsulinRoleResearcher}))
+
+	rr := httptest.NewRecorder()
+	m.Bridge(upstream.URL).ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("ETag"))
+
+	var b struct {
+		Entry []struct {
+			Resource json.RawMessage `json:"resource"`
+		} `json:"entry"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &b))
+	require.Len(t, b.Entry, 1)
+	assert.JSONEq(t, `{"resourceType":"Patient","id":"p1","birthDate":"1990"}`, string(b.Entry[0].Resource))
+}
@@ -0,0 +1,76 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type signedAPIKeys struct {
+	contracts.APIKeyUsecase
+	got contracts.SignedRequestInput
+}
+
+func (s *signedAPIKeys) AuthenticateSigned(_ context.Context, in contracts.SignedRequestInput) (*contracts.APIKey, error) {
+	s.got = in
+	if in.Signature != "c0ffee" {
+		return nil, exceptions.ErrInvalidRequestSignature(nil)
+	}
+	return &contracts.APIKey{ID: in.KeyID, Name: "Prodia Lab", Roles: []string{constvars.KonsulinRoleClinicAdmin}}, nil
+}
+
+func TestRequestSignatureAuth(t *testing.T) {
+	keys := &signedAPIKeys{}
+	m := &Middlewares{Log: zap.NewNop(), APIKeys: keys}
+
+	var captured context.Context
+	handler := m.RequestSignatureAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		captured = r.Context()
+	}))
+	request := func(signature string) *http.Request {
+		body := `{"resourceType":"Observation"}`
+		r := httptest.NewRequest(http.MethodPost, "/fhir/Observation?_pretty=true", strings.NewReader(body))
+		r = r.WithContext(context.WithValue(r.Context(), constvars.CONTEXT_RAW_BODY, []byte(body)))
+		r.Header.Set(HeaderSignatureKeyID, "0123456789abcdef")
+		r.Header.Set(HeaderSignatureTimestamp, "1772355600")
+		r.Header.Set(HeaderSignatureNonce, "nonce-0000000001")
+		r.Header.Set(HeaderSignature, signature)
+		return r
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, request("c0ffee"))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "/fhir/Observation?_pretty=true", keys.got.RequestURI)
+	assert.Equal(t, `{"resourceType":"Observation"}`, string(keys.got.Body))
+	assert.Equal(t, "1772355600", keys.got.Timestamp)
+	assert.True(t, isAPIKeyRequest(captured))
+	assert.Equal(t, "api-key:0123456789abcdef", captured.Value(keyUID))
+	assert.Equal(t, "Prodia Lab", captured.Value(ContextAPIKeyName))
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, request("bad"))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	both := request("c0ffee")
+	both.Header.Set(HeaderAPIKey, "kk_0123456789abcdef_secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, both)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "a request is either signed or bearer")
+
+	captured = nil
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fhir/Observation", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.False(t, isAPIKeyRequest(captured), "unsigned requests pass through")
+}
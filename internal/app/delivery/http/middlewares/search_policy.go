@@ -0,0 +1,339 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+// searchPolicyFile limits the FHIR searches each role may send upstream. It lives next to
+// rbac_policy.csv and is hot-reloaded the same way.
+const searchPolicyFile = "resources/search_policy.json"
+
+const (
+	searchParamCount      = "_count"
+	searchParamInclude    = "_include"
+	searchParamRevinclude = "_revinclude"
+	searchParamHas        = "_has"
+	modifierIterate       = "iterate"
+)
+
+// pagingParams are the parameters of the paging links Blaze generates itself, and the page fill
+// cursor the gateway signs. They carry no search criteria, so they are always allowed.
+var pagingParams = []string{"__t", "__page-id", "__page-offset", "__page-type", pageFillCursorParam}
+
+// resultParams shape the result of a search rather than select resources, so they are always allowed.
+// _include and _revinclude are checked against the banned includes instead.
+var resultParams = []string{"_sort", "_summary", "_elements", "_format", "_pretty", searchParamCount, searchParamInclude, searchParamRevinclude}
+
+// SearchRule restricts the searches of one role on one resource type.
+type SearchRule struct {
+	Role         string `json:"role"`
+	ResourceType string `json:"resourceType"` // "*" matches the resource types the role has no rule for
+	// Params lists the search parameters the role may use. Chained parameters are listed as sent,
+	// e.g. "general-practitioner.name", reverse chaining needs "_has" and iterated reverse includes
+	// need "_revinclude:iterate".
+	Params []string `json:"params"`
+	// Modifiers lists the parameter modifiers the role may use, e.g. "exact", "missing" or "iterate".
+	Modifiers []string `json:"modifiers,omitempty"`
+	// MaxCount caps _count in place of the policy-wide cap; 0 keeps the policy-wide cap.
+	MaxCount int `json:"maxCount,omitempty"`
+	// BannedIncludes lists the _include and _revinclude values the role may not use, in addition to
+	// the policy-wide ones.
+	BannedIncludes []string `json:"bannedIncludes,omitempty"`
+}
+
+// SearchPolicy is the set of search restrictions currently in force. It is safe for concurrent use
+// and can be reloaded while requests are served.
+type SearchPolicy struct {
+	mu sync.RWMutex
+	// maxCount caps _count for every search; 0 means no cap.
+	maxCount int
+	// bannedIncludes are "SourceType:param[:TargetType]" patterns, where "*" matches any part.
+	bannedIncludes []string
+	rules          []SearchRule
+}
+
+// LoadSearchPolicy reads the policy at path. A missing file yields a policy allowing every search.
+func LoadSearchPolicy(path string) (*SearchPolicy, error) {
+	p := &SearchPolicy{}
+	if err := p.Reload(path); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload replaces the restrictions with the ones at path. On error the current ones are kept.
+func (p *SearchPolicy) Reload(path string) error {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		raw = []byte(`{"rules":[]}`)
+	} else if err != nil {
+		return err
+	}
+
+	var doc struct {
+		MaxCount       int          `json:"maxCount"`
+		BannedIncludes []string     `json:"bannedIncludes"`
+		Rules          []SearchRule `json:"rules"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+	if doc.MaxCount < 0 {
+		return fmt.Errorf("search policy: maxCount must not be negative")
+	}
+	if err := validateIncludePatterns(doc.BannedIncludes); err != nil {
+		return fmt.Errorf("search policy: %w", err)
+	}
+	for i, rule := range doc.Rules {
+		if rule.Role == "" || rule.ResourceType == "" {
+			return fmt.Errorf("search rule %d: role and resourceType are required", i)
+		}
+		if rule.MaxCount < 0 {
+			return fmt.Errorf("search rule %d: maxCount must not be negative", i)
+		}
+		if err := validateIncludePatterns(rule.BannedIncludes); err != nil {
+			return fmt.Errorf("search rule %d: %w", i, err)
+		}
+	}
+
+	p.mu.Lock()
+	p.maxCount = doc.MaxCount
+	p.bannedIncludes = doc.BannedIncludes
+	p.rules = doc.Rules
+	p.mu.Unlock()
+	return nil
+}
+
+func validateIncludePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if parts := strings.Split(pattern, ":"); len(parts) < 2 || len(parts) > 3 || slices.Contains(parts, "") {
+			return fmt.Errorf("banned include %q must be SourceType:param[:TargetType]", pattern)
+		}
+	}
+	return nil
+}
+
+// checkRequest checks a request forwarded by Bridge to path, which is relative to the FHIR base.
+// Requests that are not searches are not checked.
+func (p *SearchPolicy) checkRequest(r *http.Request, path string, body []byte) *PreFHIRProxyHookError {
+	if p == nil {
+		return nil
+	}
+	resourceType, ok := searchResourceType(r.Method, path)
+	if !ok {
+		return nil
+	}
+
+	params := r.URL.Query()
+	if r.Method == http.MethodPost {
+		// a POST search carries its parameters form-encoded, in addition to those of the URL
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return NewPreFHIRProxyHookError(http.StatusBadRequest, "invalid", "search parameters are not form-encoded")
+		}
+		for name, values := range form {
+			params[name] = append(params[name], values...)
+		}
+	}
+
+	roles, _ := r.Context().Value(keyRoles).([]string)
+	return p.check(roles, resourceType, params)
+}
+
+// checkBundle returns the GET entries of a batch or transaction that search beyond what roles allow.
+func (p *SearchPolicy) checkBundle(raw []byte, roles []string, denials []bundleEntryDenial) []bundleEntryDenial {
+	if p == nil {
+		return denials
+	}
+	for i, entry := range gjson.GetBytes(raw, "entry").Array() {
+		method := entry.Get("request.method").String()
+		if !strings.EqualFold(method, http.MethodGet) || slices.ContainsFunc(denials, func(d bundleEntryDenial) bool { return d.index == i }) {
+			continue
+		}
+		entryURL, err := url.Parse(entry.Get("request.url").String())
+		if err != nil {
+			continue
+		}
+		resourceType, ok := searchResourceType(http.MethodGet, entryURL.Path)
+		if !ok {
+			continue
+		}
+		if v := p.check(roles, resourceType, entryURL.Query()); v != nil {
+			denials = append(denials, bundleEntryDenial{index: i, status: v.StatusCode, code: v.Code, diagnostics: v.Diagnostics})
+		}
+	}
+	return denials
+}
+
+// searchResourceType returns the resource type searched by a request to path, relative to the FHIR
+// base. It is empty for a search across all resource types.
+func searchResourceType(method, path string) (string, bool) {
+	path = strings.Trim(strings.TrimPrefix(strings.TrimPrefix(path, "/"), "fhir"), "/")
+	var segments []string
+	if path != "" {
+		segments = strings.Split(path, "/")
+	}
+	isOperation := func(segment string) bool {
+		return strings.HasPrefix(segment, "$") || strings.HasPrefix(segment, "_")
+	}
+
+	switch method {
+	case http.MethodGet:
+		switch {
+		case len(segments) == 0:
+			return "", true
+		case len(segments) == 1 && !isOperation(segments[0]):
+			return segments[0], true
+		case len(segments) == 3 && !isOperation(segments[0]) && !isOperation(segments[2]):
+			// compartment search: Patient/123/Observation
+			return segments[2], true
+		}
+	case http.MethodPost:
+		switch {
+		case len(segments) == 1 && segments[0] == "_search":
+			return "", true
+		case len(segments) == 2 && segments[1] == "_search" && !isOperation(segments[0]):
+			return segments[0], true
+		}
+	}
+	return "", false
+}
+
+// check returns why roles may not search resourceType with params, or nil when they may. The rules
+// of the caller's roles for the resource type take the place of their "*" rules, and any one of them
+// is enough to allow the search. Without any, only the policy-wide limits apply.
+func (p *SearchPolicy) check(roles []string, resourceType string, params url.Values) *PreFHIRProxyHookError {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	applicable := p.rulesFor(roles, resourceType)
+	if len(applicable) == 0 {
+		applicable = p.rulesFor(roles, "*")
+	}
+	if len(applicable) == 0 {
+		return p.checkRule(nil, resourceType, params)
+	}
+
+	var violation *PreFHIRProxyHookError
+	for _, rule := range applicable {
+		v := p.checkRule(rule, resourceType, params)
+		if v == nil {
+			return nil
+		}
+		if violation == nil {
+			violation = v
+		}
+	}
+	return violation
+}
+
+func (p *SearchPolicy) rulesFor(roles []string, resourceType string) []*SearchRule {
+	var rules []*SearchRule
+	for i := range p.rules {
+		if rule := &p.rules[i]; rule.ResourceType == resourceType && slices.Contains(roles, rule.Role) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func (p *SearchPolicy) checkRule(rule *SearchRule, resourceType string, params url.Values) *PreFHIRProxyHookError {
+	maxCount := p.maxCount
+	banned := p.bannedIncludes
+	if rule != nil {
+		if rule.MaxCount > 0 {
+			maxCount = rule.MaxCount
+		}
+		banned = append(slices.Clip(banned), rule.BannedIncludes...)
+	}
+
+	target := resourceType
+	if target == "" {
+		target = "the server"
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if slices.Contains(pagingParams, name) {
+			continue
+		}
+		base, modifier, _ := strings.Cut(name, ":")
+
+		switch base {
+		case searchParamCount:
+			for _, v := range params[name] {
+				if n, err := strconv.Atoi(v); err == nil && maxCount > 0 && n > maxCount {
+					return NewPreFHIRProxyHookError(http.StatusBadRequest, "too-costly", fmt.Sprintf("_count must not exceed %d", maxCount))
+				}
+			}
+		case searchParamInclude, searchParamRevinclude:
+			// an iterated reverse include can walk from one record to everything referencing it, so it
+			// must be listed as a parameter, "_revinclude:iterate", to be used
+			if base == searchParamRevinclude && modifier == modifierIterate && (rule == nil || !slices.Contains(rule.Params, name)) {
+				return NewPreFHIRProxyHookError(http.StatusForbidden, "forbidden", fmt.Sprintf("%s is not allowed on %s", name, target))
+			}
+			for _, v := range params[name] {
+				if pattern, ok := includeBanned(v, banned); ok {
+					return NewPreFHIRProxyHookError(http.StatusForbidden, "forbidden", fmt.Sprintf("%s=%s is not allowed (banned %s)", base, v, pattern))
+				}
+			}
+		case searchParamHas:
+			// the modifier of _has is the reverse chain, not a modifier
+			modifier = ""
+		}
+
+		if rule == nil {
+			continue
+		}
+		if !slices.Contains(resultParams, base) && !slices.Contains(rule.Params, base) && !slices.Contains(rule.Params, name) {
+			return NewPreFHIRProxyHookError(http.StatusForbidden, "forbidden", fmt.Sprintf("search parameter %s is not allowed on %s", name, target))
+		}
+		// chained parameters are allowed as listed, modifiers included
+		if modifier != "" && !slices.Contains(rule.Params, name) && !slices.Contains(rule.Modifiers, modifier) {
+			return NewPreFHIRProxyHookError(http.StatusForbidden, "forbidden", fmt.Sprintf("modifier :%s is not allowed on %s", modifier, target))
+		}
+	}
+	return nil
+}
+
+// includeBanned reports which of the banned patterns matches an _include or _revinclude value. A
+// value leaving out the target type, or the wildcard value "*", includes what any pattern bans.
+func includeBanned(value string, banned []string) (string, bool) {
+	parts := strings.Split(value, ":")
+	for _, pattern := range banned {
+		if value == "*" {
+			return pattern, true
+		}
+		matched := true
+		for i, want := range strings.Split(pattern, ":") {
+			if want == "*" || i >= len(parts) {
+				continue
+			}
+			if parts[i] != want {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,156 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"konsulin-service/internal/pkg/constvars"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+)
+
+func TestSearchPolicy_ShippedPolicyLoads(t *testing.T) {
+	p, err := LoadSearchPolicy(filepath.Join("..", "..", "..", "..", "..", searchPolicyFile))
+	require.NoError(t, err)
+	assert.NotEmpty(t, p.rules)
+
+	patient := []string{constvars.KonsulinRolePatient}
+	practitioner := []string{constvars.KonsulinRolePractitioner}
+	check := func(roles []string, resourceType, query string) *PreFHIRProxyHookError {
+		params, err := url.ParseQuery(query)
+		require.NoError(t, err)
+		return p.check(roles, resourceType, params)
+	}
+
+	assert.Nil(t, check(patient, "Appointment", "actor=Patient/p1&slot.start=ge2025-01-01T00:00:00+00:00&_include=Appointment:actor:PractitionerRole&_include:iterate=PractitionerRole:practitioner&_include=Appointment:slot"))
+	assert.Nil(t, check(patient, "Observation", "subject=Patient/p1&_count=20&__t=3&__page-id=o9"))
+	assert.Nil(t, check(practitioner, "Slot", "_has:Appointment:slot:practitioner=pr1&start=ge2025-01-01&start=le2025-01-08"))
+	assert.NotNil(t, check(patient, "Observation", "value-quantity=gt100"), "patients only search their records by the listed parameters")
+	assert.NotNil(t, check(practitioner, "Patient", "_has:Observation:patient:code=1234"))
+	assert.NotNil(t, check(practitioner, "Patient", "_id=p1&_revinclude:iterate=Observation:patient"))
+	assert.NotNil(t, check([]string{constvars.KonsulinRoleSuperadmin}, "Patient", "_revinclude:iterate=Provenance:target"), "iterated reverse includes are banned without a rule")
+}
+
+func TestSearchPolicy_Reload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "search_policy.json")
+
+	p, err := LoadSearchPolicy(path)
+	require.NoError(t, err)
+	assert.Nil(t, p.check(nil, "Patient", url.Values{"_count": {"100000"}}), "missing file allows every search")
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"maxCount":100}`), 0o600))
+	require.NoError(t, p.Reload(path))
+	assert.NotNil(t, p.check(nil, "Patient", url.Values{"_count": {"101"}}))
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"bannedIncludes":["Patient"]}`), 0o600))
+	assert.Error(t, p.Reload(path))
+	assert.NotNil(t, p.check(nil, "Patient", url.Values{"_count": {"101"}}), "invalid policy keeps the previous limits")
+}
+
+func TestSearchPolicy_Check(t *testing.T) {
+	p := &SearchPolicy{
+		maxCount:       200,
+		bannedIncludes: []string{"*:general-practitioner"},
+		rules: []SearchRule{
+			{Role: "Patient", ResourceType: "Observation", Params: []string{"subject", "code", "subject:Patient.name"}, Modifiers: []string{"missing"}, MaxCount: 20},
+			{Role: "Patient", ResourceType: "*", Params: []string{"_id", "performer"}, BannedIncludes: []string{"Encounter:participant:Practitioner"}},
+			{Role: "Practitioner", ResourceType: "Observation", Params: []string{"performer", "_revinclude:iterate"}},
+		},
+	}
+	patient := []string{constvars.KonsulinRolePatient}
+
+	tests := []struct {
+		name         string
+		roles        []string
+		resourceType string
+		query        string
+		status       int
+	}{
+		{"allowed params", patient, "Observation", "subject=Patient/p1&code:missing=false&_sort=-date&__page-id=x", 0},
+		{"param not allowed", patient, "Observation", "subject=Patient/p1&performer=Practitioner/x", http.StatusForbidden},
+		{"modifier not allowed", patient, "Observation", "code:text=heart", http.StatusForbidden},
+		{"listed chain", patient, "Observation", "subject:Patient.name=Ann", 0},
+		{"unlisted chain", patient, "Observation", "subject.general-practitioner.name=Bob", http.StatusForbidden},
+		{"reverse chain", patient, "Observation", "_has:Observation:patient:code=1234", http.StatusForbidden},
+		{"iterate not allowed", patient, "Observation", "_revinclude:iterate=Provenance:target", http.StatusForbidden},
+		{"listed iterate", []string{constvars.KonsulinRolePractitioner}, "Observation", "performer=Practitioner/x&_revinclude:iterate=Provenance:target", 0},
+		{"paging params", patient, "Observation", "subject=Patient/p1&__t=1&__page-offset=20&__gw-cursor=x", 0},
+		{"unknown __ param", patient, "Observation", "subject=Patient/p1&__page-filter=x", http.StatusForbidden},
+		{"rule count cap", patient, "Observation", "_count=21", http.StatusBadRequest},
+		{"type rule replaces * rule", patient, "Observation", "_id=o1", http.StatusForbidden},
+		{"* rule", patient, "Encounter", "_id=e1&performer=Practitioner/x&_count=150", 0},
+		{"any role allows", []string{constvars.KonsulinRolePatient, constvars.KonsulinRolePractitioner}, "Observation", "performer=Practitioner/x", 0},
+		{"banned include target", patient, "Encounter", "_include=Encounter:participant", http.StatusForbidden},
+		{"other include target", patient, "Encounter", "_include=Encounter:participant:RelatedPerson", 0},
+		{"policy-wide banned include", patient, "Observation", "_include=Patient:general-practitioner", http.StatusForbidden},
+		{"wildcard include", patient, "Observation", "_include=*", http.StatusForbidden},
+		{"no rule for role", []string{constvars.KonsulinRoleSuperadmin}, "Observation", "performer=Practitioner/x&_count=200", 0},
+		{"policy-wide count cap", []string{constvars.KonsulinRoleSuperadmin}, "Observation", "_count=201", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			require.NoError(t, err)
+			v := p.check(tt.roles, tt.resourceType, query)
+			if tt.status == 0 {
+				assert.Nil(t, v)
+				return
+			}
+			require.NotNil(t, v)
+			assert.Equal(t, tt.status, v.StatusCode)
+		})
+	}
+}
+
+func TestSearchResourceType(t *testing.T) {
+	tests := []struct {
+		method, path, resourceType string
+		search                     bool
+	}{
+		{http.MethodGet, "Observation", "Observation", true},
+		{http.MethodGet, "", "", true},
+		{http.MethodGet, "Patient/p1/Observation", "Observation", true},
+		{http.MethodGet, "Observation/o1", "", false},
+		{http.MethodGet, "Patient/p1/$everything", "", false},
+		{http.MethodPost, "Observation/_search", "Observation", true},
+		{http.MethodPost, "Observation", "", false},
+		{http.MethodGet, "/fhir/Observation", "Observation", true},
+	}
+	for _, tt := range tests {
+		resourceType, search := searchResourceType(tt.method, tt.path)
+		assert.Equal(t, tt.search, search, tt.method+" "+tt.path)
+		assert.Equal(t, tt.resourceType, resourceType, tt.method+" "+tt.path)
+	}
+}
+
+func TestBridge_SearchPolicyRejectsBeforeUpstream(t *testing.T) {
+	reached := false
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		w.Header().Set("Content-Type", "application/fhir+json")
+		_, _ = w.Write([]byte(`{"resourceType":"Bundle","type":"searchset","entry":[]}`))
+	}))
+	defer upstream.Close()
+
+	m := &Middlewares{Log: zap.NewNop(), SearchPolicy: &SearchPolicy{maxCount: 50}}
+	handler := m.Bridge(upstream.URL + "/fhir")
+
+	req := httptest.NewRequest(http.MethodPost, "/fhir/Observation/_search", strings.NewReader("_count=51"))
+	req = req.WithContext(context.WithValue(req.Context(), constvars.CONTEXT_RAW_BODY, []byte("_count=51")))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.False(t, reached)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "too-costly", gjson.Get(rec.Body.String(), "issue.0.code").String())
+}
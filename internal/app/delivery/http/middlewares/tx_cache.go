@@ -0,0 +1,146 @@
+package middlewares
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"konsulin-service/internal/app/services/shared/terminology"
+	"konsulin-service/internal/pkg/constvars"
+
+	"go.uber.org/zap"
+)
+
+const (
+	txCacheKeyPrefix = "tx:response-cache:"
+
+	defaultTxCacheTTL = time.Hour
+
+	// headerTerminologySource reports where a /tx response came from: cache, fallback or upstream.
+	headerTerminologySource = "X-Terminology-Source"
+
+	txSourceCache    = "cache"
+	txSourceFallback = "fallback"
+	txSourceUpstream = "upstream"
+)
+
+// txOperation returns the name of the FHIR operation a terminology path invokes, without the $,
+// e.g. "expand" for /ValueSet/$expand. It returns "" for plain reads and searches.
+func txOperation(relativePath string) string {
+	last := relativePath[strings.LastIndex(relativePath, "/")+1:]
+	if !strings.HasPrefix(last, "$") {
+		return ""
+	}
+	return last[1:]
+}
+
+// txCacheTTL reports whether terminology responses of an operation are cached and for how long.
+// Terminology does not depend on the caller, so every GET may be cached once access is granted.
+func (m *Middlewares) txCacheTTL(method, operation string) (time.Duration, bool) {
+	if m.InternalConfig == nil || m.RedisRepository == nil || !m.InternalConfig.FHIR.TerminologyCacheEnabled {
+		return 0, false
+	}
+	if method != http.MethodGet {
+		return 0, false
+	}
+
+	cfg := m.InternalConfig.FHIR
+	for op, secs := range cfg.TerminologyCacheTTLOverrides {
+		if strings.TrimPrefix(op, "$") == operation && secs > 0 {
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	if cfg.TerminologyCacheTTLSeconds > 0 {
+		return time.Duration(cfg.TerminologyCacheTTLSeconds) * time.Second, true
+	}
+	return defaultTxCacheTTL, true
+}
+
+// txCacheKey builds the Redis key of a terminology request. The query is normalised so parameter
+// order does not matter.
+func txCacheKey(relativePath string, query url.Values) string {
+	normalized := relativePath
+	if len(query) > 0 {
+		normalized += "?" + query.Encode()
+	}
+	sum := sha256.Sum256([]byte(normalized))
+	return txCacheKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+func (m *Middlewares) storeTxResponse(ctx context.Context, key string, entry *cachedFHIRResponse, ttl time.Duration) {
+	if err := m.RedisRepository.Set(ctx, key, entry, ttl); err != nil {
+		m.Log.Warn("failed to store terminology cache entry", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// txExpandRequest reads a ValueSet $expand with a filter, the only request the local fallback
+// answers, from a terminology path and query.
+func txExpandRequest(relativePath string, query url.Values) (terminology.ExpandRequest, bool) {
+	segments := strings.Split(strings.Trim(relativePath, "/"), "/")
+	if len(segments) < 2 || segments[0] != "ValueSet" || segments[len(segments)-1] != "$expand" || len(segments) > 3 {
+		return terminology.ExpandRequest{}, false
+	}
+	filter := strings.TrimSpace(query.Get("filter"))
+	if filter == "" {
+		return terminology.ExpandRequest{}, false
+	}
+
+	req := terminology.ExpandRequest{URL: query.Get("url"), Filter: filter}
+	if len(segments) == 3 {
+		req.ID = segments[1]
+	}
+	req.Offset, _ = strconv.Atoi(query.Get("offset"))
+	req.Count, _ = strconv.Atoi(query.Get("count"))
+	return req, true
+}
+
+// serveTxFallback answers an $expand from the local fallback after the terminology server failed
+// with cause. It returns false when the fallback cannot answer either, leaving the response to the
+// caller.
+func (m *Middlewares) serveTxFallback(w http.ResponseWriter, req terminology.ExpandRequest, cause error) bool {
+	body, err := m.TerminologyFallback.Expand(req)
+	if err != nil {
+		if !errors.Is(err, terminology.ErrNotAvailable) {
+			m.Log.Warn("terminology fallback failed", zap.Error(err))
+		}
+		return false
+	}
+
+	m.Log.Warn("terminology server unavailable; answered from the local fallback", zap.Error(cause))
+	m.writeTxResponse(w, http.StatusOK, constvars.MIMEApplicationFHIRJSON, body, txSourceFallback)
+	return true
+}
+
+// copyTxHeaders copies the terminology server's response headers, except the CORS and hop-by-hop
+// ones the gateway sets itself.
+func copyTxHeaders(w http.ResponseWriter, header http.Header) {
+	for k, v := range header {
+		if strings.HasPrefix(k, "Access-Control-") {
+			continue
+		}
+		if k == "Content-Length" || k == "Connection" {
+			continue
+		}
+
+		for _, val := range v {
+			w.Header().Add(k, val)
+		}
+	}
+}
+
+func (m *Middlewares) writeTxResponse(w http.ResponseWriter, status int, contentType string, body []byte, source string) {
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set(headerTerminologySource, source)
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		m.Log.Warn("failed writing response body", zap.Error(err))
+	}
+}
@@ -0,0 +1,124 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"konsulin-service/internal/app/config"
+	"konsulin-service/internal/app/services/shared/terminology"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/utils"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+)
+
+func txTestMiddlewares(t *testing.T, upstream *httptest.Server) *Middlewares {
+	t.Helper()
+	enforcer, err := casbin.NewEnforcer("../../../../../resources/rbac_model.conf", "../../../../../resources/rbac_policy.csv")
+	require.NoError(t, err)
+	enforcer.AddFunction("pathMatch", func(args ...interface{}) (interface{}, error) {
+		return utils.PathMatch(args[0].(string), args[1].(string)), nil
+	})
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "icd-10.json"), []byte(`{"resourceType":"ValueSet","url":"https://konsulin.care/ValueSet/icd-10",
+		"expansion":{"contains":[{"system":"http://hl7.org/fhir/sid/icd-10","code":"F32.0","display":"Mild depressive episode"},
+			{"system":"http://hl7.org/fhir/sid/icd-10","code":"F41.1","display":"Generalized anxiety disorder"}]}}`), 0o600))
+	fallback, err := terminology.LoadFallback(dir)
+	require.NoError(t, err)
+
+	return &Middlewares{
+		Log: zap.NewNop(),
+		InternalConfig: &config.InternalConfig{
+			App: config.App{EndpointPrefix: "api", Version: "v1"},
+			FHIR: config.AppFHIR{
+				TerminologyCacheEnabled:           true,
+				TerminologyCacheTTLSeconds:        60,
+				TerminologyFallbackTimeoutSeconds: 1,
+			},
+		},
+		Enforcer:            enforcer,
+		RedisRepository:     newMemoryRedis(),
+		TerminologyFallback: fallback,
+		HTTPClient:          upstream.Client(),
+	}
+}
+
+func TestTxProxy_CacheAndFallback(t *testing.T) {
+	var calls atomic.Int32
+	var down atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", constvars.MIMEApplicationFHIRJSON)
+		fmt.Fprintf(w, `{"resourceType":"ValueSet","expansion":{"total":1,"parameter":[{"name":"filter","valueString":%q}]}}`, r.URL.Query().Get("filter"))
+	}))
+	defer upstream.Close()
+
+	m := txTestMiddlewares(t, upstream)
+	proxy := m.TxProxy(upstream.URL)
+	get := func(target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r = r.WithContext(context.WithValue(r.Context(), keyRoles, []string{constvars.KonsulinRolePractitioner}))
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, r)
+		return rec
+	}
+
+	rec := get("/api/v1/tx/ValueSet/$expand?url=https://konsulin.care/ValueSet/icd-10&filter=depr")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, txSourceUpstream, rec.Header().Get(headerTerminologySource))
+
+	rec = get("/api/v1/tx/ValueSet/$expand?filter=depr&url=https://konsulin.care/ValueSet/icd-10")
+	assert.Equal(t, txSourceCache, rec.Header().Get(headerTerminologySource), "parameter order does not matter")
+	assert.Equal(t, "depr", gjson.Get(rec.Body.String(), "expansion.parameter.0.valueString").String())
+	assert.Equal(t, constvars.MIMEApplicationFHIRJSON, rec.Header().Get("Content-Type"))
+	assert.Equal(t, int32(1), calls.Load())
+
+	down.Store(true)
+	rec = get("/api/v1/tx/ValueSet/$expand?url=https://konsulin.care/ValueSet/icd-10&filter=anx")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, txSourceFallback, rec.Header().Get(headerTerminologySource))
+	assert.Equal(t, "F41.1", gjson.Get(rec.Body.String(), "expansion.contains.0.code").String())
+
+	rec = get("/api/v1/tx/ValueSet/$expand?url=https://konsulin.care/ValueSet/icd-10&filter=anx")
+	assert.Equal(t, txSourceFallback, rec.Header().Get(headerTerminologySource), "fallback answers are not cached")
+
+	rec = get("/api/v1/tx/ValueSet/$expand?url=https://konsulin.care/ValueSet/unknown&filter=anx")
+	assert.Equal(t, http.StatusBadGateway, rec.Code, "ValueSets the fallback lacks keep the upstream answer")
+	assert.Equal(t, txSourceUpstream, rec.Header().Get(headerTerminologySource))
+}
+
+func TestTxCacheTTL(t *testing.T) {
+	m := &Middlewares{
+		RedisRepository: newMemoryRedis(),
+		InternalConfig: &config.InternalConfig{FHIR: config.AppFHIR{
+			TerminologyCacheEnabled:      true,
+			TerminologyCacheTTLSeconds:   60,
+			TerminologyCacheTTLOverrides: map[string]int{"lookup": 3600, "$validate-code": 120},
+		}},
+	}
+
+	ttl, ok := m.txCacheTTL(http.MethodGet, txOperation("/CodeSystem/$lookup"))
+	assert.True(t, ok)
+	assert.Equal(t, "1h0m0s", ttl.String())
+	ttl, _ = m.txCacheTTL(http.MethodGet, txOperation("/ValueSet/$validate-code"))
+	assert.Equal(t, "2m0s", ttl.String())
+	ttl, _ = m.txCacheTTL(http.MethodGet, txOperation("/ValueSet/$expand"))
+	assert.Equal(t, "1m0s", ttl.String())
+	_, ok = m.txCacheTTL(http.MethodPost, "expand")
+	assert.False(t, ok)
+}
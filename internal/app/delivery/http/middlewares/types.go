@@ -2,10 +2,18 @@ package middlewares
 
 import (
 	"context"
+	"fmt"
 	"konsulin-service/internal/app/config"
 	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/app/services/shared/deidentify"
+	"konsulin-service/internal/app/services/shared/rbacstore"
+	"konsulin-service/internal/app/services/shared/terminology"
+	"konsulin-service/internal/pkg/fhir_dto"
 	"konsulin-service/internal/pkg/utils"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
 	"time"
 
 	"github.com/casbin/casbin/v2"
@@ -23,11 +31,24 @@ func NewMiddlewares(
 	practitionerRoleFhirClient contracts.PractitionerRoleFhirClient,
 	scheduleFhirClient contracts.ScheduleFhirClient,
 	questionnaireResponseFhirClient contracts.QuestionnaireResponseFhirClient,
+	consentFhirClient contracts.ConsentFhirClient,
+	careTeamFhirClient contracts.CareTeamFhirClient,
+	redisRepository contracts.RedisRepository,
+	rbacPolicyStore *rbacstore.Store,
 ) *Middlewares {
-	enforcer, err := casbin.NewEnforcer("resources/rbac_model.conf", "resources/rbac_policy.csv")
+	// the policy file only seeds the store; without one the enforcer reads the file directly
+	var policyAdapter interface{} = "resources/rbac_policy.csv"
+	if rbacPolicyStore != nil {
+		policyAdapter = rbacPolicyStore
+	}
+	enforcer, err := casbin.NewEnforcer("resources/rbac_model.conf", policyAdapter)
 	if err != nil {
 		logger.Fatal("failed to load RBAC policies", zap.Error(err))
 	}
+	if rbacPolicyStore != nil {
+		// reload whenever another replica, an admin or the policy file changes the stored policy
+		go rbacPolicyStore.Watch(context.Background(), enforcer.LoadPolicy)
+	}
 
 	enforcer.AddFunction("pathMatch", func(args ...interface{}) (interface{}, error) {
 		if len(args) != 2 {
@@ -41,6 +62,47 @@ func NewMiddlewares(
 		return utils.PathMatch(requestPath, policyPath), nil
 	})
 
+	redactions, err := LoadRedactionPolicy(redactionPolicyFile)
+	if err != nil {
+		logger.Fatal("failed to load redaction policy", zap.Error(err))
+	}
+
+	if err := utils.LoadOwnershipRules(ownershipRulesFile); err != nil {
+		logger.Fatal("failed to load ownership rules", zap.Error(err))
+	}
+
+	searchPolicy, err := LoadSearchPolicy(searchPolicyFile)
+	if err != nil {
+		logger.Fatal("failed to load search policy", zap.Error(err))
+	}
+
+	deidentificationPolicy, err := deidentify.LoadPolicy(deidentificationPolicyFile)
+	if err != nil {
+		logger.Fatal("failed to load de-identification policy", zap.Error(err))
+	}
+	if internalConfig.FHIR.PageFillEnabled && internalConfig.FHIR.PageFillCursorKey == "" {
+		logger.Warn("APP_FHIR_PAGE_FILL_CURSOR_KEY is not set; filtered searches are not page-filled")
+	}
+	if internalConfig.FHIR.DeidentificationKey == "" {
+		logger.Warn("APP_FHIR_DEIDENTIFICATION_KEY is not set; pseudonyms of de-identified data change on every restart")
+	}
+	deidentifier, err := deidentify.NewEngine(deidentificationPolicy, deidentify.Options{
+		Key:              []byte(internalConfig.FHIR.DeidentificationKey),
+		MinCellSize:      internalConfig.FHIR.DeidentificationMinCellSize,
+		MaxDateShiftDays: internalConfig.FHIR.DeidentificationMaxDateShiftDays,
+	})
+	if err != nil {
+		logger.Fatal("failed to create de-identification engine", zap.Error(err))
+	}
+
+	var terminologyFallback *terminology.Fallback
+	if dir := internalConfig.FHIR.TerminologyFallbackDir; dir != "" {
+		terminologyFallback, err = terminology.LoadFallback(dir)
+		if err != nil {
+			logger.Fatal("failed to load terminology fallback", zap.String("dir", dir), zap.Error(err))
+		}
+	}
+
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		logger.Fatal("failed to create policy watcher", zap.Error(err))
@@ -54,6 +116,38 @@ func NewMiddlewares(
 					return
 				}
 				if event.Op&fsnotify.Write == fsnotify.Write {
+					if filepath.Clean(event.Name) == filepath.Clean(redactionPolicyFile) {
+						if err := redactions.Reload(redactionPolicyFile); err != nil {
+							logger.Error("failed to reload redaction policy", zap.Error(err))
+						} else {
+							logger.Info("Redaction policy reloaded", zap.String("file", event.Name))
+						}
+						continue
+					}
+					if filepath.Clean(event.Name) == filepath.Clean(searchPolicyFile) {
+						if err := searchPolicy.Reload(searchPolicyFile); err != nil {
+							logger.Error("failed to reload search policy", zap.Error(err))
+						} else {
+							logger.Info("Search policy reloaded", zap.String("file", event.Name))
+						}
+						continue
+					}
+					if filepath.Clean(event.Name) == filepath.Clean(deidentificationPolicyFile) {
+						if err := deidentificationPolicy.Reload(deidentificationPolicyFile); err != nil {
+							logger.Error("failed to reload de-identification policy", zap.Error(err))
+						} else {
+							logger.Info("De-identification policy reloaded", zap.String("file", event.Name))
+						}
+						continue
+					}
+					if filepath.Clean(event.Name) == filepath.Clean(ownershipRulesFile) {
+						if err := utils.LoadOwnershipRules(ownershipRulesFile); err != nil {
+							logger.Error("failed to reload ownership rules", zap.Error(err))
+						} else {
+							logger.Info("Ownership rules reloaded", zap.String("file", event.Name))
+						}
+						continue
+					}
 					if err := enforcer.LoadPolicy(); err != nil {
 						logger.Error("failed to reload RBAC policy", zap.Error(err))
 					} else {
@@ -71,12 +165,29 @@ func NewMiddlewares(
 	if err := watcher.Add(policyFile); err != nil {
 		logger.Error("failed to watch policy file", zap.Error(err))
 	}
+	if err := watcher.Add(redactionPolicyFile); err != nil {
+		logger.Error("failed to watch redaction policy file", zap.Error(err))
+	}
+	if err := watcher.Add(deidentificationPolicyFile); err != nil {
+		logger.Error("failed to watch de-identification policy file", zap.Error(err))
+	}
+	if err := watcher.Add(ownershipRulesFile); err != nil {
+		logger.Error("failed to watch ownership rules file", zap.Error(err))
+	}
+	if err := watcher.Add(searchPolicyFile); err != nil {
+		logger.Error("failed to watch search policy file", zap.Error(err))
+	}
 
 	httpClient := &http.Client{
 		Timeout:   15 * time.Second,
 		Transport: &http.Transport{MaxIdleConnsPerHost: 100},
 	}
 
+	var audit *AuditTrail
+	if internalConfig.FHIR.AuditEnabled {
+		audit = NewAuditTrail(logger, internalConfig.FHIR.BaseUrl, internalConfig.FHIR.AuditQueueSize, internalConfig.FHIR.AuditWorkers)
+	}
+
 	return &Middlewares{
 		Log:                             logger,
 		SessionService:                  sessionService,
@@ -87,15 +198,25 @@ func NewMiddlewares(
 		PractitionerRoleFhirClient:      practitionerRoleFhirClient,
 		ScheduleFhirClient:              scheduleFhirClient,
 		QuestionnaireResponseFhirClient: questionnaireResponseFhirClient,
+		ConsentFhirClient:               consentFhirClient,
+		CareTeamFhirClient:              careTeamFhirClient,
+		RedisRepository:                 redisRepository,
 		Enforcer:                        enforcer,
+		Redactions:                      redactions,
+		SearchPolicy:                    searchPolicy,
+		Deidentifier:                    deidentifier,
+		TerminologyFallback:             terminologyFallback,
+		Audit:                           audit,
 		HTTPClient:                      httpClient,
 	}
 }
 
 type ContextKey string
 type Middlewares struct {
-	Log                             *zap.Logger
-	AuthUsecase                     contracts.AuthUsecase
+	Log         *zap.Logger
+	AuthUsecase contracts.AuthUsecase
+	// APIKeys authenticates integrator API keys; nil accepts the superadmin API key only.
+	APIKeys                         contracts.APIKeyUsecase
 	SessionService                  contracts.SessionService
 	InternalConfig                  *config.InternalConfig
 	PractitionerFhirClient          contracts.PractitionerFhirClient
@@ -103,16 +224,81 @@ type Middlewares struct {
 	PractitionerRoleFhirClient      contracts.PractitionerRoleFhirClient
 	ScheduleFhirClient              contracts.ScheduleFhirClient
 	QuestionnaireResponseFhirClient contracts.QuestionnaireResponseFhirClient
-	Enforcer                        *casbin.Enforcer
+	// ConsentFhirClient looks up patient Consents for practitioner access; nil disables consent checks.
+	ConsentFhirClient contracts.ConsentFhirClient
+	// CareTeamFhirClient looks up CareTeams granting practitioners access; nil disables CareTeam access.
+	CareTeamFhirClient contracts.CareTeamFhirClient
+	// RedisRepository backs the FHIR response cache; caching is skipped when nil.
+	RedisRepository contracts.RedisRepository
+	Enforcer        *casbin.Enforcer
+	// Redactions masks fields of proxied FHIR resources per role; nil disables redaction.
+	Redactions *RedactionPolicy
+	// SearchPolicy limits the search parameters each role may send upstream; nil allows every search.
+	SearchPolicy *SearchPolicy
+	// Deidentifier de-identifies the data sent to research roles; nil disables de-identification.
+	Deidentifier *deidentify.Engine
+	// TerminologyFallback answers ValueSet $expand on /tx when the terminology server is slow or
+	// down; nil disables the fallback.
+	TerminologyFallback *terminology.Fallback
+	// Audit records an AuditEvent for every proxied FHIR request; nil disables the audit trail.
+	Audit *AuditTrail
 
 	// HTTPClient is a client for sending HTTP requests and can be reused for all requests.
 	HTTPClient *http.Client
 
+	// PreFHIRProxyHooks run in order before a request is forwarded to the FHIR server, after Auth has
+	// accepted it. A hook may change the forwarded headers, query and body, or reject the request.
+	PreFHIRProxyHooks []PreFHIRProxyHook
+
 	// PostFHIRProxyHooks run after a successful FHIR proxy response (status < 400), before response filtering.
 	// Hooks are called synchronously; on error the middleware only logs and continues.
 	PostFHIRProxyHooks []PostFHIRProxyHook
 }
 
+// PreFHIRProxyRequest is the request a pre-FHIR-proxy hook inspects. Header, Query and Body are what
+// will be forwarded and may be modified in place or replaced.
+type PreFHIRProxyRequest struct {
+	Context context.Context // Request context (carries roles and FHIR identity)
+	Method  string          // HTTP method (GET, POST, PUT, PATCH, DELETE)
+	Path    string          // Request path (e.g. /fhir/Appointment or /fhir)
+	Query   url.Values      // Query parameters forwarded to the FHIR server
+	Header  http.Header     // Headers forwarded to the FHIR server
+	Body    []byte          // Request body forwarded to the FHIR server
+}
+
+// PreFHIRProxyHook is called before a request is proxied to the FHIR server. Returning an error
+// stops the chain and rejects the request; use NewPreFHIRProxyHookError to choose the status and
+// OperationOutcome issue, any other error is answered as an internal failure.
+type PreFHIRProxyHook func(*PreFHIRProxyRequest) error
+
+// PreFHIRProxyHookError rejects a request from a PreFHIRProxyHook.
+type PreFHIRProxyHookError struct {
+	StatusCode  int      // HTTP status of the response
+	Code        string   // OperationOutcome issue type, e.g. "business-rule", "invalid", "forbidden"
+	Diagnostics string   // Human readable reason
+	Expression  []string // FHIRPath of the offending elements, e.g. "Appointment.start"
+}
+
+func NewPreFHIRProxyHookError(statusCode int, code, diagnostics string, expression ...string) *PreFHIRProxyHookError {
+	return &PreFHIRProxyHookError{StatusCode: statusCode, Code: code, Diagnostics: diagnostics, Expression: expression}
+}
+
+func (e *PreFHIRProxyHookError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Diagnostics)
+}
+
+func (e *PreFHIRProxyHookError) outcome() fhir_dto.OperationOutcome {
+	return fhir_dto.OperationOutcome{
+		ResourceType: "OperationOutcome",
+		Issue: []fhir_dto.Issue{{
+			Severity:    "error",
+			Code:        e.Code,
+			Diagnostics: e.Diagnostics,
+			Expression:  e.Expression,
+		}},
+	}
+}
+
 // PostFHIRProxyUserRequestDetail carries request data for post-FHIR-proxy hooks.
 type PostFHIRProxyUserRequestDetail struct {
 	Context context.Context // Request context (for cancellation, etc.)
@@ -127,8 +313,19 @@ type PostFHIRProxyFHIRServerResponse struct {
 	Body       []byte // Raw response body
 }
 
-// PostFHIRProxyHook is called after a successful proxied FHIR request. Both params are structs for extensibility.
-type PostFHIRProxyHook func(PostFHIRProxyUserRequestDetail, PostFHIRProxyFHIRServerResponse) error
+// PostFHIRProxyHookFunc is called after a successful proxied FHIR request. Both params are structs for extensibility.
+type PostFHIRProxyHookFunc func(PostFHIRProxyUserRequestDetail, PostFHIRProxyFHIRServerResponse) error
+
+// PostFHIRProxyHook is a post-FHIR-proxy hook together with the requests it applies to. A GET
+// response is only buffered for the hooks when one of them runs for GET; otherwise it is streamed.
+type PostFHIRProxyHook struct {
+	Methods []string // HTTP methods the hook runs for; empty runs it for every method
+	Run     PostFHIRProxyHookFunc
+}
+
+func (h PostFHIRProxyHook) appliesTo(method string) bool {
+	return len(h.Methods) == 0 || slices.Contains(h.Methods, method)
+}
 
 type User struct {
 	ID    string
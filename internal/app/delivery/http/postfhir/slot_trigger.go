@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"konsulin-service/internal/app/contracts"
 	"konsulin-service/internal/app/delivery/http/middlewares"
+	"net/http"
 	"net/url"
 	"strings"
 
@@ -60,8 +61,15 @@ type actorRef struct {
 
 // NewSlotRegenerationHook returns a PostFHIRProxyHook that detects PractitionerRole/Schedule
 // mutations and calls HandleOnDemandSlotRegeneration for each affected practitioner role.
-// DELETE operations trigger no-op for now.
+// DELETE operations trigger no-op for now. Reads are left alone, so they stay streamed.
 func NewSlotRegenerationHook(log *zap.Logger, slotUsecase contracts.SlotUsecaseIface) middlewares.PostFHIRProxyHook {
+	return middlewares.PostFHIRProxyHook{
+		Methods: []string{http.MethodPost, http.MethodPut, http.MethodPatch},
+		Run:     newSlotRegenerationFunc(log, slotUsecase),
+	}
+}
+
+func newSlotRegenerationFunc(log *zap.Logger, slotUsecase contracts.SlotUsecaseIface) middlewares.PostFHIRProxyHookFunc {
 	return func(req middlewares.PostFHIRProxyUserRequestDetail, resp middlewares.PostFHIRProxyFHIRServerResponse) error {
 		if resp.StatusCode >= 400 {
 			return nil
@@ -0,0 +1,76 @@
+package postfhir
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/app/delivery/http/middlewares"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type recordingSlotUsecase struct {
+	contracts.SlotUsecaseIface
+	regenerated []string
+}
+
+func (s *recordingSlotUsecase) HandleOnDemandSlotRegeneration(_ context.Context, practitionerRoleID string) error {
+	s.regenerated = append(s.regenerated, practitionerRoleID)
+	return nil
+}
+
+// TestBridge_ProductionHooks builds the Bridge with the hooks cmd/http registers.
+func TestBridge_ProductionHooks(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := `{"resourceType":"Bundle","type":"searchset","entry":[{"resource":{"resourceType":"PractitionerRole","id":"pr1"}}]}`
+		if r.Method == http.MethodPut {
+			body = `{"resourceType":"PractitionerRole","id":"pr1"}`
+		}
+
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		_, _ = gw.Write([]byte(body))
+		_ = gw.Close()
+
+		w.Header().Set("Content-Type", "application/fhir+json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(buf.Bytes())
+	}))
+	defer upstream.Close()
+
+	slots := &recordingSlotUsecase{}
+	m := &middlewares.Middlewares{Log: zap.NewNop()}
+	m.PostFHIRProxyHooks = append(m.PostFHIRProxyHooks, NewSlotRegenerationHook(zap.NewNop(), slots))
+
+	t.Run("Search Bundles are streamed", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/fhir/PractitionerRole?active=true", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		rr := httptest.NewRecorder()
+		m.Bridge(upstream.URL).ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "gzip", rr.Header().Get("Content-Encoding"), "the upstream encoding is passed through")
+		assert.Empty(t, rr.Header().Get("Content-Length"), "the Bundle is written as it is filtered")
+		assert.Empty(t, slots.regenerated)
+	})
+
+	t.Run("Updates still regenerate slots", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPut, "/fhir/PractitionerRole/pr1", strings.NewReader(`{"resourceType":"PractitionerRole","id":"pr1"}`))
+
+		rr := httptest.NewRecorder()
+		m.Bridge(upstream.URL).ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, []string{"pr1"}, slots.regenerated)
+	})
+}
@@ -0,0 +1,82 @@
+package prefhir
+
+import (
+	"encoding/json"
+	"fmt"
+	"konsulin-service/internal/app/delivery/http/middlewares"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	resourceTypeAppointment = "Appointment"
+	fhirPathPrefix          = "/fhir/"
+)
+
+// timeNow is swapped in tests.
+var timeNow = time.Now
+
+// appointmentEnvelope is the part of an Appointment the start rule looks at.
+type appointmentEnvelope struct {
+	ResourceType string `json:"resourceType"`
+	Start        string `json:"start,omitempty"`
+}
+
+// transactionRequestBundle is the minimal shape of a FHIR batch/transaction request.
+type transactionRequestBundle struct {
+	ResourceType string `json:"resourceType"`
+	Entry        []struct {
+		Request *struct {
+			Method string `json:"method"`
+		} `json:"request,omitempty"`
+		Resource json.RawMessage `json:"resource,omitempty"`
+	} `json:"entry"`
+}
+
+// NewAppointmentStartInFutureHook returns a PreFHIRProxyHook that rejects new Appointments whose
+// start lies in the past, both as a direct create and inside a batch/transaction. Updates are left
+// alone so past appointments can still be fulfilled, cancelled or annotated.
+func NewAppointmentStartInFutureHook() middlewares.PreFHIRProxyHook {
+	return func(req *middlewares.PreFHIRProxyRequest) error {
+		if req.Method != http.MethodPost {
+			return nil
+		}
+
+		path := strings.Trim(strings.TrimPrefix(req.Path, fhirPathPrefix), "/")
+		switch {
+		case path == resourceTypeAppointment:
+			return checkAppointmentStart(req.Body, "Appointment.start")
+		case path == "" || path == "fhir":
+			var bundle transactionRequestBundle
+			if err := json.Unmarshal(req.Body, &bundle); err != nil || bundle.ResourceType != "Bundle" {
+				return nil
+			}
+			for i, entry := range bundle.Entry {
+				if entry.Request == nil || !strings.EqualFold(entry.Request.Method, http.MethodPost) {
+					continue
+				}
+				if err := checkAppointmentStart(entry.Resource, fmt.Sprintf("Bundle.entry[%d].resource.start", i)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+func checkAppointmentStart(raw []byte, expression string) error {
+	var appt appointmentEnvelope
+	if err := json.Unmarshal(raw, &appt); err != nil || appt.ResourceType != resourceTypeAppointment || appt.Start == "" {
+		return nil
+	}
+
+	start, err := time.Parse(time.RFC3339, appt.Start)
+	if err != nil {
+		return middlewares.NewPreFHIRProxyHookError(http.StatusBadRequest, "invalid", "Appointment.start must be a valid instant", expression)
+	}
+	if !start.After(timeNow()) {
+		return middlewares.NewPreFHIRProxyHookError(http.StatusUnprocessableEntity, "business-rule", "Appointment.start must be in the future", expression)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package prefhir
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"konsulin-service/internal/app/delivery/http/middlewares"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppointmentStartInFutureHook(t *testing.T) {
+	timeNow = func() time.Time { return time.Date(2026, 1, 10, 9, 0, 0, 0, time.UTC) }
+	defer func() { timeNow = time.Now }()
+
+	hook := NewAppointmentStartInFutureHook()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantExpr   string
+	}{
+		{"future create passes", http.MethodPost, "/fhir/Appointment", `{"resourceType":"Appointment","start":"2026-01-11T09:00:00Z"}`, 0, ""},
+		{"past create is rejected", http.MethodPost, "/fhir/Appointment", `{"resourceType":"Appointment","start":"2026-01-09T09:00:00+07:00"}`, http.StatusUnprocessableEntity, "Appointment.start"},
+		{"create without start passes", http.MethodPost, "/fhir/Appointment", `{"resourceType":"Appointment","status":"proposed"}`, 0, ""},
+		{"malformed start is invalid", http.MethodPost, "/fhir/Appointment", `{"resourceType":"Appointment","start":"tomorrow"}`, http.StatusBadRequest, "Appointment.start"},
+		{"update of a past appointment passes", http.MethodPut, "/fhir/Appointment/a1", `{"resourceType":"Appointment","status":"fulfilled","start":"2025-01-09T09:00:00Z"}`, 0, ""},
+		{"past create in a transaction is rejected", http.MethodPost, "/fhir", `{"resourceType":"Bundle","type":"transaction","entry":[
+			{"request":{"method":"POST","url":"Patient"},"resource":{"resourceType":"Patient"}},
+			{"request":{"method":"POST","url":"Appointment"},"resource":{"resourceType":"Appointment","start":"2025-01-09T09:00:00Z"}}
+		]}`, http.StatusUnprocessableEntity, "Bundle.entry[1].resource.start"},
+		{"transaction update passes", http.MethodPost, "/fhir/", `{"resourceType":"Bundle","type":"transaction","entry":[
+			{"request":{"method":"PUT","url":"Appointment/a1"},"resource":{"resourceType":"Appointment","start":"2025-01-09T09:00:00Z"}}
+		]}`, 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := hook(&middlewares.PreFHIRProxyRequest{Method: tt.method, Path: tt.path, Body: []byte(tt.body)})
+			if tt.wantStatus == 0 {
+				assert.NoError(t, err)
+				return
+			}
+
+			var hookErr *middlewares.PreFHIRProxyHookError
+			require.True(t, errors.As(err, &hookErr), "got %v", err)
+			assert.Equal(t, tt.wantStatus, hookErr.StatusCode)
+			assert.Equal(t, []string{tt.wantExpr}, hookErr.Expression)
+		})
+	}
+}
@@ -0,0 +1,12 @@
+package routers
+
+import (
+	"konsulin-service/internal/app/delivery/http/controllers"
+	"konsulin-service/internal/app/delivery/http/middlewares"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func attachAccessLogRoutes(router chi.Router, m *middlewares.Middlewares, c *controllers.AccessLogController) {
+	router.With(m.ResolveFHIRIdentity).Get("/patients/me/access-log", c.ListMyAccessLog)
+}
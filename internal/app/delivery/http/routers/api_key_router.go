@@ -0,0 +1,15 @@
+package routers
+
+import (
+	"konsulin-service/internal/app/delivery/http/controllers"
+	"konsulin-service/internal/app/delivery/http/middlewares"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func attachAPIKeyRoutes(router chi.Router, m *middlewares.Middlewares, c *controllers.APIKeyController) {
+	router.Post("/admin/api-keys", c.Create)
+	router.Get("/admin/api-keys", c.List)
+	router.Post("/admin/api-keys/{id}/rotate", c.Rotate)
+	router.Delete("/admin/api-keys/{id}", c.Revoke)
+}
@@ -0,0 +1,22 @@
+package routers
+
+import (
+	"konsulin-service/internal/app/delivery/http/controllers"
+	"konsulin-service/internal/app/delivery/http/middlewares"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// attachBulkExportKickoffRoutes serves the $export kick-off requests at the FHIR base. The gateway
+// runs exports itself, so these are not proxied.
+func attachBulkExportKickoffRoutes(router chi.Router, m *middlewares.Middlewares, c *controllers.BulkExportController) {
+	router.Get("/$export", c.ExportSystem)
+	router.Get("/Patient/$export", c.ExportPatients)
+	router.Get("/Group/{id}/$export", c.ExportGroup)
+}
+
+func attachBulkExportRoutes(router chi.Router, m *middlewares.Middlewares, c *controllers.BulkExportController) {
+	router.Get("/bulk-export/{jobID}", c.Status)
+	router.Delete("/bulk-export/{jobID}", c.Cancel)
+	router.Get("/bulk-export/{jobID}/files/{name}", c.DownloadFile)
+}
@@ -0,0 +1,13 @@
+package routers
+
+import (
+	"konsulin-service/internal/app/delivery/http/controllers"
+	"konsulin-service/internal/app/delivery/http/middlewares"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func attachHealthRoutes(router chi.Router, m *middlewares.Middlewares, c *controllers.HealthController) {
+	router.Get("/health", c.Check)
+	router.With(m.RequireSuperadminAPIKey).Get("/health/rbac-policy", c.PolicyStatus)
+}
@@ -0,0 +1,19 @@
+package routers
+
+import (
+	"konsulin-service/internal/app/delivery/http/controllers"
+	"konsulin-service/internal/app/delivery/http/middlewares"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func attachRoleRoutes(router chi.Router, m *middlewares.Middlewares, c *controllers.RoleController) {
+	router.Get("/admin/rbac/roles", c.ListRoles)
+	router.Get("/admin/rbac/permissions", c.ListPermissions)
+	router.Post("/admin/rbac/permissions", c.AddPermission)
+	router.Delete("/admin/rbac/permissions", c.RemovePermission)
+	router.Get("/admin/rbac/policy", c.ExportPolicy)
+	router.Put("/admin/rbac/policy", c.ImportPolicy)
+	router.Get("/admin/rbac/changes", c.ListPolicyChanges)
+	router.Post("/admin/rbac/reload", c.ReloadPolicy)
+}
@@ -25,6 +25,11 @@ func SetupRoutes(
 	webhookController *controllers.WebhookController,
 	scheduleController *controllers.ScheduleController,
 	organizationController *controllers.OrganizationController,
+	accessLogController *controllers.AccessLogController,
+	bulkExportController *controllers.BulkExportController,
+	apiKeyController *controllers.APIKeyController,
+	roleController *controllers.RoleController,
+	healthController *controllers.HealthController,
 ) {
 	corsOptions := cors.Options{
 		AllowOriginFunc: func(r *http.Request, origin string) bool {
@@ -51,6 +56,7 @@ func SetupRoutes(
 	router.Use(middlewares.BodyBuffer)
 	router.Use(cors.Handler(corsOptions))
 	router.Use(supertokens.Middleware)
+	router.Use(middlewares.RequestSignatureAuth)
 	router.Use(middlewares.APIKeyAuth)
 	router.Use(middlewares.SessionOptional)
 	// router.Use(middlewares.Auth)
@@ -74,13 +80,22 @@ func SetupRoutes(
 			attachScheduleRouter(r, middlewares, scheduleController)
 			attachWebhookRouter(r, middlewares, webhookController)
 			attachOrganizationRoutes(r, middlewares, organizationController)
+			attachAccessLogRoutes(r, middlewares, accessLogController)
+			attachBulkExportRoutes(r, middlewares, bulkExportController)
+			attachAPIKeyRoutes(r, middlewares, apiKeyController)
+			attachRoleRoutes(r, middlewares, roleController)
+			attachHealthRoutes(r, middlewares, healthController)
 
 			r.Mount("/tx", middlewares.TxProxy(internalConfig.FHIR.TerminologyServerBaseUrl))
 		})
 	})
 
-	router.With(middlewares.Auth).
-		Mount("/fhir", middlewares.Bridge(internalConfig.FHIR.BaseUrl))
+	router.Route("/fhir", func(r chi.Router) {
+		attachBulkExportKickoffRoutes(r, middlewares, bulkExportController)
+
+		r.With(middlewares.FHIRXML, middlewares.Auth).
+			Mount("/", middlewares.Bridge(internalConfig.FHIR.BaseUrl))
+	})
 }
 
 func isAllowedOrigin(allowedDomain, origin string) bool {
@@ -0,0 +1,317 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+	"konsulin-service/internal/pkg/fhir_dto"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+
+	// internalAPIKeyUID is the uid of the platform's own superadmin API key. Requests made with it
+	// are internal automation rather than an integration acting on the patient's data.
+	internalAPIKeyUID = "api-key-superadmin"
+)
+
+const (
+	ActorKindIntegration  = "integration"
+	ActorKindPractitioner = "practitioner"
+	ActorKindClinicAdmin  = "clinic_admin"
+	ActorKindStaff        = "staff"
+	ActorKindResearcher   = "researcher"
+	ActorKindPatient      = "patient"
+	ActorKindUser         = "user"
+)
+
+var actorKindLabels = map[string]string{
+	ActorKindIntegration:  "integration",
+	ActorKindPractitioner: "practitioner",
+	ActorKindClinicAdmin:  "clinic admin",
+	ActorKindStaff:        "Konsulin staff",
+	ActorKindResearcher:   "researcher",
+	ActorKindPatient:      "patient",
+	ActorKindUser:         "user",
+}
+
+// interactionActions turns FHIR restful-interaction codes into the verbs shown to patients.
+var interactionActions = map[string]string{
+	"read":             "viewed",
+	"vread":            "viewed",
+	"history-instance": "viewed",
+	"search-type":      "searched",
+	"create":           "created",
+	"update":           "updated",
+	"patch":            "updated",
+	"delete":           "deleted",
+}
+
+var outcomes = map[string]string{
+	constvars.FhirAuditOutcomeSuccess:        "success",
+	constvars.FhirAuditOutcomeMinorFailure:   "rejected",
+	constvars.FhirAuditOutcomeSeriousFailure: "failed",
+}
+
+// Usecase implements contracts.AccessLogUsecase.
+type Usecase struct {
+	auditEventClient   contracts.AuditEventFhirClient
+	practitionerClient contracts.PractitionerFhirClient
+	log                *zap.Logger
+}
+
+// NewAccessLogUsecase constructs a new access log usecase.
+func NewAccessLogUsecase(
+	auditEventClient contracts.AuditEventFhirClient,
+	practitionerClient contracts.PractitionerFhirClient,
+	log *zap.Logger,
+) contracts.AccessLogUsecase {
+	return &Usecase{
+		auditEventClient:   auditEventClient,
+		practitionerClient: practitionerClient,
+		log:                log,
+	}
+}
+
+// ListPatientAccessLog reads the AuditEvents naming the caller's Patient. Accesses by the patient
+// themselves and by internal system actors are left out.
+func (uc *Usecase) ListPatientAccessLog(ctx context.Context, in contracts.ListAccessLogInput) (*contracts.ListAccessLogOutput, error) {
+	fhirRole, _ := ctx.Value(constvars.CONTEXT_FHIR_IDENTITY_ROLE).(string)
+	fhirID, _ := ctx.Value(constvars.CONTEXT_FHIR_IDENTITY_ID).(string)
+	if fhirRole != constvars.KonsulinRolePatient || fhirID == "" {
+		return nil, exceptions.BuildNewCustomError(
+			errors.New("access log requested by a non-patient identity"),
+			constvars.StatusForbidden,
+			constvars.ErrClientNotAuthorized,
+			"only patients can view who accessed their records",
+		)
+	}
+	patientRef := constvars.ResourcePatient + "/" + fhirID
+
+	params, err := uc.searchParams(in)
+	if err != nil {
+		return nil, err
+	}
+	// A cursor only carries paging state; the search is always pinned to the caller's compartment.
+	params.Set("entity", patientRef)
+
+	bundle, err := uc.auditEventClient.Search(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	out := &contracts.ListAccessLogOutput{Entries: make([]contracts.AccessLogEntry, 0, len(bundle.Entry))}
+	for _, e := range bundle.Entry {
+		ev := e.Resource
+		if ev.ResourceType != constvars.ResourceAuditEvent || !namesEntity(ev, patientRef) || len(ev.Agent) == 0 {
+			continue
+		}
+		if hiddenActor(ev.Agent[0], patientRef) {
+			continue
+		}
+		out.Entries = append(out.Entries, uc.describe(ctx, ev, patientRef, names))
+	}
+
+	if next := bundle.NextLink(); next != "" {
+		out.NextCursor = encodeCursor(next)
+	}
+	return out, nil
+}
+
+func (uc *Usecase) searchParams(in contracts.ListAccessLogInput) (url.Values, error) {
+	if in.Cursor != "" {
+		params, err := decodeCursor(in.Cursor)
+		if err != nil {
+			return nil, exceptions.BuildNewCustomError(err, constvars.StatusBadRequest, constvars.ErrClientCannotProcessRequest, "invalid cursor")
+		}
+		return params, nil
+	}
+
+	pageSize := in.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	search := fhir_dto.SearchAuditEventInput{
+		EntityType: in.ResourceType,
+		DateFrom:   in.From,
+		DateTo:     in.To,
+		Count:      pageSize,
+	}
+	return search.ToQueryString(), nil
+}
+
+// encodeCursor keeps only the query of a FHIR paging link so a cursor can never point the gateway
+// at another server or resource type.
+func encodeCursor(next string) string {
+	u, err := url.Parse(next)
+	if err != nil || u.RawQuery == "" {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(u.RawQuery))
+}
+
+func decodeCursor(cursor string) (url.Values, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	return url.ParseQuery(string(raw))
+}
+
+func namesEntity(ev fhir_dto.AuditEvent, ref string) bool {
+	return slices.ContainsFunc(ev.Entity, func(e fhir_dto.AuditEventEntity) bool {
+		return e.What != nil && e.What.Reference == ref
+	})
+}
+
+// namesOtherPatient reports whether ev involves a patient besides patientRef.
+func namesOtherPatient(ev fhir_dto.AuditEvent, patientRef string) bool {
+	return slices.ContainsFunc(ev.Entity, func(e fhir_dto.AuditEventEntity) bool {
+		return e.What != nil && e.What.Reference != patientRef && strings.HasPrefix(e.What.Reference, constvars.ResourcePatient+"/")
+	})
+}
+
+// hiddenActor reports whether an access is left out of the log: the patient's own accesses and
+// those made by internal system actors.
+func hiddenActor(agent fhir_dto.AuditEventAgent, patientRef string) bool {
+	if agent.Who != nil && agent.Who.Reference == patientRef {
+		return true
+	}
+	return isApplication(agent) && agent.AltID == internalAPIKeyUID
+}
+
+func isApplication(agent fhir_dto.AuditEventAgent) bool {
+	if agent.Type == nil {
+		return false
+	}
+	return slices.ContainsFunc(agent.Type.Coding, func(c fhir_dto.Coding) bool {
+		return c.Code == constvars.FhirAuditAgentTypeApplication
+	})
+}
+
+func actorKind(agent fhir_dto.AuditEventAgent) string {
+	if isApplication(agent) {
+		return ActorKindIntegration
+	}
+
+	hasRole := func(role string) bool {
+		return slices.ContainsFunc(agent.Role, func(c fhir_dto.CodeableConcept) bool {
+			return strings.EqualFold(c.Text, role)
+		})
+	}
+	switch {
+	case hasRole(constvars.KonsulinRoleClinicAdmin):
+		return ActorKindClinicAdmin
+	case hasRole(constvars.KonsulinRolePractitioner):
+		return ActorKindPractitioner
+	case hasRole(constvars.KonsulinRoleSuperadmin):
+		return ActorKindStaff
+	case hasRole(constvars.KonsulinRoleResearcher):
+		return ActorKindResearcher
+	case hasRole(constvars.KonsulinRolePatient):
+		return ActorKindPatient
+	default:
+		return ActorKindUser
+	}
+}
+
+// describe turns an AuditEvent into an access log entry. names caches Practitioner display names
+// across the page.
+func (uc *Usecase) describe(ctx context.Context, ev fhir_dto.AuditEvent, patientRef string, names map[string]string) contracts.AccessLogEntry {
+	agent := ev.Agent[0]
+	kind := actorKind(agent)
+
+	actor := contracts.AccessLogActor{Kind: kind}
+	if agent.Who != nil {
+		actor.Reference = agent.Who.Reference
+	}
+	switch {
+	case kind == ActorKindIntegration:
+		actor.Name = agent.Name
+		actor.Reference = ""
+	case strings.HasPrefix(actor.Reference, constvars.ResourcePractitioner+"/"):
+		actor.Name = uc.practitionerName(ctx, actor.Reference, names)
+	}
+	if actor.Name == "" {
+		actor.Name = "A " + actorKindLabels[kind]
+	}
+
+	action := "accessed"
+	if len(ev.Subtype) > 0 {
+		if a, ok := interactionActions[ev.Subtype[0].Code]; ok {
+			action = a
+		}
+	}
+
+	// an event naming other patients does not say which of its resources are whose, so only the
+	// caller's own Patient is shown from it
+	ownOnly := namesOtherPatient(ev, patientRef)
+	var resources, types []string
+	for _, e := range ev.Entity {
+		if e.What == nil || e.What.Reference == "" || e.Type == nil || e.Type.System != constvars.FhirAuditResourceTypeSystem {
+			continue
+		}
+		if ownOnly && e.What.Reference != patientRef {
+			continue
+		}
+		resources = append(resources, e.What.Reference)
+		if !slices.Contains(types, e.Type.Code) {
+			types = append(types, e.Type.Code)
+		}
+	}
+	if len(resources) == 0 {
+		resources = []string{patientRef}
+		types = []string{constvars.ResourcePatient}
+	}
+
+	outcome, ok := outcomes[ev.Outcome]
+	if !ok {
+		outcome = "unknown"
+	}
+
+	recorded, err := time.Parse(time.RFC3339Nano, ev.Recorded)
+	if err != nil {
+		uc.log.Warn("AuditEvent has an unreadable recorded time", zap.String("auditEventID", ev.ID), zap.Error(err))
+	}
+
+	return contracts.AccessLogEntry{
+		Recorded:    recorded,
+		Actor:       actor,
+		Action:      action,
+		Resources:   resources,
+		Outcome:     outcome,
+		Description: fmt.Sprintf("%s (%s) %s your %s records", actor.Name, actorKindLabels[kind], action, strings.Join(types, ", ")),
+	}
+}
+
+func (uc *Usecase) practitionerName(ctx context.Context, ref string, names map[string]string) string {
+	if name, ok := names[ref]; ok {
+		return name
+	}
+
+	name := ""
+	prac, err := uc.practitionerClient.FindPractitionerByID(ctx, strings.TrimPrefix(ref, constvars.ResourcePractitioner+"/"))
+	if err != nil {
+		uc.log.Warn("failed to resolve practitioner name for access log", zap.String("reference", ref), zap.Error(err))
+	} else if prac != nil {
+		name = prac.FullName()
+	}
+	names[ref] = name
+	return name
+}
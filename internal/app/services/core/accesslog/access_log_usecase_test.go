@@ -0,0 +1,164 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/fhir_dto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type fakeAuditEventClient struct {
+	bundle *fhir_dto.AuditEventBundle
+	params url.Values
+}
+
+func (f *fakeAuditEventClient) Search(_ context.Context, params url.Values) (*fhir_dto.AuditEventBundle, error) {
+	f.params = params
+	return f.bundle, nil
+}
+
+type fakePractitionerClient struct {
+	contracts.PractitionerFhirClient
+	calls int
+}
+
+func (f *fakePractitionerClient) FindPractitionerByID(_ context.Context, id string) (*fhir_dto.Practitioner, error) {
+	f.calls++
+	return &fhir_dto.Practitioner{ID: id, Name: []fhir_dto.HumanName{{Text: "Dr. Sari"}}}, nil
+}
+
+const accessLogBundle = `{
+	"resourceType": "Bundle",
+	"type": "searchset",
+	"link": [{"relation": "next", "url": "http://blaze:8080/fhir/AuditEvent?entity=Patient/p1&__t=1&__page-id=abc"}],
+	"entry": [
+		{"resource": {"resourceType": "AuditEvent", "id": "a1", "recorded": "2026-03-01T10:00:00Z", "outcome": "0",
+			"subtype": [{"code": "read"}],
+			"agent": [{"who": {"reference": "Practitioner/pr1"}, "role": [{"text": "Practitioner"}], "requestor": true}],
+			"entity": [
+				{"what": {"reference": "Observation/o1"}, "type": {"system": "http://hl7.org/fhir/resource-types", "code": "Observation"}},
+				{"what": {"reference": "Patient/p1"}, "role": {"code": "1"}}
+			]}},
+		{"resource": {"resourceType": "AuditEvent", "id": "a2", "recorded": "2026-03-01T09:00:00Z", "outcome": "0",
+			"subtype": [{"code": "search-type"}],
+			"agent": [{"who": {"reference": "Patient/p1"}, "role": [{"text": "Patient"}], "requestor": true}],
+			"entity": [{"what": {"reference": "Patient/p1"}}]}},
+		{"resource": {"resourceType": "AuditEvent", "id": "a3", "recorded": "2026-03-01T08:00:00Z", "outcome": "0",
+			"subtype": [{"code": "search-type"}],
+			"agent": [{"type": {"coding": [{"code": "110150"}]}, "altId": "api-key-superadmin", "name": "api-key-superadmin", "requestor": true}],
+			"entity": [{"what": {"reference": "Patient/p1"}}]}},
+		{"resource": {"resourceType": "AuditEvent", "id": "a4", "recorded": "2026-03-01T07:00:00Z", "outcome": "0",
+			"subtype": [{"code": "create"}],
+			"agent": [{"type": {"coding": [{"code": "110150"}]}, "altId": "lab-sync", "name": "Lab Sync", "requestor": true}],
+			"entity": [
+				{"what": {"reference": "DiagnosticReport/d1"}, "type": {"system": "http://hl7.org/fhir/resource-types", "code": "DiagnosticReport"}},
+				{"what": {"reference": "Patient/p1"}, "role": {"code": "1"}}
+			]}},
+		{"resource": {"resourceType": "AuditEvent", "id": "a5", "recorded": "2026-03-01T06:00:00Z", "outcome": "0",
+			"agent": [{"who": {"reference": "Practitioner/pr1"}, "role": [{"text": "Practitioner"}], "requestor": true}],
+			"entity": [{"what": {"reference": "Patient/p2"}}]}},
+		{"resource": {"resourceType": "AuditEvent", "id": "a6", "recorded": "2026-03-01T05:00:00Z", "outcome": "0",
+			"subtype": [{"code": "read"}],
+			"agent": [{"who": {"reference": "Practitioner/pr1"}, "role": [{"text": "Practitioner"}, {"text": "Clinic Admin"}], "requestor": true}],
+			"entity": [{"what": {"reference": "Patient/p1"}, "type": {"system": "http://hl7.org/fhir/resource-types", "code": "Patient"}}]}}
+	]
+}`
+
+func patientContext(id string) context.Context {
+	ctx := context.WithValue(context.Background(), constvars.CONTEXT_FHIR_IDENTITY_ROLE, constvars.KonsulinRolePatient)
+	return context.WithValue(ctx, constvars.CONTEXT_FHIR_IDENTITY_ID, id)
+}
+
+func newTestUsecase(t *testing.T) (*Usecase, *fakeAuditEventClient, *fakePractitionerClient) {
+	t.Helper()
+	var bundle fhir_dto.AuditEventBundle
+	require.NoError(t, json.Unmarshal([]byte(accessLogBundle), &bundle))
+
+	audits := &fakeAuditEventClient{bundle: &bundle}
+	practitioners := &fakePractitionerClient{}
+	uc := NewAccessLogUsecase(audits, practitioners, zap.NewNop()).(*Usecase)
+	return uc, audits, practitioners
+}
+
+func TestListPatientAccessLog(t *testing.T) {
+	uc, audits, practitioners := newTestUsecase(t)
+
+	out, err := uc.ListPatientAccessLog(patientContext("p1"), contracts.ListAccessLogInput{
+		From:         "2026-03-01",
+		ResourceType: "Observation",
+		PageSize:     500,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "Patient/p1", audits.params.Get("entity"))
+	assert.Equal(t, "http://hl7.org/fhir/resource-types|Observation", audits.params.Get("entity-type"))
+	assert.Equal(t, []string{"ge2026-03-01"}, audits.params["date"])
+	assert.Equal(t, "100", audits.params.Get("_count"), "page size is capped")
+
+	require.Len(t, out.Entries, 3, "self access, internal actors and events outside the compartment are hidden")
+
+	assert.Equal(t, contracts.AccessLogActor{Kind: ActorKindPractitioner, Name: "Dr. Sari", Reference: "Practitioner/pr1"}, out.Entries[0].Actor)
+	assert.Equal(t, "viewed", out.Entries[0].Action)
+	assert.Equal(t, []string{"Observation/o1"}, out.Entries[0].Resources)
+	assert.Equal(t, "success", out.Entries[0].Outcome)
+	assert.Equal(t, "Dr. Sari (practitioner) viewed your Observation records", out.Entries[0].Description)
+
+	assert.Equal(t, contracts.AccessLogActor{Kind: ActorKindIntegration, Name: "Lab Sync"}, out.Entries[1].Actor)
+	assert.Equal(t, "created", out.Entries[1].Action)
+
+	assert.Equal(t, ActorKindClinicAdmin, out.Entries[2].Actor.Kind)
+	assert.Equal(t, 1, practitioners.calls, "practitioner names are resolved once per page")
+
+	require.NotEmpty(t, out.NextCursor)
+	assert.NotContains(t, out.NextCursor, "blaze")
+}
+
+func TestListPatientAccessLog_CursorIsPinnedToCaller(t *testing.T) {
+	uc, audits, _ := newTestUsecase(t)
+
+	forged := encodeCursor("http://blaze/fhir/AuditEvent?entity=Patient/p2&__page-id=abc")
+	_, err := uc.ListPatientAccessLog(patientContext("p1"), contracts.ListAccessLogInput{Cursor: forged})
+	require.NoError(t, err)
+	assert.Equal(t, "Patient/p1", audits.params.Get("entity"))
+	assert.Equal(t, "abc", audits.params.Get("__page-id"))
+
+	_, err = uc.ListPatientAccessLog(patientContext("p1"), contracts.ListAccessLogInput{Cursor: "%%%"})
+	assert.Error(t, err)
+}
+
+func TestListPatientAccessLog_RequiresPatient(t *testing.T) {
+	uc, _, _ := newTestUsecase(t)
+
+	ctx := context.WithValue(context.Background(), constvars.CONTEXT_FHIR_IDENTITY_ROLE, constvars.KonsulinRolePractitioner)
+	ctx = context.WithValue(ctx, constvars.CONTEXT_FHIR_IDENTITY_ID, "pr1")
+	_, err := uc.ListPatientAccessLog(ctx, contracts.ListAccessLogInput{})
+	assert.Error(t, err)
+}
+
+func TestDescribe_KeepsOtherPatientsOut(t *testing.T) {
+	uc, _, _ := newTestUsecase(t)
+
+	var ev fhir_dto.AuditEvent
+	require.NoError(t, json.Unmarshal([]byte(`{"resourceType": "AuditEvent", "id": "a7", "recorded": "2026-03-01T04:00:00Z", "outcome": "0",
+		"subtype": [{"code": "search-type"}],
+		"agent": [{"who": {"reference": "Practitioner/pr1"}, "role": [{"text": "Practitioner"}], "requestor": true}],
+		"entity": [
+			{"what": {"reference": "Observation/o1"}, "type": {"system": "http://hl7.org/fhir/resource-types", "code": "Observation"}},
+			{"what": {"reference": "Observation/o2"}, "type": {"system": "http://hl7.org/fhir/resource-types", "code": "Observation"}},
+			{"what": {"reference": "Patient/p2"}, "type": {"system": "http://hl7.org/fhir/resource-types", "code": "Patient"}},
+			{"what": {"reference": "Patient/p1"}, "role": {"code": "1"}},
+			{"what": {"reference": "Patient/p3"}, "role": {"code": "1"}}
+		]}`), &ev))
+
+	entry := uc.describe(context.Background(), ev, "Patient/p1", map[string]string{})
+	assert.Equal(t, []string{"Patient/p1"}, entry.Resources, "resources of a mixed-patient event can't be attributed to the caller")
+	assert.Equal(t, "Dr. Sari (practitioner) searched your Patient records", entry.Description)
+}
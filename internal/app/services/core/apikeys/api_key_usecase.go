@@ -0,0 +1,529 @@
+package apikeys
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"konsulin-service/internal/app/config"
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	keyPrefix         = "apikey:"
+	lastUsedKeyPrefix = "apikey:last-used:"
+	// nonceKeyPrefix marks a signed request's nonce as used, per key, until it could no longer pass
+	// the clock skew check anyway.
+	nonceKeyPrefix = "apikey:nonce:"
+	// keysKey is the set of every key ID, revoked ones included.
+	keysKey = "apikeys"
+
+	// secretPrefix starts every integrator secret, followed by the key ID and the random part:
+	// kk_<id>_<random>. The ID lets a secret be looked up without scanning the registry.
+	secretPrefix = "kk_"
+	idBytes      = 8
+	secretBytes  = 32
+
+	// lastUsedResolution is how stale a key's last-used time may get before a request updates it,
+	// so busy keys do not write to Redis on every request.
+	lastUsedResolution = time.Minute
+
+	defaultClockSkew = 5 * time.Minute
+	minNonceLength   = 16
+	maxNonceLength   = 128
+)
+
+// identityRoles scope access to the caller's own Patient or Practitioner resource. A key has no such
+// resource, so it cannot be given these roles.
+var identityRoles = []string{
+	constvars.KonsulinRoleGuest,
+	constvars.KonsulinRolePatient,
+	constvars.KonsulinRolePractitioner,
+}
+
+// Usecase implements contracts.APIKeyUsecase. Keys are kept in Redis without expiry.
+type Usecase struct {
+	redis    contracts.RedisRepository
+	enforcer *casbin.Enforcer
+	cfg      *config.InternalConfig
+	log      *zap.Logger
+	now      func() time.Time
+}
+
+// NewAPIKeyUsecase constructs a new API key usecase. The enforcer holds the Casbin roles keys may
+// be given.
+func NewAPIKeyUsecase(redis contracts.RedisRepository, enforcer *casbin.Enforcer, cfg *config.InternalConfig, log *zap.Logger) *Usecase {
+	return &Usecase{
+		redis:    redis,
+		enforcer: enforcer,
+		cfg:      cfg,
+		log:      log,
+		now:      time.Now,
+	}
+}
+
+func (u *Usecase) Create(ctx context.Context, in contracts.CreateAPIKeyInput) (*contracts.APIKeyOutput, error) {
+	uid, err := requireSuperadmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	in.Name = strings.TrimSpace(in.Name)
+	in.Owner = strings.TrimSpace(in.Owner)
+	if in.Name == "" || in.Owner == "" {
+		return nil, exceptions.BuildNewCustomError(nil, constvars.StatusBadRequest, constvars.ErrClientCannotProcessRequest, "name and owner are required")
+	}
+	roles, err := u.validRoles(in.Roles)
+	if err != nil {
+		return nil, exceptions.ErrClientCustomMessage(err)
+	}
+	now := u.now().UTC()
+	if in.ExpiresAt != nil && !in.ExpiresAt.After(now) {
+		return nil, exceptions.BuildNewCustomError(nil, constvars.StatusBadRequest, constvars.ErrClientCannotProcessRequest, "expiresAt must be in the future")
+	}
+	if in.RequireSignature && u.pepper() == "" {
+		return nil, exceptions.BuildNewCustomError(nil, constvars.StatusBadRequest, constvars.ErrClientCannotProcessRequest, "request signing is not enabled on this server")
+	}
+
+	id, err := randomString(idBytes, hex.EncodeToString)
+	if err != nil {
+		return nil, err
+	}
+	secret, hash, err := newSecret(id)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &contracts.APIKey{
+		ID:               id,
+		Name:             in.Name,
+		Owner:            in.Owner,
+		Roles:            roles,
+		SecretHash:       hash,
+		RequireSignature: in.RequireSignature,
+		CreatedBy:        uid,
+		CreatedAt:        now,
+		ExpiresAt:        in.ExpiresAt,
+	}
+	if err := u.redis.Set(ctx, keyPrefix+id, key, 0); err != nil {
+		return nil, err
+	}
+	if err := u.redis.AddToSet(ctx, keysKey, id); err != nil {
+		_ = u.redis.Delete(ctx, keyPrefix+id)
+		return nil, err
+	}
+
+	u.log.Info("apikeys.Usecase.Create key issued",
+		zap.String("api_key_id", id),
+		zap.String("api_key_name", key.Name),
+		zap.Strings("roles", key.Roles),
+		zap.String("created_by", uid),
+	)
+	out := toOutput(key)
+	out.Secret = secret
+	out.SigningSecret = u.signingSecret(key.SecretHash)
+	return &out, nil
+}
+
+func (u *Usecase) List(ctx context.Context) ([]contracts.APIKeyOutput, error) {
+	if _, err := requireSuperadmin(ctx); err != nil {
+		return nil, err
+	}
+
+	ids, err := u.redis.GetSetMembers(ctx, keysKey)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]contracts.APIKeyOutput, 0, len(ids))
+	for _, id := range ids {
+		key, err := u.load(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			out = append(out, toOutput(key))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (u *Usecase) Rotate(ctx context.Context, id string, in contracts.RotateAPIKeyInput) (*contracts.APIKeyOutput, error) {
+	uid, err := requireSuperadmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key, err := u.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil || key.RevokedAt != nil {
+		return nil, exceptions.ErrAPIKeyNotFound(nil)
+	}
+	now := u.now().UTC()
+	if in.GracePeriod < 0 {
+		return nil, exceptions.BuildNewCustomError(nil, constvars.StatusBadRequest, constvars.ErrClientCannotProcessRequest, "gracePeriodSeconds must not be negative")
+	}
+	if in.ExpiresAt != nil {
+		if !in.ExpiresAt.After(now) {
+			return nil, exceptions.BuildNewCustomError(nil, constvars.StatusBadRequest, constvars.ErrClientCannotProcessRequest, "expiresAt must be in the future")
+		}
+		key.ExpiresAt = in.ExpiresAt
+	}
+
+	secret, hash, err := newSecret(key.ID)
+	if err != nil {
+		return nil, err
+	}
+	key.PreviousSecretHash, key.PreviousSecretExpiresAt = "", nil
+	if in.GracePeriod > 0 {
+		graceEnds := now.Add(in.GracePeriod)
+		key.PreviousSecretHash, key.PreviousSecretExpiresAt = key.SecretHash, &graceEnds
+	}
+	key.SecretHash = hash
+	key.RotatedAt = &now
+	if err := u.redis.Set(ctx, keyPrefix+key.ID, key, 0); err != nil {
+		return nil, err
+	}
+
+	u.log.Info("apikeys.Usecase.Rotate key rotated",
+		zap.String("api_key_id", key.ID),
+		zap.String("api_key_name", key.Name),
+		zap.Duration("grace_period", in.GracePeriod),
+		zap.String("rotated_by", uid),
+	)
+	out := toOutput(key)
+	out.Secret = secret
+	out.SigningSecret = u.signingSecret(key.SecretHash)
+	return &out, nil
+}
+
+func (u *Usecase) Revoke(ctx context.Context, id string) error {
+	uid, err := requireSuperadmin(ctx)
+	if err != nil {
+		return err
+	}
+	key, err := u.load(ctx, id)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return exceptions.ErrAPIKeyNotFound(nil)
+	}
+	if key.RevokedAt != nil {
+		return nil
+	}
+
+	now := u.now().UTC()
+	key.RevokedAt = &now
+	key.PreviousSecretHash, key.PreviousSecretExpiresAt = "", nil
+	if err := u.redis.Set(ctx, keyPrefix+key.ID, key, 0); err != nil {
+		return err
+	}
+
+	u.log.Info("apikeys.Usecase.Revoke key revoked",
+		zap.String("api_key_id", key.ID),
+		zap.String("api_key_name", key.Name),
+		zap.String("revoked_by", uid),
+	)
+	return nil
+}
+
+func (u *Usecase) Authenticate(ctx context.Context, secret string) (*contracts.APIKey, error) {
+	id, ok := secretKeyID(secret)
+	if !ok {
+		return nil, exceptions.ErrInvalidAPIKey(nil)
+	}
+	key, err := u.usableKey(ctx, id, exceptions.ErrInvalidAPIKey)
+	if err != nil {
+		return nil, err
+	}
+	if key.RequireSignature {
+		return nil, exceptions.ErrInvalidAPIKey(errors.New("api key only accepts signed requests"))
+	}
+
+	hash := hashSecret(secret)
+	if !slices.ContainsFunc(u.secretHashes(key), func(h string) bool { return sameHash(hash, h) }) {
+		return nil, exceptions.ErrInvalidAPIKey(nil)
+	}
+	u.recordUse(ctx, key)
+	return key, nil
+}
+
+func (u *Usecase) AuthenticateSigned(ctx context.Context, in contracts.SignedRequestInput) (*contracts.APIKey, error) {
+	if !validNonce(in.Nonce) {
+		return nil, exceptions.ErrInvalidRequestSignature(fmt.Errorf("nonce must be %d to %d letters, digits, '-' or '_'", minNonceLength, maxNonceLength))
+	}
+	signedAt, err := strconv.ParseInt(in.Timestamp, 10, 64)
+	if err != nil {
+		return nil, exceptions.ErrInvalidRequestSignature(errors.New("timestamp must be Unix seconds"))
+	}
+	skew := u.clockSkew()
+	if drift := u.now().Sub(time.Unix(signedAt, 0)); drift > skew || drift < -skew {
+		return nil, exceptions.ErrInvalidRequestSignature(fmt.Errorf("timestamp is more than %s away from the server clock", skew))
+	}
+	signature, err := hex.DecodeString(in.Signature)
+	if err != nil {
+		return nil, exceptions.ErrInvalidRequestSignature(errors.New("signature must be hex"))
+	}
+
+	key, err := u.usableKey(ctx, in.KeyID, exceptions.ErrInvalidRequestSignature)
+	if err != nil {
+		return nil, err
+	}
+	payload := signingPayload(in)
+	if !slices.ContainsFunc(u.secretHashes(key), func(h string) bool { return validSignature(u.signingSecret(h), payload, signature) }) {
+		return nil, exceptions.ErrInvalidRequestSignature(nil)
+	}
+
+	// the nonce is only spent once the signature is known to be genuine, so nobody else can burn it
+	fresh, err := u.redis.TrySetNX(ctx, nonceKeyPrefix+key.ID+":"+in.Nonce, in.Timestamp, 2*skew)
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, exceptions.ErrInvalidRequestSignature(errors.New("nonce already used"))
+	}
+	u.recordUse(ctx, key)
+	return key, nil
+}
+
+// usableKey returns the key when it exists and is neither revoked nor expired. Failures are reported
+// with reject, so bearer and signed requests each keep their own error.
+func (u *Usecase) usableKey(ctx context.Context, id string, reject func(error) error) (*contracts.APIKey, error) {
+	key, err := u.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case key == nil:
+		return nil, reject(nil)
+	case key.RevokedAt != nil:
+		return nil, reject(errors.New("api key revoked"))
+	case key.ExpiresAt != nil && !u.now().Before(*key.ExpiresAt):
+		return nil, reject(errors.New("api key expired"))
+	}
+	return key, nil
+}
+
+// secretHashes returns the hashes of the secrets the key currently accepts: its own, and the one it
+// replaced while the rotation's grace period lasts.
+func (u *Usecase) secretHashes(key *contracts.APIKey) []string {
+	hashes := []string{key.SecretHash}
+	if key.PreviousSecretHash != "" && key.PreviousSecretExpiresAt != nil && u.now().Before(*key.PreviousSecretExpiresAt) {
+		hashes = append(hashes, key.PreviousSecretHash)
+	}
+	return hashes
+}
+
+func (u *Usecase) recordUse(ctx context.Context, key *contracts.APIKey) {
+	now := u.now().UTC()
+	if key.LastUsedAt != nil && now.Sub(*key.LastUsedAt) < lastUsedResolution {
+		return
+	}
+	if err := u.redis.Set(ctx, lastUsedKeyPrefix+key.ID, now, 0); err != nil {
+		u.log.Warn("apikeys.Usecase failed recording last use", zap.String("api_key_id", key.ID), zap.Error(err))
+	}
+	key.LastUsedAt = &now
+}
+
+func (u *Usecase) pepper() string {
+	if u.cfg == nil {
+		return ""
+	}
+	return u.cfg.App.RequestSigningPepper
+}
+
+// signingSecret returns the secret that signs requests for the key secret hashing to secretHash,
+// or "" when no pepper is configured. It is keyed with the pepper, which Redis never holds, so
+// reading the stored hashes is not enough to sign requests.
+func (u *Usecase) signingSecret(secretHash string) string {
+	pepper := u.pepper()
+	if pepper == "" || secretHash == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(pepper))
+	mac.Write([]byte("signing\n" + secretHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (u *Usecase) clockSkew() time.Duration {
+	if u.cfg != nil && u.cfg.App.RequestSigningClockSkewSeconds > 0 {
+		return time.Duration(u.cfg.App.RequestSigningClockSkewSeconds) * time.Second
+	}
+	return defaultClockSkew
+}
+
+// load returns the key with its last use, or nil when it does not exist.
+func (u *Usecase) load(ctx context.Context, id string) (*contracts.APIKey, error) {
+	if !validID(id) {
+		return nil, nil
+	}
+	raw, err := u.redis.Get(ctx, keyPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	if raw == "" {
+		return nil, nil
+	}
+	key := new(contracts.APIKey)
+	if err := json.Unmarshal([]byte(raw), key); err != nil {
+		return nil, exceptions.ErrCannotParseJSON(err)
+	}
+
+	if raw, err := u.redis.Get(ctx, lastUsedKeyPrefix+id); err == nil && raw != "" {
+		var lastUsed time.Time
+		if err := json.Unmarshal([]byte(raw), &lastUsed); err == nil {
+			key.LastUsedAt = &lastUsed
+		}
+	}
+	return key, nil
+}
+
+// validRoles checks every role is a Casbin role a key may hold, and drops duplicates.
+func (u *Usecase) validRoles(roles []string) ([]string, error) {
+	if len(roles) == 0 {
+		return nil, errors.New("at least one role is required")
+	}
+	known, err := u.enforcer.GetAllSubjects()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, role := range roles {
+		role = strings.TrimSpace(role)
+		if !slices.Contains(known, role) {
+			return nil, fmt.Errorf("role %q is not an RBAC role", role)
+		}
+		if slices.Contains(identityRoles, role) {
+			return nil, fmt.Errorf("role %q acts on the caller's own records and cannot be given to an API key", role)
+		}
+		if !slices.Contains(out, role) {
+			out = append(out, role)
+		}
+	}
+	return out, nil
+}
+
+func requireSuperadmin(ctx context.Context) (string, error) {
+	uid, _ := ctx.Value("uid").(string)
+	roles, _ := ctx.Value("roles").([]string)
+	if uid == "" || !slices.Contains(roles, constvars.KonsulinRoleSuperadmin) {
+		return "", exceptions.BuildNewCustomError(nil, constvars.StatusForbidden, constvars.ErrClientNotAuthorized, "managing API keys requires the Superadmin role")
+	}
+	return uid, nil
+}
+
+func toOutput(key *contracts.APIKey) contracts.APIKeyOutput {
+	return contracts.APIKeyOutput{
+		ID:               key.ID,
+		Name:             key.Name,
+		Owner:            key.Owner,
+		Roles:            key.Roles,
+		RequireSignature: key.RequireSignature,
+		CreatedBy:        key.CreatedBy,
+		CreatedAt:        key.CreatedAt,
+		ExpiresAt:        key.ExpiresAt,
+		RotatedAt:        key.RotatedAt,
+		RevokedAt:        key.RevokedAt,
+		LastUsedAt:       key.LastUsedAt,
+	}
+}
+
+// newSecret returns a new secret of the key with its hash.
+func newSecret(id string) (secret, hash string, err error) {
+	random, err := randomString(secretBytes, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return "", "", err
+	}
+	secret = secretPrefix + id + "_" + random
+	return secret, hashSecret(secret), nil
+}
+
+// hashSecret hashes a secret for storage. Secrets are random and long, so a plain SHA-256 is enough
+// to keep them from being recovered from Redis.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// signingPayload is the string a request signature covers.
+func signingPayload(in contracts.SignedRequestInput) []byte {
+	bodyHash := sha256.Sum256(in.Body)
+	return []byte(strings.Join([]string{
+		strings.ToUpper(in.Method),
+		in.RequestURI,
+		in.Timestamp,
+		in.Nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n"))
+}
+
+// validSignature checks a signature made with signingSecret, used as given as the HMAC key.
+func validSignature(signingSecret string, payload, signature []byte) bool {
+	if signingSecret == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	mac.Write(payload)
+	return hmac.Equal(mac.Sum(nil), signature)
+}
+
+func validNonce(nonce string) bool {
+	if len(nonce) < minNonceLength || len(nonce) > maxNonceLength {
+		return false
+	}
+	return strings.IndexFunc(nonce, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_')
+	}) < 0
+}
+
+func sameHash(a, b string) bool {
+	return b != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// secretKeyID returns the key ID a secret names.
+func secretKeyID(secret string) (string, bool) {
+	rest, ok := strings.CutPrefix(secret, secretPrefix)
+	if !ok {
+		return "", false
+	}
+	id, random, ok := strings.Cut(rest, "_")
+	if !ok || random == "" || !validID(id) {
+		return "", false
+	}
+	return id, true
+}
+
+func validID(id string) bool {
+	if len(id) != 2*idBytes {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func randomString(n int, encode func([]byte) string) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encode(b), nil
+}
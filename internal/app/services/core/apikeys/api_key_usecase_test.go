@@ -0,0 +1,295 @@
+package apikeys
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"konsulin-service/internal/app/config"
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// memoryRedis is an in-memory stand-in for the Redis repository; expirations are ignored.
+type memoryRedis struct {
+	contracts.RedisRepository
+	mu   sync.Mutex
+	data map[string]string
+	sets map[string]map[string]struct{}
+}
+
+func newMemoryRedis() *memoryRedis {
+	return &memoryRedis{data: map[string]string{}, sets: map[string]map[string]struct{}{}}
+}
+
+func (r *memoryRedis) Set(_ context.Context, key string, value interface{}, _ time.Duration) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.data[key] = string(raw)
+	return nil
+}
+
+func (r *memoryRedis) Get(_ context.Context, key string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.data[key], nil
+}
+
+func (r *memoryRedis) Delete(_ context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.data, key)
+	return nil
+}
+
+func (r *memoryRedis) TrySetNX(ctx context.Context, key string, value interface{}, exp time.Duration) (bool, error) {
+	r.mu.Lock()
+	_, exists := r.data[key]
+	r.mu.Unlock()
+	if exists {
+		return false, nil
+	}
+	return true, r.Set(ctx, key, value, exp)
+}
+
+func (r *memoryRedis) AddToSet(_ context.Context, key string, values ...interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sets[key] == nil {
+		r.sets[key] = map[string]struct{}{}
+	}
+	for _, v := range values {
+		r.sets[key][fmt.Sprint(v)] = struct{}{}
+	}
+	return nil
+}
+
+func (r *memoryRedis) GetSetMembers(_ context.Context, key string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var members []string
+	for m := range r.sets[key] {
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+func newTestUsecase(t *testing.T) (*Usecase, *memoryRedis, *time.Time) {
+	t.Helper()
+	enforcer, err := casbin.NewEnforcer("../../../../../resources/rbac_model.conf", "../../../../../resources/rbac_policy.csv")
+	require.NoError(t, err)
+
+	redis := newMemoryRedis()
+	u := NewAPIKeyUsecase(redis, enforcer, nil, zap.NewNop())
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	u.now = func() time.Time { return now }
+	return u, redis, &now
+}
+
+func superadmin() context.Context {
+	ctx := context.WithValue(context.Background(), "uid", "st-admin-1")
+	return context.WithValue(ctx, "roles", []string{constvars.KonsulinRoleSuperadmin})
+}
+
+func statusOf(t *testing.T, err error) int {
+	t.Helper()
+	var custom *exceptions.CustomError
+	require.ErrorAs(t, err, &custom)
+	return custom.StatusCode
+}
+
+func TestUsecase_CreateAndAuthenticate(t *testing.T) {
+	u, redis, now := newTestUsecase(t)
+	ctx := superadmin()
+
+	created, err := u.Create(ctx, contracts.CreateAPIKeyInput{
+		Name:  "Prodia Lab",
+		Owner: "it@prodia.example",
+		Roles: []string{constvars.KonsulinRoleResearcher, constvars.KonsulinRoleResearcher},
+	})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(created.Secret, secretPrefix+created.ID+"_"))
+	assert.Equal(t, []string{constvars.KonsulinRoleResearcher}, created.Roles)
+	assert.Equal(t, "st-admin-1", created.CreatedBy)
+	assert.NotContains(t, redis.data[keyPrefix+created.ID], created.Secret, "only the hash is stored")
+
+	key, err := u.Authenticate(context.Background(), created.Secret)
+	require.NoError(t, err)
+	assert.Equal(t, "Prodia Lab", key.Name)
+	require.NotNil(t, key.LastUsedAt)
+	assert.Equal(t, *now, *key.LastUsedAt)
+
+	listed, err := u.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	assert.Empty(t, listed[0].Secret)
+	require.NotNil(t, listed[0].LastUsedAt)
+
+	_, err = u.Authenticate(context.Background(), created.Secret+"x")
+	assert.Equal(t, http.StatusUnauthorized, statusOf(t, err))
+	_, err = u.Authenticate(context.Background(), "kk_0123456789abcdef_nope")
+	assert.Equal(t, http.StatusUnauthorized, statusOf(t, err))
+}
+
+func TestUsecase_CreateValidation(t *testing.T) {
+	u, _, now := newTestUsecase(t)
+	past := now.Add(-time.Hour)
+
+	cases := map[string]contracts.CreateAPIKeyInput{
+		"missing owner":      {Name: "Chatbot", Roles: []string{constvars.KonsulinRoleResearcher}},
+		"no roles":           {Name: "Chatbot", Owner: "ops"},
+		"unknown role":       {Name: "Chatbot", Owner: "ops", Roles: []string{"Robot"}},
+		"identity role":      {Name: "Chatbot", Owner: "ops", Roles: []string{constvars.KonsulinRolePatient}},
+		"practitioner role":  {Name: "Chatbot", Owner: "ops", Roles: []string{constvars.KonsulinRoleClinicAdmin, constvars.KonsulinRolePractitioner}},
+		"guest role":         {Name: "Chatbot", Owner: "ops", Roles: []string{constvars.KonsulinRoleGuest}},
+		"expiry in the past": {Name: "Chatbot", Owner: "ops", Roles: []string{constvars.KonsulinRoleResearcher}, ExpiresAt: &past},
+	}
+	for name, in := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := u.Create(superadmin(), in)
+			assert.Equal(t, http.StatusBadRequest, statusOf(t, err))
+		})
+	}
+
+	t.Run("superadmins only", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), "uid", "st-user-1")
+		ctx = context.WithValue(ctx, "roles", []string{constvars.KonsulinRoleClinicAdmin})
+		_, err := u.Create(ctx, contracts.CreateAPIKeyInput{Name: "Chatbot", Owner: "ops", Roles: []string{constvars.KonsulinRoleClinicAdmin}})
+		assert.Equal(t, http.StatusForbidden, statusOf(t, err))
+	})
+}
+
+func TestUsecase_RotateRevokeExpire(t *testing.T) {
+	u, _, now := newTestUsecase(t)
+	ctx := superadmin()
+	expires := now.Add(48 * time.Hour)
+
+	created, err := u.Create(ctx, contracts.CreateAPIKeyInput{Name: "Chatbot", Owner: "ops", Roles: []string{constvars.KonsulinRoleClinicAdmin}, ExpiresAt: &expires})
+	require.NoError(t, err)
+
+	rotated, err := u.Rotate(ctx, created.ID, contracts.RotateAPIKeyInput{GracePeriod: time.Hour})
+	require.NoError(t, err)
+	assert.NotEqual(t, created.Secret, rotated.Secret)
+
+	_, err = u.Authenticate(context.Background(), created.Secret)
+	assert.NoError(t, err, "the old secret works during the grace period")
+	_, err = u.Authenticate(context.Background(), rotated.Secret)
+	assert.NoError(t, err)
+
+	*now = now.Add(2 * time.Hour)
+	_, err = u.Authenticate(context.Background(), created.Secret)
+	assert.Error(t, err, "the old secret stops working after the grace period")
+	_, err = u.Authenticate(context.Background(), rotated.Secret)
+	assert.NoError(t, err)
+
+	*now = expires
+	_, err = u.Authenticate(context.Background(), rotated.Secret)
+	assert.Error(t, err, "expired keys are refused")
+
+	_, err = u.Rotate(ctx, "0123456789abcdef", contracts.RotateAPIKeyInput{})
+	assert.Equal(t, http.StatusNotFound, statusOf(t, err))
+
+	require.NoError(t, u.Revoke(ctx, created.ID))
+	_, err = u.Rotate(ctx, created.ID, contracts.RotateAPIKeyInput{})
+	assert.Equal(t, http.StatusNotFound, statusOf(t, err), "revoked keys cannot be rotated back to life")
+
+	listed, err := u.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	assert.NotNil(t, listed[0].RevokedAt, "revoked keys stay listed")
+}
+
+// sign signs a request the way integrators are told to.
+func sign(signingSecret string, in contracts.SignedRequestInput) string {
+	bodyHash := sha256.Sum256(in.Body)
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	mac.Write([]byte(strings.Join([]string{in.Method, in.RequestURI, in.Timestamp, in.Nonce, hex.EncodeToString(bodyHash[:])}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestUsecase_AuthenticateSigned(t *testing.T) {
+	u, redis, now := newTestUsecase(t)
+	ctx := superadmin()
+
+	_, err := u.Create(ctx, contracts.CreateAPIKeyInput{Name: "Chatbot", Owner: "ops", Roles: []string{constvars.KonsulinRoleClinicAdmin}, RequireSignature: true})
+	assert.Equal(t, http.StatusBadRequest, statusOf(t, err), "signed-only keys need a signing pepper")
+
+	u.cfg = &config.InternalConfig{App: config.App{RequestSigningClockSkewSeconds: 60, RequestSigningPepper: "pepper"}}
+	created, err := u.Create(ctx, contracts.CreateAPIKeyInput{Name: "Chatbot", Owner: "ops", Roles: []string{constvars.KonsulinRoleClinicAdmin}, RequireSignature: true})
+	require.NoError(t, err)
+	require.NotEmpty(t, created.SigningSecret)
+	assert.NotContains(t, redis.data[keyPrefix+created.ID], created.SigningSecret)
+
+	_, err = u.Authenticate(context.Background(), created.Secret)
+	assert.Equal(t, http.StatusUnauthorized, statusOf(t, err), "signed-only keys refuse bearer use")
+
+	signed := func(nonce string, signedAt time.Time) contracts.SignedRequestInput {
+		in := contracts.SignedRequestInput{
+			KeyID:      created.ID,
+			Timestamp:  strconv.FormatInt(signedAt.Unix(), 10),
+			Nonce:      nonce,
+			Method:     http.MethodPost,
+			RequestURI: "/api/v1/hook/analyze?async=true",
+			Body:       []byte(`{"email":"user@email.com"}`),
+		}
+		in.Signature = sign(created.SigningSecret, in)
+		return in
+	}
+
+	key, err := u.AuthenticateSigned(context.Background(), signed("nonce-0000000001", *now))
+	require.NoError(t, err)
+	assert.Equal(t, created.ID, key.ID)
+
+	_, err = u.AuthenticateSigned(context.Background(), signed("nonce-0000000001", *now))
+	assert.Equal(t, http.StatusUnauthorized, statusOf(t, err), "a nonce is accepted once")
+
+	_, err = u.AuthenticateSigned(context.Background(), signed("nonce-0000000002", now.Add(-2*time.Minute)))
+	assert.Equal(t, http.StatusUnauthorized, statusOf(t, err), "stale timestamps are refused")
+
+	tampered := signed("nonce-0000000003", *now)
+	tampered.Body = []byte(`{"email":"someone@else.com"}`)
+	_, err = u.AuthenticateSigned(context.Background(), tampered)
+	assert.Equal(t, http.StatusUnauthorized, statusOf(t, err), "the body is covered by the signature")
+
+	_, err = u.AuthenticateSigned(context.Background(), signed("short", *now))
+	assert.Equal(t, http.StatusUnauthorized, statusOf(t, err))
+
+	tampered = signed("nonce-0000000004", *now)
+	tampered.RequestURI = "/api/v1/hook/analyze?async=false"
+	_, err = u.AuthenticateSigned(context.Background(), tampered)
+	assert.Equal(t, http.StatusUnauthorized, statusOf(t, err), "the query is covered by the signature")
+
+	_, err = u.AuthenticateSigned(context.Background(), signed("nonce-0000000004", *now))
+	assert.NoError(t, err, "rejected requests do not spend their nonce")
+
+	// the stored hash is not enough to sign
+	var stored contracts.APIKey
+	require.NoError(t, json.Unmarshal([]byte(redis.data[keyPrefix+created.ID]), &stored))
+	forged := signed("nonce-0000000005", *now)
+	storedHash, _ := hex.DecodeString(stored.SecretHash)
+	forged.Signature = sign(string(storedHash), forged)
+	_, err = u.AuthenticateSigned(context.Background(), forged)
+	assert.Equal(t, http.StatusUnauthorized, statusOf(t, err))
+	forged.Signature = sign(stored.SecretHash, forged)
+	_, err = u.AuthenticateSigned(context.Background(), forged)
+	assert.Equal(t, http.StatusUnauthorized, statusOf(t, err))
+}
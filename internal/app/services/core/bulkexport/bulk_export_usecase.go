@@ -0,0 +1,347 @@
+package bulkexport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"konsulin-service/internal/app/config"
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/app/services/shared/deidentify"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/dto/requests"
+	"konsulin-service/internal/pkg/exceptions"
+	"konsulin-service/internal/pkg/fhir_dto"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	jobKeyPrefix      = "bulkexport:job:"
+	progressKeyPrefix = "bulkexport:progress:"
+	// jobsKey is the set of jobs whose files have not been removed yet.
+	jobsKey = "bulkexport:jobs"
+	// claimKeyPrefix marks a paid access-dataset ServiceRequest as used by a job. Claims do not
+	// expire: one purchase is one export.
+	claimKeyPrefix = "bulkexport:servicerequest:"
+
+	defaultRetention = 24 * time.Hour
+	// maxPurchases caps how many paid access-dataset ServiceRequests, of every researcher, are
+	// looked through for an unused one of the caller.
+	maxPurchases = 100
+)
+
+func errJobNotFound() error {
+	return exceptions.BuildNewCustomError(nil, constvars.StatusNotFound, "export job not found", "bulk export job missing, expired or owned by another user")
+}
+
+// Usecase implements contracts.BulkExportUsecase. Jobs are kept in Redis and run by the Worker.
+type Usecase struct {
+	redis                contracts.RedisRepository
+	serviceRequestClient contracts.ServiceRequestFhirClient
+	store                contracts.BulkExportFileStore
+	cfg                  *config.InternalConfig
+	log                  *zap.Logger
+	client               *http.Client
+
+	// deid de-identifies the exports of research roles; nil exports every job as stored.
+	deid *deidentify.Engine
+}
+
+// NewBulkExportUsecase constructs a new bulk export usecase.
+func NewBulkExportUsecase(
+	redis contracts.RedisRepository,
+	serviceRequestClient contracts.ServiceRequestFhirClient,
+	store contracts.BulkExportFileStore,
+	deid *deidentify.Engine,
+	cfg *config.InternalConfig,
+	log *zap.Logger,
+) *Usecase {
+	return &Usecase{
+		redis:                redis,
+		serviceRequestClient: serviceRequestClient,
+		store:                store,
+		deid:                 deid,
+		cfg:                  cfg,
+		log:                  log,
+		client:               &http.Client{Timeout: time.Minute},
+	}
+}
+
+func (u *Usecase) Kickoff(ctx context.Context, in contracts.BulkExportKickoffInput) (*contracts.BulkExportJob, error) {
+	requestID, _ := ctx.Value(constvars.CONTEXT_REQUEST_ID_KEY).(string)
+	uid, _ := ctx.Value("uid").(string)
+	roles, _ := ctx.Value("roles").([]string)
+	if uid == "" {
+		return nil, exceptions.ErrAuthInvalidRole(errors.New("bulk export requires an authenticated user"))
+	}
+
+	types, err := u.exportTypes(in.Types)
+	if err != nil {
+		return nil, exceptions.ErrClientCustomMessage(err)
+	}
+
+	job := &contracts.BulkExportJob{
+		ID:         uuid.NewString(),
+		Level:      in.Level,
+		GroupID:    in.GroupID,
+		Types:      types,
+		Since:      in.Since,
+		RequestURL: in.RequestURL,
+		OwnerUID:   uid,
+		OwnerRoles: roles,
+		Status:     contracts.BulkExportStatusAccepted,
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	if !slices.Contains(roles, constvars.KonsulinRoleSuperadmin) {
+		if !slices.Contains(roles, constvars.KonsulinRoleResearcher) {
+			return nil, exceptions.BuildNewCustomError(nil, constvars.StatusForbidden,
+				"bulk export is available to researchers who purchased dataset access",
+				"bulk export requires the Researcher or Superadmin role")
+		}
+		if job.ServiceRequestID, err = u.claimServiceRequest(ctx, uid, job.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := u.saveJob(ctx, job); err != nil {
+		u.releaseServiceRequest(ctx, job)
+		return nil, err
+	}
+	if err := u.redis.AddToSet(ctx, jobsKey, job.ID); err != nil {
+		u.releaseServiceRequest(ctx, job)
+		_ = u.redis.Delete(ctx, jobKeyPrefix+job.ID)
+		return nil, err
+	}
+
+	u.log.Info("bulkexport.Usecase.Kickoff job accepted",
+		zap.String(constvars.LoggingRequestIDKey, requestID),
+		zap.String("job_id", job.ID),
+		zap.String("level", job.Level),
+		zap.Strings("types", job.Types),
+		zap.String("service_request_id", job.ServiceRequestID),
+	)
+	return job, nil
+}
+
+func (u *Usecase) Status(ctx context.Context, jobID string) (*contracts.BulkExportStatusOutput, error) {
+	job, err := u.ownedJob(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &contracts.BulkExportStatusOutput{Job: job}
+	switch job.Status {
+	case contracts.BulkExportStatusCompleted:
+		out.Manifest = u.manifest(job)
+	case contracts.BulkExportStatusInProgress:
+		if progress, err := u.redis.Get(ctx, progressKeyPrefix+job.ID); err == nil && progress != "" {
+			_ = json.Unmarshal([]byte(progress), &job.Progress)
+		}
+	}
+	return out, nil
+}
+
+func (u *Usecase) Cancel(ctx context.Context, jobID string) error {
+	job, err := u.ownedJob(ctx, jobID)
+	if err != nil {
+		return err
+	}
+
+	if err := u.redis.Delete(ctx, jobKeyPrefix+job.ID); err != nil {
+		return err
+	}
+	// a job cancelled before it delivered anything does not use up the purchase
+	if job.Status != contracts.BulkExportStatusCompleted {
+		u.releaseServiceRequest(ctx, job)
+	}
+	u.forget(ctx, job.ID)
+	return nil
+}
+
+func (u *Usecase) OpenFile(ctx context.Context, jobID, name string) (io.ReadCloser, error) {
+	job, err := u.ownedJob(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status != contracts.BulkExportStatusCompleted || !slices.ContainsFunc(job.Output, func(f contracts.BulkExportFile) bool { return f.Name == name }) {
+		return nil, exceptions.BuildNewCustomError(nil, constvars.StatusNotFound, "export file not found", "bulk export file not in the job output")
+	}
+	return u.store.Open(ctx, job.ID, name)
+}
+
+// exportTypes checks the requested types are exportable; none requested means all of them.
+func (u *Usecase) exportTypes(requested []string) ([]string, error) {
+	allowed := u.cfg.FHIR.BulkExportResourceTypes
+	if len(requested) == 0 {
+		return allowed, nil
+	}
+	var types []string
+	for _, t := range requested {
+		if !slices.Contains(allowed, t) {
+			return nil, fmt.Errorf("resource type %s cannot be exported; exportable types are %s", t, strings.Join(allowed, ", "))
+		}
+		if !slices.Contains(types, t) {
+			types = append(types, t)
+		}
+	}
+	return types, nil
+}
+
+// accessDatasetURI is the instantiatesUri CreatePay gives access-dataset ServiceRequests.
+func (u *Usecase) accessDatasetURI() string {
+	baseURL := strings.TrimRight(u.cfg.App.BaseUrl, "/")
+	instantiateURI := fmt.Sprintf("%s/%s/%s", baseURL, u.cfg.App.WebhookInstantiateBasePath, constvars.ServiceAccessDataset)
+	if parsed, err := url.Parse(instantiateURI); err == nil {
+		parsed.Path = path.Clean(parsed.Path)
+		instantiateURI = parsed.String()
+	}
+	return instantiateURI
+}
+
+// claimServiceRequest finds a paid access-dataset ServiceRequest of uid no other job used yet, and
+// claims it for jobID.
+func (u *Usecase) claimServiceRequest(ctx context.Context, uid, jobID string) (string, error) {
+	purchases, err := u.serviceRequestClient.Search(ctx, &fhir_dto.SearchServiceRequestInput{
+		Status:          "active",
+		InstantiatesURI: u.accessDatasetURI(),
+		Tag:             constvars.ServiceRequestPaymentTagSystem + "|" + constvars.ServiceRequestPaymentTagPaid,
+		// tagging a purchase as paid updates it, so the latest purchases come first
+		Sort:  "-_lastUpdated",
+		Count: maxPurchases,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, sr := range purchases {
+		if !purchasedBy(sr, uid) {
+			continue
+		}
+		claimed, err := u.redis.TrySetNX(ctx, claimKeyPrefix+sr.ID, jobID, 0)
+		if err != nil {
+			return "", err
+		}
+		if claimed {
+			return sr.ID, nil
+		}
+	}
+	return "", exceptions.BuildNewCustomError(nil, constvars.StatusForbidden,
+		"bulk export requires a paid dataset access purchase that was not used for an export yet",
+		"no unclaimed paid access-dataset ServiceRequest for the user")
+}
+
+// purchasedBy reports whether the ServiceRequest was created by CreatePay for uid.
+func purchasedBy(sr fhir_dto.GetServiceRequestOutput, uid string) bool {
+	if len(sr.Note) == 0 {
+		return false
+	}
+	var note requests.NoteStorage
+	if err := json.Unmarshal([]byte(sr.Note[0].Text), &note); err != nil {
+		return false
+	}
+	return note.UID != "" && note.UID == uid
+}
+
+// releaseServiceRequest gives the purchase a job used back, so it can start another one.
+func (u *Usecase) releaseServiceRequest(ctx context.Context, job *contracts.BulkExportJob) {
+	if job.ServiceRequestID == "" {
+		return
+	}
+	if err := u.redis.Delete(ctx, claimKeyPrefix+job.ServiceRequestID); err != nil {
+		u.log.Error("bulkexport.Usecase failed releasing ServiceRequest claim",
+			zap.String("job_id", job.ID),
+			zap.String("service_request_id", job.ServiceRequestID),
+			zap.Error(err),
+		)
+	}
+}
+
+// ownedJob loads a job of the caller. Superadmins may see every job; other users are told a job
+// they do not own does not exist.
+func (u *Usecase) ownedJob(ctx context.Context, jobID string) (*contracts.BulkExportJob, error) {
+	uid, _ := ctx.Value("uid").(string)
+	roles, _ := ctx.Value("roles").([]string)
+
+	job, err := u.loadJob(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if job == nil || (job.OwnerUID != uid && !slices.Contains(roles, constvars.KonsulinRoleSuperadmin)) {
+		return nil, errJobNotFound()
+	}
+	return job, nil
+}
+
+// loadJob returns the job, or nil when it does not exist.
+func (u *Usecase) loadJob(ctx context.Context, jobID string) (*contracts.BulkExportJob, error) {
+	if !validName(jobID) {
+		return nil, nil
+	}
+	raw, err := u.redis.Get(ctx, jobKeyPrefix+jobID)
+	if err != nil {
+		return nil, err
+	}
+	if raw == "" {
+		return nil, nil
+	}
+	job := new(contracts.BulkExportJob)
+	if err := json.Unmarshal([]byte(raw), job); err != nil {
+		return nil, exceptions.ErrCannotParseJSON(err)
+	}
+	return job, nil
+}
+
+// saveJob stores the job until its retention, counted from its creation, ends.
+func (u *Usecase) saveJob(ctx context.Context, job *contracts.BulkExportJob) error {
+	return u.redis.Set(ctx, jobKeyPrefix+job.ID, job, u.remaining(job))
+}
+
+func (u *Usecase) remaining(job *contracts.BulkExportJob) time.Duration {
+	retention := defaultRetention
+	if hours := u.cfg.FHIR.BulkExportRetentionHours; hours > 0 {
+		retention = time.Duration(hours) * time.Hour
+	}
+	return max(time.Until(job.CreatedAt.Add(retention)), time.Minute)
+}
+
+// forget removes the files of a job that expired or was cancelled.
+func (u *Usecase) forget(ctx context.Context, jobID string) {
+	if err := u.store.RemoveJob(ctx, jobID); err != nil {
+		u.log.Error("bulkexport.Usecase failed removing job files", zap.String("job_id", jobID), zap.Error(err))
+		return
+	}
+	_ = u.redis.Delete(ctx, progressKeyPrefix+jobID)
+	if err := u.redis.RemoveFromSet(ctx, jobsKey, jobID); err != nil {
+		u.log.Error("bulkexport.Usecase failed removing job from the job set", zap.String("job_id", jobID), zap.Error(err))
+	}
+}
+
+// manifest lists the files of a completed job with their download URLs.
+func (u *Usecase) manifest(job *contracts.BulkExportJob) *contracts.BulkExportManifest {
+	m := &contracts.BulkExportManifest{
+		TransactionTime:     job.TransactionTime,
+		Request:             job.RequestURL,
+		RequiresAccessToken: true,
+		Output:              []contracts.BulkExportManifestFile{},
+		Error:               []contracts.BulkExportManifestFile{},
+	}
+	base := fmt.Sprintf("%s/%s/%s", strings.TrimRight(u.cfg.App.BaseUrl, "/"), u.cfg.App.EndpointPrefix, u.cfg.App.Version)
+	for _, f := range job.Output {
+		m.Output = append(m.Output, contracts.BulkExportManifestFile{
+			Type:  f.Type,
+			URL:   fmt.Sprintf("%s/bulk-export/%s/files/%s", base, job.ID, url.PathEscape(f.Name)),
+			Count: f.Count,
+		})
+	}
+	return m
+}
@@ -0,0 +1,255 @@
+package bulkexport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"konsulin-service/internal/app/config"
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+	"konsulin-service/internal/pkg/fhir_dto"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// memoryRedis is an in-memory stand-in for the Redis repository; expirations are ignored.
+type memoryRedis struct {
+	contracts.RedisRepository
+	mu   sync.Mutex
+	data map[string]string
+	sets map[string]map[string]struct{}
+}
+
+func newMemoryRedis() *memoryRedis {
+	return &memoryRedis{data: map[string]string{}, sets: map[string]map[string]struct{}{}}
+}
+
+func (r *memoryRedis) Set(_ context.Context, key string, value interface{}, _ time.Duration) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.data[key] = string(raw)
+	return nil
+}
+
+func (r *memoryRedis) Get(_ context.Context, key string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.data[key], nil
+}
+
+func (r *memoryRedis) Delete(_ context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.data, key)
+	return nil
+}
+
+func (r *memoryRedis) TrySetNX(ctx context.Context, key string, value interface{}, exp time.Duration) (bool, error) {
+	r.mu.Lock()
+	_, exists := r.data[key]
+	r.mu.Unlock()
+	if exists {
+		return false, nil
+	}
+	return true, r.Set(ctx, key, value, exp)
+}
+
+func (r *memoryRedis) AddToSet(_ context.Context, key string, values ...interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sets[key] == nil {
+		r.sets[key] = map[string]struct{}{}
+	}
+	for _, v := range values {
+		r.sets[key][fmt.Sprint(v)] = struct{}{}
+	}
+	return nil
+}
+
+func (r *memoryRedis) GetSetMembers(_ context.Context, key string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var members []string
+	for m := range r.sets[key] {
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+func (r *memoryRedis) RemoveFromSet(_ context.Context, key string, values ...interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range values {
+		delete(r.sets[key], fmt.Sprint(v))
+	}
+	return nil
+}
+
+type fakeServiceRequestClient struct {
+	contracts.ServiceRequestFhirClient
+	purchases []fhir_dto.GetServiceRequestOutput
+	search    *fhir_dto.SearchServiceRequestInput
+}
+
+func (f *fakeServiceRequestClient) Search(_ context.Context, input *fhir_dto.SearchServiceRequestInput) ([]fhir_dto.GetServiceRequestOutput, error) {
+	f.search = input
+	return f.purchases, nil
+}
+
+func purchase(id, uid string) fhir_dto.GetServiceRequestOutput {
+	return fhir_dto.GetServiceRequestOutput{
+		ID:   id,
+		Note: []fhir_dto.Annotation{{Text: `{"rawBody":{},"uid":"` + uid + `"}`}},
+	}
+}
+
+func newTestUsecase(t *testing.T, fhirBase string, purchases ...fhir_dto.GetServiceRequestOutput) (*Usecase, *fakeServiceRequestClient) {
+	t.Helper()
+	store, err := NewLocalFileStore(t.TempDir())
+	require.NoError(t, err)
+
+	srClient := &fakeServiceRequestClient{purchases: purchases}
+	cfg := &config.InternalConfig{
+		App: config.App{BaseUrl: "https://api.konsulin.care", EndpointPrefix: "api", Version: "v1", WebhookInstantiateBasePath: "/api/v1/hook"},
+		FHIR: config.AppFHIR{
+			BaseUrl:                 fhirBase,
+			BulkExportResourceTypes: []string{"Patient", "Observation", "Condition"},
+		},
+	}
+	return NewBulkExportUsecase(newMemoryRedis(), srClient, store, nil, cfg, zap.NewNop()), srClient
+}
+
+func caller(uid string, roles ...string) context.Context {
+	ctx := context.WithValue(context.Background(), "uid", uid)
+	return context.WithValue(ctx, "roles", roles)
+}
+
+func statusCode(t *testing.T, err error) int {
+	t.Helper()
+	var customErr *exceptions.CustomError
+	require.ErrorAs(t, err, &customErr)
+	return customErr.StatusCode
+}
+
+func TestKickoff_Access(t *testing.T) {
+	in := contracts.BulkExportKickoffInput{Level: contracts.BulkExportLevelSystem}
+
+	t.Run("superadmins need no purchase", func(t *testing.T) {
+		u, _ := newTestUsecase(t, "http://fhir")
+		job, err := u.Kickoff(caller("api-key-superadmin", constvars.KonsulinRoleSuperadmin), in)
+		require.NoError(t, err)
+		assert.Empty(t, job.ServiceRequestID)
+		assert.Equal(t, []string{"Patient", "Observation", "Condition"}, job.Types)
+	})
+
+	t.Run("a researcher uses each paid purchase once", func(t *testing.T) {
+		u, srClient := newTestUsecase(t, "http://fhir", purchase("sr-other", "u2"), purchase("sr1", "u1"))
+		ctx := caller("u1", constvars.KonsulinRoleResearcher)
+
+		job, err := u.Kickoff(ctx, in)
+		require.NoError(t, err)
+		assert.Equal(t, "sr1", job.ServiceRequestID)
+		assert.Equal(t, "https://api.konsulin.care/api/v1/hook/access-dataset", srClient.search.InstantiatesURI)
+		assert.Equal(t, constvars.ServiceRequestPaymentTagSystem+"|paid", srClient.search.Tag)
+
+		_, err = u.Kickoff(ctx, in)
+		assert.Equal(t, constvars.StatusForbidden, statusCode(t, err), "the only purchase is used")
+
+		require.NoError(t, u.Cancel(ctx, job.ID))
+		_, err = u.Kickoff(ctx, in)
+		assert.NoError(t, err, "a cancelled job gives its purchase back")
+	})
+
+	t.Run("other roles are refused", func(t *testing.T) {
+		u, _ := newTestUsecase(t, "http://fhir", purchase("sr1", "u1"))
+		_, err := u.Kickoff(caller("u1", constvars.KonsulinRolePractitioner), in)
+		assert.Equal(t, constvars.StatusForbidden, statusCode(t, err))
+	})
+
+	t.Run("types outside the exportable ones are refused", func(t *testing.T) {
+		u, _ := newTestUsecase(t, "http://fhir")
+		_, err := u.Kickoff(caller("api-key-superadmin", constvars.KonsulinRoleSuperadmin), contracts.BulkExportKickoffInput{Level: contracts.BulkExportLevelSystem, Types: []string{"Person"}})
+		assert.Equal(t, constvars.StatusBadRequest, statusCode(t, err))
+	})
+}
+
+func TestRunJob_GroupExport(t *testing.T) {
+	fhir := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", constvars.MIMEApplicationFHIRJSON)
+		switch r.URL.Path {
+		case "/fhir/Group/g1":
+			fmt.Fprint(w, `{"resourceType":"Group","id":"g1","member":[{"entity":{"reference":"Patient/p1"}},{"entity":{"reference":"Patient/p2"}},{"entity":{"reference":"Patient/p3"},"inactive":true}]}`)
+		case "/fhir/Patient/p1/$everything":
+			if r.URL.Query().Get("page") == "" {
+				assert.Equal(t, "Observation,Condition", r.URL.Query().Get("_type"))
+				// next links carry the FHIR server's own base
+				fmt.Fprint(w, `{"resourceType":"Bundle","link":[{"relation":"next","url":"http://blaze-internal/fhir/Patient/p1/$everything?page=2"}],"entry":[
+					{"resource":{"resourceType":"Observation","id":"o1","subject":{"reference":"Patient/p1"}}}]}`)
+				return
+			}
+			fmt.Fprint(w, `{"resourceType":"Bundle","entry":[{"resource":{"resourceType":"Condition","id":"c1"}},{"resource":{"resourceType":"Observation","id":"shared"}}]}`)
+		case "/fhir/Patient/p2/$everything":
+			fmt.Fprint(w, `{"resourceType":"Bundle","entry":[{"resource":{"resourceType":"Observation","id":"shared"}},{"resource":{"resourceType":"Patient","id":"p2"}}]}`)
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer fhir.Close()
+
+	u, _ := newTestUsecase(t, fhir.URL+"/fhir/", purchase("sr1", "u1"))
+	ctx := caller("u1", constvars.KonsulinRoleResearcher)
+
+	job, err := u.Kickoff(ctx, contracts.BulkExportKickoffInput{
+		Level:      contracts.BulkExportLevelGroup,
+		GroupID:    "g1",
+		Types:      []string{"Observation", "Condition"},
+		RequestURL: "https://api.konsulin.care/fhir/Group/g1/$export?_type=Observation,Condition",
+	})
+	require.NoError(t, err)
+
+	status, err := u.Status(ctx, job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, contracts.BulkExportStatusAccepted, status.Job.Status)
+	assert.Nil(t, status.Manifest)
+
+	u.runJob(context.Background(), job)
+
+	status, err = u.Status(ctx, job.ID)
+	require.NoError(t, err)
+	require.Equal(t, contracts.BulkExportStatusCompleted, status.Job.Status, status.Job.Error)
+	require.NotNil(t, status.Manifest)
+	assert.Equal(t, "https://api.konsulin.care/fhir/Group/g1/$export?_type=Observation,Condition", status.Manifest.Request)
+	assert.Equal(t, []contracts.BulkExportManifestFile{
+		{Type: "Observation", URL: "https://api.konsulin.care/api/v1/bulk-export/" + job.ID + "/files/Observation.ndjson", Count: 2},
+		{Type: "Condition", URL: "https://api.konsulin.care/api/v1/bulk-export/" + job.ID + "/files/Condition.ndjson", Count: 1},
+	}, status.Manifest.Output)
+
+	file, err := u.OpenFile(ctx, job.ID, "Observation.ndjson")
+	require.NoError(t, err)
+	defer file.Close()
+	body, err := io.ReadAll(file)
+	require.NoError(t, err)
+	assert.Equal(t,
+		`{"resourceType":"Observation","id":"o1","subject":{"reference":"Patient/p1"}}`+"\n"+`{"resourceType":"Observation","id":"shared"}`+"\n",
+		string(body))
+
+	_, err = u.Status(caller("u2", constvars.KonsulinRoleResearcher), job.ID)
+	assert.Equal(t, constvars.StatusNotFound, statusCode(t, err), "jobs are private to their owner")
+	_, err = u.OpenFile(ctx, job.ID, "../Observation.ndjson")
+	assert.Equal(t, constvars.StatusNotFound, statusCode(t, err))
+}
@@ -0,0 +1,394 @@
+package bulkexport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/app/services/shared/deidentify"
+	"konsulin-service/internal/pkg/constvars"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+)
+
+// pageSize is the _count of the upstream searches an export runs.
+const pageSize = 200
+
+// errCancelled stops an export whose job was cancelled while it ran.
+var errCancelled = errors.New("bulk export job cancelled")
+
+// exportFile is the NDJSON file of one resource type being written.
+type exportFile struct {
+	name  string
+	w     io.WriteCloser
+	buf   *bufio.Writer
+	count int
+}
+
+// export is a job being run: the files written so far and, for patient-centred exports, the
+// resources already written, since a resource may be in several patients' compartments.
+type export struct {
+	u     *Usecase
+	job   *contracts.BulkExportJob
+	files map[string]*exportFile
+	seen  map[string]struct{}
+	total int
+	// deid is set when the job's owner only receives de-identified data. Resources counted in cells
+	// are held until the whole export is read, so small cells can be suppressed.
+	deid      *deidentify.Engine
+	cells     *deidentify.Cells
+	heldCells []heldLine
+}
+
+// heldLine is a de-identified resource waiting for the size of its cell to be known.
+type heldLine struct {
+	resourceType string
+	line         []byte
+	cell         string
+}
+
+// runJob runs the export of job and records its outcome. A failed job gives back the purchase it
+// used and keeps no files.
+func (u *Usecase) runJob(ctx context.Context, job *contracts.BulkExportJob) {
+	job.Status = contracts.BulkExportStatusInProgress
+	job.TransactionTime = time.Now().UTC()
+	if err := u.saveJob(ctx, job); err != nil {
+		u.log.Error("bulkexport.Usecase.runJob failed saving job", zap.String("job_id", job.ID), zap.Error(err))
+		return
+	}
+
+	e := &export{u: u, job: job, files: make(map[string]*exportFile), seen: make(map[string]struct{})}
+	if u.deid.AppliesTo(job.OwnerRoles) {
+		e.deid = u.deid
+		e.cells = u.deid.NewCells()
+	}
+	err := e.run(ctx)
+	if err == nil {
+		err = e.releaseCells(ctx)
+	}
+	if closeErr := e.close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		// the job may have been cancelled while its last page was written
+		err = e.checkCancelled(ctx)
+	}
+	switch {
+	case errors.Is(err, errCancelled):
+		u.log.Info("bulkexport.Usecase.runJob job cancelled", zap.String("job_id", job.ID))
+		u.forget(ctx, job.ID)
+		return
+	case ctx.Err() != nil:
+		// the instance is shutting down; the job stays in progress and is run again elsewhere
+		u.log.Info("bulkexport.Usecase.runJob job interrupted", zap.String("job_id", job.ID))
+		return
+	case err != nil:
+		u.log.Error("bulkexport.Usecase.runJob job failed", zap.String("job_id", job.ID), zap.Error(err))
+		if removeErr := u.store.RemoveJob(ctx, job.ID); removeErr != nil {
+			u.log.Error("bulkexport.Usecase.runJob failed removing files", zap.String("job_id", job.ID), zap.Error(removeErr))
+		}
+		u.releaseServiceRequest(ctx, job)
+		job.Status = contracts.BulkExportStatusFailed
+		job.Error = err.Error()
+	default:
+		job.Status = contracts.BulkExportStatusCompleted
+		job.Output = e.output()
+		u.log.Info("bulkexport.Usecase.runJob job completed", zap.String("job_id", job.ID), zap.Int("resources", e.total))
+	}
+	if err := u.saveJob(ctx, job); err != nil {
+		u.log.Error("bulkexport.Usecase.runJob failed saving job", zap.String("job_id", job.ID), zap.Error(err))
+	}
+}
+
+func (e *export) run(ctx context.Context) error {
+	switch e.job.Level {
+	case contracts.BulkExportLevelSystem:
+		for _, t := range e.job.Types {
+			query := url.Values{"_count": {strconv.Itoa(pageSize)}}
+			if e.job.Since != nil {
+				query.Set("_lastUpdated", "gt"+e.job.Since.Format(time.RFC3339))
+			}
+			if err := e.readPages(ctx, t+"?"+query.Encode(), false); err != nil {
+				return err
+			}
+		}
+		return nil
+	case contracts.BulkExportLevelPatient:
+		ids, err := e.allPatients(ctx)
+		if err != nil {
+			return err
+		}
+		return e.readCompartments(ctx, ids)
+	case contracts.BulkExportLevelGroup:
+		ids, err := e.groupPatients(ctx)
+		if err != nil {
+			return err
+		}
+		return e.readCompartments(ctx, ids)
+	}
+	return fmt.Errorf("unknown export level %q", e.job.Level)
+}
+
+// readCompartments exports the compartment of each patient through Patient/$everything.
+func (e *export) readCompartments(ctx context.Context, patientIDs []string) error {
+	query := url.Values{
+		"_count": {strconv.Itoa(pageSize)},
+		"_type":  {strings.Join(e.job.Types, ",")},
+	}
+	if e.job.Since != nil {
+		query.Set("_since", e.job.Since.Format(time.RFC3339))
+	}
+	for _, id := range patientIDs {
+		page := constvars.ResourcePatient + "/" + url.PathEscape(id) + "/$everything?" + query.Encode()
+		if err := e.readPages(ctx, page, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allPatients lists the ID of every Patient.
+func (e *export) allPatients(ctx context.Context) ([]string, error) {
+	var ids []string
+	page := constvars.ResourcePatient + "?_elements=id&_count=" + strconv.Itoa(pageSize)
+	err := e.eachPage(ctx, page, func(entries []gjson.Result) error {
+		for _, entry := range entries {
+			if id := entry.Get("resource.id").String(); id != "" {
+				ids = append(ids, id)
+			}
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// groupPatients lists the Patients that are members of the job's Group.
+func (e *export) groupPatients(ctx context.Context) ([]string, error) {
+	body, err := e.fetch(ctx, e.u.fhirURL(constvars.ResourceGroup+"/"+url.PathEscape(e.job.GroupID)))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, member := range gjson.GetBytes(body, "member").Array() {
+		ref := member.Get("entity.reference").String()
+		if id, ok := strings.CutPrefix(ref, constvars.ResourcePatient+"/"); ok && id != "" && !member.Get("inactive").Bool() {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// readPages writes the resources of a search and of all its following pages.
+func (e *export) readPages(ctx context.Context, page string, dedupe bool) error {
+	return e.eachPage(ctx, page, func(entries []gjson.Result) error {
+		for _, entry := range entries {
+			if err := e.write(ctx, entry.Get("resource"), dedupe); err != nil {
+				return err
+			}
+		}
+		e.u.saveProgress(ctx, e.job, fmt.Sprintf("%d resources exported", e.total))
+		return nil
+	})
+}
+
+// eachPage calls fn with the entries of page, relative to the FHIR base, and of every page its
+// next links lead to. The job is checked for cancellation before each page.
+func (e *export) eachPage(ctx context.Context, page string, fn func([]gjson.Result) error) error {
+	next := e.u.fhirURL(page)
+	for next != "" {
+		if err := e.checkCancelled(ctx); err != nil {
+			return err
+		}
+		body, err := e.fetch(ctx, next)
+		if err != nil {
+			return err
+		}
+		if err := fn(gjson.GetBytes(body, "entry").Array()); err != nil {
+			return err
+		}
+
+		next = ""
+		for _, link := range gjson.GetBytes(body, "link").Array() {
+			if link.Get("relation").String() == "next" {
+				next = e.u.rebase(link.Get("url").String())
+			}
+		}
+	}
+	return nil
+}
+
+func (e *export) fetch(ctx context.Context, target string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(constvars.HeaderAccept, constvars.MIMEApplicationFHIRJSON)
+
+	resp, err := e.u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("FHIR server answered %d to %s", resp.StatusCode, req.URL.Path)
+	}
+	return body, nil
+}
+
+// write appends a resource to the NDJSON file of its type, de-identified when the job requires it.
+func (e *export) write(ctx context.Context, resource gjson.Result, dedupe bool) error {
+	resourceType := resource.Get("resourceType").String()
+	if !slices.Contains(e.job.Types, resourceType) {
+		return nil
+	}
+	if dedupe {
+		key := resourceType + "/" + resource.Get("id").String()
+		if _, ok := e.seen[key]; ok {
+			return nil
+		}
+		e.seen[key] = struct{}{}
+	}
+
+	var line bytes.Buffer
+	if err := json.Compact(&line, []byte(resource.Raw)); err != nil {
+		return err
+	}
+	if e.deid == nil {
+		return e.writeLine(ctx, resourceType, line.Bytes())
+	}
+
+	deidentified, cell, err := e.deid.Resource(line.Bytes())
+	if err != nil {
+		return err
+	}
+	if cell != "" {
+		e.cells.Add(cell)
+		e.heldCells = append(e.heldCells, heldLine{resourceType: resourceType, line: deidentified, cell: cell})
+		return nil
+	}
+	return e.writeLine(ctx, resourceType, deidentified)
+}
+
+// releaseCells writes the held de-identified resources whose cell reached the minimum cell size.
+func (e *export) releaseCells(ctx context.Context) error {
+	suppressed := 0
+	for _, h := range e.heldCells {
+		if !e.cells.Keeps(h.cell) {
+			suppressed++
+			continue
+		}
+		if err := e.writeLine(ctx, h.resourceType, h.line); err != nil {
+			return err
+		}
+	}
+	if suppressed > 0 {
+		e.u.log.Info("bulkexport.Usecase.runJob suppressed small cells", zap.String("job_id", e.job.ID), zap.Int("removed", suppressed))
+	}
+	e.heldCells = nil
+	return nil
+}
+
+func (e *export) writeLine(ctx context.Context, resourceType string, line []byte) error {
+	f, err := e.file(ctx, resourceType)
+	if err != nil {
+		return err
+	}
+	if _, err := f.buf.Write(line); err != nil {
+		return err
+	}
+	if err := f.buf.WriteByte('\n'); err != nil {
+		return err
+	}
+	f.count++
+	e.total++
+	return nil
+}
+
+func (e *export) file(ctx context.Context, resourceType string) (*exportFile, error) {
+	if f, ok := e.files[resourceType]; ok {
+		return f, nil
+	}
+	name := resourceType + ".ndjson"
+	w, err := e.u.store.Create(ctx, e.job.ID, name)
+	if err != nil {
+		return nil, err
+	}
+	f := &exportFile{name: name, w: w, buf: bufio.NewWriter(w)}
+	e.files[resourceType] = f
+	return f, nil
+}
+
+func (e *export) close() error {
+	var errs []error
+	for _, f := range e.files {
+		errs = append(errs, f.buf.Flush(), f.w.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// output lists the files written, in the order of the job's types.
+func (e *export) output() []contracts.BulkExportFile {
+	out := []contracts.BulkExportFile{}
+	for _, t := range e.job.Types {
+		if f, ok := e.files[t]; ok {
+			out = append(out, contracts.BulkExportFile{Type: t, Name: f.name, Count: f.count})
+		}
+	}
+	return out
+}
+
+func (e *export) checkCancelled(ctx context.Context) error {
+	job, err := e.u.loadJob(ctx, e.job.ID)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return errCancelled
+	}
+	return nil
+}
+
+// saveProgress records how far a running job is; it is kept apart from the job so it never
+// recreates a job cancelled meanwhile.
+func (u *Usecase) saveProgress(ctx context.Context, job *contracts.BulkExportJob, progress string) {
+	if err := u.redis.Set(ctx, progressKeyPrefix+job.ID, progress, u.remaining(job)); err != nil {
+		u.log.Warn("bulkexport.Usecase failed saving progress", zap.String("job_id", job.ID), zap.Error(err))
+	}
+}
+
+// fhirURL resolves a path relative to the FHIR base.
+func (u *Usecase) fhirURL(relative string) string {
+	return strings.TrimRight(u.cfg.FHIR.BaseUrl, "/") + "/" + strings.TrimLeft(relative, "/")
+}
+
+// rebase points a link the FHIR server returned, which carries the server's own idea of its base,
+// at the configured FHIR base.
+func (u *Usecase) rebase(link string) string {
+	target, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	base, err := url.Parse(u.cfg.FHIR.BaseUrl)
+	if err != nil {
+		return link
+	}
+	target.Scheme, target.Host = base.Scheme, base.Host
+	return target.String()
+}
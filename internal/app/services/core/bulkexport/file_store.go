@@ -0,0 +1,63 @@
+package bulkexport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"konsulin-service/internal/app/contracts"
+	"os"
+	"path/filepath"
+)
+
+// localFileStore keeps export files on the local filesystem, one directory per job. It suits a
+// single instance or instances sharing a volume.
+type localFileStore struct {
+	root string
+}
+
+// NewLocalFileStore returns a file store writing under root, which is created when missing.
+func NewLocalFileStore(root string) (contracts.BulkExportFileStore, error) {
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, fmt.Errorf("create bulk export directory: %w", err)
+	}
+	return &localFileStore{root: root}, nil
+}
+
+func (s *localFileStore) path(jobID, name string) (string, error) {
+	// IDs and names are generated by the usecase, but they also arrive in download URLs
+	if !validName(jobID) || !validName(name) {
+		return "", fmt.Errorf("invalid bulk export file %q of job %q", name, jobID)
+	}
+	return filepath.Join(s.root, jobID, name), nil
+}
+
+func (s *localFileStore) Create(_ context.Context, jobID, name string) (io.WriteCloser, error) {
+	p, err := s.path(jobID, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+		return nil, err
+	}
+	return os.Create(p)
+}
+
+func (s *localFileStore) Open(_ context.Context, jobID, name string) (io.ReadCloser, error) {
+	p, err := s.path(jobID, name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *localFileStore) RemoveJob(_ context.Context, jobID string) error {
+	if !validName(jobID) {
+		return fmt.Errorf("invalid bulk export job %q", jobID)
+	}
+	return os.RemoveAll(filepath.Join(s.root, jobID))
+}
+
+// validName reports whether name is a single path element.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
@@ -0,0 +1,131 @@
+package bulkexport
+
+import (
+	"context"
+	"fmt"
+	"konsulin-service/internal/app/contracts"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	workerInterval = 15 * time.Second
+	lockKeyPrefix  = "bulkexport:lock:"
+	// jobLockTTL is refreshed while a job runs, so a job whose instance died is picked up again
+	// soon after by another one.
+	jobLockTTL = 2 * time.Minute
+)
+
+// Worker runs queued $export jobs. Each job is locked while it runs, so instances share the
+// queue without running a job twice.
+type Worker struct {
+	log     *zap.Logger
+	usecase *Usecase
+	locker  contracts.LockerService
+	stop    chan struct{}
+}
+
+// NewWorker creates a new bulk export worker.
+func NewWorker(log *zap.Logger, usecase *Usecase, lockerSvc contracts.LockerService) *Worker {
+	return &Worker{
+		log:     log,
+		usecase: usecase,
+		locker:  lockerSvc,
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start begins the ticker loop. It returns a stop function to halt execution.
+func (w *Worker) Start(ctx context.Context) (stop func()) {
+	ticker := time.NewTicker(workerInterval)
+	ctx, cancel := context.WithCancel(ctx)
+
+	fmt.Println("Bulk export worker started")
+
+	go func() {
+		defer cancel()
+		for {
+			select {
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			case <-w.stop:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				w.runOnce(ctx)
+			}
+		}
+	}()
+
+	return func() {
+		close(w.stop)
+		// abort the job running, which another instance resumes once its lock expired
+		cancel()
+	}
+}
+
+func (w *Worker) runOnce(ctx context.Context) {
+	ids, err := w.usecase.redis.GetSetMembers(ctx, jobsKey)
+	if err != nil {
+		w.log.Info("bulkexport.worker failed listing jobs", zap.Error(err))
+		return
+	}
+
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		job, err := w.usecase.loadJob(ctx, id)
+		if err != nil {
+			w.log.Info("bulkexport.worker failed loading job", zap.String("job_id", id), zap.Error(err))
+			continue
+		}
+		if job == nil {
+			// retention ended
+			w.usecase.forget(ctx, id)
+			continue
+		}
+		if job.Status == contracts.BulkExportStatusAccepted || job.Status == contracts.BulkExportStatusInProgress {
+			w.runLocked(ctx, job)
+		}
+	}
+}
+
+// runLocked runs the job unless another instance holds its lock.
+func (w *Worker) runLocked(ctx context.Context, job *contracts.BulkExportJob) {
+	key := lockKeyPrefix + job.ID
+	acquired, lockVal, err := w.locker.TryLock(ctx, key, jobLockTTL)
+	if err != nil {
+		w.log.Info("bulkexport.worker lock attempt failed", zap.String("job_id", job.ID), zap.Error(err))
+		return
+	}
+	if !acquired {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(jobLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := w.locker.Refresh(ctx, key, lockVal, jobLockTTL); err != nil {
+					w.log.Warn("bulkexport.worker failed refreshing job lock", zap.String("job_id", job.ID), zap.Error(err))
+				}
+			}
+		}
+	}()
+
+	w.log.Info("bulkexport.worker running job", zap.String("job_id", job.ID), zap.String("level", job.Level))
+	w.usecase.runJob(ctx, job)
+	close(done)
+
+	if err := w.locker.Unlock(context.Background(), key, lockVal); err != nil {
+		w.log.Error("bulkexport.worker unlock failed", zap.String("job_id", job.ID), zap.Error(err))
+	}
+}
@@ -308,6 +308,16 @@ func (uc *paymentUsecase) handleWebhookPaymentNotification(ctx context.Context,
 		return nil
 	}
 
+	if status == requests.XenditInvoiceStatusPaid || status == requests.XenditInvoiceStatusSettled {
+		if err := uc.markServiceRequestPaid(ctx, sr); err != nil {
+			uc.Log.Error("paymentUsecase.handleWebhookPaymentNotification failed tagging ServiceRequest as paid",
+				zap.String(constvars.LoggingRequestIDKey, requestID),
+				zap.String("service_request_id", sr.ID),
+				zap.Error(err),
+			)
+		}
+	}
+
 	note, err := extractNoteStorage(sr)
 	if err != nil {
 		uc.Log.Error("paymentUsecase.handleWebhookPaymentNotification failed parsing stored note",
@@ -339,6 +349,35 @@ func (uc *paymentUsecase) handleWebhookPaymentNotification(ctx context.Context,
 	return nil
 }
 
+// markServiceRequestPaid tags the ServiceRequest of a paid webhook service, unless it already is.
+func (uc *paymentUsecase) markServiceRequestPaid(ctx context.Context, sr *fhir_dto.GetServiceRequestOutput) error {
+	for _, tag := range sr.Meta.Tag {
+		if tag.System == constvars.ServiceRequestPaymentTagSystem && tag.Code == constvars.ServiceRequestPaymentTagPaid {
+			return nil
+		}
+	}
+
+	meta := sr.Meta
+	meta.Tag = append(slices.Clone(meta.Tag), fhir_dto.Coding{
+		System: constvars.ServiceRequestPaymentTagSystem,
+		Code:   constvars.ServiceRequestPaymentTagPaid,
+	})
+	_, err := uc.Storage.FhirClient.Update(ctx, sr.ID, &fhir_dto.UpdateServiceRequestInput{
+		ResourceType:       constvars.ResourceServiceRequest,
+		ID:                 sr.ID,
+		Meta:               meta,
+		Status:             sr.Status,
+		Intent:             sr.Intent,
+		Subject:            sr.Subject,
+		Requester:          &sr.Requester,
+		OccurrenceDateTime: sr.OccurrenceDateTime,
+		AuthoredOn:         sr.AuthoredOn,
+		InstantiatesUri:    sr.InstantiatesUri,
+		Note:               sr.Note,
+	})
+	return err
+}
+
 // handleAppointmentPaymentNotification processes appointment payment notifications
 func (uc *paymentUsecase) handleAppointmentPaymentNotification(ctx context.Context, externalID string, status requests.XenditInvoiceStatus) error {
 	requestID, _ := ctx.Value(constvars.CONTEXT_REQUEST_ID_KEY).(string)
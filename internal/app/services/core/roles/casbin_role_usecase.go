@@ -2,38 +2,261 @@ package roles
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/app/services/shared/rbacstore"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+	"konsulin-service/internal/pkg/utils"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
 
 	"github.com/casbin/casbin/v2"
+	"go.uber.org/zap"
 )
 
+var policyMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// nonFHIRPathPrefixes are the gateway routes, besides the FHIR proxy, that consult the policy.
+var nonFHIRPathPrefixes = []string{"/api/", "/hook/"}
+
+// CasbinRoleUsecase manages the RBAC policy. Changes go to the policy store, which the enforcer
+// loads from, and every change records the superadmin who made it.
 type CasbinRoleUsecase struct {
 	enforcer *casbin.Enforcer
+	store    contracts.RBACPolicyStore
+	log      *zap.Logger
 }
 
-func NewCasbinRoleUsecase(e *casbin.Enforcer) *CasbinRoleUsecase {
-	return &CasbinRoleUsecase{enforcer: e}
+func NewCasbinRoleUsecase(e *casbin.Enforcer, store contracts.RBACPolicyStore, log *zap.Logger) *CasbinRoleUsecase {
+	return &CasbinRoleUsecase{enforcer: e, store: store, log: log}
 }
 
 func (u *CasbinRoleUsecase) ListRoles(ctx context.Context) ([]string, error) {
-	return u.enforcer.GetAllRoles()
+	if _, err := requireSuperadmin(ctx); err != nil {
+		return nil, err
+	}
+
+	subjects, err := u.enforcer.GetAllSubjects()
+	if err != nil {
+		return nil, err
+	}
+	roles, err := u.enforcer.GetAllRoles()
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles {
+		if !slices.Contains(subjects, role) {
+			subjects = append(subjects, role)
+		}
+	}
+	sort.Strings(subjects)
+	return subjects, nil
+}
+
+// ListPermissions returns the permissions of role, or of every role when role is empty.
+func (u *CasbinRoleUsecase) ListPermissions(ctx context.Context, role string) ([]contracts.Permission, error) {
+	if _, err := requireSuperadmin(ctx); err != nil {
+		return nil, err
+	}
+
+	var (
+		policy [][]string
+		err    error
+	)
+	if role = strings.TrimSpace(role); role == "" {
+		policy, err = u.enforcer.GetPolicy()
+	} else {
+		policy, err = u.enforcer.GetFilteredPolicy(0, role)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := make([]contracts.Permission, 0, len(policy))
+	for _, rule := range policy {
+		if len(rule) < 3 {
+			continue
+		}
+		permissions = append(permissions, contracts.Permission{Role: rule[0], Method: rule[1], Path: rule[2]})
+	}
+	return permissions, nil
+}
+
+func (u *CasbinRoleUsecase) AddPermission(ctx context.Context, role, method, path string) (*contracts.PolicyChange, error) {
+	return u.changePermission(ctx, "add", role, method, path)
+}
+
+func (u *CasbinRoleUsecase) RemovePermission(ctx context.Context, role, method, path string) (*contracts.PolicyChange, error) {
+	return u.changePermission(ctx, "remove", role, method, path)
+}
+
+func (u *CasbinRoleUsecase) changePermission(ctx context.Context, action, role, method, path string) (*contracts.PolicyChange, error) {
+	uid, err := requireSuperadmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rule := []string{"p", strings.TrimSpace(role), strings.ToUpper(strings.TrimSpace(method)), strings.TrimSpace(path)}
+	if err := validateRule(rule); err != nil {
+		return nil, exceptions.ErrInvalidPolicyRule(err)
+	}
+
+	var added, removed [][]string
+	if action == "add" {
+		added = [][]string{rule}
+	} else {
+		removed = [][]string{rule}
+	}
+	change, err := u.store.Update(ctx, uid, action, added, removed)
+	if err != nil {
+		return nil, err
+	}
+	return u.reload(ctx, change)
+}
+
+func (u *CasbinRoleUsecase) ExportPolicy(ctx context.Context) ([]byte, error) {
+	if _, err := requireSuperadmin(ctx); err != nil {
+		return nil, err
+	}
+
+	rules, err := u.store.Rules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return rbacstore.FormatCSV(rules), nil
+}
+
+func (u *CasbinRoleUsecase) ImportPolicy(ctx context.Context, csv []byte) (*contracts.PolicyChange, error) {
+	uid, err := requireSuperadmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := rbacstore.ParseCSV(csv)
+	if err != nil {
+		return nil, exceptions.ErrInvalidPolicyRule(err)
+	}
+	if len(rules) == 0 {
+		return nil, exceptions.ErrInvalidPolicyRule(errors.New("the imported policy has no rules"))
+	}
+	for i, rule := range rules {
+		if err := validateRule(rule); err != nil {
+			return nil, exceptions.ErrInvalidPolicyRule(fmt.Errorf("rule %d: %w", i+1, err))
+		}
+	}
+
+	change, err := u.store.Replace(ctx, uid, "import", rules)
+	if err != nil {
+		return nil, err
+	}
+	return u.reload(ctx, change)
+}
+
+func (u *CasbinRoleUsecase) ListPolicyChanges(ctx context.Context, limit int) ([]contracts.PolicyChange, error) {
+	if _, err := requireSuperadmin(ctx); err != nil {
+		return nil, err
+	}
+	return u.store.Changes(ctx, limit)
 }
 
-func (u *CasbinRoleUsecase) AddPermission(ctx context.Context, role, method, path string) error {
-	if _, err := u.enforcer.AddPolicy(role, method, path); err != nil {
-		return err
+// ReloadPolicy publishes a new policy version so every instance, this one included, reloads
+// its enforcer from the store.
+func (u *CasbinRoleUsecase) ReloadPolicy(ctx context.Context) (*contracts.PolicyChange, error) {
+	uid, err := requireSuperadmin(ctx)
+	if err != nil {
+		return nil, err
 	}
-	if err := u.enforcer.SavePolicy(); err != nil {
-		return err
+
+	change, err := u.store.Bump(ctx, uid)
+	if err != nil {
+		return nil, err
 	}
-	return u.enforcer.LoadPolicy()
+	return u.reload(ctx, change)
 }
 
-func (u *CasbinRoleUsecase) RemovePermission(ctx context.Context, role, method, path string) error {
-	if _, err := u.enforcer.RemovePolicy(role, method, path); err != nil {
-		return err
+// reload makes the enforcer of this instance pick up a stored change.
+func (u *CasbinRoleUsecase) reload(ctx context.Context, change *contracts.PolicyChange) (*contracts.PolicyChange, error) {
+	if change == nil {
+		return nil, nil
 	}
-	if err := u.enforcer.SavePolicy(); err != nil {
-		return err
+	if err := u.enforcer.LoadPolicy(); err != nil {
+		return nil, err
+	}
+
+	requestID, _ := ctx.Value(constvars.CONTEXT_REQUEST_ID_KEY).(string)
+	u.log.Info("RBAC policy changed",
+		zap.String(constvars.LoggingRequestIDKey, requestID),
+		zap.Int64("version", change.Version),
+		zap.String("by", change.By),
+		zap.String("action", change.Action),
+		zap.Int("added", len(change.Added)),
+		zap.Int("removed", len(change.Removed)))
+	return change, nil
+}
+
+// validateRule checks a policy line against the model: "p, role, method, path" or
+// "g, user, role".
+func validateRule(rule []string) error {
+	for _, field := range rule {
+		if field == "" {
+			return errors.New("policy fields can't be empty")
+		}
+		if strings.ContainsAny(field, ",\r\n") {
+			return fmt.Errorf("policy field %q can't contain commas or line breaks", field)
+		}
+	}
+
+	switch rule[0] {
+	case "g":
+		if len(rule) != 3 {
+			return errors.New(`role assignments have the form "g, user, role"`)
+		}
+		return nil
+	case "p":
+		if len(rule) != 4 {
+			return errors.New(`permissions have the form "p, role, method, path"`)
+		}
+	default:
+		return fmt.Errorf("unknown policy type %q", rule[0])
+	}
+
+	if !slices.Contains(policyMethods, rule[2]) {
+		return fmt.Errorf("method %q is not one of %s", rule[2], strings.Join(policyMethods, ", "))
+	}
+	return validatePath(rule[3])
+}
+
+func validatePath(path string) error {
+	parsed, err := url.Parse(path)
+	if err != nil || !strings.HasPrefix(parsed.Path, "/") {
+		return fmt.Errorf("path %q is not an absolute path", path)
+	}
+
+	if rest, ok := strings.CutPrefix(parsed.Path, "/fhir/"); ok {
+		resourceType, _, _ := strings.Cut(rest, "/")
+		if resourceType != "metadata" && !utils.IsFHIRResourceType(resourceType) {
+			return fmt.Errorf("path %q does not name a FHIR resource type", path)
+		}
+		return nil
+	}
+	for _, prefix := range nonFHIRPathPrefixes {
+		if strings.HasPrefix(parsed.Path, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("path %q must start with /fhir/<ResourceType>, %s", path, strings.Join(nonFHIRPathPrefixes, " or "))
+}
+
+func requireSuperadmin(ctx context.Context) (string, error) {
+	uid, _ := ctx.Value("uid").(string)
+	roles, _ := ctx.Value("roles").([]string)
+	if uid == "" || !slices.Contains(roles, constvars.KonsulinRoleSuperadmin) {
+		return "", exceptions.BuildNewCustomError(nil, constvars.StatusForbidden, constvars.ErrClientNotAuthorized, "managing the RBAC policy requires the Superadmin role")
 	}
-	return u.enforcer.LoadPolicy()
+	return uid, nil
 }
@@ -0,0 +1,137 @@
+package roles
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/app/services/shared/rbacstore"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type memoryRedis struct {
+	contracts.RedisRepository
+	data map[string]string
+}
+
+func (r *memoryRedis) Set(_ context.Context, key string, value interface{}, _ time.Duration) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	r.data[key] = string(raw)
+	return nil
+}
+
+func (r *memoryRedis) Get(_ context.Context, key string) (string, error) {
+	return r.data[key], nil
+}
+
+func (r *memoryRedis) Publish(context.Context, string, string) error { return nil }
+
+func newTestRoleUsecase(t *testing.T) *CasbinRoleUsecase {
+	t.Helper()
+	seedFile := filepath.Join(t.TempDir(), "rbac_policy.csv")
+	require.NoError(t, os.WriteFile(seedFile, []byte("p, Guest, GET, /fhir/Organization\n"), 0o644))
+
+	store := rbacstore.NewStore(&memoryRedis{data: map[string]string{}}, nil, seedFile, zap.NewNop())
+	enforcer, err := casbin.NewEnforcer("../../../../../resources/rbac_model.conf", store)
+	require.NoError(t, err)
+	return NewCasbinRoleUsecase(enforcer, store, zap.NewNop())
+}
+
+func superadmin() context.Context {
+	ctx := context.WithValue(context.Background(), "uid", "st-admin-1")
+	return context.WithValue(ctx, "roles", []string{constvars.KonsulinRoleSuperadmin})
+}
+
+func statusOf(t *testing.T, err error) int {
+	t.Helper()
+	var custom *exceptions.CustomError
+	require.ErrorAs(t, err, &custom)
+	return custom.StatusCode
+}
+
+func TestCasbinRoleUsecase_Permissions(t *testing.T) {
+	u := newTestRoleUsecase(t)
+	ctx := superadmin()
+
+	change, err := u.AddPermission(ctx, "Researcher", "get", "/fhir/Observation")
+	require.NoError(t, err)
+	assert.Equal(t, "st-admin-1", change.By)
+	assert.Equal(t, [][]string{{"p", "Researcher", "GET", "/fhir/Observation"}}, change.Added)
+
+	ok, err := u.enforcer.HasPolicy("Researcher", "GET", "/fhir/Observation")
+	require.NoError(t, err)
+	assert.True(t, ok, "the enforcer is reloaded")
+
+	roles, err := u.ListRoles(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Guest", "Researcher"}, roles)
+
+	_, err = u.RemovePermission(ctx, "Researcher", "GET", "/fhir/Observation")
+	require.NoError(t, err)
+	permissions, err := u.ListPermissions(ctx, "Researcher")
+	require.NoError(t, err)
+	assert.Empty(t, permissions)
+
+	changes, err := u.ListPolicyChanges(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, changes, 3)
+	assert.Equal(t, "remove", changes[0].Action)
+
+	invalid := map[string][3]string{
+		"unknown resource type": {"Researcher", "GET", "/fhir/Observations"},
+		"unknown method":        {"Researcher", "TRACE", "/fhir/Observation"},
+		"unrouted path":         {"Researcher", "GET", "/admin"},
+		"comma in the path":     {"Researcher", "GET", "/fhir/Observation?_elements=code,value"},
+		"empty role":            {" ", "GET", "/fhir/Observation"},
+	}
+	for name, p := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := u.AddPermission(ctx, p[0], p[1], p[2])
+			assert.Equal(t, http.StatusBadRequest, statusOf(t, err))
+		})
+	}
+
+	t.Run("superadmins only", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), "uid", "st-user-1")
+		ctx = context.WithValue(ctx, "roles", []string{constvars.KonsulinRoleClinicAdmin})
+		_, err := u.AddPermission(ctx, "Researcher", "GET", "/fhir/Observation")
+		assert.Equal(t, http.StatusForbidden, statusOf(t, err))
+	})
+}
+
+func TestCasbinRoleUsecase_ImportExport(t *testing.T) {
+	u := newTestRoleUsecase(t)
+	ctx := superadmin()
+
+	change, err := u.ImportPolicy(ctx, []byte("p, Guest, GET, /fhir/Slot\np, Practitioner, POST, /api/v1/tx\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "import", change.Action)
+	assert.Equal(t, [][]string{{"p", "Guest", "GET", "/fhir/Organization"}}, change.Removed)
+
+	csv, err := u.ExportPolicy(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "p, Guest, GET, /fhir/Slot\np, Practitioner, POST, /api/v1/tx\n", string(csv))
+
+	_, err = u.ImportPolicy(ctx, []byte("p, Guest, GET, /fhir/Slot\np, Guest, GET, /fhir/Nope\n"))
+	assert.Equal(t, http.StatusBadRequest, statusOf(t, err))
+	_, err = u.ImportPolicy(ctx, []byte("# nothing\n"))
+	assert.Equal(t, http.StatusBadRequest, statusOf(t, err), "an empty import would lock everyone out")
+
+	csv, err = u.ExportPolicy(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "p, Guest, GET, /fhir/Slot\np, Practitioner, POST, /api/v1/tx\n", string(csv), "rejected imports change nothing")
+}
@@ -0,0 +1,88 @@
+package audit_events
+
+import (
+	"context"
+	"encoding/json"
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+	"konsulin-service/internal/pkg/fhir_dto"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+var (
+	auditEventFhirClientInstance contracts.AuditEventFhirClient
+	onceAuditEventFhirClient     sync.Once
+)
+
+type auditEventFhirClient struct {
+	BaseUrl string
+	Log     *zap.Logger
+}
+
+func NewAuditEventFhirClient(baseUrl string, logger *zap.Logger) contracts.AuditEventFhirClient {
+	onceAuditEventFhirClient.Do(func() {
+		client := &auditEventFhirClient{
+			BaseUrl: baseUrl + constvars.ResourceAuditEvent,
+			Log:     logger,
+		}
+		auditEventFhirClientInstance = client
+	})
+	return auditEventFhirClientInstance
+}
+
+// Search queries AuditEvent resources and returns the searchset page, including its paging links.
+func (c *auditEventFhirClient) Search(ctx context.Context, params url.Values) (*fhir_dto.AuditEventBundle, error) {
+	requestID, _ := ctx.Value(constvars.CONTEXT_REQUEST_ID_KEY).(string)
+	c.Log.Info("auditEventFhirClient.Search called",
+		zap.String(constvars.LoggingRequestIDKey, requestID),
+	)
+
+	req, err := http.NewRequestWithContext(ctx, constvars.MethodGet, c.BaseUrl+"?"+params.Encode(), nil)
+	if err != nil {
+		c.Log.Error("auditEventFhirClient.Search error creating HTTP request",
+			zap.String(constvars.LoggingRequestIDKey, requestID),
+			zap.Error(err),
+		)
+		return nil, exceptions.ErrCreateHTTPRequest(err)
+	}
+	req.Header.Set(constvars.HeaderContentType, constvars.MIMEApplicationFHIRJSON)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		c.Log.Error("auditEventFhirClient.Search error sending HTTP request",
+			zap.String(constvars.LoggingRequestIDKey, requestID),
+			zap.Error(err),
+		)
+		return nil, exceptions.ErrSendHTTPRequest(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != constvars.StatusOK {
+		c.Log.Error("auditEventFhirClient.Search received non-OK status",
+			zap.String(constvars.LoggingRequestIDKey, requestID),
+			zap.Int("status_code", resp.StatusCode),
+		)
+		return nil, exceptions.ErrGetFHIRResource(nil, constvars.ResourceAuditEvent)
+	}
+
+	bundle := new(fhir_dto.AuditEventBundle)
+	if err := json.NewDecoder(resp.Body).Decode(bundle); err != nil {
+		c.Log.Error("auditEventFhirClient.Search error decoding response",
+			zap.String(constvars.LoggingRequestIDKey, requestID),
+			zap.Error(err),
+		)
+		return nil, exceptions.ErrDecodeResponse(err, constvars.ResourceAuditEvent)
+	}
+
+	c.Log.Info("auditEventFhirClient.Search succeeded",
+		zap.String(constvars.LoggingRequestIDKey, requestID),
+		zap.Int("result_count", len(bundle.Entry)),
+	)
+	return bundle, nil
+}
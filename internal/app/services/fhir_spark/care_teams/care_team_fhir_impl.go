@@ -0,0 +1,111 @@
+package care_teams
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+	"konsulin-service/internal/pkg/fhir_dto"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+var (
+	careTeamFhirClientInstance contracts.CareTeamFhirClient
+	onceCareTeamFhirClient     sync.Once
+)
+
+type careTeamFhirClient struct {
+	BaseUrl string
+	Log     *zap.Logger
+}
+
+func NewCareTeamFhirClient(baseUrl string, logger *zap.Logger) contracts.CareTeamFhirClient {
+	onceCareTeamFhirClient.Do(func() {
+		client := &careTeamFhirClient{
+			BaseUrl: baseUrl + constvars.ResourceCareTeam,
+			Log:     logger,
+		}
+		careTeamFhirClientInstance = client
+	})
+	return careTeamFhirClientInstance
+}
+
+func (c *careTeamFhirClient) Search(ctx context.Context, params contracts.CareTeamSearchParams) ([]fhir_dto.CareTeam, error) {
+	requestID, _ := ctx.Value(constvars.CONTEXT_REQUEST_ID_KEY).(string)
+	c.Log.Info("careTeamFhirClient.Search called",
+		zap.String(constvars.LoggingRequestIDKey, requestID),
+	)
+
+	urlStr := c.BaseUrl
+	if enc := params.ToQueryParam().Encode(); enc != "" {
+		urlStr += "?" + enc
+	}
+
+	req, err := http.NewRequestWithContext(ctx, constvars.MethodGet, urlStr, nil)
+	if err != nil {
+		c.Log.Error("careTeamFhirClient.Search error creating HTTP request",
+			zap.String(constvars.LoggingRequestIDKey, requestID),
+			zap.Error(err),
+		)
+		return nil, exceptions.ErrCreateHTTPRequest(err)
+	}
+	req.Header.Set(constvars.HeaderContentType, constvars.MIMEApplicationFHIRJSON)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		c.Log.Error("careTeamFhirClient.Search error sending HTTP request",
+			zap.String(constvars.LoggingRequestIDKey, requestID),
+			zap.Error(err),
+		)
+		return nil, exceptions.ErrSendHTTPRequest(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != constvars.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		var outcome fhir_dto.OperationOutcome
+		_ = json.Unmarshal(bodyBytes, &outcome)
+		c.Log.Error("careTeamFhirClient.Search received non-OK status",
+			zap.String(constvars.LoggingRequestIDKey, requestID),
+			zap.Int("status_code", resp.StatusCode),
+		)
+		if len(outcome.Issue) > 0 {
+			return nil, exceptions.ErrGetFHIRResource(fmt.Errorf("%s", outcome.Issue[0].Diagnostics), constvars.ResourceCareTeam)
+		}
+		return nil, exceptions.ErrGetFHIRResource(fmt.Errorf("status %d", resp.StatusCode), constvars.ResourceCareTeam)
+	}
+
+	var bundle fhir_dto.FHIRBundle
+	if err := json.NewDecoder(resp.Body).Decode(&bundle); err != nil {
+		c.Log.Error("careTeamFhirClient.Search error decoding response",
+			zap.String(constvars.LoggingRequestIDKey, requestID),
+			zap.Error(err),
+		)
+		return nil, exceptions.ErrDecodeResponse(err, constvars.ResourceCareTeam)
+	}
+
+	careTeams := make([]fhir_dto.CareTeam, 0, len(bundle.Entry))
+	for _, e := range bundle.Entry {
+		var careTeam fhir_dto.CareTeam
+		if err := json.Unmarshal(e.Resource, &careTeam); err != nil {
+			return nil, exceptions.ErrCannotParseJSON(err)
+		}
+		if careTeam.ResourceType != constvars.ResourceCareTeam {
+			continue
+		}
+		careTeams = append(careTeams, careTeam)
+	}
+
+	c.Log.Info("careTeamFhirClient.Search succeeded",
+		zap.String(constvars.LoggingRequestIDKey, requestID),
+		zap.Int("result_count", len(careTeams)),
+	)
+	return careTeams, nil
+}
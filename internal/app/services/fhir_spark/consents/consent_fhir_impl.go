@@ -0,0 +1,111 @@
+package consents
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"konsulin-service/internal/app/contracts"
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/internal/pkg/exceptions"
+	"konsulin-service/internal/pkg/fhir_dto"
+	"net/http"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+var (
+	consentFhirClientInstance contracts.ConsentFhirClient
+	onceConsentFhirClient     sync.Once
+)
+
+type consentFhirClient struct {
+	BaseUrl string
+	Log     *zap.Logger
+}
+
+func NewConsentFhirClient(baseUrl string, logger *zap.Logger) contracts.ConsentFhirClient {
+	onceConsentFhirClient.Do(func() {
+		client := &consentFhirClient{
+			BaseUrl: baseUrl + constvars.ResourceConsent,
+			Log:     logger,
+		}
+		consentFhirClientInstance = client
+	})
+	return consentFhirClientInstance
+}
+
+func (c *consentFhirClient) Search(ctx context.Context, params contracts.ConsentSearchParams) ([]fhir_dto.Consent, error) {
+	requestID, _ := ctx.Value(constvars.CONTEXT_REQUEST_ID_KEY).(string)
+	c.Log.Info("consentFhirClient.Search called",
+		zap.String(constvars.LoggingRequestIDKey, requestID),
+	)
+
+	urlStr := c.BaseUrl
+	if enc := params.ToQueryParam().Encode(); enc != "" {
+		urlStr += "?" + enc
+	}
+
+	req, err := http.NewRequestWithContext(ctx, constvars.MethodGet, urlStr, nil)
+	if err != nil {
+		c.Log.Error("consentFhirClient.Search error creating HTTP request",
+			zap.String(constvars.LoggingRequestIDKey, requestID),
+			zap.Error(err),
+		)
+		return nil, exceptions.ErrCreateHTTPRequest(err)
+	}
+	req.Header.Set(constvars.HeaderContentType, constvars.MIMEApplicationFHIRJSON)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		c.Log.Error("consentFhirClient.Search error sending HTTP request",
+			zap.String(constvars.LoggingRequestIDKey, requestID),
+			zap.Error(err),
+		)
+		return nil, exceptions.ErrSendHTTPRequest(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != constvars.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		var outcome fhir_dto.OperationOutcome
+		_ = json.Unmarshal(bodyBytes, &outcome)
+		c.Log.Error("consentFhirClient.Search received non-OK status",
+			zap.String(constvars.LoggingRequestIDKey, requestID),
+			zap.Int("status_code", resp.StatusCode),
+		)
+		if len(outcome.Issue) > 0 {
+			return nil, exceptions.ErrGetFHIRResource(fmt.Errorf("%s", outcome.Issue[0].Diagnostics), constvars.ResourceConsent)
+		}
+		return nil, exceptions.ErrGetFHIRResource(fmt.Errorf("status %d", resp.StatusCode), constvars.ResourceConsent)
+	}
+
+	var bundle fhir_dto.FHIRBundle
+	if err := json.NewDecoder(resp.Body).Decode(&bundle); err != nil {
+		c.Log.Error("consentFhirClient.Search error decoding response",
+			zap.String(constvars.LoggingRequestIDKey, requestID),
+			zap.Error(err),
+		)
+		return nil, exceptions.ErrDecodeResponse(err, constvars.ResourceConsent)
+	}
+
+	consents := make([]fhir_dto.Consent, 0, len(bundle.Entry))
+	for _, e := range bundle.Entry {
+		var consent fhir_dto.Consent
+		if err := json.Unmarshal(e.Resource, &consent); err != nil {
+			return nil, exceptions.ErrCannotParseJSON(err)
+		}
+		if consent.ResourceType != constvars.ResourceConsent {
+			continue
+		}
+		consents = append(consents, consent)
+	}
+
+	c.Log.Info("consentFhirClient.Search succeeded",
+		zap.String(constvars.LoggingRequestIDKey, requestID),
+		zap.Int("result_count", len(consents)),
+	)
+	return consents, nil
+}
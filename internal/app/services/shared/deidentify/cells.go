@@ -0,0 +1,25 @@
+package deidentify
+
+// Cells counts the resources of a data set per cell, so the ones in cells smaller than the minimum
+// cell size can be suppressed once the whole set has been seen.
+type Cells struct {
+	k      int
+	counts map[string]int
+}
+
+// NewCells starts counting the cells of a data set.
+func (e *Engine) NewCells() *Cells {
+	return &Cells{k: e.opts.MinCellSize, counts: make(map[string]int)}
+}
+
+// Add counts a resource in cell. Resources without a cell are not counted.
+func (c *Cells) Add(cell string) {
+	if cell != "" {
+		c.counts[cell]++
+	}
+}
+
+// Keeps reports whether a resource in cell may be released.
+func (c *Cells) Keeps(cell string) bool {
+	return cell == "" || c.k < 2 || c.counts[cell] >= c.k
+}
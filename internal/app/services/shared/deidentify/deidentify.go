@@ -0,0 +1,384 @@
+// Package deidentify strips direct identifiers from FHIR resources before they leave the gateway
+// for research use: configured fields are removed, dates are generalised or shifted by an offset
+// that is the same for every resource of a patient, resource IDs are replaced by keyed hashes so
+// references between resources still match, and resources in small cells are suppressed.
+package deidentify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// ErrSuppressed is returned for a single resource that forms a cell smaller than the minimum cell
+// size on its own.
+var ErrSuppressed = errors.New("resource suppressed by small-cell suppression")
+
+// patientReferencePaths are the members whose reference ties a resource to its patient, which
+// decides the date offset of the resource.
+var patientReferencePaths = []string{"subject", "patient", "beneficiary", "individual"}
+
+// literalReference matches the "Type/id" at the end of a relative or absolute reference, with an
+// optional version.
+var literalReference = regexp.MustCompile(`(^|/)([A-Z][A-Za-z]+)/([A-Za-z0-9\-.]{1,64})(/_history/[A-Za-z0-9\-.]{1,64})?$`)
+
+// Options configure an Engine.
+type Options struct {
+	// Key keys the hashes behind pseudonyms and date offsets. It must be the same on every instance
+	// for pseudonyms to stay stable; when empty a random key is used for the life of the process.
+	Key []byte
+	// MinCellSize is the k of small-cell suppression; values below 2 disable suppression.
+	MinCellSize int
+	// MaxDateShiftDays bounds the date offset of a patient, in days either way.
+	MaxDateShiftDays int
+}
+
+// Engine de-identifies resources under a Policy. A nil Engine de-identifies nothing.
+type Engine struct {
+	policy *Policy
+	opts   Options
+}
+
+// NewEngine creates an engine applying policy.
+func NewEngine(policy *Policy, opts Options) (*Engine, error) {
+	if len(opts.Key) == 0 {
+		opts.Key = make([]byte, 32)
+		if _, err := rand.Read(opts.Key); err != nil {
+			return nil, err
+		}
+	}
+	return &Engine{policy: policy, opts: opts}, nil
+}
+
+// AppliesTo reports whether data sent to a caller with roles must be de-identified.
+func (e *Engine) AppliesTo(roles []string) bool {
+	return e != nil && e.policy.appliesTo(roles)
+}
+
+// Body de-identifies a single resource or every entry of a Bundle, suppressing the entries in
+// small cells. A single resource that would be suppressed yields ErrSuppressed.
+func (e *Engine) Body(body []byte) ([]byte, error) {
+	if gjson.GetBytes(body, "resourceType").String() != "Bundle" {
+		out, cell, err := e.Resource(body)
+		if err != nil {
+			return nil, err
+		}
+		if cell != "" && e.opts.MinCellSize > 1 {
+			return nil, ErrSuppressed
+		}
+		return out, nil
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	var entries []json.RawMessage
+	if raw, ok := doc["entry"]; ok {
+		if err := json.Unmarshal(raw, &entries); err != nil {
+			return nil, err
+		}
+	}
+
+	cells := e.NewCells()
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		out, cell, err := e.Entry(entry)
+		if err != nil {
+			return nil, err
+		}
+		entries[i], keys[i] = out, cell
+		cells.Add(cell)
+	}
+	kept := entries[:0]
+	for i, entry := range entries {
+		if cells.Keeps(keys[i]) {
+			kept = append(kept, entry)
+		}
+	}
+
+	b, err := json.Marshal(kept)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := doc["entry"]; ok {
+		doc["entry"] = b
+	}
+	if _, ok := doc["total"]; ok && len(kept) < len(keys) {
+		doc["total"] = json.RawMessage(strconv.Itoa(len(kept)))
+	}
+	return json.Marshal(doc)
+}
+
+// Entry de-identifies the resource of a Bundle entry and the URLs of the entry that name it. The
+// cell of the resource is returned with it.
+func (e *Engine) Entry(raw json.RawMessage) (json.RawMessage, string, error) {
+	var entry map[string]any
+	if err := decode(raw, &entry); err != nil {
+		return nil, "", err
+	}
+
+	cell := ""
+	if resource, ok := entry["resource"].(map[string]any); ok {
+		var err error
+		if cell, err = e.deidentify(resource); err != nil {
+			return nil, "", err
+		}
+	}
+	if s, ok := entry["fullUrl"].(string); ok {
+		entry["fullUrl"] = e.pseudonymizeURL(s, true)
+	}
+	for _, path := range []string{"request.url", "response.location"} {
+		visit(entry, strings.Split(path, "."), func(parent map[string]any, key string) {
+			if s, ok := parent[key].(string); ok {
+				parent[key] = e.pseudonymizeURL(s, true)
+			}
+		})
+	}
+
+	out, err := json.Marshal(entry)
+	return out, cell, err
+}
+
+// Resource de-identifies a single resource and returns it with its cell, which is empty when the
+// resource type has no quasi-identifiers.
+func (e *Engine) Resource(raw []byte) ([]byte, string, error) {
+	var resource map[string]any
+	if err := decode(raw, &resource); err != nil {
+		return nil, "", err
+	}
+	cell, err := e.deidentify(resource)
+	if err != nil {
+		return nil, "", err
+	}
+	out, err := json.Marshal(resource)
+	return out, cell, err
+}
+
+func (e *Engine) deidentify(resource map[string]any) (string, error) {
+	resourceType, _ := resource["resourceType"].(string)
+	offset := e.dateOffset(patientOf(resource))
+	rules := e.policy.rulesFor(resourceType)
+
+	e.apply(resource, rules, offset)
+	if contained, ok := resource["contained"].([]any); ok {
+		for _, c := range contained {
+			if r, ok := c.(map[string]any); ok {
+				containedType, _ := r["resourceType"].(string)
+				// contained resources keep their local IDs, which only "#id" references use
+				e.apply(r, e.policy.rulesFor(containedType), offset)
+			}
+		}
+	}
+
+	if id, ok := resource["id"].(string); ok && e.policy.pseudonymized(resourceType) {
+		resource["id"] = e.pseudonym(resourceType, id)
+	}
+	e.pseudonymizeReferences(resource)
+
+	return cellOf(resourceType, resource, rules), nil
+}
+
+func (e *Engine) apply(resource map[string]any, rules []Rule, offset time.Duration) {
+	for _, rule := range rules {
+		for _, path := range rule.Remove {
+			visit(resource, strings.Split(path, "."), func(parent map[string]any, key string) {
+				delete(parent, key)
+			})
+		}
+		for path, precision := range rule.Generalize {
+			visit(resource, strings.Split(path, "."), func(parent map[string]any, key string) {
+				if s, ok := parent[key].(string); ok {
+					parent[key] = generalizeDate(s, precision)
+				}
+			})
+		}
+		for _, path := range rule.ShiftDates {
+			visit(resource, strings.Split(path, "."), func(parent map[string]any, key string) {
+				if s, ok := parent[key].(string); ok {
+					parent[key] = shiftDate(s, offset)
+				}
+			})
+		}
+	}
+}
+
+// pseudonymizeReferences rewrites every reference in node to a pseudonymised resource. The display
+// and identifier of those references are dropped, as they often carry a name or a record number.
+func (e *Engine) pseudonymizeReferences(node any) {
+	switch n := node.(type) {
+	case map[string]any:
+		if ref, ok := n["reference"].(string); ok {
+			if rewritten := e.pseudonymizeURL(ref, false); rewritten != ref {
+				n["reference"] = rewritten
+				delete(n, "display")
+				delete(n, "identifier")
+			}
+		}
+		for _, child := range n {
+			e.pseudonymizeReferences(child)
+		}
+	case []any:
+		for _, elem := range n {
+			e.pseudonymizeReferences(elem)
+		}
+	}
+}
+
+// pseudonymizeURL replaces the ID of the resource a reference or URL points to. An absolute
+// reference is cut down to a relative one unless keepBase is set.
+func (e *Engine) pseudonymizeURL(s string, keepBase bool) string {
+	m := literalReference.FindStringSubmatchIndex(s)
+	if m == nil {
+		return s
+	}
+	resourceType, id := s[m[4]:m[5]], s[m[6]:m[7]]
+	if !e.policy.pseudonymized(resourceType) {
+		return s
+	}
+	version := ""
+	if m[8] >= 0 {
+		version = s[m[8]:m[9]]
+	}
+	ref := resourceType + "/" + e.pseudonym(resourceType, id) + version
+	if keepBase {
+		return s[:m[4]] + ref
+	}
+	return ref
+}
+
+// pseudonym is the replacement ID of a resource: a keyed hash of its type and ID, so the same
+// resource gets the same pseudonym in every response and export.
+func (e *Engine) pseudonym(resourceType, id string) string {
+	return hex.EncodeToString(e.hash("id|" + resourceType + "/" + id)[:16])
+}
+
+// dateOffset is the shift applied to the dates of the resources of patient, derived from a keyed
+// hash so it is the same for every resource of the patient and unguessable without the key.
+func (e *Engine) dateOffset(patient string) time.Duration {
+	if patient == "" || e.opts.MaxDateShiftDays <= 0 {
+		return 0
+	}
+	span := uint64(2*e.opts.MaxDateShiftDays + 1)
+	days := int64(binary.BigEndian.Uint64(e.hash("date-shift|" + patient)[:8])%span) - int64(e.opts.MaxDateShiftDays)
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func (e *Engine) hash(s string) []byte {
+	mac := hmac.New(sha256.New, e.opts.Key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// patientOf returns the patient a resource belongs to, as a "Patient/id" reference, or the
+// resource's own reference when it is not tied to a patient.
+func patientOf(resource map[string]any) string {
+	resourceType, _ := resource["resourceType"].(string)
+	id, _ := resource["id"].(string)
+	if resourceType == "Patient" {
+		return "Patient/" + id
+	}
+	for _, member := range patientReferencePaths {
+		if ref, ok := resource[member].(map[string]any); ok {
+			if s, ok := ref["reference"].(string); ok {
+				if m := literalReference.FindStringSubmatch(s); m != nil && m[2] == "Patient" {
+					return "Patient/" + m[3]
+				}
+			}
+		}
+	}
+	if resourceType == "" || id == "" {
+		return ""
+	}
+	return resourceType + "/" + id
+}
+
+// cellOf returns the cell of a de-identified resource: its type and the values of its
+// quasi-identifiers. It is empty when no rule names quasi-identifiers.
+func cellOf(resourceType string, resource map[string]any, rules []Rule) string {
+	var values []string
+	for _, rule := range rules {
+		for _, path := range rule.QuasiIdentifiers {
+			var found []string
+			visit(resource, strings.Split(path, "."), func(parent map[string]any, key string) {
+				b, _ := json.Marshal(parent[key])
+				found = append(found, string(b))
+			})
+			values = append(values, path+"="+strings.Join(found, ","))
+		}
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	return resourceType + "|" + strings.Join(values, "|")
+}
+
+// visit calls fn with the object holding each member the path leads to, descending through arrays.
+func visit(node any, segs []string, fn func(parent map[string]any, key string)) {
+	switch n := node.(type) {
+	case map[string]any:
+		child, ok := n[segs[0]]
+		if !ok {
+			return
+		}
+		if len(segs) == 1 {
+			fn(n, segs[0])
+			return
+		}
+		visit(child, segs[1:], fn)
+	case []any:
+		for _, elem := range n {
+			visit(elem, segs, fn)
+		}
+	}
+}
+
+// generalizeDate cuts a FHIR date, dateTime or instant down to a year or year-month.
+func generalizeDate(s, precision string) string {
+	n := 4
+	if precision == generalizeMonth {
+		n = 7
+	}
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// shiftDate moves a FHIR date, dateTime or instant by offset, keeping its precision and time zone.
+// Partial dates, a year or a year-month, are too coarse to shift by days and are kept.
+func shiftDate(s string, offset time.Duration) string {
+	if offset == 0 {
+		return s
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t.Add(offset).Format(time.DateOnly)
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return s
+	}
+	layout := "2006-01-02T15:04:05"
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		digits := len(s[dot+1:]) - len(strings.TrimLeft(s[dot+1:], "0123456789"))
+		layout += "." + strings.Repeat("0", digits)
+	}
+	return t.Add(offset).Format(layout + "Z07:00")
+}
+
+func decode(raw []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
@@ -0,0 +1,99 @@
+package deidentify
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+const testPolicy = `{
+  "roles": ["Researcher"],
+  "exemptRoles": ["Superadmin"],
+  "rules": [
+    {
+      "resourceType": "Patient",
+      "remove": ["name", "telecom", "identifier"],
+      "generalize": {"birthDate": "year"},
+      "pseudonymize": true,
+      "quasiIdentifiers": ["gender", "birthDate"]
+    },
+    {
+      "resourceType": "Observation",
+      "remove": ["identifier"],
+      "shiftDates": ["effectiveDateTime", "effectivePeriod.start"],
+      "pseudonymize": true
+    }
+  ]
+}`
+
+func newTestEngine(t *testing.T, k int) *Engine {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(path, []byte(testPolicy), 0o600))
+	policy, err := LoadPolicy(path)
+	require.NoError(t, err)
+	e, err := NewEngine(policy, Options{Key: []byte("test-key"), MinCellSize: k, MaxDateShiftDays: 30})
+	require.NoError(t, err)
+	return e
+}
+
+func TestEngine_AppliesTo(t *testing.T) {
+	e := newTestEngine(t, 0)
+	assert.True(t, e.AppliesTo([]string{"Researcher"}))
+	assert.True(t, e.AppliesTo([]string{"Practitioner", "Researcher"}))
+	assert.False(t, e.AppliesTo([]string{"Researcher", "Superadmin"}))
+	assert.False(t, e.AppliesTo([]string{"Practitioner"}))
+	assert.False(t, (*Engine)(nil).AppliesTo([]string{"Researcher"}))
+}
+
+func TestEngine_Resource(t *testing.T) {
+	e := newTestEngine(t, 0)
+
+	patient, cell, err := e.Resource([]byte(`{"resourceType":"Patient","id":"p1","name":[{"family":"Doe"}],"identifier":[{"value":"123"}],"gender":"female","birthDate":"1990-05-17"}`))
+	require.NoError(t, err)
+	pseudonym := gjson.GetBytes(patient, "id").String()
+	assert.NotEqual(t, "p1", pseudonym)
+	assert.False(t, gjson.GetBytes(patient, "name").Exists())
+	assert.False(t, gjson.GetBytes(patient, "identifier").Exists())
+	assert.Equal(t, "1990", gjson.GetBytes(patient, "birthDate").String())
+	assert.Equal(t, `Patient|gender="female"|birthDate="1990"`, cell)
+
+	first, cell, err := e.Resource([]byte(`{"resourceType":"Observation","id":"o1","subject":{"reference":"Patient/p1","display":"Jane Doe"},"effectiveDateTime":"2024-03-01T10:00:00.000+07:00"}`))
+	require.NoError(t, err)
+	assert.Empty(t, cell)
+	assert.Equal(t, "Patient/"+pseudonym, gjson.GetBytes(first, "subject.reference").String(), "references follow the pseudonymised ID")
+	assert.False(t, gjson.GetBytes(first, "subject.display").Exists())
+	shifted := gjson.GetBytes(first, "effectiveDateTime").String()
+	assert.NotEqual(t, "2024-03-01T10:00:00.000+07:00", shifted)
+	assert.Regexp(t, `^\d{4}-\d{2}-\d{2}T10:00:00\.000\+07:00$`, shifted, "precision and time zone are kept")
+
+	second, _, err := e.Resource([]byte(`{"resourceType":"Observation","id":"o2","subject":{"reference":"https://fhir.example/fhir/Patient/p1"},"effectivePeriod":{"start":"2024-03-01"}}`))
+	require.NoError(t, err)
+	assert.Equal(t, "Patient/"+pseudonym, gjson.GetBytes(second, "subject.reference").String())
+	assert.Equal(t, shifted[:10], gjson.GetBytes(second, "effectivePeriod.start").String(), "a patient's dates move by the same offset")
+}
+
+func TestEngine_Body_SuppressesSmallCells(t *testing.T) {
+	e := newTestEngine(t, 2)
+
+	bundle := `{"resourceType":"Bundle","type":"searchset","total":4,"entry":[
+		{"fullUrl":"https://fhir.example/fhir/Patient/p1","resource":{"resourceType":"Patient","id":"p1","gender":"female","birthDate":"1990-01-01"}},
+		{"fullUrl":"https://fhir.example/fhir/Patient/p2","resource":{"resourceType":"Patient","id":"p2","gender":"female","birthDate":"1990-12-31"}},
+		{"fullUrl":"https://fhir.example/fhir/Patient/p3","resource":{"resourceType":"Patient","id":"p3","gender":"male","birthDate":"1950-06-01"}},
+		{"resource":{"resourceType":"Observation","id":"o1","subject":{"reference":"Patient/p3"}}}]}`
+
+	out, err := e.Body([]byte(bundle))
+	require.NoError(t, err)
+	entries := gjson.GetBytes(out, "entry").Array()
+	require.Len(t, entries, 3, "the only 1950 male is suppressed")
+	assert.Equal(t, int64(3), gjson.GetBytes(out, "total").Int())
+	assert.Equal(t, "https://fhir.example/fhir/Patient/"+entries[0].Get("resource.id").String(), entries[0].Get("fullUrl").String())
+	assert.Equal(t, "Observation", entries[2].Get("resource.resourceType").String())
+
+	_, err = e.Body([]byte(`{"resourceType":"Patient","id":"p1","gender":"female","birthDate":"1990-01-01"}`))
+	assert.ErrorIs(t, err, ErrSuppressed)
+}
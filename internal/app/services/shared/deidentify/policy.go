@@ -0,0 +1,128 @@
+package deidentify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+)
+
+const (
+	generalizeYear  = "year"
+	generalizeMonth = "month"
+)
+
+// Rule de-identifies one resource type. Paths are dot-separated JSON member names and descend
+// through arrays, e.g. "effectivePeriod.start" or "item.answer.valueDate".
+type Rule struct {
+	ResourceType string `json:"resourceType"` // "*" matches every resource type
+	// Remove lists the paths deleted from the resource.
+	Remove []string `json:"remove,omitempty"`
+	// Generalize maps date paths to the precision they are cut down to: "year" or "month".
+	Generalize map[string]string `json:"generalize,omitempty"`
+	// ShiftDates lists the date paths moved by the date offset of the resource's patient.
+	ShiftDates []string `json:"shiftDates,omitempty"`
+	// Pseudonymize replaces the resource's id, and every reference to a resource of this type, with
+	// a keyed hash of the original.
+	Pseudonymize bool `json:"pseudonymize,omitempty"`
+	// QuasiIdentifiers lists the paths whose values, once de-identified, form the cell a resource
+	// is counted in. Resources in a cell smaller than the minimum cell size are suppressed.
+	QuasiIdentifiers []string `json:"quasiIdentifiers,omitempty"`
+}
+
+// Policy is the set of de-identification rules currently in force. It is safe for concurrent use
+// and can be reloaded while requests are served.
+type Policy struct {
+	mu sync.RWMutex
+	// roles are the roles whose data is de-identified.
+	roles []string
+	// exemptRoles see identified data even when they also hold one of roles.
+	exemptRoles []string
+	rules       map[string][]Rule
+}
+
+// LoadPolicy reads the policy at path. A missing file yields an empty policy, which de-identifies
+// nothing.
+func LoadPolicy(path string) (*Policy, error) {
+	p := &Policy{}
+	if err := p.Reload(path); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload replaces the policy with the one at path. On error the current policy is kept.
+func (p *Policy) Reload(path string) error {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		raw = []byte(`{"rules":[]}`)
+	} else if err != nil {
+		return err
+	}
+
+	var doc struct {
+		Roles       []string `json:"roles"`
+		ExemptRoles []string `json:"exemptRoles"`
+		Rules       []Rule   `json:"rules"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+	rules := make(map[string][]Rule)
+	for i, rule := range doc.Rules {
+		if rule.ResourceType == "" {
+			return fmt.Errorf("de-identification rule %d: resourceType is required", i)
+		}
+		for path, precision := range rule.Generalize {
+			if precision != generalizeYear && precision != generalizeMonth {
+				return fmt.Errorf("de-identification rule %d: unsupported precision %q for %s", i, precision, path)
+			}
+		}
+		rules[rule.ResourceType] = append(rules[rule.ResourceType], rule)
+	}
+
+	p.mu.Lock()
+	p.roles = doc.Roles
+	p.exemptRoles = doc.ExemptRoles
+	p.rules = rules
+	p.mu.Unlock()
+	return nil
+}
+
+// appliesTo reports whether data leaving the gateway for a caller with roles is de-identified.
+func (p *Policy) appliesTo(roles []string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	applies := false
+	for _, role := range roles {
+		if slices.Contains(p.exemptRoles, role) {
+			return false
+		}
+		if slices.Contains(p.roles, role) {
+			applies = true
+		}
+	}
+	return applies
+}
+
+// rulesFor returns the rules for resourceType, including the ones for every type.
+func (p *Policy) rulesFor(resourceType string) []Rule {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return slices.Concat(p.rules[resourceType], p.rules["*"])
+}
+
+// pseudonymized reports whether the IDs of resourceType are replaced.
+func (p *Policy) pseudonymized(resourceType string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, rule := range slices.Concat(p.rules[resourceType], p.rules["*"]) {
+		if rule.Pseudonymize {
+			return true
+		}
+	}
+	return false
+}
@@ -47,7 +47,7 @@ func NewHookRateLimiter(redis contracts.RedisRepository, log *zap.Logger, cfg *c
 type EvaluateInput struct {
 	ServiceName string
 	NowUTC      time.Time
-	// ActorID identifies the requester (uid, api-key-superadmin, or "anonymous")
+	// ActorID identifies the requester (uid, api-key-superadmin, api-key:<id> for integrator keys, or "anonymous")
 	ActorID string
 }
 
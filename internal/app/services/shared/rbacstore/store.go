@@ -0,0 +1,495 @@
+package rbacstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"konsulin-service/internal/app/contracts"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+	"go.uber.org/zap"
+)
+
+const (
+	policyKey     = "rbac:policy"
+	policyLockKey = "rbac:policy:lock"
+	lockTTL       = 10 * time.Second
+	lockAttempts  = 50
+	lockRetry     = 100 * time.Millisecond
+	maxChanges    = 200
+
+	// versionKey holds the version of the stored policy for cheap polling; every new version is
+	// also published on reloadChannel.
+	versionKey    = "rbac:policy:version"
+	reloadChannel = "rbac:policy:reload"
+	// versionCheckInterval bounds how long an instance that missed a published version, or lost
+	// its subscription, keeps a stale policy.
+	versionCheckInterval = time.Minute
+
+	// SeedActor is recorded as the author of changes that come from the policy file.
+	SeedActor = "rbac_policy.csv"
+	// casbinActor is recorded for writes made through the enforcer itself rather than the admin API.
+	casbinActor = "casbin"
+)
+
+// document is what is stored under policyKey. SeedRules are the rules of the policy file the
+// last time it was merged, so a new release of the file only applies its own additions and
+// removals and keeps the changes made through the admin API.
+type document struct {
+	Version   int64                    `json:"version"`
+	Rules     [][]string               `json:"rules"`
+	SeedRules [][]string               `json:"seedRules"`
+	Changes   []contracts.PolicyChange `json:"changes"`
+}
+
+// Store keeps the RBAC policy in Redis and is the Casbin adapter of the enforcer, so changes
+// made through the admin API survive restarts and are shared by every replica. The policy file
+// seeds it on first use. Every change gets a new version, which Watch uses to keep the enforcers
+// of all replicas on the same policy.
+type Store struct {
+	redis    contracts.RedisRepository
+	locker   contracts.LockerService
+	seedFile string
+	log      *zap.Logger
+	mu       sync.Mutex
+	now      func() time.Time
+
+	statusMu sync.RWMutex
+	status   contracts.PolicyStatus
+}
+
+var _ persist.Adapter = (*Store)(nil)
+
+func NewStore(redis contracts.RedisRepository, locker contracts.LockerService, seedFile string, log *zap.Logger) *Store {
+	return &Store{
+		redis:    redis,
+		locker:   locker,
+		seedFile: seedFile,
+		log:      log,
+		now:      time.Now,
+	}
+}
+
+func (s *Store) Rules(ctx context.Context) ([][]string, error) {
+	doc, err := s.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return doc.Rules, nil
+}
+
+func (s *Store) current(ctx context.Context) (*document, error) {
+	var doc *document
+	err := s.withLock(ctx, func() error {
+		var err error
+		doc, err = s.sync(ctx)
+		return err
+	})
+	return doc, err
+}
+
+func (s *Store) Update(ctx context.Context, by, action string, added, removed [][]string) (*contracts.PolicyChange, error) {
+	var change *contracts.PolicyChange
+	err := s.withLock(ctx, func() error {
+		doc, err := s.sync(ctx)
+		if err != nil {
+			return err
+		}
+		change = s.apply(doc, by, action, added, removed)
+		if change == nil {
+			return nil
+		}
+		return s.save(ctx, doc)
+	})
+	return change, err
+}
+
+func (s *Store) Replace(ctx context.Context, by, action string, rules [][]string) (*contracts.PolicyChange, error) {
+	var change *contracts.PolicyChange
+	err := s.withLock(ctx, func() error {
+		doc, err := s.sync(ctx)
+		if err != nil {
+			return err
+		}
+		change = s.apply(doc, by, action, difference(rules, doc.Rules), difference(doc.Rules, rules))
+		if change == nil {
+			return nil
+		}
+		return s.save(ctx, doc)
+	})
+	return change, err
+}
+
+func (s *Store) Bump(ctx context.Context, by string) (*contracts.PolicyChange, error) {
+	var change contracts.PolicyChange
+	err := s.withLock(ctx, func() error {
+		doc, err := s.sync(ctx)
+		if err != nil {
+			return err
+		}
+		change = s.record(doc, contracts.PolicyChange{By: by, Action: "reload"})
+		return s.save(ctx, doc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+func (s *Store) Status() contracts.PolicyStatus {
+	s.statusMu.RLock()
+	defer s.statusMu.RUnlock()
+	return s.status
+}
+
+// Watch calls reload whenever another instance, or the policy file, changes the stored policy,
+// until ctx is done. reload is expected to call the enforcer's LoadPolicy.
+func (s *Store) Watch(ctx context.Context, reload func() error) {
+	ticker := time.NewTicker(versionCheckInterval)
+	defer ticker.Stop()
+
+	var messages <-chan string
+	for {
+		if messages == nil {
+			var err error
+			if messages, err = s.redis.Subscribe(ctx, reloadChannel); err != nil {
+				s.log.Warn("failed to subscribe to RBAC policy versions, checking every minute instead", zap.Error(err))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case message, ok := <-messages:
+			if !ok {
+				messages = nil
+				continue
+			}
+			s.reloadIfChanged(message, reload)
+		case <-ticker.C:
+			stored, err := s.redis.Get(ctx, versionKey)
+			if err != nil {
+				s.log.Warn("failed to read the RBAC policy version", zap.Error(err))
+				continue
+			}
+			s.reloadIfChanged(stored, reload)
+		}
+	}
+}
+
+func (s *Store) reloadIfChanged(version string, reload func() error) {
+	parsed, err := strconv.ParseInt(version, 10, 64)
+	if err != nil || parsed == s.Status().Version {
+		return
+	}
+	if err := reload(); err != nil {
+		s.log.Error("failed to reload RBAC policy", zap.Int64("version", parsed), zap.Error(err))
+		return
+	}
+	status := s.Status()
+	s.log.Info("RBAC policy reloaded", zap.Int64("version", status.Version), zap.String("hash", status.Hash))
+}
+
+func (s *Store) Changes(ctx context.Context, limit int) ([]contracts.PolicyChange, error) {
+	doc, err := s.load(ctx)
+	if err != nil || doc == nil {
+		return nil, err
+	}
+
+	changes := make([]contracts.PolicyChange, 0, len(doc.Changes))
+	for i := len(doc.Changes) - 1; i >= 0; i-- {
+		if limit > 0 && len(changes) == limit {
+			break
+		}
+		changes = append(changes, doc.Changes[i])
+	}
+	return changes, nil
+}
+
+// LoadPolicy is called by the enforcer on start-up and on every reload.
+func (s *Store) LoadPolicy(m model.Model) error {
+	doc, err := s.current(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, rule := range doc.Rules {
+		if err := persist.LoadPolicyArray(rule, m); err != nil {
+			return err
+		}
+	}
+
+	s.statusMu.Lock()
+	s.status = contracts.PolicyStatus{
+		Version:  doc.Version,
+		Hash:     Hash(doc.Rules),
+		Rules:    len(doc.Rules),
+		LoadedAt: s.now().UTC(),
+	}
+	s.statusMu.Unlock()
+	return nil
+}
+
+func (s *Store) SavePolicy(m model.Model) error {
+	var rules [][]string
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range m[sec] {
+			for _, rule := range ast.Policy {
+				rules = append(rules, append([]string{ptype}, rule...))
+			}
+		}
+	}
+	_, err := s.Replace(context.Background(), casbinActor, "save", rules)
+	return err
+}
+
+func (s *Store) AddPolicy(_ string, ptype string, rule []string) error {
+	_, err := s.Update(context.Background(), casbinActor, "add", [][]string{append([]string{ptype}, rule...)}, nil)
+	return err
+}
+
+func (s *Store) RemovePolicy(_ string, ptype string, rule []string) error {
+	_, err := s.Update(context.Background(), casbinActor, "remove", nil, [][]string{append([]string{ptype}, rule...)})
+	return err
+}
+
+func (s *Store) RemoveFilteredPolicy(_ string, ptype string, fieldIndex int, fieldValues ...string) error {
+	rules, err := s.Rules(context.Background())
+	if err != nil {
+		return err
+	}
+
+	var removed [][]string
+	for _, rule := range rules {
+		if rule[0] != ptype {
+			continue
+		}
+		matches := true
+		for i, value := range fieldValues {
+			field := 1 + fieldIndex + i
+			if value != "" && (field >= len(rule) || rule[field] != value) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			removed = append(removed, rule)
+		}
+	}
+	_, err = s.Update(context.Background(), casbinActor, "remove", nil, removed)
+	return err
+}
+
+// sync returns the stored policy, seeding it from the policy file when Redis has none and
+// merging the file's own changes when it differs from the last merge.
+func (s *Store) sync(ctx context.Context) (*document, error) {
+	seed, err := s.readSeed()
+	if err != nil {
+		return nil, err
+	}
+	doc, err := s.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if doc == nil {
+		doc = &document{}
+		s.apply(doc, SeedActor, "seed", seed, nil)
+		doc.SeedRules = seed
+		if err := s.save(ctx, doc); err != nil {
+			return nil, err
+		}
+		s.log.Info("RBAC policy store seeded", zap.String("file", s.seedFile), zap.Int("rules", len(seed)))
+		return doc, nil
+	}
+
+	added, removed := difference(seed, doc.SeedRules), difference(doc.SeedRules, seed)
+	if len(added) == 0 && len(removed) == 0 {
+		return doc, nil
+	}
+	s.apply(doc, SeedActor, "seed", added, removed)
+	doc.SeedRules = seed
+	if err := s.save(ctx, doc); err != nil {
+		return nil, err
+	}
+	s.log.Info("RBAC policy file merged into the policy store",
+		zap.String("file", s.seedFile),
+		zap.Int("added", len(added)),
+		zap.Int("removed", len(removed)))
+	return doc, nil
+}
+
+// apply changes doc.Rules and records the change, or returns nil when nothing changes.
+func (s *Store) apply(doc *document, by, action string, added, removed [][]string) *contracts.PolicyChange {
+	change := contracts.PolicyChange{By: by, Action: action}
+	for _, rule := range removed {
+		if i := indexOf(doc.Rules, rule); i >= 0 {
+			doc.Rules = slices.Delete(doc.Rules, i, i+1)
+			change.Removed = append(change.Removed, rule)
+		}
+	}
+	for _, rule := range added {
+		if indexOf(doc.Rules, rule) < 0 {
+			doc.Rules = append(doc.Rules, rule)
+			change.Added = append(change.Added, rule)
+		}
+	}
+	if len(change.Added) == 0 && len(change.Removed) == 0 {
+		return nil
+	}
+
+	change = s.record(doc, change)
+	return &change
+}
+
+// record gives change the next version and appends it to the history.
+func (s *Store) record(doc *document, change contracts.PolicyChange) contracts.PolicyChange {
+	doc.Version++
+	change.Version = doc.Version
+	change.At = s.now().UTC()
+
+	doc.Changes = append(doc.Changes, change)
+	if len(doc.Changes) > maxChanges {
+		doc.Changes = doc.Changes[len(doc.Changes)-maxChanges:]
+	}
+	return change
+}
+
+func (s *Store) load(ctx context.Context) (*document, error) {
+	raw, err := s.redis.Get(ctx, policyKey)
+	if err != nil {
+		return nil, err
+	}
+	if raw == "" {
+		return nil, nil
+	}
+	var doc document
+	if err := json.Unmarshal([]byte(raw), &doc); err != nil {
+		return nil, fmt.Errorf("decode stored RBAC policy: %w", err)
+	}
+	return &doc, nil
+}
+
+// save stores doc and announces its version to the other instances.
+func (s *Store) save(ctx context.Context, doc *document) error {
+	if err := s.redis.Set(ctx, policyKey, doc, 0); err != nil {
+		return err
+	}
+	if err := s.redis.Set(ctx, versionKey, doc.Version, 0); err != nil {
+		return err
+	}
+
+	// instances that miss the message find the version when they next check it
+	if err := s.redis.Publish(ctx, reloadChannel, strconv.FormatInt(doc.Version, 10)); err != nil {
+		s.log.Warn("failed to publish RBAC policy version", zap.Int64("version", doc.Version), zap.Error(err))
+	}
+	return nil
+}
+
+func (s *Store) readSeed() ([][]string, error) {
+	data, err := os.ReadFile(s.seedFile)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCSV(data)
+}
+
+// withLock serialises writers in this process and, through the locker, across replicas.
+func (s *Store) withLock(ctx context.Context, fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locker == nil {
+		return fn()
+	}
+
+	for attempt := 0; attempt < lockAttempts; attempt++ {
+		ok, lockValue, err := s.locker.TryLock(ctx, policyLockKey, lockTTL)
+		if err != nil {
+			return err
+		}
+		if ok {
+			defer func() {
+				if err := s.locker.Unlock(ctx, policyLockKey, lockValue); err != nil {
+					s.log.Warn("failed to release RBAC policy lock", zap.Error(err))
+				}
+			}()
+			return fn()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockRetry):
+		}
+	}
+	return errors.New("timed out waiting for the RBAC policy lock")
+}
+
+// ParseCSV parses policy lines in the format of resources/rbac_policy.csv. Blank lines and
+// comments are skipped.
+func ParseCSV(data []byte) ([][]string, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	rules := make([][]string, 0, len(records))
+	for _, record := range records {
+		rule := make([]string, len(record))
+		for i, field := range record {
+			rule[i] = strings.TrimSpace(field)
+		}
+		if indexOf(rules, rule) < 0 {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// Hash identifies a policy regardless of the order of its rules.
+func Hash(rules [][]string) string {
+	sorted := slices.Clone(rules)
+	slices.SortFunc(sorted, func(a, b []string) int { return slices.Compare(a, b) })
+	sum := sha256.Sum256(FormatCSV(sorted))
+	return hex.EncodeToString(sum[:])
+}
+
+// FormatCSV writes rules in the format of resources/rbac_policy.csv.
+func FormatCSV(rules [][]string) []byte {
+	var b bytes.Buffer
+	for _, rule := range rules {
+		b.WriteString(strings.Join(rule, ", "))
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+func indexOf(rules [][]string, rule []string) int {
+	return slices.IndexFunc(rules, func(r []string) bool { return slices.Equal(r, rule) })
+}
+
+// difference returns the rules of a that are not in b.
+func difference(a, b [][]string) [][]string {
+	var out [][]string
+	for _, rule := range a {
+		if indexOf(b, rule) < 0 {
+			out = append(out, rule)
+		}
+	}
+	return out
+}
@@ -0,0 +1,157 @@
+package rbacstore
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"konsulin-service/internal/app/contracts"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// memoryRedis is an in-memory stand-in for the Redis repository; published messages go to the
+// subscribers channel.
+type memoryRedis struct {
+	contracts.RedisRepository
+	data        map[string]string
+	published   []string
+	subscribers chan string
+}
+
+func (r *memoryRedis) Set(_ context.Context, key string, value interface{}, _ time.Duration) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	r.data[key] = string(raw)
+	return nil
+}
+
+func (r *memoryRedis) Get(_ context.Context, key string) (string, error) {
+	return r.data[key], nil
+}
+
+func (r *memoryRedis) Publish(_ context.Context, _ string, message string) error {
+	r.published = append(r.published, message)
+	return nil
+}
+
+func (r *memoryRedis) Subscribe(context.Context, string) (<-chan string, error) {
+	return r.subscribers, nil
+}
+
+func writeSeed(t *testing.T, path, csv string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(csv), 0o644))
+}
+
+func TestStore_SeedAndMerge(t *testing.T) {
+	seedFile := filepath.Join(t.TempDir(), "rbac_policy.csv")
+	writeSeed(t, seedFile, "p, Guest, GET, /fhir/Organization\np, Clinic Admin, GET, /fhir/CareTeam\n")
+
+	redis := &memoryRedis{data: map[string]string{}}
+	store := NewStore(redis, nil, seedFile, zap.NewNop())
+	ctx := context.Background()
+
+	rules, err := store.Rules(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"p", "Guest", "GET", "/fhir/Organization"}, {"p", "Clinic Admin", "GET", "/fhir/CareTeam"}}, rules)
+
+	change, err := store.Update(ctx, "st-admin-1", "add", [][]string{{"p", "Researcher", "GET", "/fhir/Observation"}}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "st-admin-1", change.By)
+
+	change, err = store.Update(ctx, "st-admin-1", "add", [][]string{{"p", "Researcher", "GET", "/fhir/Observation"}}, nil)
+	require.NoError(t, err)
+	assert.Nil(t, change, "adding a rule twice changes nothing")
+
+	// a new release of the file adds and drops its own rules and keeps the admin's
+	writeSeed(t, seedFile, "p, Guest, GET, /fhir/Organization\np, Guest, GET, /fhir/Slot\n")
+	rules, err = store.Rules(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, [][]string{
+		{"p", "Guest", "GET", "/fhir/Organization"},
+		{"p", "Researcher", "GET", "/fhir/Observation"},
+		{"p", "Guest", "GET", "/fhir/Slot"},
+	}, rules)
+
+	changes, err := store.Changes(ctx, 2)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	assert.Equal(t, SeedActor, changes[0].By)
+	assert.Equal(t, [][]string{{"p", "Guest", "GET", "/fhir/Slot"}}, changes[0].Added)
+	assert.Equal(t, [][]string{{"p", "Clinic Admin", "GET", "/fhir/CareTeam"}}, changes[0].Removed)
+	assert.Equal(t, "st-admin-1", changes[1].By)
+
+	restarted := NewStore(redis, nil, seedFile, zap.NewNop())
+	enforcer, err := casbin.NewEnforcer("../../../../../resources/rbac_model.conf", restarted)
+	require.NoError(t, err)
+	policy, err := enforcer.GetFilteredPolicy(0, "Researcher")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"Researcher", "GET", "/fhir/Observation"}}, policy, "admin changes survive a restart")
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	rules, err := ParseCSV([]byte("# comment\np, Clinic Admin, GET, /fhir/CareTeam\n\ng, st-user-1, Researcher\n"))
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"p", "Clinic Admin", "GET", "/fhir/CareTeam"}, {"g", "st-user-1", "Researcher"}}, rules)
+	assert.Equal(t, "p, Clinic Admin, GET, /fhir/CareTeam\ng, st-user-1, Researcher\n", string(FormatCSV(rules)))
+}
+
+func TestStore_VersionsAndWatch(t *testing.T) {
+	seedFile := filepath.Join(t.TempDir(), "rbac_policy.csv")
+	writeSeed(t, seedFile, "p, Guest, GET, /fhir/Organization\n")
+
+	redis := &memoryRedis{data: map[string]string{}, subscribers: make(chan string)}
+	store := NewStore(redis, nil, seedFile, zap.NewNop())
+	enforcer, err := casbin.NewEnforcer("../../../../../resources/rbac_model.conf", store)
+	require.NoError(t, err)
+
+	status := store.Status()
+	assert.Equal(t, int64(1), status.Version, "seeding is the first version")
+	assert.Equal(t, 1, status.Rules)
+	assert.Equal(t, Hash([][]string{{"p", "Guest", "GET", "/fhir/Organization"}}), status.Hash)
+	assert.Equal(t, []string{"1"}, redis.published)
+
+	// another replica adds a rule and publishes version 2
+	other := NewStore(redis, nil, seedFile, zap.NewNop())
+	change, err := other.Update(context.Background(), "st-admin-1", "add", [][]string{{"p", "Guest", "GET", "/fhir/Slot"}}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), change.Version)
+	assert.Equal(t, "2", redis.data[versionKey])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloaded := make(chan struct{}, 2)
+	go store.Watch(ctx, func() error {
+		defer func() { reloaded <- struct{}{} }()
+		return enforcer.LoadPolicy()
+	})
+
+	redis.subscribers <- "2"
+	<-reloaded
+	ok, err := enforcer.HasPolicy("Guest", "GET", "/fhir/Slot")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), store.Status().Version)
+
+	// an admin asks every replica to reload; the version this replica already has is skipped
+	change, err = store.Bump(context.Background(), "st-admin-1")
+	require.NoError(t, err)
+	assert.Equal(t, "reload", change.Action)
+	assert.Equal(t, int64(3), change.Version)
+	assert.Equal(t, "3", redis.published[len(redis.published)-1])
+
+	redis.subscribers <- "2"
+	redis.subscribers <- "3"
+	<-reloaded
+	assert.Equal(t, int64(3), store.Status().Version)
+	assert.Len(t, reloaded, 0, "the version already loaded is not reloaded")
+}
@@ -264,6 +264,28 @@ func (r *redisRepository) GetSetMembers(ctx context.Context, key string) ([]stri
 	return setMembers, err
 }
 
+func (r *redisRepository) RemoveFromSet(ctx context.Context, key string, values ...interface{}) error {
+	requestID, _ := ctx.Value(constvars.CONTEXT_REQUEST_ID_KEY).(string)
+	r.Log.Info("redisRepository.RemoveFromSet called",
+		zap.String(constvars.LoggingRequestIDKey, requestID),
+		zap.String(constvars.LoggingRedisKey, key),
+		zap.Any(constvars.LoggingRedisValuesKey, values))
+
+	err := r.Client.SRem(ctx, key, values...).Err()
+	if err != nil {
+		r.Log.Error("redisRepository.RemoveFromSet error",
+			zap.String(constvars.LoggingRequestIDKey, requestID),
+			zap.String(constvars.LoggingRedisKey, key),
+			zap.Error(err))
+		return exceptions.ErrRedisRemoveFromSet(err)
+	}
+
+	r.Log.Info("redisRepository.RemoveFromSet succeeded",
+		zap.String(constvars.LoggingRequestIDKey, requestID),
+		zap.String(constvars.LoggingRedisKey, key))
+	return err
+}
+
 func (r *redisRepository) TrySetNX(ctx context.Context, key string, value interface{}, exp time.Duration) (bool, error) {
 	requestID, _ := ctx.Value(constvars.CONTEXT_REQUEST_ID_KEY).(string)
 	r.Log.Info("redisRepository.TrySetNX called",
@@ -294,3 +316,64 @@ func (r *redisRepository) TrySetNX(ctx context.Context, key string, value interf
 		zap.Bool(constvars.LoggingRedisAcquiredKey, acquired))
 	return acquired, nil
 }
+
+func (r *redisRepository) Publish(ctx context.Context, channel string, message string) error {
+	requestID, _ := ctx.Value(constvars.CONTEXT_REQUEST_ID_KEY).(string)
+	r.Log.Info("redisRepository.Publish called",
+		zap.String(constvars.LoggingRequestIDKey, requestID),
+		zap.String(constvars.LoggingRedisChannelKey, channel))
+
+	if err := r.Client.Publish(ctx, channel, message).Err(); err != nil {
+		r.Log.Error("redisRepository.Publish error",
+			zap.String(constvars.LoggingRequestIDKey, requestID),
+			zap.String(constvars.LoggingRedisChannelKey, channel),
+			zap.Error(err))
+		return exceptions.ErrRedisPublish(err)
+	}
+
+	r.Log.Info("redisRepository.Publish succeeded",
+		zap.String(constvars.LoggingRequestIDKey, requestID),
+		zap.String(constvars.LoggingRedisChannelKey, channel))
+	return nil
+}
+
+func (r *redisRepository) Subscribe(ctx context.Context, channel string) (<-chan string, error) {
+	r.Log.Info("redisRepository.Subscribe called",
+		zap.String(constvars.LoggingRedisChannelKey, channel))
+
+	pubsub := r.Client.Subscribe(ctx, channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		_ = pubsub.Close()
+		r.Log.Error("redisRepository.Subscribe error",
+			zap.String(constvars.LoggingRedisChannelKey, channel),
+			zap.Error(err))
+		return nil, exceptions.ErrRedisSubscribe(err)
+	}
+
+	// the client resubscribes by itself after a lost connection
+	messages := make(chan string)
+	go func() {
+		defer close(messages)
+		defer pubsub.Close()
+		incoming := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-incoming:
+				if !ok {
+					return
+				}
+				select {
+				case messages <- msg.Payload:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	r.Log.Info("redisRepository.Subscribe succeeded",
+		zap.String(constvars.LoggingRedisChannelKey, channel))
+	return messages, nil
+}
@@ -0,0 +1,396 @@
+package terminology
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// ErrNotAvailable is returned when the preloaded terminology cannot answer a request.
+var ErrNotAvailable = errors.New("terminology not available offline")
+
+// Fallback expands preloaded ValueSets when the terminology server cannot be reached. It answers
+// ValueSet $expand only, from the ValueSet and CodeSystem resources found in a directory, and is
+// read-only once loaded.
+type Fallback struct {
+	valueSets   map[string]*valueSet // by canonical URL and by id
+	codeSystems map[string]*codeSystem
+}
+
+type valueSet struct {
+	ID      string `json:"id"`
+	URL     string `json:"url"`
+	Version string `json:"version"`
+	Status  string `json:"status"`
+	Compose struct {
+		Include []composeInclude `json:"include"`
+		Exclude []composeInclude `json:"exclude"`
+	} `json:"compose"`
+	Expansion struct {
+		Contains []Concept `json:"contains"`
+	} `json:"expansion"`
+}
+
+type composeInclude struct {
+	System  string `json:"system"`
+	Version string `json:"version"`
+	Concept []struct {
+		Code    string `json:"code"`
+		Display string `json:"display"`
+	} `json:"concept"`
+	Filter []struct {
+		Property string `json:"property"`
+		Op       string `json:"op"`
+		Value    string `json:"value"`
+	} `json:"filter"`
+	ValueSet []string `json:"valueSet"`
+}
+
+type codeSystem struct {
+	URL     string              `json:"url"`
+	Version string              `json:"version"`
+	Concept []codeSystemConcept `json:"concept"`
+}
+
+type codeSystemConcept struct {
+	Code    string              `json:"code"`
+	Display string              `json:"display"`
+	Concept []codeSystemConcept `json:"concept"`
+}
+
+// Concept is one code of an expansion.
+type Concept struct {
+	System  string `json:"system,omitempty"`
+	Version string `json:"version,omitempty"`
+	Code    string `json:"code"`
+	Display string `json:"display,omitempty"`
+}
+
+// ExpandRequest holds the $expand parameters the fallback understands. The ValueSet is named by its
+// id (ValueSet/{id}/$expand) or by its canonical url.
+type ExpandRequest struct {
+	ID     string
+	URL    string
+	Filter string
+	Offset int
+	// Count limits the codes returned; zero returns them all.
+	Count int
+}
+
+// LoadFallback reads every .json file under dir. A file holds a ValueSet, a CodeSystem or a Bundle
+// of them; other resources are ignored.
+func LoadFallback(dir string) (*Fallback, error) {
+	f := &Fallback{valueSets: map[string]*valueSet{}, codeSystems: map[string]*codeSystem{}}
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".json") {
+			return err
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := f.add(raw); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *Fallback) add(raw json.RawMessage) error {
+	var probe struct {
+		ResourceType string `json:"resourceType"`
+		Entry        []struct {
+			Resource json.RawMessage `json:"resource"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return err
+	}
+
+	switch probe.ResourceType {
+	case "Bundle":
+		for _, entry := range probe.Entry {
+			if err := f.add(entry.Resource); err != nil {
+				return err
+			}
+		}
+	case "ValueSet":
+		var vs valueSet
+		if err := json.Unmarshal(raw, &vs); err != nil {
+			return err
+		}
+		if vs.URL != "" {
+			f.valueSets[vs.URL] = &vs
+		}
+		if vs.ID != "" {
+			f.valueSets[vs.ID] = &vs
+		}
+	case "CodeSystem":
+		var cs codeSystem
+		if err := json.Unmarshal(raw, &cs); err != nil {
+			return err
+		}
+		if cs.URL != "" {
+			f.codeSystems[cs.URL] = &cs
+		}
+	}
+	return nil
+}
+
+// CanExpand reports whether the fallback holds the ValueSet a request names.
+func (f *Fallback) CanExpand(req ExpandRequest) bool {
+	return f != nil && f.lookup(req) != nil
+}
+
+func (f *Fallback) lookup(req ExpandRequest) *valueSet {
+	if req.ID != "" {
+		return f.valueSets[req.ID]
+	}
+	if url, _, _ := strings.Cut(req.URL, "|"); url != "" {
+		return f.valueSets[url]
+	}
+	return nil
+}
+
+// Expand returns the ValueSet a request names with an expansion of the codes matching its filter.
+// Every word of the filter must start a word of the code's display or the code itself, ignoring
+// case.
+func (f *Fallback) Expand(req ExpandRequest) ([]byte, error) {
+	if f == nil {
+		return nil, ErrNotAvailable
+	}
+	vs := f.lookup(req)
+	if vs == nil {
+		return nil, ErrNotAvailable
+	}
+	concepts, err := f.concepts(vs, map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+
+	words := strings.Fields(strings.ToLower(req.Filter))
+	var matched []Concept
+	for _, c := range concepts {
+		if matchesFilter(c, words) {
+			matched = append(matched, c)
+		}
+	}
+
+	total := len(matched)
+	page := matched[min(max(req.Offset, 0), total):]
+	if req.Count > 0 && len(page) > req.Count {
+		page = page[:req.Count]
+	}
+
+	parameters := []map[string]any{}
+	if req.Filter != "" {
+		parameters = append(parameters, map[string]any{"name": "filter", "valueString": req.Filter})
+	}
+	if req.Offset > 0 {
+		parameters = append(parameters, map[string]any{"name": "offset", "valueInteger": req.Offset})
+	}
+	if req.Count > 0 {
+		parameters = append(parameters, map[string]any{"name": "count", "valueInteger": req.Count})
+	}
+
+	expansion := map[string]any{
+		"identifier": "urn:uuid:" + uuid.NewString(),
+		"timestamp":  time.Now().UTC().Format(time.RFC3339),
+		"total":      total,
+		"offset":     max(req.Offset, 0),
+		"parameter":  parameters,
+		"contains":   page,
+	}
+	if len(parameters) == 0 {
+		delete(expansion, "parameter")
+	}
+	if len(page) == 0 {
+		delete(expansion, "contains")
+	}
+
+	out := map[string]any{
+		"resourceType": "ValueSet",
+		"url":          vs.URL,
+		"status":       vs.Status,
+		"expansion":    expansion,
+	}
+	if vs.ID != "" {
+		out["id"] = vs.ID
+	}
+	if vs.Version != "" {
+		out["version"] = vs.Version
+	}
+	if vs.Status == "" {
+		out["status"] = "active"
+	}
+	return json.Marshal(out)
+}
+
+// concepts lists the codes of a ValueSet: its stored expansion when it has one, otherwise its
+// compose evaluated against the preloaded CodeSystems. seen guards against ValueSets including
+// each other.
+func (f *Fallback) concepts(vs *valueSet, seen map[string]bool) ([]Concept, error) {
+	if len(vs.Expansion.Contains) > 0 {
+		return vs.Expansion.Contains, nil
+	}
+	if seen[vs.URL] {
+		return nil, fmt.Errorf("ValueSet %s includes itself", vs.URL)
+	}
+	seen[vs.URL] = true
+	defer delete(seen, vs.URL)
+
+	var out []Concept
+	included := map[string]bool{}
+	for _, include := range vs.Compose.Include {
+		concepts, err := f.includeConcepts(include, seen)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range concepts {
+			if key := c.System + "|" + c.Code; !included[key] {
+				included[key] = true
+				out = append(out, c)
+			}
+		}
+	}
+
+	if len(vs.Compose.Exclude) > 0 {
+		excluded := map[string]bool{}
+		for _, exclude := range vs.Compose.Exclude {
+			concepts, err := f.includeConcepts(exclude, seen)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range concepts {
+				excluded[c.System+"|"+c.Code] = true
+			}
+		}
+		kept := out[:0]
+		for _, c := range out {
+			if !excluded[c.System+"|"+c.Code] {
+				kept = append(kept, c)
+			}
+		}
+		out = kept
+	}
+	return out, nil
+}
+
+// includeConcepts evaluates one compose include. Includes naming codes need no CodeSystem; whole
+// systems and is-a/descendent-of filters need the CodeSystem to be preloaded. Any other filter
+// makes the ValueSet unavailable offline rather than expanded wrongly.
+func (f *Fallback) includeConcepts(include composeInclude, seen map[string]bool) ([]Concept, error) {
+	var out []Concept
+	for _, url := range include.ValueSet {
+		vs := f.valueSets[strings.SplitN(url, "|", 2)[0]]
+		if vs == nil {
+			return nil, ErrNotAvailable
+		}
+		concepts, err := f.concepts(vs, seen)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, concepts...)
+	}
+	if include.System == "" {
+		return out, nil
+	}
+
+	cs := f.codeSystems[include.System]
+	version := include.Version
+	if version == "" && cs != nil {
+		version = cs.Version
+	}
+
+	if len(include.Concept) > 0 {
+		for _, c := range include.Concept {
+			display := c.Display
+			if display == "" && cs != nil {
+				if found := findConcept(cs.Concept, c.Code); found != nil {
+					display = found.Display
+				}
+			}
+			out = append(out, Concept{System: include.System, Version: version, Code: c.Code, Display: display})
+		}
+		return out, nil
+	}
+
+	if cs == nil {
+		return nil, ErrNotAvailable
+	}
+	roots := cs.Concept
+	for _, filter := range include.Filter {
+		if filter.Property != "concept" || (filter.Op != "is-a" && filter.Op != "descendent-of") {
+			return nil, ErrNotAvailable
+		}
+		parent := findConcept(roots, filter.Value)
+		if parent == nil {
+			return out, nil
+		}
+		if filter.Op == "is-a" {
+			roots = []codeSystemConcept{*parent}
+		} else {
+			roots = parent.Concept
+		}
+	}
+	walkConcepts(roots, func(c codeSystemConcept) {
+		out = append(out, Concept{System: include.System, Version: version, Code: c.Code, Display: c.Display})
+	})
+	return out, nil
+}
+
+func findConcept(concepts []codeSystemConcept, code string) *codeSystemConcept {
+	for i := range concepts {
+		if concepts[i].Code == code {
+			return &concepts[i]
+		}
+		if found := findConcept(concepts[i].Concept, code); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func walkConcepts(concepts []codeSystemConcept, visit func(codeSystemConcept)) {
+	for _, c := range concepts {
+		visit(c)
+		walkConcepts(c.Concept, visit)
+	}
+}
+
+func matchesFilter(c Concept, words []string) bool {
+	if len(words) == 0 {
+		return true
+	}
+	code := strings.ToLower(c.Code)
+	displayWords := strings.FieldsFunc(strings.ToLower(c.Display), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, word := range words {
+		if strings.HasPrefix(code, word) {
+			continue
+		}
+		found := false
+		for _, dw := range displayWords {
+			if strings.HasPrefix(dw, word) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package terminology
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tidwall/gjson"
+)
+
+const testCodeSystem = `{"resourceType":"CodeSystem","url":"http://hl7.org/fhir/sid/icd-10","version":"2019","concept":[
+	{"code":"F32","display":"Depressive episode","concept":[
+		{"code":"F32.0","display":"Mild depressive episode"},
+		{"code":"F32.1","display":"Moderate depressive episode"}]},
+	{"code":"F41","display":"Other anxiety disorders","concept":[
+		{"code":"F41.1","display":"Generalized anxiety disorder"}]}]}`
+
+const testValueSets = `{"resourceType":"Bundle","type":"collection","entry":[
+	{"resource":{"resourceType":"ValueSet","id":"mental-health","url":"https://konsulin.care/ValueSet/mental-health","status":"active",
+		"compose":{"include":[{"system":"http://hl7.org/fhir/sid/icd-10","filter":[{"property":"concept","op":"is-a","value":"F32"}]},
+			{"system":"http://hl7.org/fhir/sid/icd-10","concept":[{"code":"F41.1"}]}],
+			"exclude":[{"system":"http://hl7.org/fhir/sid/icd-10","concept":[{"code":"F32"}]}]}}},
+	{"resource":{"resourceType":"ValueSet","url":"https://konsulin.care/ValueSet/regex","compose":{"include":[{"system":"http://hl7.org/fhir/sid/icd-10","filter":[{"property":"code","op":"regex","value":"F.*"}]}]}}}]}`
+
+func newTestFallback(t *testing.T) *Fallback {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "icd-10.json"), []byte(testCodeSystem), 0o600))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "valuesets"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "valuesets", "bundle.json"), []byte(testValueSets), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("not loaded"), 0o600))
+	f, err := LoadFallback(dir)
+	require.NoError(t, err)
+	return f
+}
+
+func TestFallback_Expand(t *testing.T) {
+	f := newTestFallback(t)
+
+	out, err := f.Expand(ExpandRequest{URL: "https://konsulin.care/ValueSet/mental-health", Filter: "depress"})
+	require.NoError(t, err)
+	assert.Equal(t, "ValueSet", gjson.GetBytes(out, "resourceType").String())
+	assert.Equal(t, int64(2), gjson.GetBytes(out, "expansion.total").Int(), "the excluded parent code is left out")
+	assert.Equal(t, `["F32.0","F32.1"]`, gjson.GetBytes(out, "expansion.contains.#.code").Raw)
+	assert.Equal(t, "2019", gjson.GetBytes(out, "expansion.contains.0.version").String())
+
+	out, err = f.Expand(ExpandRequest{ID: "mental-health", Filter: "GEN anx"})
+	require.NoError(t, err)
+	assert.Equal(t, "Generalized anxiety disorder", gjson.GetBytes(out, "expansion.contains.0.display").String(), "displays come from the CodeSystem")
+
+	out, err = f.Expand(ExpandRequest{ID: "mental-health", Filter: "f", Offset: 1, Count: 1})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), gjson.GetBytes(out, "expansion.total").Int())
+	assert.Equal(t, `["F32.1"]`, gjson.GetBytes(out, "expansion.contains.#.code").Raw)
+
+	assert.True(t, f.CanExpand(ExpandRequest{URL: "https://konsulin.care/ValueSet/mental-health|1.0"}))
+	assert.False(t, f.CanExpand(ExpandRequest{URL: "https://konsulin.care/ValueSet/unknown"}))
+	assert.False(t, (*Fallback)(nil).CanExpand(ExpandRequest{ID: "mental-health"}))
+
+	_, err = f.Expand(ExpandRequest{URL: "https://konsulin.care/ValueSet/regex", Filter: "f"})
+	assert.ErrorIs(t, err, ErrNotAvailable, "filters the fallback cannot evaluate are not guessed at")
+}
@@ -175,7 +175,10 @@ const (
 	ErrDevRedisLeftPopList     = "failed to LPOP data from list in redis"
 	ErrDevRedisSAdd            = "failed to SAdd data into set in redis"
 	ErrDevRedisSMembers        = "failed to SMembers data from set in redis"
+	ErrDevRedisSRem            = "failed to SRem data from set in redis"
 	ErrDevRedisUnlock          = "failed to unlock data from redis"
+	ErrDevRedisPublish         = "failed to PUBLISH message to channel in redis"
+	ErrDevRedisSubscribe       = "failed to SUBSCRIBE to channel in redis"
 
 	// RabbitMQ messages
 	ErrDevRabbitMQPublishMessage = "failed to publish message to %s queue"
@@ -34,6 +34,9 @@ const (
 	ResourcePaymentNotice            = "PaymentNotice"
 	ResourceMedicationRequest        = "MedicationRequest"
 	ResourceMedicationAdministration = "MedicationAdministration"
+	ResourceAuditEvent               = "AuditEvent"
+	ResourceConsent                  = "Consent"
+	ResourceCareTeam                 = "CareTeam"
 )
 
 const (
@@ -104,3 +107,15 @@ const (
 	FhirSupertokenSystemIdentifier      = "https://login.konsulin.care/userid"
 	KonsulinOmnichannelSystemIdentifier = "https://login.konsulin.care/chatwoot-id"
 )
+
+// AuditEvent codes written by the FHIR proxy audit trail and read back by the access log.
+const (
+	FhirAuditResourceTypeSystem    = "http://hl7.org/fhir/resource-types"
+	FhirAuditObjectRoleSystem      = "http://terminology.hl7.org/CodeSystem/object-role"
+	FhirAuditObjectRolePatient     = "1"
+	FhirAuditAgentTypeApplication  = "110150"
+	FhirAuditRequestIDSystem       = "urn:konsulin:request-id"
+	FhirAuditOutcomeSuccess        = "0"
+	FhirAuditOutcomeMinorFailure   = "4"
+	FhirAuditOutcomeSeriousFailure = "8"
+)
@@ -14,16 +14,18 @@ const (
 )
 
 const (
-	MIMETextXML             = "text/xml"
-	MIMETextHTML            = "text/html"
-	MIMETextPlain           = "text/plain"
-	MIMETextJavaScript      = "text/javascript"
-	MIMEApplicationXML      = "application/xml"
-	MIMEApplicationJSON     = "application/json"
-	MIMEApplicationFHIRJSON = "application/fhir+json"
-	MIMEApplicationFHIRXML  = "application/fhir+xml"
+	MIMETextXML              = "text/xml"
+	MIMETextHTML             = "text/html"
+	MIMETextPlain            = "text/plain"
+	MIMETextJavaScript       = "text/javascript"
+	MIMEApplicationXML       = "application/xml"
+	MIMEApplicationJSON      = "application/json"
+	MIMEApplicationFHIRJSON  = "application/fhir+json"
+	MIMEApplicationFHIRXML   = "application/fhir+xml"
+	MIMEApplicationJSONPatch = "application/json-patch+json"
 
 	MIMEApplicationJavaScript = "application/javascript"
+	MIMEApplicationFHIRNDJSON = "application/fhir+ndjson"
 	MIMEApplicationForm       = "application/x-www-form-urlencoded"
 	MIMEOctetStream           = "application/octet-stream"
 	MIMEMultipartForm         = "multipart/form-data"
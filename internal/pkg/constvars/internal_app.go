@@ -58,6 +58,13 @@ const (
 	CONTEXT_RAW_BODY                 ContextKey = "raw_body"
 	CONTEXT_FHIR_ROLE                ContextKey = "fhir_role"
 	CONTEXT_UID                      ContextKey = "uid"
+	// CONTEXT_FHIR_IDENTITY_ROLE and CONTEXT_FHIR_IDENTITY_ID hold the caller's own FHIR resource,
+	// e.g. "Patient" and its ID, once it has been resolved from the session.
+	CONTEXT_FHIR_IDENTITY_ROLE ContextKey = "fhir_identity_role"
+	CONTEXT_FHIR_IDENTITY_ID   ContextKey = "fhir_identity_id"
+	// CONTEXT_BUNDLE_ENTRY_DENIALS holds the entries removed from a batch Bundle before it is
+	// proxied, so they can be answered in the batch-response.
+	CONTEXT_BUNDLE_ENTRY_DENIALS ContextKey = "bundle_entry_denials"
 )
 
 const (
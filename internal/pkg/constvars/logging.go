@@ -66,6 +66,7 @@ const (
 	LoggingRedisMembersKey        = "redis_members"
 	LoggingRedisAcquiredKey       = "redis_is_acquired"
 	LoggingRedisExpirationTimeKey = "redis_expiration_time"
+	LoggingRedisChannelKey        = "redis_channel"
 )
 
 const (
@@ -48,6 +48,26 @@ const (
 
 	// Patient-related messages
 	CreatePatientAppointmentSuccessMessage = "appoinment successfully created for patient"
+	GetAccessLogSuccessMessage             = "get access log successfully"
+
+	// API key messages
+	CreateAPIKeySuccessMessage = "API key successfully created"
+	GetAPIKeysSuccessMessage   = "get API keys successfully"
+	RotateAPIKeySuccessMessage = "API key successfully rotated"
+	RevokeAPIKeySuccessMessage = "API key successfully revoked"
+
+	// RBAC policy messages
+	GetRolesSuccessMessage         = "get roles successfully"
+	GetPermissionsSuccessMessage   = "get permissions successfully"
+	AddPermissionSuccessMessage    = "permission successfully added"
+	RemovePermissionSuccessMessage = "permission successfully removed"
+	ImportPolicySuccessMessage     = "RBAC policy successfully imported"
+	GetPolicyChangesSuccessMessage = "get RBAC policy changes successfully"
+	ReloadPolicySuccessMessage     = "RBAC policy reload published"
+
+	// Health messages
+	HealthCheckSuccessMessage     = "service is healthy"
+	GetPolicyStatusSuccessMessage = "get RBAC policy status successfully"
 
 	// Appointment payment messages
 	AppointmentPaymentSuccessMessage   = "Payment successful and appointment confirmed."
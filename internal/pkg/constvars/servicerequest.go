@@ -12,6 +12,13 @@ const (
 	ServiceRequestSubjectPractitioner ServiceRequestSubject = "Group/practitioner"
 )
 
+// ServiceRequestPaymentTagSystem tags the ServiceRequest of a confirmed payment, so services
+// delivered after the purchase, like dataset exports, can tell it was paid for.
+const (
+	ServiceRequestPaymentTagSystem = "https://konsulin.care/fhir/CodeSystem/payment-status"
+	ServiceRequestPaymentTagPaid   = "paid"
+)
+
 // DefaultGroups enumerates the group IDs required for ServiceRequest.subject references.
 // These are the trailing IDs after "Group/".
 var DefaultGroups = []string{
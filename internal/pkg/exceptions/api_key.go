@@ -14,8 +14,19 @@ func ErrRolesRequired(err error) error {
 	return BuildNewCustomError(err, http.StatusBadRequest, "roles can't be empty", ErrDevRolesRequired)
 }
 
+func ErrAPIKeyNotFound(err error) error {
+	return BuildNewCustomError(err, http.StatusNotFound, "API key not found", ErrDevAPIKeyNotFound)
+}
+
+func ErrInvalidRequestSignature(err error) error {
+	return BuildNewCustomError(err, http.StatusUnauthorized, "Invalid request signature", ErrDevInvalidRequestSignature)
+}
+
 const (
 	ErrDevInvalidAPIKey  = "INVALID_API_KEY"
 	ErrDevAPIKeyRequired = "API_KEY_REQUIRED"
 	ErrDevRolesRequired  = "The field ⁠ roles is missing"
+	ErrDevAPIKeyNotFound = "API_KEY_NOT_FOUND"
+
+	ErrDevInvalidRequestSignature = "INVALID_REQUEST_SIGNATURE"
 )
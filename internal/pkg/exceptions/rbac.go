@@ -0,0 +1,11 @@
+package exceptions
+
+import "net/http"
+
+func ErrInvalidPolicyRule(err error) error {
+	return BuildNewCustomError(err, http.StatusBadRequest, "Invalid RBAC policy rule", ErrDevInvalidPolicyRule)
+}
+
+const (
+	ErrDevInvalidPolicyRule = "INVALID_POLICY_RULE"
+)
@@ -0,0 +1,102 @@
+package fhir_dto
+
+import (
+	"net/url"
+	"strconv"
+)
+
+// AuditEvent is a FHIR R4 AuditEvent as written by the FHIR proxy audit trail.
+// See: https://hl7.org/fhir/R4/auditevent.html
+type AuditEvent struct {
+	ResourceType string             `json:"resourceType"`
+	ID           string             `json:"id,omitempty"`
+	Type         Coding             `json:"type"`
+	Subtype      []Coding           `json:"subtype,omitempty"`
+	Action       string             `json:"action,omitempty"`
+	Recorded     string             `json:"recorded"`
+	Outcome      string             `json:"outcome,omitempty"`
+	OutcomeDesc  string             `json:"outcomeDesc,omitempty"`
+	Agent        []AuditEventAgent  `json:"agent"`
+	Source       AuditEventSource   `json:"source"`
+	Entity       []AuditEventEntity `json:"entity,omitempty"`
+}
+
+type AuditEventAgent struct {
+	Type      *CodeableConcept   `json:"type,omitempty"`
+	Role      []CodeableConcept  `json:"role,omitempty"`
+	Who       *Reference         `json:"who,omitempty"`
+	AltID     string             `json:"altId,omitempty"`
+	Name      string             `json:"name,omitempty"`
+	Requestor bool               `json:"requestor"`
+	Network   *AuditEventNetwork `json:"network,omitempty"`
+}
+
+type AuditEventNetwork struct {
+	Address string `json:"address,omitempty"`
+	Type    string `json:"type,omitempty"`
+}
+
+type AuditEventSource struct {
+	Observer Reference `json:"observer"`
+}
+
+type AuditEventEntity struct {
+	What  *Reference `json:"what,omitempty"`
+	Type  *Coding    `json:"type,omitempty"`
+	Role  *Coding    `json:"role,omitempty"`
+	Query string     `json:"query,omitempty"`
+}
+
+// AuditEventBundle is a searchset of AuditEvents.
+type AuditEventBundle struct {
+	ResourceType string       `json:"resourceType"`
+	Type         string       `json:"type,omitempty"`
+	Link         []BundleLink `json:"link,omitempty"`
+	Entry        []struct {
+		Resource AuditEvent `json:"resource"`
+	} `json:"entry,omitempty"`
+}
+
+// NextLink returns the URL of the next page, or "" on the last page.
+func (b *AuditEventBundle) NextLink() string {
+	for _, l := range b.Link {
+		if l.Relation == "next" {
+			return l.Url
+		}
+	}
+	return ""
+}
+
+// SearchAuditEventInput contains search parameters for querying AuditEvent resources.
+type SearchAuditEventInput struct {
+	// Entity is a reference the event must name, e.g. "Patient/123".
+	Entity string
+	// EntityType is a FHIR resource type one of the entities must have.
+	EntityType string
+	// DateFrom and DateTo bound AuditEvent.recorded; FHIR date or dateTime values.
+	DateFrom string
+	DateTo   string
+	Count    int
+}
+
+// ToQueryString converts search input to URL query parameters, newest events first.
+func (s *SearchAuditEventInput) ToQueryString() url.Values {
+	params := url.Values{}
+	if s.Entity != "" {
+		params.Set("entity", s.Entity)
+	}
+	if s.EntityType != "" {
+		params.Set("entity-type", "http://hl7.org/fhir/resource-types|"+s.EntityType)
+	}
+	if s.DateFrom != "" {
+		params.Add("date", "ge"+s.DateFrom)
+	}
+	if s.DateTo != "" {
+		params.Add("date", "le"+s.DateTo)
+	}
+	if s.Count > 0 {
+		params.Set("_count", strconv.Itoa(s.Count))
+	}
+	params.Set("_sort", "-date")
+	return params
+}
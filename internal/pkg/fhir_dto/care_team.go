@@ -0,0 +1,49 @@
+package fhir_dto
+
+import (
+	"slices"
+	"time"
+)
+
+type CareTeam struct {
+	ResourceType string                `json:"resourceType"`
+	ID           string                `json:"id,omitempty"`
+	Status       string                `json:"status,omitempty"`
+	Name         string                `json:"name,omitempty"`
+	Subject      *Reference            `json:"subject,omitempty"`
+	Period       *Period               `json:"period,omitempty"`
+	Participant  []CareTeamParticipant `json:"participant,omitempty"`
+}
+
+type CareTeamParticipant struct {
+	Role       []CodeableConcept `json:"role,omitempty"`
+	Member     *Reference        `json:"member,omitempty"`
+	OnBehalfOf *Reference        `json:"onBehalfOf,omitempty"`
+	Period     *Period           `json:"period,omitempty"`
+}
+
+// HasMember reports whether one of members is a current participant of this active CareTeam.
+func (ct CareTeam) HasMember(members []string, at time.Time) bool {
+	if ct.Status != "active" || !periodCovers(ct.Period, at) {
+		return false
+	}
+
+	return slices.ContainsFunc(ct.Participant, func(p CareTeamParticipant) bool {
+		return p.Member != nil && slices.Contains(members, p.Member.Reference) && periodCovers(p.Period, at)
+	})
+}
+
+// periodCovers reports whether at falls within p; a missing period or bound is open ended and an
+// unreadable bound covers nothing.
+func periodCovers(p *Period, at time.Time) bool {
+	if p == nil {
+		return true
+	}
+	if start, ok := parseProvisionTime(p.Start, false); p.Start != "" && (!ok || at.Before(start)) {
+		return false
+	}
+	if end, ok := parseProvisionTime(p.End, true); p.End != "" && (!ok || at.After(end)) {
+		return false
+	}
+	return true
+}
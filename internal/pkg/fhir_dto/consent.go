@@ -0,0 +1,72 @@
+package fhir_dto
+
+import (
+	"slices"
+	"time"
+)
+
+type Consent struct {
+	ResourceType string            `json:"resourceType"`
+	ID           string            `json:"id,omitempty"`
+	Status       string            `json:"status,omitempty"`
+	Scope        *CodeableConcept  `json:"scope,omitempty"`
+	Category     []CodeableConcept `json:"category,omitempty"`
+	Patient      *Reference        `json:"patient,omitempty"`
+	DateTime     string            `json:"dateTime,omitempty"`
+	Provision    *ConsentProvision `json:"provision,omitempty"`
+}
+
+type ConsentProvision struct {
+	Type   string                  `json:"type,omitempty"`
+	Period *Period                 `json:"period,omitempty"`
+	Actor  []ConsentProvisionActor `json:"actor,omitempty"`
+	Class  []Coding                `json:"class,omitempty"`
+}
+
+type ConsentProvisionActor struct {
+	Role      *CodeableConcept `json:"role,omitempty"`
+	Reference Reference        `json:"reference"`
+}
+
+// Permits reports whether this Consent lets actor see the patient's resources of resourceType at
+// the given time. Only active consents with a permit provision count; a provision without class
+// covers every resource type, otherwise the class codes list the resource types granted.
+func (c Consent) Permits(patientRef, actor, resourceType string, at time.Time) bool {
+	if c.Status != "active" || c.Patient == nil || c.Patient.Reference != patientRef || c.Provision == nil {
+		return false
+	}
+
+	p := c.Provision
+	if p.Type != "" && p.Type != "permit" {
+		return false
+	}
+
+	if !periodCovers(p.Period, at) {
+		return false
+	}
+
+	if !slices.ContainsFunc(p.Actor, func(a ConsentProvisionActor) bool { return a.Reference.Reference == actor }) {
+		return false
+	}
+
+	if len(p.Class) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(p.Class, func(cl Coding) bool { return cl.Code == resourceType })
+}
+
+// parseProvisionTime reads a FHIR dateTime. A date without a time starts at midnight UTC, or ends at
+// the last instant of that day when endOfDay is set.
+func parseProvisionTime(v string, endOfDay bool) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, true
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, true
+}
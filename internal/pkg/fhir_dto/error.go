@@ -6,6 +6,8 @@ type OperationOutcome struct {
 }
 
 type Issue struct {
-	Severity    string `json:"severity"`
-	Diagnostics string `json:"diagnostics"`
+	Severity    string   `json:"severity"`
+	Code        string   `json:"code,omitempty"`
+	Diagnostics string   `json:"diagnostics"`
+	Expression  []string `json:"expression,omitempty"`
 }
@@ -2,6 +2,7 @@ package fhir_dto
 
 import (
 	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -55,7 +56,13 @@ type GetServiceRequestOutput struct {
 
 // SearchServiceRequestInput contains search parameters for querying ServiceRequest resources.
 type SearchServiceRequestInput struct {
-	ID string
+	ID              string
+	Status          string
+	InstantiatesURI string
+	// Tag is a token in system|code form matched against meta.tag.
+	Tag   string
+	Sort  string
+	Count int
 }
 
 // ToQueryString converts search input to URL query parameters.
@@ -64,6 +71,21 @@ func (s *SearchServiceRequestInput) ToQueryString() url.Values {
 	if s.ID != "" {
 		params.Set("_id", s.ID)
 	}
+	if s.Status != "" {
+		params.Set("status", s.Status)
+	}
+	if s.InstantiatesURI != "" {
+		params.Set("instantiates-uri", s.InstantiatesURI)
+	}
+	if s.Tag != "" {
+		params.Set("_tag", s.Tag)
+	}
+	if s.Sort != "" {
+		params.Set("_sort", s.Sort)
+	}
+	if s.Count > 0 {
+		params.Set("_count", strconv.Itoa(s.Count))
+	}
 	return params
 }
 
@@ -0,0 +1,291 @@
+package fhirxml
+
+import (
+	"strings"
+	"unicode"
+)
+
+// typeResource marks an element holding a whole resource, e.g. Bundle.entry.resource.
+const typeResource = "Resource"
+
+// primitiveJSON maps the FHIR primitive types to how their values are written in JSON. Types left
+// out of the map are written as strings.
+var primitiveJSON = map[string]string{
+	"boolean":     "boolean",
+	"integer":     "number",
+	"positiveInt": "number",
+	"unsignedInt": "number",
+	"decimal":     "number",
+}
+
+var primitiveTypes = map[string]bool{
+	"boolean": true, "integer": true, "positiveInt": true, "unsignedInt": true, "decimal": true,
+	"string": true, "code": true, "uri": true, "url": true, "canonical": true, "id": true, "oid": true,
+	"uuid": true, "markdown": true, "base64Binary": true, "date": true, "dateTime": true,
+	"instant": true, "time": true, "xhtml": true,
+}
+
+// plainResources are the resources that are not DomainResources: they have no text, contained
+// resources or extensions.
+var plainResources = map[string]bool{"Bundle": true, "Parameters": true, "Binary": true}
+
+// definitions lists, in document order, the elements of the resources, data types and backbone
+// elements the gateway exchanges. An element is "name:Type", "*" marks a repeating element and
+// "name[x]" a choice element whose type is given by the suffix of its name. Elements inherited from
+// Resource, DomainResource, Element and BackboneElement are added by lookup.
+//
+// Only the types used in this project are described; elements of other types are converted with
+// the generic rules of convertUnknown and writeUnknown.
+var definitions = map[string]string{
+	// data types
+	"Meta":            "versionId:id, lastUpdated:instant, source:uri, profile:canonical*, security:Coding*, tag:Coding*",
+	"Narrative":       "status:code, div:xhtml",
+	"Extension":       "value[x]",
+	"Coding":          "system:uri, version:string, code:code, display:string, userSelected:boolean",
+	"CodeableConcept": "coding:Coding*, text:string",
+	"Identifier":      "use:code, type:CodeableConcept, system:uri, value:string, period:Period, assigner:Reference",
+	"Reference":       "reference:string, type:uri, identifier:Identifier, display:string",
+	"Period":          "start:dateTime, end:dateTime",
+	"HumanName":       "use:code, text:string, family:string, given:string*, prefix:string*, suffix:string*, period:Period",
+	"ContactPoint":    "system:code, value:string, use:code, rank:positiveInt, period:Period",
+	"Address":         "use:code, type:code, text:string, line:string*, city:string, district:string, state:string, postalCode:string, country:string, period:Period",
+	"Quantity":        "value:decimal, comparator:code, unit:string, system:uri, code:code",
+	"Age":             "value:decimal, comparator:code, unit:string, system:uri, code:code",
+	"Count":           "value:decimal, comparator:code, unit:string, system:uri, code:code",
+	"Distance":        "value:decimal, comparator:code, unit:string, system:uri, code:code",
+	"Duration":        "value:decimal, comparator:code, unit:string, system:uri, code:code",
+	"Money":           "value:decimal, currency:code",
+	"Range":           "low:Quantity, high:Quantity",
+	"Ratio":           "numerator:Quantity, denominator:Quantity",
+	"Annotation":      "author[x], time:dateTime, text:markdown",
+	"Attachment":      "contentType:code, language:code, data:base64Binary, url:url, size:unsignedInt, hash:base64Binary, title:string, creation:dateTime",
+	"SampledData":     "origin:Quantity, period:decimal, factor:decimal, lowerLimit:decimal, upperLimit:decimal, dimensions:positiveInt, data:string",
+	"Timing":          "event:dateTime*, repeat:Timing.repeat, code:CodeableConcept",
+	"Timing.repeat":   "bounds[x], count:positiveInt, countMax:positiveInt, duration:decimal, durationMax:decimal, durationUnit:code, frequency:positiveInt, frequencyMax:positiveInt, period:decimal, periodMax:decimal, periodUnit:code, dayOfWeek:code*, timeOfDay:time*, when:code*, offset:unsignedInt",
+	"ContactDetail":   "name:string, telecom:ContactPoint*",
+	"UsageContext":    "code:Coding, value[x]",
+	"Signature":       "type:Coding*, when:instant, who:Reference, onBehalfOf:Reference, targetFormat:code, sigFormat:code, data:base64Binary",
+	"Expression":      "description:string, name:id, language:code, expression:string, reference:uri",
+	"RelatedArtifact": "type:code, label:string, display:string, citation:markdown, url:url, document:Attachment, resource:canonical",
+
+	// resources
+	"Patient":               "identifier:Identifier*, active:boolean, name:HumanName*, telecom:ContactPoint*, gender:code, birthDate:date, deceased[x], address:Address*, maritalStatus:CodeableConcept, multipleBirth[x], photo:Attachment*, contact:Patient.contact*, communication:Patient.communication*, generalPractitioner:Reference*, managingOrganization:Reference, link:Patient.link*",
+	"Patient.contact":       "relationship:CodeableConcept*, name:HumanName, telecom:ContactPoint*, address:Address, gender:code, organization:Reference, period:Period",
+	"Patient.communication": "language:CodeableConcept, preferred:boolean",
+	"Patient.link":          "other:Reference, type:code",
+
+	"Practitioner":               "identifier:Identifier*, active:boolean, name:HumanName*, telecom:ContactPoint*, address:Address*, gender:code, birthDate:date, photo:Attachment*, qualification:Practitioner.qualification*, communication:CodeableConcept*",
+	"Practitioner.qualification": "identifier:Identifier*, code:CodeableConcept, period:Period, issuer:Reference",
+
+	"PractitionerRole":               "identifier:Identifier*, active:boolean, period:Period, practitioner:Reference, organization:Reference, code:CodeableConcept*, specialty:CodeableConcept*, location:Reference*, healthcareService:Reference*, telecom:ContactPoint*, availableTime:PractitionerRole.availableTime*, notAvailable:PractitionerRole.notAvailable*, availabilityExceptions:string, endpoint:Reference*",
+	"PractitionerRole.availableTime": "daysOfWeek:code*, allDay:boolean, availableStartTime:time, availableEndTime:time",
+	"PractitionerRole.notAvailable":  "description:string, during:Period",
+
+	"Organization":         "identifier:Identifier*, active:boolean, type:CodeableConcept*, name:string, alias:string*, telecom:ContactPoint*, address:Address*, partOf:Reference, contact:Organization.contact*, endpoint:Reference*",
+	"Organization.contact": "purpose:CodeableConcept, name:HumanName, telecom:ContactPoint*, address:Address",
+
+	"Person":      "identifier:Identifier*, name:HumanName*, telecom:ContactPoint*, gender:code, birthDate:date, address:Address*, photo:Attachment, managingOrganization:Reference, active:boolean, link:Person.link*",
+	"Person.link": "target:Reference, assurance:code",
+
+	"Observation":                "identifier:Identifier*, basedOn:Reference*, partOf:Reference*, status:code, category:CodeableConcept*, code:CodeableConcept, subject:Reference, focus:Reference*, encounter:Reference, effective[x], issued:instant, performer:Reference*, value[x], dataAbsentReason:CodeableConcept, interpretation:CodeableConcept*, note:Annotation*, bodySite:CodeableConcept, method:CodeableConcept, specimen:Reference, device:Reference, referenceRange:Observation.referenceRange*, hasMember:Reference*, derivedFrom:Reference*, component:Observation.component*",
+	"Observation.referenceRange": "low:Quantity, high:Quantity, type:CodeableConcept, appliesTo:CodeableConcept*, age:Range, text:string",
+	"Observation.component":      "code:CodeableConcept, value[x], dataAbsentReason:CodeableConcept, interpretation:CodeableConcept*, referenceRange:Observation.referenceRange*",
+
+	"Condition":          "identifier:Identifier*, clinicalStatus:CodeableConcept, verificationStatus:CodeableConcept, category:CodeableConcept*, severity:CodeableConcept, code:CodeableConcept, bodySite:CodeableConcept*, subject:Reference, encounter:Reference, onset[x], abatement[x], recordedDate:dateTime, recorder:Reference, asserter:Reference, stage:Condition.stage*, evidence:Condition.evidence*, note:Annotation*",
+	"Condition.stage":    "summary:CodeableConcept, assessment:Reference*, type:CodeableConcept",
+	"Condition.evidence": "code:CodeableConcept*, detail:Reference*",
+
+	"Encounter":                 "identifier:Identifier*, status:code, statusHistory:Encounter.statusHistory*, class:Coding, classHistory:Encounter.classHistory*, type:CodeableConcept*, serviceType:CodeableConcept, priority:CodeableConcept, subject:Reference, episodeOfCare:Reference*, basedOn:Reference*, participant:Encounter.participant*, appointment:Reference*, period:Period, length:Duration, reasonCode:CodeableConcept*, reasonReference:Reference*, diagnosis:Encounter.diagnosis*, account:Reference*, hospitalization:Encounter.hospitalization, location:Encounter.location*, serviceProvider:Reference, partOf:Reference",
+	"Encounter.statusHistory":   "status:code, period:Period",
+	"Encounter.classHistory":    "class:Coding, period:Period",
+	"Encounter.participant":     "type:CodeableConcept*, period:Period, individual:Reference",
+	"Encounter.diagnosis":       "condition:Reference, use:CodeableConcept, rank:positiveInt",
+	"Encounter.hospitalization": "preAdmissionIdentifier:Identifier, origin:Reference, admitSource:CodeableConcept, reAdmission:CodeableConcept, dietPreference:CodeableConcept*, specialCourtesy:CodeableConcept*, specialArrangement:CodeableConcept*, destination:Reference, dischargeDisposition:CodeableConcept",
+	"Encounter.location":        "location:Reference, status:code, physicalType:CodeableConcept, period:Period",
+
+	"Appointment":             "identifier:Identifier*, status:code, cancelationReason:CodeableConcept, serviceCategory:CodeableConcept*, serviceType:CodeableConcept*, specialty:CodeableConcept*, appointmentType:CodeableConcept, reasonCode:CodeableConcept*, reasonReference:Reference*, priority:unsignedInt, description:string, supportingInformation:Reference*, start:instant, end:instant, minutesDuration:positiveInt, slot:Reference*, created:dateTime, comment:string, patientInstruction:string, basedOn:Reference*, participant:Appointment.participant*, requestedPeriod:Period*",
+	"Appointment.participant": "type:CodeableConcept*, actor:Reference, required:code, status:code, period:Period",
+
+	"Schedule": "identifier:Identifier*, active:boolean, serviceCategory:CodeableConcept*, serviceType:CodeableConcept*, specialty:CodeableConcept*, actor:Reference*, planningHorizon:Period, comment:string",
+	"Slot":     "identifier:Identifier*, serviceCategory:CodeableConcept*, serviceType:CodeableConcept*, specialty:CodeableConcept*, appointmentType:CodeableConcept, schedule:Reference, status:code, start:instant, end:instant, overbooked:boolean, comment:string",
+
+	"Questionnaire":                   "url:uri, identifier:Identifier*, version:string, name:string, title:string, derivedFrom:canonical*, status:code, experimental:boolean, subjectType:code*, date:dateTime, publisher:string, contact:ContactDetail*, description:markdown, useContext:UsageContext*, jurisdiction:CodeableConcept*, purpose:markdown, copyright:markdown, approvalDate:date, lastReviewDate:date, effectivePeriod:Period, code:Coding*, item:Questionnaire.item*",
+	"Questionnaire.item":              "linkId:string, definition:uri, code:Coding*, prefix:string, text:string, type:code, enableWhen:Questionnaire.item.enableWhen*, enableBehavior:code, required:boolean, repeats:boolean, readOnly:boolean, maxLength:integer, answerValueSet:canonical, answerOption:Questionnaire.item.answerOption*, initial:Questionnaire.item.initial*, item:Questionnaire.item*",
+	"Questionnaire.item.enableWhen":   "question:string, operator:code, answer[x]",
+	"Questionnaire.item.answerOption": "value[x], initialSelected:boolean",
+	"Questionnaire.item.initial":      "value[x]",
+
+	"QuestionnaireResponse":             "identifier:Identifier, basedOn:Reference*, partOf:Reference*, questionnaire:canonical, status:code, subject:Reference, encounter:Reference, authored:dateTime, author:Reference, source:Reference, item:QuestionnaireResponse.item*",
+	"QuestionnaireResponse.item":        "linkId:string, definition:uri, text:string, answer:QuestionnaireResponse.item.answer*, item:QuestionnaireResponse.item*",
+	"QuestionnaireResponse.item.answer": "value[x], item:QuestionnaireResponse.item*",
+
+	"ServiceRequest": "identifier:Identifier*, instantiatesCanonical:canonical*, instantiatesUri:uri*, basedOn:Reference*, replaces:Reference*, requisition:Identifier, status:code, intent:code, category:CodeableConcept*, priority:code, doNotPerform:boolean, code:CodeableConcept, orderDetail:CodeableConcept*, quantity[x], subject:Reference, encounter:Reference, occurrence[x], asNeeded[x], authoredOn:dateTime, requester:Reference, performerType:CodeableConcept, performer:Reference*, locationCode:CodeableConcept*, locationReference:Reference*, reasonCode:CodeableConcept*, reasonReference:Reference*, insurance:Reference*, supportingInfo:Reference*, specimen:Reference*, bodySite:CodeableConcept*, note:Annotation*, patientInstruction:string, relevantHistory:Reference*",
+
+	"Consent":                 "identifier:Identifier*, status:code, scope:CodeableConcept, category:CodeableConcept*, patient:Reference, dateTime:dateTime, performer:Reference*, organization:Reference*, source[x], policy:Consent.policy*, policyRule:CodeableConcept, verification:Consent.verification*, provision:Consent.provision",
+	"Consent.policy":          "authority:uri, uri:uri",
+	"Consent.verification":    "verified:boolean, verifiedWith:Reference, verificationDate:dateTime",
+	"Consent.provision":       "type:code, period:Period, actor:Consent.provision.actor*, action:CodeableConcept*, securityLabel:Coding*, purpose:Coding*, class:Coding*, code:CodeableConcept*, dataPeriod:Period, data:Consent.provision.data*, provision:Consent.provision*",
+	"Consent.provision.actor": "role:CodeableConcept, reference:Reference",
+	"Consent.provision.data":  "meaning:code, reference:Reference",
+
+	"CareTeam":             "identifier:Identifier*, status:code, category:CodeableConcept*, name:string, subject:Reference, encounter:Reference, period:Period, participant:CareTeam.participant*, reasonCode:CodeableConcept*, reasonReference:Reference*, managingOrganization:Reference*, telecom:ContactPoint*, note:Annotation*",
+	"CareTeam.participant": "role:CodeableConcept*, member:Reference, onBehalfOf:Reference, period:Period",
+
+	"Group":                "identifier:Identifier*, active:boolean, type:code, actual:boolean, code:CodeableConcept, name:string, quantity:unsignedInt, managingEntity:Reference, characteristic:Group.characteristic*, member:Group.member*",
+	"Group.characteristic": "code:CodeableConcept, value[x], exclude:boolean, period:Period",
+	"Group.member":         "entity:Reference, period:Period, inactive:boolean",
+
+	"Invoice":                         "identifier:Identifier*, status:code, cancelledReason:string, type:CodeableConcept, subject:Reference, recipient:Reference, date:dateTime, participant:Invoice.participant*, issuer:Reference, account:Reference, lineItem:Invoice.lineItem*, totalPriceComponent:Invoice.lineItem.priceComponent*, totalNet:Money, totalGross:Money, paymentTerms:markdown, note:Annotation*",
+	"Invoice.participant":             "role:CodeableConcept, actor:Reference",
+	"Invoice.lineItem":                "sequence:positiveInt, chargeItem[x], priceComponent:Invoice.lineItem.priceComponent*",
+	"Invoice.lineItem.priceComponent": "type:code, code:CodeableConcept, factor:decimal, amount:Money",
+
+	"ChargeItem":           "identifier:Identifier*, definitionUri:uri*, definitionCanonical:canonical*, status:code, partOf:Reference*, code:CodeableConcept, subject:Reference, context:Reference, occurrence[x], performer:ChargeItem.performer*, performingOrganization:Reference, requestingOrganization:Reference, costCenter:Reference, quantity:Quantity, bodysite:CodeableConcept*, factorOverride:decimal, priceOverride:Money, overrideReason:string, enterer:Reference, enteredDate:dateTime, reason:CodeableConcept*, service:Reference*, product[x], account:Reference*, note:Annotation*, supportingInformation:Reference*",
+	"ChargeItem.performer": "function:CodeableConcept, actor:Reference",
+
+	"ChargeItemDefinition":                              "url:uri, identifier:Identifier*, version:string, title:string, derivedFromUri:uri*, partOf:canonical*, replaces:canonical*, status:code, experimental:boolean, date:dateTime, publisher:string, contact:ContactDetail*, description:markdown, useContext:UsageContext*, jurisdiction:CodeableConcept*, copyright:markdown, approvalDate:date, lastReviewDate:date, effectivePeriod:Period, code:CodeableConcept, instance:Reference*, applicability:ChargeItemDefinition.applicability*, propertyGroup:ChargeItemDefinition.propertyGroup*",
+	"ChargeItemDefinition.applicability":                "description:string, language:string, expression:string",
+	"ChargeItemDefinition.propertyGroup":                "applicability:ChargeItemDefinition.applicability*, priceComponent:ChargeItemDefinition.propertyGroup.priceComponent*",
+	"ChargeItemDefinition.propertyGroup.priceComponent": "type:code, code:CodeableConcept, factor:decimal, amount:Money",
+
+	"PaymentNotice":                     "identifier:Identifier*, status:code, request:Reference, response:Reference, created:dateTime, provider:Reference, payment:Reference, paymentDate:date, payee:Reference, recipient:Reference, amount:Money, paymentStatus:CodeableConcept",
+	"PaymentReconciliation":             "identifier:Identifier*, status:code, period:Period, created:dateTime, paymentIssuer:Reference, request:Reference, requestor:Reference, outcome:code, disposition:string, paymentDate:date, paymentAmount:Money, paymentIdentifier:Identifier, detail:PaymentReconciliation.detail*, formCode:CodeableConcept, processNote:PaymentReconciliation.processNote*",
+	"PaymentReconciliation.detail":      "identifier:Identifier, predecessor:Identifier, type:CodeableConcept, request:Reference, submitter:Reference, response:Reference, date:date, responsible:Reference, payee:Reference, amount:Money",
+	"PaymentReconciliation.processNote": "type:code, text:string",
+
+	"AuditEvent":               "type:Coding, subtype:Coding*, action:code, period:Period, recorded:instant, outcome:code, outcomeDesc:string, purposeOfEvent:CodeableConcept*, agent:AuditEvent.agent*, source:AuditEvent.source, entity:AuditEvent.entity*",
+	"AuditEvent.agent":         "type:CodeableConcept, role:CodeableConcept*, who:Reference, altId:string, name:string, requestor:boolean, location:Reference, policy:uri*, media:Coding, network:AuditEvent.agent.network, purposeOfUse:CodeableConcept*",
+	"AuditEvent.agent.network": "address:string, type:code",
+	"AuditEvent.source":        "site:string, observer:Reference, type:Coding*",
+	"AuditEvent.entity":        "what:Reference, type:Coding, role:Coding, lifecycle:Coding, securityLabel:Coding*, name:string, description:string, query:base64Binary, detail:AuditEvent.entity.detail*",
+	"AuditEvent.entity.detail": "type:string, value[x]",
+
+	"ResearchStudy":           "identifier:Identifier*, title:string, protocol:Reference*, partOf:Reference*, status:code, primaryPurposeType:CodeableConcept, phase:CodeableConcept, category:CodeableConcept*, focus:CodeableConcept*, condition:CodeableConcept*, contact:ContactDetail*, relatedArtifact:RelatedArtifact*, keyword:CodeableConcept*, location:CodeableConcept*, description:markdown, enrollment:Reference*, period:Period, sponsor:Reference, principalInvestigator:Reference, site:Reference*, reasonStopped:CodeableConcept, note:Annotation*, arm:ResearchStudy.arm*, objective:ResearchStudy.objective*",
+	"ResearchStudy.arm":       "name:string, type:CodeableConcept, description:string",
+	"ResearchStudy.objective": "name:string, type:CodeableConcept",
+
+	"PlanDefinition":                      "url:uri, identifier:Identifier*, version:string, name:string, title:string, subtitle:string, type:CodeableConcept, status:code, experimental:boolean, subject[x], date:dateTime, publisher:string, contact:ContactDetail*, description:markdown, useContext:UsageContext*, jurisdiction:CodeableConcept*, purpose:markdown, usage:string, copyright:markdown, approvalDate:date, lastReviewDate:date, effectivePeriod:Period, topic:CodeableConcept*, author:ContactDetail*, editor:ContactDetail*, reviewer:ContactDetail*, endorser:ContactDetail*, relatedArtifact:RelatedArtifact*, library:canonical*, goal:PlanDefinition.goal*, action:PlanDefinition.action*",
+	"PlanDefinition.goal":                 "category:CodeableConcept, description:CodeableConcept, priority:CodeableConcept, start:CodeableConcept, addresses:CodeableConcept*, documentation:RelatedArtifact*, target:PlanDefinition.goal.target*",
+	"PlanDefinition.goal.target":          "measure:CodeableConcept, detail[x], due:Duration",
+	"PlanDefinition.action":               "prefix:string, title:string, description:string, textEquivalent:string, priority:code, code:CodeableConcept*, reason:CodeableConcept*, documentation:RelatedArtifact*, goalId:id*, subject[x], trigger:TriggerDefinition*, condition:PlanDefinition.action.condition*, input:DataRequirement*, output:DataRequirement*, relatedAction:PlanDefinition.action.relatedAction*, timing[x], participant:PlanDefinition.action.participant*, type:CodeableConcept, groupingBehavior:code, selectionBehavior:code, requiredBehavior:code, precheckBehavior:code, cardinalityBehavior:code, definition[x], transform:canonical, dynamicValue:PlanDefinition.action.dynamicValue*, action:PlanDefinition.action*",
+	"PlanDefinition.action.condition":     "kind:code, expression:Expression",
+	"PlanDefinition.action.relatedAction": "actionId:id, relationship:code, offset[x]",
+	"PlanDefinition.action.participant":   "type:code, role:CodeableConcept",
+	"PlanDefinition.action.dynamicValue":  "path:string, expression:Expression",
+
+	"Bundle":                "identifier:Identifier, type:code, timestamp:instant, total:unsignedInt, link:Bundle.link*, entry:Bundle.entry*, signature:Signature",
+	"Bundle.link":           "relation:string, url:uri",
+	"Bundle.entry":          "link:Bundle.link*, fullUrl:uri, resource:Resource, search:Bundle.entry.search, request:Bundle.entry.request, response:Bundle.entry.response",
+	"Bundle.entry.search":   "mode:code, score:decimal",
+	"Bundle.entry.request":  "method:code, url:uri, ifNoneMatch:string, ifModifiedSince:instant, ifMatch:string, ifNoneExist:string",
+	"Bundle.entry.response": "status:string, location:uri, etag:string, lastModified:instant, outcome:Resource",
+
+	"OperationOutcome":       "issue:OperationOutcome.issue*",
+	"OperationOutcome.issue": "severity:code, code:code, details:CodeableConcept, diagnostics:string, location:string*, expression:string*",
+
+	"Parameters":           "parameter:Parameters.parameter*",
+	"Parameters.parameter": "name:string, value[x], resource:Resource, part:Parameters.parameter*",
+}
+
+// element describes one element of a type.
+type element struct {
+	name string // without the [x] of choice elements
+	typ  string // empty for choice elements
+	// repeats is set for elements with a maximum cardinality above one, which are arrays in JSON.
+	repeats bool
+	choice  bool
+}
+
+// typeDef is the parsed definition of a type, with its inherited elements first.
+type typeDef struct {
+	elements []element
+}
+
+var (
+	resourceBase = []element{{name: "id", typ: "id"}, {name: "meta", typ: "Meta"}, {name: "implicitRules", typ: "uri"}, {name: "language", typ: "code"}}
+	domainBase   = []element{{name: "text", typ: "Narrative"}, {name: "contained", typ: typeResource, repeats: true}, {name: "extension", typ: "Extension", repeats: true}, {name: "modifierExtension", typ: "Extension", repeats: true}}
+	elementBase  = []element{{name: "extension", typ: "Extension", repeats: true}}
+	backboneBase = []element{{name: "extension", typ: "Extension", repeats: true}, {name: "modifierExtension", typ: "Extension", repeats: true}}
+)
+
+var types = parseDefinitions()
+
+func parseDefinitions() map[string]*typeDef {
+	defs := make(map[string]*typeDef, len(definitions))
+	for name, spec := range definitions {
+		var base []element
+		switch {
+		case isResourceType(name) && plainResources[name]:
+			base = resourceBase
+		case isResourceType(name):
+			base = append(append([]element{}, resourceBase...), domainBase...)
+		case strings.Contains(name, "."):
+			base = backboneBase
+		default:
+			base = elementBase
+		}
+
+		def := &typeDef{elements: append([]element{}, base...)}
+		for _, field := range strings.Split(spec, ",") {
+			field = strings.TrimSpace(field)
+			e := element{}
+			if strings.HasSuffix(field, "*") {
+				e.repeats = true
+				field = strings.TrimSuffix(field, "*")
+			}
+			if name, ok := strings.CutSuffix(field, "[x]"); ok {
+				e.name, e.choice = name, true
+			} else {
+				e.name, e.typ, _ = strings.Cut(field, ":")
+			}
+			def.elements = append(def.elements, e)
+		}
+		defs[name] = def
+	}
+	return defs
+}
+
+// isResourceType reports whether a defined type is a resource rather than a data type or a backbone
+// element.
+func isResourceType(name string) bool {
+	if strings.Contains(name, ".") {
+		return false
+	}
+	switch name {
+	case "Meta", "Narrative", "Extension", "Coding", "CodeableConcept", "Identifier", "Reference",
+		"Period", "HumanName", "ContactPoint", "Address", "Quantity", "Age", "Count", "Distance",
+		"Duration", "Money", "Range", "Ratio", "Annotation", "Attachment", "SampledData", "Timing",
+		"ContactDetail", "UsageContext", "Signature", "Expression", "RelatedArtifact":
+		return false
+	}
+	return true
+}
+
+// lookup finds the element called name in the type typeName and returns its position in document
+// order and its type. For choice elements the type is read from the suffix of name, e.g.
+// "valueQuantity" is a Quantity. ok is false for elements of unknown types or names.
+func lookup(typeName, name string) (pos int, typ string, repeats bool, ok bool) {
+	def := types[typeName]
+	if def == nil {
+		return 0, "", false, false
+	}
+	for i, e := range def.elements {
+		if !e.choice && e.name == name {
+			return i, e.typ, e.repeats, true
+		}
+	}
+	for i, e := range def.elements {
+		if !e.choice {
+			continue
+		}
+		suffix, found := strings.CutPrefix(name, e.name)
+		if !found || suffix == "" || !unicode.IsUpper(rune(suffix[0])) {
+			continue
+		}
+		if primitive := strings.ToLower(suffix[:1]) + suffix[1:]; primitiveTypes[primitive] {
+			return i, primitive, e.repeats, true
+		}
+		return i, suffix, e.repeats, true
+	}
+	return 0, "", false, false
+}
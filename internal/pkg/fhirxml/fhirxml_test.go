@@ -0,0 +1,110 @@
+package fhirxml
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	resources := map[string]string{
+		"Patient": `{"resourceType":"Patient","id":"p1","meta":{"versionId":"3","lastUpdated":"2024-05-01T10:00:00.000Z","tag":[{"system":"http://konsulin.care/tags","code":"anonymous"}]},
+			"text":{"status":"generated","div":"<div xmlns=\"http://www.w3.org/1999/xhtml\"><p>Jane <b>Doe</b></p></div>"},
+			"extension":[{"url":"http://konsulin.care/ext/uid","valueString":"u1"}],
+			"identifier":[{"system":"https://fhir.kemkes.go.id/id/nik","value":"3171"}],"active":true,
+			"name":[{"use":"official","family":"Doe","given":["Jane","Q"],"_given":[null,{"extension":[{"url":"http://hl7.org/fhir/StructureDefinition/iso21090-EN-qualifier","valueCode":"IN"}]}]}],
+			"telecom":[{"system":"email","value":"jane@example.com","use":"home","rank":1}],
+			"gender":"female","birthDate":"1990-05-17","_birthDate":{"id":"bd","extension":[{"url":"http://hl7.org/fhir/StructureDefinition/patient-birthTime","valueDateTime":"1990-05-17T08:30:00+07:00"}]},
+			"deceasedBoolean":false,"address":[{"line":["Jl. Sudirman 1","RT 01"],"city":"Jakarta","country":"ID"}],
+			"contact":[{"relationship":[{"coding":[{"system":"http://terminology.hl7.org/CodeSystem/v2-0131","code":"N"}]}],"name":{"text":"John Doe"}}]}`,
+		"Practitioner": `{"resourceType":"Practitioner","id":"pr1","name":[{"given":["Ann"],"family":"Lee","prefix":["dr."]}],
+			"qualification":[{"code":{"text":"Psychologist"},"period":{"start":"2015-01-01"}}]}`,
+		"PractitionerRole": `{"resourceType":"PractitionerRole","id":"r1","active":true,"practitioner":{"reference":"Practitioner/pr1"},"organization":{"reference":"Organization/o1"},
+			"availableTime":[{"daysOfWeek":["mon","wed"],"availableStartTime":"09:00:00","availableEndTime":"17:00:00"}]}`,
+		"Observation": `{"resourceType":"Observation","id":"o1","status":"final","category":[{"coding":[{"system":"http://terminology.hl7.org/CodeSystem/observation-category","code":"survey"}]}],
+			"code":{"coding":[{"system":"http://loinc.org","code":"44249-1"}],"text":"PHQ-9"},"subject":{"reference":"Patient/p1","display":"Jane Doe"},
+			"effectiveDateTime":"2024-03-01T10:00:00+07:00","valueQuantity":{"value":12.50,"unit":"score","system":"http://unitsofmeasure.org","code":"{score}"},
+			"component":[{"code":{"text":"interest"},"valueInteger":2},{"code":{"text":"mood"},"valueCodeableConcept":{"text":"low"}}],
+			"note":[{"authorReference":{"reference":"Practitioner/pr1"},"text":"Follow up in & <2> weeks \"soon\""}]}`,
+		"Questionnaire": `{"resourceType":"Questionnaire","id":"q1","url":"https://konsulin.care/Questionnaire/phq9","status":"active",
+			"item":[{"linkId":"1","text":"Consent?","type":"boolean","required":true},
+				{"linkId":"2","text":"Details","type":"group","enableWhen":[{"question":"1","operator":"=","answerBoolean":true}],
+					"item":[{"linkId":"2.1","type":"choice","answerOption":[{"valueCoding":{"code":"a"}},{"valueString":"other","initialSelected":true}]}]}]}`,
+		"QuestionnaireResponse": `{"resourceType":"QuestionnaireResponse","id":"qr1","questionnaire":"https://konsulin.care/Questionnaire/phq9","status":"completed",
+			"subject":{"reference":"Patient/p1"},"authored":"2024-03-01",
+			"item":[{"linkId":"1","answer":[{"valueBoolean":true}]},{"linkId":"2","item":[{"linkId":"2.1","answer":[{"valueCoding":{"code":"a"},"item":[{"linkId":"2.1.1","answer":[{"valueDecimal":0.1}]}]}]}]}]}`,
+		"Appointment": `{"resourceType":"Appointment","id":"a1","status":"booked","start":"2024-03-01T09:00:00Z","end":"2024-03-01T10:00:00Z","minutesDuration":60,
+			"slot":[{"reference":"Slot/s1"}],"participant":[{"actor":{"reference":"Patient/p1"},"status":"accepted"},{"actor":{"reference":"Practitioner/pr1"},"status":"accepted"}]}`,
+		"Invoice": `{"resourceType":"Invoice","id":"i1","status":"issued","subject":{"reference":"Patient/p1"},
+			"lineItem":[{"sequence":1,"chargeItemReference":{"reference":"ChargeItem/c1"},"priceComponent":[{"type":"base","amount":{"value":150000,"currency":"IDR"}}]}],
+			"totalNet":{"value":150000,"currency":"IDR"}}`,
+		"Bundle": `{"resourceType":"Bundle","id":"b1","type":"searchset","total":2,
+			"link":[{"relation":"self","url":"https://api.konsulin.care/fhir/Patient?_count=1"},{"relation":"next","url":"https://api.konsulin.care/fhir/Patient?_count=1&page=2"}],
+			"entry":[{"fullUrl":"https://api.konsulin.care/fhir/Patient/p1","resource":{"resourceType":"Patient","id":"p1",
+					"contained":[{"resourceType":"Organization","id":"org","name":"Klinik"}],"managingOrganization":{"reference":"#org"}},"search":{"mode":"match","score":1}},
+				{"resource":{"resourceType":"OperationOutcome","issue":[{"severity":"warning","code":"processing","diagnostics":"partial"}]},"search":{"mode":"outcome"}}]}`,
+		"Parameters": `{"resourceType":"Parameters","parameter":[{"name":"count","valueInteger":3},{"name":"patient","resource":{"resourceType":"Patient","id":"p1"}},
+			{"name":"group","part":[{"name":"flag","valueBoolean":false}]}]}`,
+		"unknown elements": `{"resourceType":"Patient","id":"p1","futureElement":{"id":"x","nested":"v","extension":[{"url":"http://e","valueString":"s"}]},"futureList":[{"a":"1"},{"a":"2"}]}`,
+	}
+
+	for name, resource := range resources {
+		t.Run(name, func(t *testing.T) {
+			xmlData, err := FromJSON([]byte(resource))
+			require.NoError(t, err)
+			back, err := ToJSON(xmlData)
+			require.NoError(t, err, string(xmlData))
+			assert.JSONEq(t, resource, string(back), string(xmlData))
+
+			// and the other way round: the XML is reproduced exactly
+			again, err := FromJSON(back)
+			require.NoError(t, err)
+			assert.Equal(t, string(xmlData), string(again))
+		})
+	}
+}
+
+func TestFromJSON(t *testing.T) {
+	out, err := FromJSON([]byte(`{"birthDate":"1990-05-17","name":[{"family":"Doe"}],"id":"p1","resourceType":"Patient",
+		"extension":[{"url":"http://konsulin.care/ext/uid","valueString":"u1"}],"_gender":{"extension":[{"url":"http://e","valueCode":"x"}]}}`))
+	require.NoError(t, err)
+	assert.Equal(t, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+		`<Patient xmlns="http://hl7.org/fhir"><id value="p1"/>`+
+		`<extension url="http://konsulin.care/ext/uid"><valueString value="u1"/></extension>`+
+		`<name><family value="Doe"/></name>`+
+		`<gender><extension url="http://e"><valueCode value="x"/></extension></gender>`+
+		`<birthDate value="1990-05-17"/></Patient>`, string(out), "elements follow the definition order")
+
+	_, err = FromJSON([]byte(`{"id":"p1"}`))
+	assert.Error(t, err)
+	_, err = FromJSON([]byte(`{"resourceType":"Patient","<bad>":1}`))
+	assert.Error(t, err)
+}
+
+func TestToJSON(t *testing.T) {
+	out, err := ToJSON([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<Observation xmlns="http://hl7.org/fhir">
+  <!-- sent by a partner system -->
+  <id value="o1"/>
+  <status value="final"/>
+  <code><text value="weight"/></code>
+  <valueQuantity><value value="70.0"/><unit value="kg"/></valueQuantity>
+  <interpretation><text value="normal"/></interpretation>
+</Observation>`))
+	require.NoError(t, err)
+	assert.Equal(t, `{"resourceType":"Observation","id":"o1","status":"final","code":{"text":"weight"},"valueQuantity":{"value":70.0,"unit":"kg"},"interpretation":[{"text":"normal"}]}`,
+		string(out), "repeating elements are arrays even when they appear once")
+
+	for name, doc := range map[string]string{
+		"not FHIR":       `<Patient><id value="p1"/></Patient>`,
+		"bad boolean":    `<Patient xmlns="http://hl7.org/fhir"><active value="yes"/></Patient>`,
+		"bad number":     `<Appointment xmlns="http://hl7.org/fhir"><minutesDuration value="1e"/></Appointment>`,
+		"text content":   `<Patient xmlns="http://hl7.org/fhir"><gender>female</gender></Patient>`,
+		"malformed":      `<Patient xmlns="http://hl7.org/fhir"><id value="p1"></Patient>`,
+		"empty resource": `<Bundle xmlns="http://hl7.org/fhir"><entry><resource/></entry></Bundle>`,
+	} {
+		_, err := ToJSON([]byte(doc))
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,245 @@
+package fhirxml
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// unknownPosition places elements missing from the definitions after the known ones, in the order
+// they appear in the JSON.
+const unknownPosition = 1 << 20
+
+// FromJSON converts a FHIR JSON resource to its FHIR XML representation.
+func FromJSON(data []byte) ([]byte, error) {
+	obj, err := decodeObject(data)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := writeResource(&buf, obj, true); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// IsResource reports whether data is a JSON object with a resourceType, i.e. a FHIR resource
+// FromJSON can convert.
+func IsResource(data []byte) bool {
+	var probe struct {
+		ResourceType string `json:"resourceType"`
+	}
+	return json.Unmarshal(data, &probe) == nil && probe.ResourceType != ""
+}
+
+func writeResource(buf *bytes.Buffer, obj object, root bool) error {
+	value, _ := obj.get("resourceType")
+	resourceType, _ := value.(string)
+	if resourceType == "" || !isName(resourceType) {
+		return errors.New("missing or invalid resourceType")
+	}
+
+	buf.WriteString("<" + resourceType)
+	if root {
+		buf.WriteString(` xmlns="` + Namespace + `"`)
+	}
+	buf.WriteByte('>')
+	if err := writeMembers(buf, obj, resourceType, true); err != nil {
+		return err
+	}
+	buf.WriteString("</" + resourceType + ">")
+	return nil
+}
+
+// writeMembers writes the members of obj as child elements, in the order of the type's definition.
+// Primitive members are merged with their "_name" counterpart.
+func writeMembers(buf *bytes.Buffer, obj object, typeName string, isResource bool) error {
+	type child struct {
+		name     string
+		typ      string
+		pos      int
+		value    any
+		extra    any
+		hasValue bool
+	}
+
+	var children []*child
+	byName := make(map[string]*child)
+	for i, m := range obj {
+		if isResource && m.key == "resourceType" || isAttribute(m.key, typeName, isResource) {
+			continue
+		}
+		name, isExtra := strings.CutPrefix(m.key, "_")
+		c := byName[name]
+		if c == nil {
+			c = &child{name: name, pos: unknownPosition + i}
+			if pos, typ, _, ok := lookup(typeName, name); ok {
+				c.pos, c.typ = pos, typ
+			} else {
+				c.typ = guessJSONType(name)
+			}
+			byName[name] = c
+			children = append(children, c)
+		}
+		if isExtra {
+			c.extra = m.value
+		} else {
+			c.value, c.hasValue = m.value, true
+		}
+	}
+	sort.SliceStable(children, func(i, j int) bool { return children[i].pos < children[j].pos })
+
+	for _, c := range children {
+		if !isName(c.name) {
+			return fmt.Errorf("invalid element name %q", c.name)
+		}
+		values, isArray := c.value.([]any)
+		extras, _ := c.extra.([]any)
+		if !isArray && !c.hasValue {
+			isArray = extras != nil
+		}
+		if !isArray {
+			if err := writeElement(buf, c.name, c.typ, c.value, c.extra); err != nil {
+				return err
+			}
+			continue
+		}
+		for i := 0; i < max(len(values), len(extras)); i++ {
+			var value, extra any
+			if i < len(values) {
+				value = values[i]
+			}
+			if i < len(extras) {
+				extra = extras[i]
+			}
+			if err := writeElement(buf, c.name, c.typ, value, extra); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeElement(buf *bytes.Buffer, name, typ string, value, extra any) error {
+	if obj, ok := value.(object); ok {
+		if _, isResource := obj.get("resourceType"); isResource {
+			buf.WriteString("<" + name + ">")
+			if err := writeResource(buf, obj, false); err != nil {
+				return err
+			}
+			buf.WriteString("</" + name + ">")
+			return nil
+		}
+
+		buf.WriteString("<" + name)
+		writeAttribute(buf, obj, "id")
+		if typ == "Extension" {
+			writeAttribute(buf, obj, "url")
+		}
+		var inner bytes.Buffer
+		if err := writeMembers(&inner, obj, typ, false); err != nil {
+			return err
+		}
+		if inner.Len() == 0 {
+			buf.WriteString("/>")
+			return nil
+		}
+		buf.WriteByte('>')
+		buf.Write(inner.Bytes())
+		buf.WriteString("</" + name + ">")
+		return nil
+	}
+
+	if typ == "xhtml" {
+		div, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("element %s must be an XHTML string", name)
+		}
+		buf.WriteString(div)
+		return nil
+	}
+
+	// a primitive: its value is an attribute and its id and extensions come from the "_name" member
+	buf.WriteString("<" + name)
+	extraObj, _ := extra.(object)
+	writeAttribute(buf, extraObj, "id")
+	switch v := value.(type) {
+	case nil:
+	case string:
+		writeAttrValue(buf, "value", v)
+	case json.Number:
+		writeAttrValue(buf, "value", v.String())
+	case bool:
+		writeAttrValue(buf, "value", fmt.Sprint(v))
+	default:
+		return fmt.Errorf("element %s has an unexpected value", name)
+	}
+	extensions, _ := extraObj.get("extension")
+	list, _ := extensions.([]any)
+	if len(list) == 0 {
+		buf.WriteString("/>")
+		return nil
+	}
+	buf.WriteByte('>')
+	for _, ext := range list {
+		if err := writeElement(buf, "extension", "Extension", ext, nil); err != nil {
+			return err
+		}
+	}
+	buf.WriteString("</" + name + ">")
+	return nil
+}
+
+// isAttribute reports whether a member is written as an XML attribute of its element rather than a
+// child element: the id of data types and backbone elements, and the url of extensions.
+func isAttribute(key, typeName string, isResource bool) bool {
+	if isResource {
+		return false
+	}
+	return key == "id" || key == "url" && typeName == "Extension"
+}
+
+func writeAttribute(buf *bytes.Buffer, obj object, key string) {
+	if value, ok := obj.get(key); ok {
+		if s, ok := value.(string); ok {
+			writeAttrValue(buf, key, s)
+		}
+	}
+}
+
+func writeAttrValue(buf *bytes.Buffer, key, value string) {
+	buf.WriteString(" " + key + `="`)
+	_ = xml.EscapeText(buf, []byte(value))
+	buf.WriteByte('"')
+}
+
+// guessJSONType types a member missing from the definitions. Objects are written by their own
+// members, so only extensions need a type to place their url attribute.
+func guessJSONType(name string) string {
+	if name == "extension" || name == "modifierExtension" {
+		return "Extension"
+	}
+	return ""
+}
+
+// isName reports whether s can be used as an XML element name. FHIR names are plain ASCII
+// identifiers.
+func isName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case i > 0 && (r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
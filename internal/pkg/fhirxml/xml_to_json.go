@@ -0,0 +1,272 @@
+package fhirxml
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode"
+)
+
+const (
+	// Namespace is the XML namespace of FHIR resources.
+	Namespace = "http://hl7.org/fhir"
+	// xhtmlNamespace is the namespace of the narrative div, which is carried as raw XHTML.
+	xhtmlNamespace = "http://www.w3.org/1999/xhtml"
+)
+
+// node is an element of a parsed FHIR XML document.
+type node struct {
+	name     string
+	space    string
+	attrs    map[string]string
+	children []*node
+	// raw holds the markup of an XHTML element, which is kept verbatim.
+	raw string
+}
+
+// ToJSON converts a FHIR XML resource to its FHIR JSON representation.
+func ToJSON(data []byte) ([]byte, error) {
+	root, err := parseXML(data)
+	if err != nil {
+		return nil, err
+	}
+	if root.space != Namespace {
+		return nil, fmt.Errorf("root element %s is not in the FHIR namespace", root.name)
+	}
+	obj, err := convertResource(root)
+	if err != nil {
+		return nil, err
+	}
+	return obj.MarshalJSON()
+}
+
+func parseXML(data []byte) (*node, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var (
+		root  *node
+		stack []*node
+	)
+	for {
+		offset := dec.InputOffset()
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			n := &node{name: tok.Name.Local, space: tok.Name.Space, attrs: make(map[string]string, len(tok.Attr))}
+			for _, attr := range tok.Attr {
+				if attr.Name.Space == "" {
+					n.attrs[attr.Name.Local] = attr.Value
+				}
+			}
+			if len(stack) == 0 {
+				if root != nil {
+					return nil, errors.New("more than one root element")
+				}
+				root = n
+			} else {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			}
+
+			if n.space == xhtmlNamespace {
+				if err := dec.Skip(); err != nil {
+					return nil, err
+				}
+				n.raw = string(data[offset:dec.InputOffset()])
+				continue
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 && len(bytes.TrimSpace(tok)) > 0 {
+				return nil, fmt.Errorf("unexpected text in element %s", stack[len(stack)-1].name)
+			}
+		}
+	}
+	if root == nil {
+		return nil, errors.New("empty XML document")
+	}
+	return root, nil
+}
+
+func convertResource(n *node) (object, error) {
+	obj := object{{key: "resourceType", value: n.name}}
+	if err := convertChildren(&obj, n, n.name); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func convertComplex(n *node, typeName string) (object, error) {
+	obj := object{}
+	if id, ok := n.attrs["id"]; ok {
+		obj.set("id", id)
+	}
+	if url, ok := n.attrs["url"]; ok && typeName == "Extension" {
+		obj.set("url", url)
+	}
+	if err := convertChildren(&obj, n, typeName); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// convertChildren adds the child elements of n to obj. Repeated elements are grouped into one
+// array member placed where the first of them appears.
+func convertChildren(obj *object, n *node, typeName string) error {
+	var names []string
+	groups := make(map[string][]*node)
+	for _, child := range n.children {
+		if _, seen := groups[child.name]; !seen {
+			names = append(names, child.name)
+		}
+		groups[child.name] = append(groups[child.name], child)
+	}
+
+	for _, name := range names {
+		nodes := groups[name]
+		_, typ, repeats, known := lookup(typeName, name)
+		if !known {
+			typ, repeats = guessXMLType(name, nodes[0])
+		}
+		array := repeats || len(nodes) > 1
+
+		if primitiveTypes[typ] && typ != "xhtml" {
+			if err := convertPrimitives(obj, name, typ, nodes, array); err != nil {
+				return err
+			}
+			continue
+		}
+
+		values := make([]any, 0, len(nodes))
+		for _, child := range nodes {
+			var (
+				value any
+				err   error
+			)
+			switch typ {
+			case "xhtml":
+				value = child.raw
+			case typeResource:
+				if len(child.children) != 1 {
+					return fmt.Errorf("element %s must contain exactly one resource", name)
+				}
+				value, err = convertResource(child.children[0])
+			default:
+				value, err = convertComplex(child, typ)
+			}
+			if err != nil {
+				return err
+			}
+			values = append(values, value)
+		}
+		if array {
+			obj.set(name, values)
+		} else {
+			obj.set(name, values[0])
+		}
+	}
+	return nil
+}
+
+// convertPrimitives adds primitive elements as a name member holding their values and, when any
+// of them has an id or extensions, a "_name" member holding those.
+func convertPrimitives(obj *object, name, typ string, nodes []*node, array bool) error {
+	values := make([]any, len(nodes))
+	extras := make([]any, len(nodes))
+	hasValue, hasExtras := false, false
+	for i, n := range nodes {
+		if raw, ok := n.attrs["value"]; ok {
+			value, err := primitiveValue(typ, raw)
+			if err != nil {
+				return fmt.Errorf("element %s: %w", name, err)
+			}
+			values[i], hasValue = value, true
+		}
+
+		extra := object{}
+		if id, ok := n.attrs["id"]; ok {
+			extra.set("id", id)
+		}
+		var extensions []any
+		for _, child := range n.children {
+			if child.name != "extension" {
+				return fmt.Errorf("element %s: unexpected child %s", name, child.name)
+			}
+			ext, err := convertComplex(child, "Extension")
+			if err != nil {
+				return err
+			}
+			extensions = append(extensions, ext)
+		}
+		if extensions != nil {
+			extra.set("extension", extensions)
+		}
+		if len(extra) > 0 {
+			extras[i], hasExtras = extra, true
+		}
+	}
+
+	if array {
+		if hasValue {
+			obj.set(name, values)
+		}
+		if hasExtras {
+			obj.set("_"+name, extras)
+		}
+		return nil
+	}
+	if hasValue {
+		obj.set(name, values[0])
+	}
+	if hasExtras {
+		obj.set("_"+name, extras[0])
+	}
+	return nil
+}
+
+// primitiveValue converts the value attribute of a primitive to its JSON value.
+func primitiveValue(typ, raw string) (any, error) {
+	switch primitiveJSON[typ] {
+	case "boolean":
+		if raw != "true" && raw != "false" {
+			return nil, fmt.Errorf("invalid boolean %q", raw)
+		}
+		return raw == "true", nil
+	case "number":
+		if _, err := strconv.ParseFloat(raw, 64); err != nil || !json.Valid([]byte(raw)) {
+			return nil, fmt.Errorf("invalid number %q", raw)
+		}
+		return json.Number(raw), nil
+	}
+	return raw, nil
+}
+
+// guessXMLType types an element missing from the definitions: extensions are known everywhere, an
+// element wrapping a single capitalised element holds a resource, an element with a value
+// attribute is taken for a string and anything else for a complex type.
+func guessXMLType(name string, n *node) (string, bool) {
+	switch {
+	case name == "extension" || name == "modifierExtension":
+		return "Extension", true
+	case n.space == xhtmlNamespace:
+		return "xhtml", false
+	case len(n.children) == 1 && unicode.IsUpper(rune(n.children[0].name[0])):
+		return typeResource, false
+	}
+	if _, ok := n.attrs["value"]; ok {
+		return "string", false
+	}
+	return "", false
+}
@@ -0,0 +1,203 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync/atomic"
+
+	"konsulin-service/internal/pkg/constvars"
+	"konsulin-service/resources"
+)
+
+// Ownership rule match modes. A rule without one matches references.
+const (
+	OwnershipMatchReference = "reference"
+	OwnershipMatchID        = "id"
+	OwnershipMatchValue     = "value"
+)
+
+// Ownership checks that need a FHIR lookup and are implemented by the FHIR proxy middleware.
+const (
+	OwnershipCheckQuestionnaireResponse = "questionnaireResponse"
+	OwnershipCheckSchedule              = "schedule"
+)
+
+// OwnershipRecursiveReferences is the rule path that matches every reference in the resource.
+const OwnershipRecursiveReferences = "**"
+
+// OwnershipRule proves ownership from one element of a resource.
+type OwnershipRule struct {
+	// Path is a gjson path; "#" descends through arrays, e.g. "participant.#.actor.reference".
+	Path string `json:"path,omitempty"`
+	// Match is "reference" (the default), "id" for the resource's own id, or "value" for In.
+	Match string `json:"match,omitempty"`
+	// In lists the values that grant access when Match is "value".
+	In []string `json:"in,omitempty"`
+	// ReferenceTo lists resource types any reference to which grants access.
+	ReferenceTo []string `json:"referenceTo,omitempty"`
+	// Decisive makes a write rule final once the path references the caller's resource type.
+	Decisive bool `json:"decisive,omitempty"`
+	// Check names a write rule implemented in code instead of a path.
+	Check string `json:"check,omitempty"`
+}
+
+// ResourceOwnership holds the rules of one resource type.
+type ResourceOwnership struct {
+	// Owners lists the FHIR identities (Patient, Practitioner) whose ownership must be proven.
+	Owners []string `json:"owners,omitempty"`
+	// Read rules are tried before the default read rules.
+	Read []OwnershipRule `json:"read,omitempty"`
+	// Write rules per FHIR identity are tried before that identity's default write rules.
+	Write map[string][]OwnershipRule `json:"write,omitempty"`
+	// PublicWhenAllReferencesTo makes a resource readable when every reference in it points to one
+	// of these types.
+	PublicWhenAllReferencesTo []string `json:"publicWhenAllReferencesTo,omitempty"`
+}
+
+// OwnershipRules declares which resources are public and how ownership of the rest is proven.
+type OwnershipRules struct {
+	Public []string `json:"public"`
+	// FailClosedOnError lists the resource types denied when their ownership cannot be evaluated.
+	FailClosedOnError []string                     `json:"failClosedOnError"`
+	Read              []OwnershipRule              `json:"read"`
+	Write             map[string][]OwnershipRule   `json:"write"`
+	Resources         map[string]ResourceOwnership `json:"resources"`
+}
+
+var ownershipRules atomic.Pointer[OwnershipRules]
+
+func init() {
+	rules, err := ParseOwnershipRules(resources.OwnershipRules)
+	if err != nil {
+		panic(fmt.Sprintf("invalid built-in ownership rules: %v", err))
+	}
+	ownershipRules.Store(rules)
+}
+
+// CurrentOwnershipRules returns the ownership rules in force.
+func CurrentOwnershipRules() *OwnershipRules {
+	return ownershipRules.Load()
+}
+
+// SetOwnershipRules replaces the ownership rules in force.
+func SetOwnershipRules(rules *OwnershipRules) {
+	ownershipRules.Store(rules)
+}
+
+// LoadOwnershipRules puts the rules at path in force. A missing file restores the built-in rules;
+// on any other error the current rules are kept.
+func LoadOwnershipRules(path string) error {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		raw = resources.OwnershipRules
+	} else if err != nil {
+		return err
+	}
+
+	rules, err := ParseOwnershipRules(raw)
+	if err != nil {
+		return err
+	}
+	SetOwnershipRules(rules)
+	return nil
+}
+
+// ParseOwnershipRules decodes and validates an ownership rules document.
+func ParseOwnershipRules(raw []byte) (*OwnershipRules, error) {
+	var rules OwnershipRules
+	if err := json.Unmarshal(raw, &rules); err != nil {
+		return nil, err
+	}
+
+	if err := validateOwnershipRules("read", rules.Read, false); err != nil {
+		return nil, err
+	}
+	for identity, list := range rules.Write {
+		if err := validateOwnershipIdentity(identity); err != nil {
+			return nil, fmt.Errorf("write: %w", err)
+		}
+		if err := validateOwnershipRules("write."+identity, list, true); err != nil {
+			return nil, err
+		}
+	}
+	for resourceType, res := range rules.Resources {
+		for _, owner := range res.Owners {
+			if err := validateOwnershipIdentity(owner); err != nil {
+				return nil, fmt.Errorf("%s owners: %w", resourceType, err)
+			}
+		}
+		if err := validateOwnershipRules(resourceType+".read", res.Read, false); err != nil {
+			return nil, err
+		}
+		for identity, list := range res.Write {
+			if err := validateOwnershipIdentity(identity); err != nil {
+				return nil, fmt.Errorf("%s write: %w", resourceType, err)
+			}
+			if err := validateOwnershipRules(resourceType+".write."+identity, list, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &rules, nil
+}
+
+func validateOwnershipIdentity(identity string) error {
+	if identity != constvars.ResourcePatient && identity != constvars.ResourcePractitioner {
+		return fmt.Errorf("unsupported identity %q", identity)
+	}
+	return nil
+}
+
+func validateOwnershipRules(where string, rules []OwnershipRule, write bool) error {
+	for i, rule := range rules {
+		if !write && (rule.Check != "" || rule.Decisive) {
+			return fmt.Errorf("%s rule %d: check and decisive only apply to write rules", where, i)
+		}
+		switch {
+		case rule.Check != "":
+			if rule.Check != OwnershipCheckQuestionnaireResponse && rule.Check != OwnershipCheckSchedule {
+				return fmt.Errorf("%s rule %d: unknown check %q", where, i, rule.Check)
+			}
+		case rule.Path == "":
+			return fmt.Errorf("%s rule %d: path or check is required", where, i)
+		}
+		switch rule.Match {
+		case "", OwnershipMatchReference, OwnershipMatchID:
+		case OwnershipMatchValue:
+			if len(rule.In) == 0 {
+				return fmt.Errorf("%s rule %d: match value requires in", where, i)
+			}
+		default:
+			return fmt.Errorf("%s rule %d: unsupported match %q", where, i, rule.Match)
+		}
+	}
+	return nil
+}
+
+// OwnedBy reports whether ownership of resourceType must be proven for the given FHIR identity.
+func (r *OwnershipRules) OwnedBy(resourceType, identity string) bool {
+	return slices.Contains(r.Resources[resourceType].Owners, identity)
+}
+
+// IsPublic reports whether resourceType is readable by everyone.
+func (r *OwnershipRules) IsPublic(resourceType string) bool {
+	return slices.Contains(r.Public, resourceType)
+}
+
+// FailsClosed reports whether resourceType is denied when its ownership cannot be evaluated.
+func (r *OwnershipRules) FailsClosed(resourceType string) bool {
+	return slices.Contains(r.FailClosedOnError, resourceType)
+}
+
+// ReadRules returns the rules proving read ownership of resourceType, most specific first.
+func (r *OwnershipRules) ReadRules(resourceType string) []OwnershipRule {
+	return append(slices.Clip(r.Resources[resourceType].Read), r.Read...)
+}
+
+// WriteRules returns the rules proving that identity may write resourceType, most specific first.
+func (r *OwnershipRules) WriteRules(resourceType, identity string) []OwnershipRule {
+	return append(slices.Clip(r.Resources[resourceType].Write[identity]), r.Write[identity]...)
+}
@@ -0,0 +1,10 @@
+// Package resources exposes the policy files that the service must be able to run without.
+package resources
+
+import _ "embed"
+
+// OwnershipRules is the ownership_rules.json the binary was built with. It is in force until the
+// file on disk is loaded, and whenever the file is missing.
+//
+//go:embed ownership_rules.json
+var OwnershipRules []byte